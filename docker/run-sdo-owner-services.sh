@@ -34,6 +34,30 @@ Additional environment variables (that do not usually need to be set):
   SDO_GET_PKGS_FROM - where to have the edge devices get the horizon packages from. If set to css:, it will be expanded to css:/api/v1/objects/IBM/agent_files. Or it can be set to something like https://github.com/open-horizon/anax/releases/latest/download (which is the default).
   SDO_GET_CFG_FILE_FROM - where to have the edge devices get the agent-install.cfg file from. If set to css: (the default), it will be expanded to css:/api/v1/objects/IBM/agent_files/agent-install.cfg. Or it can set to agent-install.cfg, which means using the file that the SDO owner services creates.
   SDO_RV_VOUCHER_TTL - tell the rendezvous server to persist vouchers for this number of seconds (default 7200).
+  SDO_ALLOW_SAMPLE_OWNER_KEY - set to 'true' to accept imported vouchers that are signed over to the sample owner key (only for dev/test). Default is false.
+  SDO_ALLOW_KEY_IMPORT_OVER_HTTP - set to 'true' to accept POST /api/orgs/{org-id}/keys/import over http. Only set it when a proxy in front of the ocs-api terminates TLS. Default is false.
+  SDO_PREREGISTER_NODES - set to 'true' to create the node in the exchange (with the device uuid and node token) when each voucher is imported. Default is false.
+  SDO_NODE_TOKEN_LENGTH - the number of characters in the generated node tokens (16-256). Default is 88.
+  SDO_NODE_TOKEN_CHAR_CLASSES - comma-separated list of the character classes in the generated node tokens: lower, upper, digit, symbol. Default is all of them.
+  SDO_NODE_TOKEN_EXCHANGE_COMPAT - the exchange password rules the node tokens must satisfy: current or legacy (exchange versions without node token rules). Default is current.
+  SDO_PURGE_NODE_TOKENS - set to 'false' to keep the node token of each device in the OCS db after the device is onboarded. Default is true.
+  SDO_PURGE_NODE_TOKENS_INTERVAL - the number of seconds between checks for onboarded devices whose node token should be purged. Default is 60.
+  SDO_API_PERMISSIONS - what each exchange role is allowed to do with the API, as a semicolon-separated list of <role>=<method>:<resource>,... The roles are orgadmin, user, node, agbot, hubadmin, the resources are vouchers, keys, and either can be *. For example, to also let users delete vouchers: user=GET:*,POST:*,PUT:*,DELETE:vouchers. Default is orgadmin=*:*;user=GET:*,POST:*,PUT:* (users can do everything except delete), and the other roles nothing.
+  SDO_API_AUTH_CACHE_TTL - the number of seconds the result of verifying valid exchange credentials is cached. 0 disables the cache. Default is 60.
+  SDO_API_AUTH_CACHE_NEGATIVE_TTL - the number of seconds the result of verifying exchange credentials that are not valid is cached. Default is 5.
+  SDO_API_AUTH_CACHE_STALE_TTL - the number of seconds after the cached result of valid credentials expires that it is still used if the exchange is not available (502/503/504 or the circuit breaker is open), except for DELETE requests and owner keys. Revoked credentials are also accepted during that time. 0 disables it. Default is 0.
+  SDO_API_AUTH_CACHE_SIZE - the max number of exchange credentials whose verification result is cached. Default is 1000.
+  SDO_EXCHANGE_RETRIES - the number of times an exchange call for a request (authenticating it, or creating or changing the node of a device) is retried, when it fails with a timeout, a refused or reset connection, or 502/503/504 (but not a TLS or DNS error). If it still fails, the request gets 503 with Retry-After. Default is 3.
+  SDO_EXCHANGE_RETRY_BACKOFF_MS - the max number of milliseconds to wait before the 1st retry, doubled for each retry after that (the wait is random up to that). Default is 200.
+  SDO_EXCHANGE_RETRY_MAX_BACKOFF_MS - the max number of milliseconds to wait before any retry. Default is 2000.
+  SDO_EXCHANGE_RETRY_DEADLINE_SECONDS - the max number of seconds an exchange call can take, including its retries. 0 means each attempt only has the timeout of the http client. Default is 30.
+  SDO_EXCHANGE_BREAKER_THRESHOLD - the number of failed exchange calls in a row after which requests fail right away with 503, until the exchange is tested again. 0 disables this. Default is 5.
+  SDO_EXCHANGE_BREAKER_OPEN_SECONDS - the number of seconds requests fail right away, before the exchange is tested again. Default is 30.
+  SDO_API_TOKEN_INTROSPECTION_URL - the OAuth 2.0 token introspection endpoint that validates the bearer tokens sent to the SDO owner services API. If not set, the exchange validates them as IAM tokens. The exchange does not accept the tokens validated by the introspection endpoint, so the requests that make exchange calls for the client (pre-registering the node of a device, rotating the token of a pre-registered node, and transferring an owner key) return 403 for them.
+  SDO_API_TOKEN_INTROSPECTION_CLIENT_ID, SDO_API_TOKEN_INTROSPECTION_CLIENT_SECRET - the credentials to call the token introspection endpoint with, if it requires them.
+  SDO_API_TOKEN_INTROSPECTION_CA_CERT - the CA cert file (in the container) to trust for the token introspection endpoint, in addition to the system CAs.
+  SDO_API_TOKEN_ORG_CLAIM, SDO_API_TOKEN_USER_CLAIM - the fields of the token introspection response that have the exchange org and user name of the token. Defaults are org and username.
+  SDO_API_TOKEN_ADMIN_SCOPE - the scope of the bearer tokens of org admins, when using token introspection. Default is orgadmin.
   VERBOSE - set to 1 or 'true' for more verbose output.
 EndOfMessage
     exit 1
@@ -144,4 +168,4 @@ else
     chk $? 'Pulling from Docker Hub...'
 fi
 # Run the service container
-docker run --name $SDO_DOCKER_IMAGE -dt --mount "type=volume,src=sdo-ocs-db,dst=$SDO_OCS_DB_CONTAINER_DIR" $privateKeyMount $certKeyMount -p $portNum:$portNum -p $SDO_RV_PORT:$SDO_RV_PORT -p $SDO_OPS_PORT:$SDO_OPS_PORT -e "SDO_KEY_PWD=$SDO_KEY_PWD" -e "SDO_OWNER_SVC_HOST=$SDO_OWNER_SVC_HOST" -e "SDO_OCS_DB_PATH=$SDO_OCS_DB_CONTAINER_DIR" -e "SDO_OCS_API_PORT=$SDO_OCS_API_PORT" -e "SDO_OCS_API_TLS_PORT=$SDO_OCS_API_TLS_PORT" -e "SDO_API_CERT_PATH=$SDO_API_CERT_PATH" -e "SDO_RV_PORT=$SDO_RV_PORT" -e "SDO_OPS_PORT=$SDO_OPS_PORT" -e "SDO_OPS_EXTERNAL_PORT=$SDO_OPS_EXTERNAL_PORT" -e "HZN_EXCHANGE_URL=$HZN_EXCHANGE_URL" -e "EXCHANGE_INTERNAL_URL=$EXCHANGE_INTERNAL_URL" -e "EXCHANGE_INTERNAL_CERT=$EXCHANGE_INTERNAL_CERT" -e "EXCHANGE_INTERNAL_RETRIES=$EXCHANGE_INTERNAL_RETRIES" -e "EXCHANGE_INTERNAL_INTERVAL=$EXCHANGE_INTERNAL_INTERVAL" -e "HZN_FSS_CSSURL=$HZN_FSS_CSSURL" -e "HZN_MGMT_HUB_CERT=$HZN_MGMT_HUB_CERT" -e "SDO_GET_PKGS_FROM=$SDO_GET_PKGS_FROM" -e "SDO_GET_CFG_FILE_FROM=$SDO_GET_CFG_FILE_FROM" -e "SDO_RV_VOUCHER_TTL=$SDO_RV_VOUCHER_TTL" -e "VERBOSE=$VERBOSE" $DOCKER_REGISTRY/$SDO_DOCKER_IMAGE:$VERSION
+docker run --name $SDO_DOCKER_IMAGE -dt --mount "type=volume,src=sdo-ocs-db,dst=$SDO_OCS_DB_CONTAINER_DIR" $privateKeyMount $certKeyMount -p $portNum:$portNum -p $SDO_RV_PORT:$SDO_RV_PORT -p $SDO_OPS_PORT:$SDO_OPS_PORT -e "SDO_KEY_PWD=$SDO_KEY_PWD" -e "SDO_OWNER_SVC_HOST=$SDO_OWNER_SVC_HOST" -e "SDO_OCS_DB_PATH=$SDO_OCS_DB_CONTAINER_DIR" -e "SDO_OCS_API_PORT=$SDO_OCS_API_PORT" -e "SDO_OCS_API_TLS_PORT=$SDO_OCS_API_TLS_PORT" -e "SDO_API_CERT_PATH=$SDO_API_CERT_PATH" -e "SDO_RV_PORT=$SDO_RV_PORT" -e "SDO_OPS_PORT=$SDO_OPS_PORT" -e "SDO_OPS_EXTERNAL_PORT=$SDO_OPS_EXTERNAL_PORT" -e "HZN_EXCHANGE_URL=$HZN_EXCHANGE_URL" -e "EXCHANGE_INTERNAL_URL=$EXCHANGE_INTERNAL_URL" -e "EXCHANGE_INTERNAL_CERT=$EXCHANGE_INTERNAL_CERT" -e "EXCHANGE_INTERNAL_RETRIES=$EXCHANGE_INTERNAL_RETRIES" -e "EXCHANGE_INTERNAL_INTERVAL=$EXCHANGE_INTERNAL_INTERVAL" -e "HZN_FSS_CSSURL=$HZN_FSS_CSSURL" -e "HZN_MGMT_HUB_CERT=$HZN_MGMT_HUB_CERT" -e "SDO_GET_PKGS_FROM=$SDO_GET_PKGS_FROM" -e "SDO_GET_CFG_FILE_FROM=$SDO_GET_CFG_FILE_FROM" -e "SDO_RV_VOUCHER_TTL=$SDO_RV_VOUCHER_TTL" -e "SDO_ALLOW_SAMPLE_OWNER_KEY=$SDO_ALLOW_SAMPLE_OWNER_KEY" -e "SDO_ALLOW_KEY_IMPORT_OVER_HTTP=$SDO_ALLOW_KEY_IMPORT_OVER_HTTP" -e "SDO_PREREGISTER_NODES=$SDO_PREREGISTER_NODES" -e "SDO_NODE_TOKEN_LENGTH=$SDO_NODE_TOKEN_LENGTH" -e "SDO_NODE_TOKEN_CHAR_CLASSES=$SDO_NODE_TOKEN_CHAR_CLASSES" -e "SDO_NODE_TOKEN_EXCHANGE_COMPAT=$SDO_NODE_TOKEN_EXCHANGE_COMPAT" -e "SDO_PURGE_NODE_TOKENS=$SDO_PURGE_NODE_TOKENS" -e "SDO_PURGE_NODE_TOKENS_INTERVAL=$SDO_PURGE_NODE_TOKENS_INTERVAL" -e "SDO_API_PERMISSIONS=$SDO_API_PERMISSIONS" -e "SDO_API_AUTH_CACHE_TTL=$SDO_API_AUTH_CACHE_TTL" -e "SDO_API_AUTH_CACHE_NEGATIVE_TTL=$SDO_API_AUTH_CACHE_NEGATIVE_TTL" -e "SDO_API_AUTH_CACHE_STALE_TTL=$SDO_API_AUTH_CACHE_STALE_TTL" -e "SDO_API_AUTH_CACHE_SIZE=$SDO_API_AUTH_CACHE_SIZE" -e "SDO_EXCHANGE_RETRIES=$SDO_EXCHANGE_RETRIES" -e "SDO_EXCHANGE_RETRY_BACKOFF_MS=$SDO_EXCHANGE_RETRY_BACKOFF_MS" -e "SDO_EXCHANGE_RETRY_MAX_BACKOFF_MS=$SDO_EXCHANGE_RETRY_MAX_BACKOFF_MS" -e "SDO_EXCHANGE_RETRY_DEADLINE_SECONDS=$SDO_EXCHANGE_RETRY_DEADLINE_SECONDS" -e "SDO_EXCHANGE_BREAKER_THRESHOLD=$SDO_EXCHANGE_BREAKER_THRESHOLD" -e "SDO_EXCHANGE_BREAKER_OPEN_SECONDS=$SDO_EXCHANGE_BREAKER_OPEN_SECONDS" -e "SDO_API_TOKEN_INTROSPECTION_URL=$SDO_API_TOKEN_INTROSPECTION_URL" -e "SDO_API_TOKEN_INTROSPECTION_CLIENT_ID=$SDO_API_TOKEN_INTROSPECTION_CLIENT_ID" -e "SDO_API_TOKEN_INTROSPECTION_CLIENT_SECRET=$SDO_API_TOKEN_INTROSPECTION_CLIENT_SECRET" -e "SDO_API_TOKEN_INTROSPECTION_CA_CERT=$SDO_API_TOKEN_INTROSPECTION_CA_CERT" -e "SDO_API_TOKEN_ORG_CLAIM=$SDO_API_TOKEN_ORG_CLAIM" -e "SDO_API_TOKEN_USER_CLAIM=$SDO_API_TOKEN_USER_CLAIM" -e "SDO_API_TOKEN_ADMIN_SCOPE=$SDO_API_TOKEN_ADMIN_SCOPE" -e "VERBOSE=$VERBOSE" $DOCKER_REGISTRY/$SDO_DOCKER_IMAGE:$VERSION
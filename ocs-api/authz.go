@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Authorization of every API request, before its handler runs: the request credentials are authenticated with the exchange, which
+also determines the role of the identity, and the role must be allowed by ApiPermissions (see outils/permissions.go) to run the
+method of the route on the resource of the route. The authenticated identity is passed to the handler in the request context.
+*/
+
+// The permission matrix, from the SDO_API_PERMISSIONS env var
+var ApiPermissions = outils.DefaultApiPermissions()
+
+// The routes that anyone can run
+var publicRoutes = map[string]bool{
+	"/api/version": true,
+	"/api/health":  true,
+}
+
+// Return the API resource of the route pattern: vouchers or keys, or "" for the public routes
+func routeResource(pattern string) string {
+	if publicRoutes[pattern] {
+		return ""
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(pattern, "/api/"), "orgs/{org-id}/")
+	resource := strings.SplitN(path, "/", 2)[0]
+	if resource == "voucher" { // backward compat route
+		resource = outils.ApiResourceVouchers
+	}
+	return resource
+}
+
+// The Router.Authorize hook
+func authorizeRoute(route *Route, params PathParams, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	resource := routeResource(route.Pattern)
+	if resource == "" {
+		return r, true
+	}
+
+	// Determine the org id to use for the device, based on various inputs
+	deviceOrgId, httpErr := getDeviceOrgId(params["org-id"], r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return nil, false
+	}
+
+	// Credentials that were revoked in the exchange are accepted from the stale cache entries during an exchange outage, so that is not
+	// allowed for the requests that do the most damage
+	allowStale := route.Method != http.MethodDelete && resource != outils.ApiResourceKeys
+	exUser, httpErr := outils.ExchangeAuthenticateIdentity(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath, ApiPermissions.AllowsNodesOrAgbots(), allowStale)
+	if httpErr != nil {
+		outils.WriteHttpError(w, httpErr) // includes Retry-After when the exchange is not available
+		return nil, false
+	} else if exUser == nil {
+		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !ApiPermissions.Allows(exUser.Role, route.Method, resource) {
+		outils.Verbose("Denying %s %s to %s/%s, whose role is %s", route.Method, r.URL.Path, exUser.Org, exUser.Name, exUser.Role)
+		http.Error(w, "permission denied: the "+exUser.Role+" role is not allowed to run "+route.Method+" on "+resource, http.StatusForbidden)
+		return nil, false
+	}
+	return outils.WithExchangeUser(r, deviceOrgId, exUser), true
+}
+
+// Return the device org and the exchange identity that authorizeRoute authorized for the request. The handlers only get the identity
+// from here, so they can't authenticate the request a 2nd time and reach a different decision. Writes an error response and returns
+// false if the request was not authorized (a route that authorizeRoute treats as public).
+func authorizedUser(w http.ResponseWriter, r *http.Request) (string, *outils.ExchangeUser, bool) {
+	deviceOrgId, exUser, ok := outils.ContextExchangeUser(r)
+	if !ok {
+		outils.Error("%s %s was not authorized before its handler was called", r.Method, r.URL.Path)
+		http.Error(w, "the request was not authorized", http.StatusInternalServerError)
+	}
+	return deviceOrgId, exUser, ok
+}
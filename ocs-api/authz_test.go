@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+func TestAuthorizeHubAdmin(t *testing.T) {
+	_, api := newTestApi(t)
+
+	// The hub admin is authenticated, but its role is not allowed anything by default
+	if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "root/hub", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("hub admin with the default permissions: got %d %s, expected 403", w.Code, w.Body.String())
+	}
+	// An admin of another org is not
+	if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "other/eve", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("admin of another org: got %d %s, expected 401", w.Code, w.Body.String())
+	}
+
+	ApiPermissions[outils.RoleHubAdmin] = []outils.ApiPermissionRule{{Method: http.MethodGet, Resource: "*"}}
+	if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "root/hub", "", nil); w.Code != http.StatusOK {
+		t.Errorf("hub admin allowed to GET: got %d %s, expected 200", w.Code, w.Body.String())
+	}
+	if w := testRequest(t, api, http.MethodGet, "/api/vouchers?orgid=myorg", "root/hub", "", nil); w.Code != http.StatusOK {
+		t.Errorf("hub admin allowed to GET, with ?orgid: got %d %s, expected 200", w.Code, w.Body.String())
+	}
+}
+
+func TestDefaultUserPermissions(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/bob", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Fatalf("user import: got %d %s, expected 201", w.Code, w.Body.String())
+	}
+	if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers/"+deviceUuid, "myorg/carol", "", nil); w.Code != http.StatusOK {
+		t.Errorf("user get: got %d %s, expected 200", w.Code, w.Body.String())
+	}
+	if w := testRequest(t, api, http.MethodDelete, "/api/orgs/myorg/vouchers/"+deviceUuid, "myorg/bob", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("user delete: got %d %s, expected 403", w.Code, w.Body.String())
+	}
+	if w := testRequest(t, api, http.MethodDelete, "/api/orgs/myorg/vouchers/"+deviceUuid, "myorg/admin", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("admin delete: got %d %s, expected 204", w.Code, w.Body.String())
+	}
+}
+
+// The handlers use the identity authorizeRoute put in the request context, instead of authenticating the request again
+func TestAuthenticateOnce(t *testing.T) {
+	ex, api := newTestApi(t)
+	newTestOwnerKeystore(t)
+	outils.AuthCache = outils.NewExchangeAuthCache(outils.AuthCacheConfig{})
+	keyInput, _ := json.Marshal(OwnerKeyInput{Key_name: "k1", Common_name: "test", Email_name: "test@example.com", Company_name: "test", Country_name: "US", State_name: "NY", Locale_name: "Albany"})
+	for _, test := range []struct {
+		method, path string
+		body         []byte
+		code         int
+	}{
+		{http.MethodGet, "/api/orgs/myorg/vouchers", nil, http.StatusOK},
+		{http.MethodGet, "/api/vouchers?orgid=myorg", nil, http.StatusOK},
+		{http.MethodPost, "/api/orgs/myorg/keys", keyInput, http.StatusCreated},
+		{http.MethodGet, "/api/orgs/myorg/keys", nil, http.StatusOK},
+	} {
+		before := len(ex.requestsFor(http.MethodGet, "/orgs/myorg/users/bob"))
+		if w := testRequest(t, api, test.method, test.path, "myorg/bob", "application/json", test.body); w.Code != test.code {
+			t.Errorf("%s %s: got %d %s, expected %d", test.method, test.path, w.Code, w.Body.String(), test.code)
+		}
+		if calls := len(ex.requestsFor(http.MethodGet, "/orgs/myorg/users/bob")) - before; calls != 1 {
+			t.Errorf("%s %s: the credentials were verified with the exchange %d times, expected 1", test.method, test.path, calls)
+		}
+	}
+}
+
+func TestAuthCacheStale(t *testing.T) {
+	ex, api := newTestApi(t)
+	if outils.DefaultAuthCacheConfig().StaleTTL != 0 {
+		t.Error("stale cache entries are used by default")
+	}
+	outils.AuthCache = outils.NewExchangeAuthCache(outils.AuthCacheConfig{TTL: time.Millisecond, StaleTTL: time.Minute, MaxEntries: 10})
+	if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "myorg/admin", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, expected 200", w.Code, w.Body.String())
+	}
+	time.Sleep(5 * time.Millisecond) // the cache entry expires
+
+	// The exchange is not available: the stale entry is used, except to delete and for owner keys
+	ex.fail["GET /orgs/myorg/users/admin"] = http.StatusServiceUnavailable
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/api/orgs/myorg/vouchers", http.StatusOK},
+		{http.MethodDelete, "/api/orgs/myorg/vouchers/123", http.StatusServiceUnavailable},
+		{http.MethodGet, "/api/orgs/myorg/keys", http.StatusServiceUnavailable},
+	} {
+		if w := testRequest(t, api, test.method, test.path, "myorg/admin", "", nil); w.Code != test.code {
+			t.Errorf("exchange unavailable, %s %s: got %d %s, expected %d", test.method, test.path, w.Code, w.Body.String(), test.code)
+		}
+	}
+
+	// The exchange fails with another error, that isn't an outage
+	ex.fail["GET /orgs/myorg/users/admin"] = http.StatusInternalServerError
+	if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "myorg/admin", "", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("exchange 500: got %d %s, expected 500", w.Code, w.Body.String())
+	}
+}
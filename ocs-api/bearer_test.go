@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+// A fake token introspection endpoint, over TLS. It returns status if it is set, otherwise the claims of the token.
+type testIntrospection struct {
+	server *httptest.Server
+	tokens map[string]map[string]interface{}
+	status int
+	calls  int32
+}
+
+// Start the introspection endpoint, and configure the ocs-api to use it and trust its cert
+func newTestIntrospection(t *testing.T) *testIntrospection {
+	ti := &testIntrospection{tokens: map[string]map[string]interface{}{}}
+	ti.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ti.calls, 1)
+		if ti.status != 0 {
+			w.WriteHeader(ti.status)
+			return
+		}
+		claims, ok := ti.tokens[r.FormValue("token")]
+		if !ok {
+			claims = map[string]interface{}{"active": false}
+		}
+		writeTestJson(w, http.StatusOK, claims)
+	}))
+	t.Cleanup(ti.server.Close)
+
+	caCertPath := filepath.Join(t.TempDir(), "introspection-ca.crt")
+	if err := os.WriteFile(caCertPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ti.server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	outils.TokenIntrospection.Url = ti.server.URL
+	outils.TokenIntrospection.CaCertPath = caCertPath
+	return ti
+}
+
+// Run the request with the bearer token and return the response
+func testBearerRequest(t *testing.T, handler http.Handler, method, path, token string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(string(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestIntrospectToken(t *testing.T) {
+	_, api := newTestApi(t)
+	outils.AuthCache = outils.NewExchangeAuthCache(outils.AuthCacheConfig{}) // every request calls the endpoint
+	ti := newTestIntrospection(t)
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	ti.tokens["bob-token"] = map[string]interface{}{"active": true, "org": "myorg", "username": "bob", "exp": exp}
+	ti.tokens["expired-token"] = map[string]interface{}{"active": true, "org": "myorg", "username": "bob", "exp": float64(time.Now().Add(-time.Minute).Unix())}
+
+	for _, test := range []struct {
+		name, token string
+		status      int // returned by the endpoint
+		code        int
+	}{
+		{"active token", "bob-token", 0, http.StatusOK},
+		{"inactive token", "unknown-token", 0, http.StatusUnauthorized},
+		{"expired token", "expired-token", 0, http.StatusUnauthorized},
+		{"endpoint returns 400", "bob-token", http.StatusBadRequest, http.StatusUnauthorized},
+		{"endpoint returns 401", "bob-token", http.StatusUnauthorized, http.StatusUnauthorized},
+		{"endpoint returns 403", "bob-token", http.StatusForbidden, http.StatusForbidden},
+		{"endpoint returns 500", "bob-token", http.StatusInternalServerError, http.StatusServiceUnavailable},
+	} {
+		ti.status = test.status
+		w := testBearerRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", test.token, nil)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d %s, expected %d", test.name, w.Code, w.Body.String(), test.code)
+		}
+		if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: the response does not have Retry-After", test.name)
+		}
+	}
+
+	// Without the CA cert, the cert of the endpoint is not trusted
+	ti.status = 0
+	outils.TokenIntrospection.CaCertPath = ""
+	if w := testBearerRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "bob-token", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("untrusted endpoint: got %d %s, expected 500", w.Code, w.Body.String())
+	}
+}
+
+// The token is not cached after it expires, even if the cache TTL is longer
+func TestIntrospectTokenCacheExpires(t *testing.T) {
+	_, api := newTestApi(t)
+	ti := newTestIntrospection(t)
+	exp := time.Now().Add(2 * time.Second).Unix()
+	ti.tokens["bob-token"] = map[string]interface{}{"active": true, "org": "myorg", "username": "bob", "exp": float64(exp)}
+
+	for i := 0; i < 2; i++ {
+		if w := testBearerRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "bob-token", nil); w.Code != http.StatusOK {
+			t.Fatalf("got %d %s, expected 200", w.Code, w.Body.String())
+		}
+	}
+	if calls := atomic.LoadInt32(&ti.calls); calls != 1 {
+		t.Errorf("the endpoint was called %d times, expected 1", calls)
+	}
+
+	time.Sleep(time.Until(time.Unix(exp, 0)) + 10*time.Millisecond)
+	if w := testBearerRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers", "bob-token", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: got %d %s, expected 401", w.Code, w.Body.String())
+	}
+	if calls := atomic.LoadInt32(&ti.calls); calls != 2 {
+		t.Errorf("the endpoint was called %d times, expected 2", calls)
+	}
+}
+
+// The exchange does not accept the tokens validated by the introspection endpoint, so they can't be used for exchange calls
+func TestIntrospectedTokenExchangeCalls(t *testing.T) {
+	ex, api := newTestApi(t)
+	newTestOwnerKeystore(t)
+	ti := newTestIntrospection(t)
+	ti.tokens["admin-token"] = map[string]interface{}{"active": true, "org": "myorg", "username": "admin", "scope": "orgadmin"}
+	body, _ := json.Marshal(OwnerKeyInput{Key_name: "k1", Common_name: "test", Email_name: "test@example.com", Company_name: "test", Country_name: "US", State_name: "NY", Locale_name: "Albany"})
+	if w := testBearerRequest(t, api, http.MethodPost, "/api/orgs/myorg/keys", "admin-token", body); w.Code != http.StatusCreated {
+		t.Fatalf("create key: got %d %s", w.Code, w.Body.String())
+	}
+
+	w := testBearerRequest(t, api, http.MethodPut, "/api/orgs/myorg/keys/k1/owner", "admin-token", []byte(`{"owner": "bob"}`))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "exchange credentials") {
+		t.Errorf("transfer key: got %d %s, expected 403", w.Code, w.Body.String())
+	}
+	if calls := ex.requestsFor(http.MethodGet, "/orgs/myorg/users/bob"); len(calls) != 0 {
+		t.Errorf("the exchange was called with the token: %v", calls)
+	}
+	if w := testRequest(t, api, http.MethodPut, "/api/orgs/myorg/keys/k1/owner", "myorg/admin", "application/json", []byte(`{"owner": "bob"}`)); w.Code != http.StatusNoContent {
+		t.Errorf("transfer key with exchange credentials: got %d %s, expected 204", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Reading the vouchers of a bulk voucher import request. The vouchers can be sent as a json array, a multipart/form-data upload,
+or a tar, tar.gz, or zip file.
+*/
+
+const (
+	MaxBulkVouchersBodyBytes  = 32 * 1024 * 1024 // real vouchers are a few KB, so this is thousands of vouchers
+	MaxVoucherFileBytes       = 1024 * 1024
+	MaxBulkVouchers           = 10000
+	MaxBulkVouchersTotalBytes = 64 * 1024 * 1024 // the vouchers after they are decompressed, so a small tar.gz or zip can't expand to fill the memory
+)
+
+// 1 voucher of a bulk import request. Err is set if this voucher could not be read (which should not prevent the others from being imported).
+type BulkVoucher struct {
+	Name  string // the file name, or the array index for a json array
+	Bytes []byte
+	Err   string
+}
+
+// The number of vouchers and bytes that are left to read from the request, so the body can not have more than MaxBulkVouchers
+// vouchers or MaxBulkVouchersTotalBytes of them in total
+type bulkVoucherBudget struct {
+	vouchers int
+	bytes    int64
+}
+
+func newBulkVoucherBudget() *bulkVoucherBudget {
+	return &bulkVoucherBudget{vouchers: MaxBulkVouchers, bytes: MaxBulkVouchersTotalBytes}
+}
+
+// Count 1 more voucher. Returns 413 if there are too many.
+func (b *bulkVoucherBudget) addVoucher() *outils.HttpError {
+	if b.vouchers--; b.vouchers < 0 {
+		return outils.NewHttpError(http.StatusRequestEntityTooLarge, "Error: the request has more than %d vouchers", MaxBulkVouchers)
+	}
+	return nil
+}
+
+// Read 1 voucher file, guarding against files that are too big to be a voucher. Returns 413 if there are too many vouchers, or
+// they are too big in total.
+func (b *bulkVoucherBudget) readVoucher(name string, reader io.Reader) (BulkVoucher, *outils.HttpError) {
+	if httpErr := b.addVoucher(); httpErr != nil {
+		return BulkVoucher{}, httpErr
+	}
+	limit := int64(MaxVoucherFileBytes + 1)
+	if b.bytes < limit {
+		limit = b.bytes + 1
+	}
+	voucherBytes, err := ioutil.ReadAll(io.LimitReader(reader, limit))
+	if b.bytes -= int64(len(voucherBytes)); b.bytes < 0 {
+		return BulkVoucher{}, outils.NewHttpError(http.StatusRequestEntityTooLarge, "Error: the vouchers in the request are larger than %d bytes in total", MaxBulkVouchersTotalBytes)
+	}
+	if err != nil {
+		return BulkVoucher{Name: name, Err: "Error reading voucher file: " + err.Error()}, nil
+	} else if len(voucherBytes) > MaxVoucherFileBytes {
+		return BulkVoucher{Name: name, Err: fmt.Sprintf("voucher file is larger than %d bytes", MaxVoucherFileBytes)}, nil
+	}
+	return BulkVoucher{Name: name, Bytes: voucherBytes}, nil
+}
+
+// Read all of the vouchers in the request body, based on its content type
+func readBulkVouchers(r *http.Request) ([]BulkVoucher, *outils.HttpError) {
+	contentType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error: invalid or missing content-type: %v", err)
+	}
+	r.Body = http.MaxBytesReader(nil, r.Body, MaxBulkVouchersBodyBytes) // set it in the request, because the multipart reader reads r.Body
+
+	switch contentType {
+	case "application/json":
+		return readJsonArrayVouchers(r.Body)
+	case "multipart/form-data":
+		return readMultipartVouchers(r, params["boundary"])
+	case "application/x-tar", "application/tar":
+		return readTarVouchers(r.Body)
+	case "application/gzip", "application/x-gzip", "application/x-compressed-tar":
+		gzReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "Error reading gzip request body: %v", err)
+		}
+		defer gzReader.Close()
+		return readTarVouchers(gzReader)
+	case "application/zip", "application/x-zip-compressed":
+		return readZipVouchers(r.Body)
+	default:
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error: content-type must be one of: application/json, multipart/form-data, application/x-tar, application/gzip, application/zip")
+	}
+}
+
+func readJsonArrayVouchers(body io.Reader) ([]BulkVoucher, *outils.HttpError) {
+	var rawVouchers []json.RawMessage // this keeps the exact bytes of each voucher, which are needed to verify the voucher hashes
+	if err := json.NewDecoder(body).Decode(&rawVouchers); err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error parsing request body as a json array of vouchers: %v", err)
+	}
+	if len(rawVouchers) > MaxBulkVouchers {
+		return nil, outils.NewHttpError(http.StatusRequestEntityTooLarge, "Error: the request has more than %d vouchers", MaxBulkVouchers)
+	}
+	vouchers := make([]BulkVoucher, 0, len(rawVouchers))
+	for i, raw := range rawVouchers {
+		vouchers = append(vouchers, BulkVoucher{Name: fmt.Sprintf("[%d]", i), Bytes: raw})
+	}
+	return vouchers, nil
+}
+
+func readMultipartVouchers(r *http.Request, boundary string) ([]BulkVoucher, *outils.HttpError) {
+	if boundary == "" {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error: multipart/form-data content-type is missing the boundary")
+	}
+	mpReader, err := r.MultipartReader()
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error reading multipart request body: %v", err)
+	}
+	budget := newBulkVoucherBudget()
+	vouchers := []BulkVoucher{}
+	for {
+		part, err := mpReader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "Error reading multipart request body: %v", err)
+		}
+		name := part.FileName()
+		if name == "" {
+			name = part.FormName()
+		}
+		bv, httpErr := budget.readVoucher(name, part)
+		part.Close()
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		vouchers = append(vouchers, bv)
+	}
+	return vouchers, nil
+}
+
+func readTarVouchers(body io.Reader) ([]BulkVoucher, *outils.HttpError) {
+	tarReader := tar.NewReader(body)
+	budget := newBulkVoucherBudget()
+	vouchers := []BulkVoucher{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "Error reading tar request body: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg || isIgnoredArchiveFile(header.Name) {
+			continue
+		}
+		bv, httpErr := budget.readVoucher(header.Name, tarReader)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		vouchers = append(vouchers, bv)
+	}
+	return vouchers, nil
+}
+
+func readZipVouchers(body io.Reader) ([]BulkVoucher, *outils.HttpError) {
+	// The zip reader needs random access, so the body (which is limited to MaxBulkVouchersBodyBytes) is copied to a temp file,
+	// instead of being held in memory
+	zipFile, err := ioutil.TempFile("", "ocs-api-vouchers-*.zip")
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error creating a temporary file for the zip request body: %v", err)
+	}
+	defer os.Remove(zipFile.Name())
+	defer zipFile.Close()
+	zipSize, err := io.Copy(zipFile, body)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error reading the request body: %v", err)
+	}
+	zipReader, err := zip.NewReader(zipFile, zipSize)
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusBadRequest, "Error reading zip request body: %v", err)
+	}
+	budget := newBulkVoucherBudget()
+	vouchers := []BulkVoucher{}
+	for _, f := range zipReader.File {
+		if f.FileInfo().IsDir() || isIgnoredArchiveFile(f.Name) {
+			continue
+		}
+		fileReader, err := f.Open()
+		if err != nil {
+			if httpErr := budget.addVoucher(); httpErr != nil {
+				return nil, httpErr
+			}
+			vouchers = append(vouchers, BulkVoucher{Name: f.Name, Err: "Error reading file from zip: " + err.Error()})
+			continue
+		}
+		bv, httpErr := budget.readVoucher(f.Name, fileReader)
+		fileReader.Close()
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		vouchers = append(vouchers, bv)
+	}
+	return vouchers, nil
+}
+
+// Skip hidden files and the metadata that some archivers add (e.g. __MACOSX/)
+func isIgnoredArchiveFile(name string) bool {
+	return strings.HasPrefix(path.Base(name), ".") || strings.HasPrefix(name, "__MACOSX/")
+}
+
+// Return the device uuid of the voucher (oh.g), without validating the rest of the voucher, or "" if it can not be read
+func bulkVoucherDeviceUuid(voucherBytes []byte) string {
+	var v struct {
+		Oh struct {
+			G string `json:"g"`
+		} `json:"oh"`
+	}
+	if err := json.Unmarshal(voucherBytes, &v); err != nil {
+		return ""
+	}
+	guidBytes, err := base64.StdEncoding.DecodeString(v.Oh.G)
+	if err != nil {
+		return ""
+	}
+	guid, err := uuid.FromBytes(guidBytes)
+	if err != nil {
+		return ""
+	}
+	return guid.String()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	name    string
+	content []byte
+}
+
+// The files of the test archives: 2 vouchers, a file that is too big to be a voucher, and files that are skipped
+func bulkTestFiles() []testFile {
+	return []testFile{
+		{"vouchers/a.json", []byte(`{"sz":1}`)},
+		{".hidden.json", []byte(`{"hidden":true}`)},
+		{"__MACOSX/vouchers/._a.json", []byte("mac metadata")},
+		{"vouchers/big.json", bytes.Repeat([]byte("x"), MaxVoucherFileBytes+1)},
+		{"b.json", []byte(`{"sz":2}`)},
+	}
+}
+
+func tarBody(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "vouchers/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(f.content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tgzBody(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(tarBody(t, files))
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zipBody(t *testing.T, files []testFile) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.Create("vouchers/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Multipart does not skip hidden files (they are uploaded on purpose), so only the vouchers and the big file are sent
+func multipartBody(t *testing.T, files []testFile) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, f := range files {
+		if strings.Contains(f.name, "/.") || strings.HasPrefix(f.name, ".") || strings.HasPrefix(f.name, "__MACOSX/") {
+			continue
+		}
+		fw, err := mw.CreateFormFile("voucher", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.content)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+func TestReadBulkVouchers(t *testing.T) {
+	files := bulkTestFiles()
+	multipartBytes, multipartType := multipartBody(t, files)
+	tests := []struct {
+		contentType string
+		body        []byte
+	}{
+		{"application/x-tar", tarBody(t, files)},
+		{"application/gzip", tgzBody(t, files)},
+		{"application/zip", zipBody(t, files)},
+		{multipartType, multipartBytes},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/orgs/myorg/vouchers/bulk", bytes.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		vouchers, httpErr := readBulkVouchers(r)
+		if httpErr != nil {
+			t.Errorf("%s: %v", test.contentType, httpErr)
+			continue
+		}
+		if len(vouchers) != 3 {
+			t.Errorf("%s: got %d vouchers, expected 3: %v", test.contentType, len(vouchers), vouchers)
+			continue
+		}
+		// The multipart file names are the base names
+		if !strings.HasSuffix(vouchers[0].Name, "a.json") || string(vouchers[0].Bytes) != `{"sz":1}` || vouchers[0].Err != "" {
+			t.Errorf("%s: 1st voucher is %s %q %s, expected a.json", test.contentType, vouchers[0].Name, vouchers[0].Bytes, vouchers[0].Err)
+		}
+		if !strings.HasSuffix(vouchers[1].Name, "big.json") || !strings.Contains(vouchers[1].Err, "larger than") {
+			t.Errorf("%s: 2nd voucher is %s with error %q, expected big.json with a size error", test.contentType, vouchers[1].Name, vouchers[1].Err)
+		}
+		if vouchers[2].Name != "b.json" || string(vouchers[2].Bytes) != `{"sz":2}` || vouchers[2].Err != "" {
+			t.Errorf("%s: 3rd voucher is %s %q %s, expected b.json", test.contentType, vouchers[2].Name, vouchers[2].Bytes, vouchers[2].Err)
+		}
+	}
+}
+
+func TestReadBulkVouchersJsonAndErrors(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/orgs/myorg/vouchers/bulk", strings.NewReader(`[{"sz": 1}, {"voucher": {"sz": 2}}]`))
+	r.Header.Set("Content-Type", "application/json")
+	vouchers, httpErr := readBulkVouchers(r)
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	// The vouchers keep their exact bytes, which the voucher hashes are over
+	if len(vouchers) != 2 || vouchers[0].Name != "[0]" || string(vouchers[0].Bytes) != `{"sz": 1}` || vouchers[1].Name != "[1]" || string(vouchers[1].Bytes) != `{"voucher": {"sz": 2}}` {
+		t.Errorf("got %v", vouchers)
+	}
+
+	for _, test := range []struct {
+		contentType, body string
+	}{
+		{"application/json", `{"sz": 1}`},
+		{"application/zip", "not a zip file"},
+		{"application/gzip", "not a gzip file"},
+		{"text/plain", "[]"},
+		{"", "[]"},
+		{"application/json", "[" + strings.Repeat(`{"sz":1},`, MaxBulkVouchersBodyBytes/9) + `{"sz":1}]`},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/orgs/myorg/vouchers/bulk", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		if _, httpErr := readBulkVouchers(r); httpErr == nil || httpErr.Code != http.StatusBadRequest {
+			t.Errorf("%s body of %d bytes: got %v, expected a 400 error", test.contentType, len(test.body), httpErr)
+		}
+	}
+}
+
+// Too many vouchers, or vouchers that decompress to too many bytes in total, are rejected before they are all read
+func TestReadBulkVouchersLimits(t *testing.T) {
+	manyFiles := make([]testFile, MaxBulkVouchers+1)
+	for i := range manyFiles {
+		manyFiles[i] = testFile{fmt.Sprintf("%d.json", i), []byte(`{}`)}
+	}
+	bigFiles := make([]testFile, MaxBulkVouchersTotalBytes/MaxVoucherFileBytes+1)
+	for i := range bigFiles {
+		bigFiles[i] = testFile{fmt.Sprintf("%d.json", i), bytes.Repeat([]byte(" "), MaxVoucherFileBytes)}
+	}
+	manyMultipartBytes, manyMultipartType := multipartBody(t, manyFiles)
+	tests := []struct {
+		name, contentType string
+		body              []byte
+	}{
+		{"json array of too many vouchers", "application/json", []byte("[" + strings.Repeat(`{},`, MaxBulkVouchers) + "{}]")},
+		{"tar of too many vouchers", "application/x-tar", tarBody(t, manyFiles)},
+		{"zip of too many vouchers", "application/zip", zipBody(t, manyFiles)},
+		{"multipart of too many vouchers", manyMultipartType, manyMultipartBytes},
+		{"tar.gz of too many bytes", "application/gzip", tgzBody(t, bigFiles)},
+		{"zip of too many bytes", "application/zip", zipBody(t, bigFiles)},
+	}
+	for _, test := range tests {
+		if len(test.body) > MaxBulkVouchersBodyBytes {
+			t.Fatalf("%s: the body is %d bytes, which is more than the body limit", test.name, len(test.body))
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/orgs/myorg/vouchers/bulk", bytes.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		if _, httpErr := readBulkVouchers(r); httpErr == nil || httpErr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: got %v, expected a 413 error", test.name, httpErr)
+		}
+	}
+
+	// Exactly at the limits is ok
+	r := httptest.NewRequest(http.MethodPost, "/api/orgs/myorg/vouchers/bulk", bytes.NewReader(tgzBody(t, bigFiles[1:])))
+	r.Header.Set("Content-Type", "application/gzip")
+	if vouchers, httpErr := readBulkVouchers(r); httpErr != nil || len(vouchers) != len(bigFiles)-1 {
+		t.Errorf("tar.gz at the byte limit: got %d vouchers %v, expected %d", len(vouchers), httpErr, len(bigFiles)-1)
+	}
+}
+
+func TestBulkVoucherImportDuplicates(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	dupVoucher, dupUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	otherVoucher, otherUuid := newTestVoucher(t, &ownerKey.PublicKey)
+
+	body, _ := json.Marshal([]json.RawMessage{dupVoucher, otherVoucher, dupVoucher})
+	w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers/bulk", "myorg/admin", "application/json", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Imported int `json:"imported"`
+		Failed   int `json:"failed"`
+		Results  []struct {
+			Name       string `json:"name"`
+			DeviceUuid string `json:"deviceUuid"`
+			NodeToken  string `json:"nodeToken"`
+			Field      string `json:"field"`
+			Error      string `json:"error"`
+		} `json:"results"`
+	}
+	decodeTestResponse(t, w, &resp)
+	if resp.Imported != 1 || resp.Failed != 2 || len(resp.Results) != 3 {
+		t.Fatalf("got %s, expected 1 imported and 2 failed", w.Body.String())
+	}
+	for _, i := range []int{0, 2} {
+		if r := resp.Results[i]; r.DeviceUuid != dupUuid || r.Field != "oh.g" || !strings.Contains(r.Error, "[0], [2]") || r.NodeToken != "" {
+			t.Errorf("result %d is %+v, expected a duplicate device error", i, r)
+		}
+	}
+	if r := resp.Results[1]; r.DeviceUuid != otherUuid || r.Error != "" || r.NodeToken == "" {
+		t.Errorf("result 1 is %+v, expected the device to be imported", r)
+	}
+	if Devices.Get(dupUuid) != nil || Devices.Get(otherUuid) == nil {
+		t.Errorf("expected only device %s to be imported", otherUuid)
+	}
+}
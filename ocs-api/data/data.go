@@ -1,71 +1,27 @@
 package data
 
-// Data for OCS Config Files -------------------
-// Is there a better way to handle this?
-
-var PsiJson = `[
-  {
-    "module": "sdo_sys",
-    "msg": "maxver",
-    "value": "1"
-  }
-]`
-
-// this one is optional, that's why it is separate
-var SviJson1 = `
-  {
-    "module": "sdo_sys",
-    "msg": "filedesc",
-    "valueLen": -1,
-    "valueId": "agent-install-crt_name",
-    "enc": "base64"
-  },
-  {
-    "module": "sdo_sys",
-    "msg": "write",
-    "valueLen": -1,
-    "valueId": "agent-install.crt",
-    "enc": "base64"
-  },`
-
-var SviJson2 = `
-  {
-    "module": "sdo_sys",
-    "msg": "filedesc",
-    "valueLen": -1,
-    "valueId": "agent-install-cfg_name",
-    "enc": "base64"
-  },
-  {
-    "module": "sdo_sys",
-    "msg": "write",
-    "valueLen": -1,
-    "valueId": "agent-install.cfg",
-    "enc": "base64"
-  },
-  {
-    "module": "sdo_sys",
-    "msg": "filedesc",
-    "valueLen": -1,
-    "valueId": "agent-install-wrapper-sh_name",
-    "enc": "base64"
-  },
-  {
-    "module": "sdo_sys",
-    "msg": "write",
-    "valueLen": -1,
-    "valueId": "agent-install-wrapper.sh",
-    "enc": "base64"
-  },
-  {
-    "module": "sdo_sys",
-    "msg": "exec",
-    "valueLen": -1,
-    "valueId": "`
-
-// need to put the uuid between these 2
-
-var SviJson3 = `_exec",
-    "enc": "base64"
-  }
+// The public keys of keys/sample-owner-keystore.p12, which is only valid for dev/test
+var SampleOwnerPublicKey = `ec_256:
+-----BEGIN PUBLIC KEY-----
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAEWVUE2G0GLy8scmAOyQyhcBiF/fSU
+d3i/Og7XDShiJb2IsbCZSRqt1ek15IbeCI5z7BHea2GZGgaK63cyD15gNA==
+-----END PUBLIC KEY-----
+,
+ec_384:
+-----BEGIN PUBLIC KEY-----
+MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAE4RFfGVQdojLIODXnUT6NqB6KpmmPV2Rl
+aVWXzdDef83f/JT+/XLPcpAZVoS++pwZpDoCkRU+E2FqKFdKDDD4g7obfqWd87z1
+EtjdVaI1qiagqaSlkul2oQPBAujpIaHZ
+-----END PUBLIC KEY-----
+,
+rsa_2048:
+-----BEGIN PUBLIC KEY-----
+MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAtE58Wx9S4BWTNdrTmj3+
+kJXNKuOAk3sgQwvF0Y8uXo3/ECeS/hj5SDmxG5fSnBlmGVKJwGV1bTVERDZ4uh4a
+W1fWMmoUd4xcxun4N4B9+WDSQlX/+Rd3wBLEkKQfNr7lU9ZitfaGkBKxs23Y0GCY
+Hfwh91TjXzNtGzAzv4F/SqQ45KrSafQIIEj72yuadBrQuN+XHkagpJwFtLYr0rbt
+RZfSLcSvoGZtpwW9JfIDntC+eqoqcwOrMRWZAnyAY52GFZqK9+cjJlXuoAS4uH+q
+6KHgLC5u0rcpLiDYJgiv56s4pwd4ILSuRGSohCYsIIIk9rD+tVWqFsGZGDcZXU0z
+CQIDAQAB
+-----END PUBLIC KEY-----
 `
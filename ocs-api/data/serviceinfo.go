@@ -0,0 +1,205 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Models and builder for the SDO service info messages of the OCS db files svi.json (sent to the device) and psi.json (expected from the device)
+
+const (
+	SdoSysModule = "sdo_sys"
+
+	SdoSysMsgFiledesc = "filedesc" // the value is the name of the file the following write messages write to
+	SdoSysMsgWrite    = "write"    // the value is (a chunk of) the file content
+	SdoSysMsgExec     = "exec"     // the value is the null separated args of the command to run
+	SdoSysMsgMaxver   = "maxver"
+
+	SviEncBase64 = "base64"
+	SviEncAscii  = "ascii"
+
+	SviValueLenWholeFile = -1 // tells the OCS to send the whole value file
+)
+
+// 1 entry of svi.json. The value is read by the OCS from the value file v1/values/<valueId>.
+type SviEntry struct {
+	Module   string `json:"module"`
+	Msg      string `json:"msg"`
+	ValueLen int    `json:"valueLen"`
+	ValueId  string `json:"valueId"`
+	Enc      string `json:"enc"`
+}
+
+// 1 entry of psi.json
+type PsiEntry struct {
+	Module string `json:"module"`
+	Msg    string `json:"msg"`
+	Value  string `json:"value"`
+}
+
+// An sdo_sys entry that sends the whole value file base64 encoded
+func NewSdoSysEntry(msg, valueId string) SviEntry {
+	return SviEntry{Module: SdoSysModule, Msg: msg, ValueLen: SviValueLenWholeFile, ValueId: valueId, Enc: SviEncBase64}
+}
+
+// The filedesc and write entries that send 1 file to the device
+func NewSviFileEntries(nameValueId, contentValueId string) []SviEntry {
+	return []SviEntry{NewSdoSysEntry(SdoSysMsgFiledesc, nameValueId), NewSdoSysEntry(SdoSysMsgWrite, contentValueId)}
+}
+
+// The value id of the exec file of the device, which runs agent-install-wrapper.sh
+func ExecValueId(deviceUuid string) string { return deviceUuid + "_exec" }
+
+// Builds the list of svi entries. Entries are identified by their value id when inserting, moving, or removing.
+type SviBuilder struct {
+	entries []SviEntry
+}
+
+func NewSviBuilder() *SviBuilder { return &SviBuilder{} }
+
+// The svi entries common to all devices: agent-install.crt (if includeCrt), agent-install.cfg, agent-install-wrapper.sh, and
+// the exec of agent-install-wrapper.sh.
+func NewDeviceSviBuilder(deviceUuid string, includeCrt bool) *SviBuilder {
+	return NewSviBuilder().
+		AddIf(includeCrt, NewSviFileEntries("agent-install-crt_name", "agent-install.crt")...).
+		Add(NewSviFileEntries("agent-install-cfg_name", "agent-install.cfg")...).
+		Add(NewSviFileEntries("agent-install-wrapper-sh_name", "agent-install-wrapper.sh")...).
+		Add(NewSdoSysEntry(SdoSysMsgExec, ExecValueId(deviceUuid)))
+}
+
+// Append entries
+func (b *SviBuilder) Add(entries ...SviEntry) *SviBuilder {
+	b.entries = append(b.entries, entries...)
+	return b
+}
+
+// Append entries only if the condition is true (e.g. the value file exists)
+func (b *SviBuilder) AddIf(condition bool, entries ...SviEntry) *SviBuilder {
+	if condition {
+		b.Add(entries...)
+	}
+	return b
+}
+
+// Insert entries before the 1st entry with this value id
+func (b *SviBuilder) InsertBefore(valueId string, entries ...SviEntry) error {
+	i := b.indexOf(valueId)
+	if i < 0 {
+		return errors.New("svi entry with valueId " + valueId + " not found")
+	}
+	b.insert(i, entries)
+	return nil
+}
+
+// Insert entries after the 1st entry with this value id
+func (b *SviBuilder) InsertAfter(valueId string, entries ...SviEntry) error {
+	i := b.indexOf(valueId)
+	if i < 0 {
+		return errors.New("svi entry with valueId " + valueId + " not found")
+	}
+	b.insert(i+1, entries)
+	return nil
+}
+
+// Move the 1st entry with this value id to the index (in the list without the moved entry)
+func (b *SviBuilder) Move(valueId string, index int) error {
+	i := b.indexOf(valueId)
+	if i < 0 {
+		return errors.New("svi entry with valueId " + valueId + " not found")
+	}
+	entry := b.entries[i]
+	b.entries = append(b.entries[:i], b.entries[i+1:]...)
+	if index < 0 || index > len(b.entries) {
+		b.insert(i, []SviEntry{entry}) // put it back
+		return fmt.Errorf("svi entry index %d is out of range", index)
+	}
+	b.insert(index, []SviEntry{entry})
+	return nil
+}
+
+// Remove all entries with this value id
+func (b *SviBuilder) Remove(valueId string) {
+	entries := b.entries[:0]
+	for _, e := range b.entries {
+		if e.ValueId != valueId {
+			entries = append(entries, e)
+		}
+	}
+	b.entries = entries
+}
+
+// A copy of the current entries
+func (b *SviBuilder) Entries() []SviEntry {
+	return append([]SviEntry{}, b.entries...)
+}
+
+// Validate the entries and return the content of svi.json
+func (b *SviBuilder) Build() ([]byte, error) {
+	if err := ValidateSviEntries(b.entries); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(b.entries, "", "  ")
+}
+
+func (b *SviBuilder) indexOf(valueId string) int {
+	for i, e := range b.entries {
+		if e.ValueId == valueId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *SviBuilder) insert(index int, entries []SviEntry) {
+	b.entries = append(b.entries[:index], append(append([]SviEntry{}, entries...), b.entries[index:]...)...)
+}
+
+// Verify the entries are something the OCS and the device can process
+func ValidateSviEntries(entries []SviEntry) error {
+	haveFiledesc := false
+	for i, e := range entries {
+		if e.Module == "" {
+			return fmt.Errorf("svi entry %d: module is empty", i)
+		}
+		if e.ValueId == "" {
+			return fmt.Errorf("svi entry %d: valueId is empty", i)
+		}
+		if e.ValueLen < SviValueLenWholeFile {
+			return fmt.Errorf("svi entry %d: valueLen %d is invalid", i, e.ValueLen)
+		}
+		if e.Enc != SviEncBase64 && e.Enc != SviEncAscii {
+			return fmt.Errorf("svi entry %d: enc must be %s or %s", i, SviEncBase64, SviEncAscii)
+		}
+		if e.Module != SdoSysModule {
+			continue // other modules define their own messages
+		}
+		switch e.Msg {
+		case SdoSysMsgFiledesc:
+			haveFiledesc = true
+		case SdoSysMsgWrite:
+			if !haveFiledesc {
+				return fmt.Errorf("svi entry %d: %s must come after a %s", i, SdoSysMsgWrite, SdoSysMsgFiledesc)
+			}
+		case SdoSysMsgExec:
+		default:
+			return fmt.Errorf("svi entry %d: %s msg %s is not supported", i, SdoSysModule, e.Msg)
+		}
+	}
+	return nil
+}
+
+// The psi entries common to all devices
+func NewDevicePsiEntries() []PsiEntry {
+	return []PsiEntry{{Module: SdoSysModule, Msg: SdoSysMsgMaxver, Value: "1"}}
+}
+
+// Return the content of psi.json
+func BuildPsi(entries []PsiEntry) ([]byte, error) {
+	for i, e := range entries {
+		if e.Module == "" || e.Msg == "" {
+			return nil, fmt.Errorf("psi entry %d: module and msg must be set", i)
+		}
+	}
+	return json.MarshalIndent(entries, "", "  ")
+}
@@ -0,0 +1,59 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testSviValueIds(b *SviBuilder) []string {
+	ids := []string{}
+	for _, e := range b.Entries() {
+		ids = append(ids, e.ValueId)
+	}
+	return ids
+}
+
+// Inserting or moving relative to an entry that does not exist returns an error and does not change the entries
+func TestSviBuilderMissingAnchor(t *testing.T) {
+	b := NewSviBuilder().Add(NewSviFileEntries("a_name", "a")...).Add(NewSdoSysEntry(SdoSysMsgExec, "exec"))
+	expected := []string{"a_name", "a", "exec"}
+	extra := NewSviFileEntries("b_name", "b")
+
+	for _, test := range []struct {
+		name string
+		op   func() error
+	}{
+		{"InsertBefore missing", func() error { return b.InsertBefore("missing", extra...) }},
+		{"InsertAfter missing", func() error { return b.InsertAfter("missing", extra...) }},
+		{"Move missing", func() error { return b.Move("missing", 0) }},
+		{"Move to a negative index", func() error { return b.Move("exec", -1) }},
+		{"Move past the end", func() error { return b.Move("a_name", 3) }},
+	} {
+		if err := test.op(); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+		if ids := testSviValueIds(b); !reflect.DeepEqual(ids, expected) {
+			t.Errorf("%s: the entries are %v, expected %v", test.name, ids, expected)
+		}
+	}
+
+	// The same operations with entries that exist
+	if err := b.InsertBefore("exec", extra...); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.InsertAfter("exec", NewSdoSysEntry(SdoSysMsgExec, "exec2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Move("exec2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Move("exec2", 5); err != nil {
+		t.Fatal(err)
+	}
+	if ids, expected := testSviValueIds(b), []string{"a_name", "a", "b_name", "b", "exec", "exec2"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("the entries are %v, expected %v", ids, expected)
+	}
+	if _, err := b.Build(); err != nil {
+		t.Errorf("Build: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Embedded index of the per-device facts the ocs-api needs (org, import time, importing user, node token hash), so listing vouchers
+and checking which org a device is in do not require walking the OCS db dirs. The index is an append-only log of json records
+(1 per line) that is replayed and compacted at startup. The OCS db files (e.g. orgid.txt) are still written, because the OCS needs them,
+and they are the source of truth the index is reconciled with at startup.
+*/
+
+const (
+	deviceIndexOpPut    = "put"
+	deviceIndexOpDelete = "delete"
+)
+
+// The indexed facts about 1 imported device/voucher
+type DeviceRecord struct {
+	DeviceUuid        string `json:"deviceUuid"`
+	Orgid             string `json:"orgid"`
+	ImportedAt        string `json:"importedAt"`                  // RFC 3339
+	ImportedBy        string `json:"importedBy,omitempty"`        // the exchange user that imported the voucher, if known
+	NodeTokenHash     string `json:"nodeTokenHash,omitempty"`     // hex sha256 of the node token, empty if the device has no node token
+	ExchangeNode      bool   `json:"exchangeNode,omitempty"`      // the node was pre-registered in the exchange when the voucher was imported
+	NodeTokenIssuedAt string `json:"nodeTokenIssuedAt,omitempty"` // RFC 3339 with fractional seconds, when the current node token was generated
+	NodeTokenPurgedAt string `json:"nodeTokenPurgedAt,omitempty"` // RFC 3339, when the node token was removed from the exec file after onboarding
+	OwnerKey          string `json:"ownerKey,omitempty"`          // the name of the org owner key the voucher is signed over to, empty for the sample owner key
+}
+
+func (rec *DeviceRecord) HasNodeToken() bool { return rec.NodeTokenHash != "" }
+
+// 1 line of the index log file
+type deviceIndexEntry struct {
+	Op     string        `json:"op"`
+	Record *DeviceRecord `json:"record"`
+}
+
+type DeviceIndex struct {
+	lock     sync.RWMutex
+	fileName string
+	file     *os.File // the log file, opened for appending
+	devices  map[string]*DeviceRecord
+}
+
+// Hash the node token the way it is stored in the index
+func hashNodeToken(nodeToken string) string {
+	if nodeToken == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(nodeToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// Open (or create) the index, replay its log, reconcile it with the device dirs of the OCS db, and compact the log
+func OpenDeviceIndex(fileName string) (*DeviceIndex, error) {
+	idx := &DeviceIndex{fileName: filepath.Clean(fileName), devices: map[string]*DeviceRecord{}}
+	if err := os.MkdirAll(filepath.Dir(idx.fileName), 0750); err != nil {
+		return nil, err
+	}
+	if err := idx.replay(); err != nil {
+		return nil, err
+	}
+	if err := idx.reconcile(); err != nil {
+		return nil, err
+	}
+	if err := idx.compact(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Load the records from the log file, if it exists. A truncated last line (from a crash during a write) is ignored.
+func (idx *DeviceIndex) replay() error {
+	logBytes, err := ioutil.ReadFile(idx.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(logBytes))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		entry := deviceIndexEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Record == nil {
+			outils.Warning("ignoring invalid line %d of device index %s", lineNum, idx.fileName)
+			continue
+		}
+		switch entry.Op {
+		case deviceIndexOpPut:
+			idx.devices[entry.Record.DeviceUuid] = entry.Record
+		case deviceIndexOpDelete:
+			delete(idx.devices, entry.Record.DeviceUuid)
+		}
+	}
+	return scanner.Err()
+}
+
+// Make the index match the device dirs of the OCS db, in case it is new (upgrade from a version without the index), or the
+// OCS db was changed while we were not running.
+func (idx *DeviceIndex) reconcile() error {
+	devicesDirName := OcsDbDir + "/v1/devices"
+	deviceDirs, err := ioutil.ReadDir(filepath.Clean(devicesDirName))
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	orgKeys := map[string][]OwnerKeyFile{} // the owner keys of each org, read when needed
+	for _, dir := range deviceDirs {
+		deviceUuid := dir.Name()
+		if !dir.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(deviceUuid); err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Clean(devicesDirName + "/" + deviceUuid + "/voucher.json"))
+		if err != nil {
+			continue // not a complete import
+		}
+		orgidTxtStr, httpErr := getOrgidTxtStr(deviceUuid)
+		if httpErr != nil {
+			return httpErr
+		}
+		found[deviceUuid] = true
+
+		rec := idx.devices[deviceUuid]
+		if rec == nil || rec.Orgid != orgidTxtStr {
+			outils.Verbose("adding device %s of org %s to the device index", deviceUuid, orgidTxtStr)
+			rec = &DeviceRecord{DeviceUuid: deviceUuid, Orgid: orgidTxtStr, ImportedAt: info.ModTime().UTC().Format(ocsTimestampDisplayFormat)}
+			idx.devices[deviceUuid] = rec
+		}
+		// The exec file holds the node token, so it is the source of truth for whether there is one
+		rec.NodeTokenHash = hashNodeToken(readExecNodeToken(deviceUuid))
+		if rec.HasNodeToken() {
+			rec.NodeTokenPurgedAt = ""
+		}
+		// Records of vouchers imported by older versions don't have the owner key, so find it from the voucher. (For vouchers
+		// signed over to the sample key this is done on every start, but parsing a voucher is cheap.)
+		if rec.OwnerKey == "" {
+			if _, ok := orgKeys[rec.Orgid]; !ok {
+				keys, httpErr := getOrgOwnerKeys(rec.Orgid)
+				if httpErr != nil {
+					return httpErr
+				}
+				orgKeys[rec.Orgid] = keys
+			}
+			rec.OwnerKey = getDeviceOwnerKey(deviceUuid, orgKeys[rec.Orgid])
+		}
+	}
+	for deviceUuid := range idx.devices {
+		if !found[deviceUuid] {
+			outils.Verbose("removing device %s from the device index, because it is no longer in the OCS db", deviceUuid)
+			delete(idx.devices, deviceUuid)
+		}
+	}
+	return nil
+}
+
+// Rewrite the log file with only the current records, and open it for appending
+func (idx *DeviceIndex) compact() error {
+	var buf bytes.Buffer
+	for _, deviceUuid := range idx.sortedUuids() {
+		line, err := json.Marshal(deviceIndexEntry{Op: deviceIndexOpPut, Record: idx.devices[deviceUuid]})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmpFileName := idx.fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpFileName, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFileName, idx.fileName); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(idx.fileName, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	idx.file = file
+	return nil
+}
+
+// Append an entry to the log. The caller must hold the write lock.
+func (idx *DeviceIndex) appendEntry(op string, rec *DeviceRecord) *outils.HttpError {
+	line, err := json.Marshal(deviceIndexEntry{Op: op, Record: rec})
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error encoding device index entry: "+err.Error())
+	}
+	if _, err := idx.file.Write(append(line, '\n')); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error writing to device index "+idx.fileName+": "+err.Error())
+	}
+	if err := idx.file.Sync(); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error writing to device index "+idx.fileName+": "+err.Error())
+	}
+	return nil
+}
+
+// The device uuids in sorted order. The caller must hold the lock.
+func (idx *DeviceIndex) sortedUuids() []string {
+	uuids := make([]string, 0, len(idx.devices))
+	for deviceUuid := range idx.devices {
+		uuids = append(uuids, deviceUuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+// Add or replace the record of a device
+func (idx *DeviceIndex) Put(rec DeviceRecord) *outils.HttpError {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if httpErr := idx.appendEntry(deviceIndexOpPut, &rec); httpErr != nil {
+		return httpErr
+	}
+	idx.devices[rec.DeviceUuid] = &rec
+	return nil
+}
+
+// Remove the record of a device, if it exists
+func (idx *DeviceIndex) Delete(deviceUuid string) *outils.HttpError {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if _, ok := idx.devices[deviceUuid]; !ok {
+		return nil
+	}
+	if httpErr := idx.appendEntry(deviceIndexOpDelete, &DeviceRecord{DeviceUuid: deviceUuid}); httpErr != nil {
+		return httpErr
+	}
+	delete(idx.devices, deviceUuid)
+	return nil
+}
+
+// Return a copy of the record of a device, or nil if it is not in the index
+func (idx *DeviceIndex) Get(deviceUuid string) *DeviceRecord {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	if rec, ok := idx.devices[deviceUuid]; ok {
+		recCopy := *rec
+		return &recCopy
+	}
+	return nil
+}
+
+// Return copies of the records of the devices in this org, sorted by device uuid
+func (idx *DeviceIndex) ListOrg(orgId string) []DeviceRecord {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	records := []DeviceRecord{}
+	for _, deviceUuid := range idx.sortedUuids() {
+		if rec := idx.devices[deviceUuid]; rec.Orgid == orgId {
+			records = append(records, *rec)
+		}
+	}
+	return records
+}
+
+// Return copies of the records of all of the devices, sorted by device uuid
+func (idx *DeviceIndex) List() []DeviceRecord {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	records := []DeviceRecord{}
+	for _, deviceUuid := range idx.sortedUuids() {
+		records = append(records, *idx.devices[deviceUuid])
+	}
+	return records
+}
+
+// Get the node token from the device's exec file (written by importVoucher()), or return "" if there isn't one
+func readExecNodeToken(deviceUuid string) string {
+	execBytes, err := ioutil.ReadFile(filepath.Clean(OcsDbDir + "/v1/values/" + deviceUuid + "_exec"))
+	if err != nil {
+		return ""
+	}
+	// The exec file is the null separated args of agent-install-wrapper.sh, and the -a arg is <device-uuid>:<node-token>
+	args := strings.Split(string(execBytes), "\x00")
+	for i, arg := range args {
+		if arg == "-a" && i+1 < len(args) {
+			if parts := strings.SplitN(args[i+1], ":", 2); len(parts) == 2 {
+				return parts[1]
+			}
+		}
+	}
+	return ""
+}
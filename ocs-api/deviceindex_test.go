@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Reopen the device index, like the ocs-api does when it starts
+func reopenTestDeviceIndex(t *testing.T) {
+	t.Helper()
+	Devices.file.Close()
+	var err error
+	if Devices, err = OpenDeviceIndex(Devices.fileName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeviceIndexReplay(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	deviceUuids := []string{}
+	for i := 0; i < 3; i++ {
+		voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+		if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+			t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+		}
+		deviceUuids = append(deviceUuids, deviceUuid)
+	}
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers/"+deviceUuids[0]+"/token", "myorg/admin", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("rotate: got %d %s", w.Code, w.Body.String())
+	}
+	if w := testRequest(t, api, http.MethodDelete, "/api/orgs/myorg/vouchers/"+deviceUuids[2], "myorg/admin", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: got %d %s", w.Code, w.Body.String())
+	}
+	expected := Devices.List()
+	if len(expected) != 2 {
+		t.Fatalf("the index has %d devices, expected 2", len(expected))
+	}
+
+	for _, test := range []struct {
+		name, lines string
+	}{
+		{"truncated last line", `{"op":"put","record":{"deviceUuid":"` + deviceUuids[1]},
+		{"corrupt last line", "not json\n"},
+		{"line without a record", `{"op":"delete"}` + "\n"},
+		{"corrupt line before valid lines", "{\n" + `{"op":"put","record":{"deviceUuid":"` + deviceUuids[2] + `","orgid":"myorg"}}` + "\n" + `{"op":"delete","record":{"deviceUuid":"` + deviceUuids[2] + `"}}` + "\n"},
+	} {
+		if _, err := Devices.file.WriteString(test.lines); err != nil {
+			t.Fatal(err)
+		}
+		reopenTestDeviceIndex(t)
+		if devices := Devices.List(); !reflect.DeepEqual(devices, expected) {
+			t.Errorf("%s: the index has %+v, expected %+v", test.name, devices, expected)
+		}
+
+		// The log was compacted to 1 valid line per device
+		logBytes, err := os.ReadFile(Devices.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.Split(bytes.TrimSuffix(logBytes, []byte("\n")), []byte("\n"))
+		if len(lines) != len(expected) {
+			t.Errorf("%s: the compacted log has %d lines, expected %d", test.name, len(lines), len(expected))
+		}
+		for _, line := range lines {
+			entry := deviceIndexEntry{}
+			if err := json.Unmarshal(line, &entry); err != nil || entry.Op != deviceIndexOpPut || entry.Record == nil {
+				t.Errorf("%s: invalid line in the compacted log: %s", test.name, line)
+			}
+		}
+	}
+}
+
+// The index is reconciled with the device dirs of the OCS db when it is opened
+func TestDeviceIndexReconcile(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	deviceUuids := []string{}
+	for i := 0; i < 2; i++ {
+		voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+		if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+			t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+		}
+		deviceUuids = append(deviceUuids, deviceUuid)
+	}
+	nodeTokenHash := Devices.Get(deviceUuids[0]).NodeTokenHash
+
+	// The 2nd device was removed from the OCS db, and the index was lost (e.g. an upgrade from a version without it)
+	if err := os.RemoveAll(OcsDbDir + "/v1/devices/" + deviceUuids[1]); err != nil {
+		t.Fatal(err)
+	}
+	Devices.file.Close()
+	if err := os.Remove(Devices.fileName); err != nil {
+		t.Fatal(err)
+	}
+	reopenTestDeviceIndex(t)
+
+	devices := Devices.List()
+	if len(devices) != 1 {
+		t.Fatalf("the index has %+v, expected only device %s", devices, deviceUuids[0])
+	}
+	if rec := devices[0]; rec.DeviceUuid != deviceUuids[0] || rec.Orgid != "myorg" || rec.NodeTokenHash != nodeTokenHash || rec.OwnerKey != "k1" || rec.ImportedAt == "" {
+		t.Errorf("the index has %+v, expected device %s of myorg with its node token and owner key", rec, deviceUuids[0])
+	}
+
+	// The exec file is the source of truth for the node token
+	if httpErr := writeDeviceExecFile(deviceUuids[0], ""); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	reopenTestDeviceIndex(t)
+	if rec := Devices.Get(deviceUuids[0]); rec == nil || rec.HasNodeToken() {
+		t.Errorf("the index has %+v, expected the device without a node token", rec)
+	}
+}
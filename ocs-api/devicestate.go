@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Determines the onboarding status of a device from the state.json file that the OCS writes in the device dir as TO0 and TO2 progress.
+(postVoucherHandler removes state.json, so it only exists after the to0scheduler has processed the voucher.)
+*/
+
+// The normalized onboarding lifecycle states of a device
+const (
+	DeviceStateImported      = "imported"
+	DeviceStateTo0Registered = "to0-registered"
+	DeviceStateTo2InProgress = "to2-in-progress"
+	DeviceStateOnboarded     = "onboarded"
+	DeviceStateFailed        = "failed"
+)
+
+// The to2State values the OCS writes, and the timestamp format of our responses
+const (
+	ocsTo2StateBegin          = "to2begin"
+	ocsTo2StateEnd            = "to2end"
+	ocsTo2StateError          = "to2error"
+	ocsTimestampDisplayFormat = time.RFC3339
+)
+
+// The SDO ProtocolError the OCS stores in state.json
+type OcsProtocolError struct {
+	ErrorCode int    `json:"ec"`
+	Message   string `json:"em"`
+	MsgNum    int    `json:"emsg"`
+}
+
+// The content of state.json (see DeviceState in docs/ocs-swagger.yaml)
+type OcsDeviceState struct {
+	To2State     string            `json:"to2State"`
+	To2Timestamp string            `json:"to2Timestamp"`
+	To2Error     *OcsProtocolError `json:"to2Error"`
+	To0Ws        int               `json:"to0Ws"`
+	To0Timestamp string            `json:"to0Timestamp"`
+	To0Error     *OcsProtocolError `json:"to0Error"`
+}
+
+type DeviceStatusError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// The response body of GET /api/orgs/{org-id}/vouchers/{device-id}/status
+type DeviceStatus struct {
+	DeviceUuid      string             `json:"deviceUuid"`
+	State           string             `json:"state"`
+	ImportedAt      string             `json:"importedAt"`
+	To0RegisteredAt string             `json:"to0RegisteredAt,omitempty"`
+	To0ExpiresAt    string             `json:"to0ExpiresAt,omitempty"`
+	To2UpdatedAt    string             `json:"to2UpdatedAt,omitempty"`
+	Error           *DeviceStatusError `json:"error,omitempty"`
+	to2Time         time.Time          // To2UpdatedAt before it is rounded to seconds, zero if it can not be parsed
+}
+
+// Read the device's state.json file in the OCS db and determine its onboarding status
+func getDeviceStatus(rec *DeviceRecord) (*DeviceStatus, *outils.HttpError) {
+	deviceDir := OcsDbDir + "/v1/devices/" + rec.DeviceUuid
+	status := &DeviceStatus{DeviceUuid: rec.DeviceUuid, State: DeviceStateImported, ImportedAt: rec.ImportedAt}
+
+	stateFileName := deviceDir + "/state.json"
+	if !outils.PathExists(stateFileName) {
+		return status, nil // TO0 has not been run for this voucher yet
+	}
+	stateBytes, err := ioutil.ReadFile(filepath.Clean(stateFileName))
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading "+stateFileName+": "+err.Error())
+	}
+	ocsState := OcsDeviceState{}
+	if err := json.Unmarshal(stateBytes, &ocsState); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing "+stateFileName+": "+err.Error())
+	}
+
+	if ocsState.To0Timestamp != "" {
+		status.To0RegisteredAt = normalizeOcsTimestamp(ocsState.To0Timestamp)
+		if to0Time, err := parseOcsTimestamp(ocsState.To0Timestamp); err == nil && ocsState.To0Ws > 0 {
+			status.To0ExpiresAt = to0Time.Add(time.Duration(ocsState.To0Ws) * time.Second).UTC().Format(ocsTimestampDisplayFormat)
+		}
+	}
+	if ocsState.To2Timestamp != "" {
+		status.To2UpdatedAt = normalizeOcsTimestamp(ocsState.To2Timestamp)
+		status.to2Time, _ = parseOcsTimestamp(ocsState.To2Timestamp)
+	}
+
+	// TO2 progress takes precedence over TO0, because TO2 can only happen after TO0
+	switch ocsState.To2State {
+	case ocsTo2StateEnd:
+		status.State = DeviceStateOnboarded
+	case ocsTo2StateBegin:
+		status.State = DeviceStateTo2InProgress
+	case ocsTo2StateError:
+		status.State = DeviceStateFailed
+		status.Error = newDeviceStatusError(ocsState.To2Error)
+	default:
+		if ocsState.To0Error != nil && ocsState.To0Error.ErrorCode != 0 {
+			status.State = DeviceStateFailed
+			status.Error = newDeviceStatusError(ocsState.To0Error)
+		} else if ocsState.To0Timestamp != "" {
+			status.State = DeviceStateTo0Registered
+		}
+	}
+	return status, nil
+}
+
+func newDeviceStatusError(protocolErr *OcsProtocolError) *DeviceStatusError {
+	if protocolErr == nil {
+		return &DeviceStatusError{Message: "unknown error"}
+	}
+	return &DeviceStatusError{Code: protocolErr.ErrorCode, Message: protocolErr.Message}
+}
+
+// The OCS writes ISO 8601 timestamps
+func parseOcsTimestamp(ts string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, ts)
+}
+
+// Return the timestamp in the format we use in our responses, or as is if we can't parse it
+func normalizeOcsTimestamp(ts string) string {
+	if t, err := parseOcsTimestamp(ts); err == nil {
+		return t.UTC().Format(ocsTimestampDisplayFormat)
+	}
+	return ts
+}
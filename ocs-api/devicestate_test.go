@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Each shape of state.json the OCS writes maps to the right status
+func TestGetDeviceStatus(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+	rec := Devices.Get(deviceUuid)
+	stateFileName := OcsDbDir + "/v1/devices/" + deviceUuid + "/state.json"
+
+	for _, test := range []struct {
+		name, stateJson string // "" means there is no state.json
+		expected        DeviceStatus
+	}{
+		{"no state.json", "", DeviceStatus{State: DeviceStateImported}},
+		{"empty state", `{}`, DeviceStatus{State: DeviceStateImported}},
+		{"to0 registered", `{"to0Timestamp": "2026-03-01T10:00:00.123Z", "to0Ws": 3600}`,
+			DeviceStatus{State: DeviceStateTo0Registered, To0RegisteredAt: "2026-03-01T10:00:00Z", To0ExpiresAt: "2026-03-01T11:00:00Z"}},
+		{"to0 registered without a wait time", `{"to0Timestamp": "2026-03-01T10:00:00Z", "to0Ws": 0}`,
+			DeviceStatus{State: DeviceStateTo0Registered, To0RegisteredAt: "2026-03-01T10:00:00Z"}},
+		{"to0 error", `{"to0Error": {"ec": 101, "em": "rv unreachable", "emsg": 20}}`,
+			DeviceStatus{State: DeviceStateFailed, Error: &DeviceStatusError{Code: 101, Message: "rv unreachable"}}},
+		{"to0 error code 0", `{"to0Timestamp": "2026-03-01T10:00:00Z", "to0Error": {"ec": 0}}`,
+			DeviceStatus{State: DeviceStateTo0Registered, To0RegisteredAt: "2026-03-01T10:00:00Z"}},
+		{"to2 in progress", `{"to2State": "to2begin", "to2Timestamp": "2026-03-01T10:05:00+02:00", "to0Timestamp": "2026-03-01T10:00:00Z"}`,
+			DeviceStatus{State: DeviceStateTo2InProgress, To0RegisteredAt: "2026-03-01T10:00:00Z", To2UpdatedAt: "2026-03-01T08:05:00Z"}},
+		{"onboarded", `{"to2State": "to2end", "to2Timestamp": "2026-03-01T10:10:00Z", "to0Error": {"ec": 101, "em": "old error"}}`,
+			DeviceStatus{State: DeviceStateOnboarded, To2UpdatedAt: "2026-03-01T10:10:00Z"}},
+		{"onboarded with a timestamp that can't be parsed", `{"to2State": "to2end", "to2Timestamp": "yesterday"}`,
+			DeviceStatus{State: DeviceStateOnboarded, To2UpdatedAt: "yesterday"}},
+		{"to2 error", `{"to2State": "to2error", "to2Timestamp": "2026-03-01T10:10:00Z", "to2Error": {"ec": 100, "em": "bad voucher"}}`,
+			DeviceStatus{State: DeviceStateFailed, To2UpdatedAt: "2026-03-01T10:10:00Z", Error: &DeviceStatusError{Code: 100, Message: "bad voucher"}}},
+		{"to2 error without the error", `{"to2State": "to2error"}`,
+			DeviceStatus{State: DeviceStateFailed, Error: &DeviceStatusError{Message: "unknown error"}}},
+	} {
+		if err := os.RemoveAll(stateFileName); err != nil {
+			t.Fatal(err)
+		}
+		if test.stateJson != "" {
+			if err := os.WriteFile(stateFileName, []byte(test.stateJson), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		status, httpErr := getDeviceStatus(rec)
+		if httpErr != nil {
+			t.Errorf("%s: %v", test.name, httpErr)
+			continue
+		}
+		test.expected.DeviceUuid, test.expected.ImportedAt = deviceUuid, rec.ImportedAt
+		// The unrounded TO2 time is only set if the timestamp can be parsed (the node token purge tests check its value)
+		if _, err := parseOcsTimestamp(status.To2UpdatedAt); status.to2Time.IsZero() != (err != nil) {
+			t.Errorf("%s: the TO2 time is %v, for TO2 timestamp %q", test.name, status.to2Time, status.To2UpdatedAt)
+		}
+		status.to2Time = time.Time{}
+		if !reflect.DeepEqual(*status, test.expected) {
+			t.Errorf("%s: got %+v %+v, expected %+v %+v", test.name, *status, status.Error, test.expected, test.expected.Error)
+		}
+
+		// The status endpoint returns the same
+		w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers/"+deviceUuid+"/status", "myorg/admin", "", nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: GET status got %d %s", test.name, w.Code, w.Body.String())
+			continue
+		}
+		respStatus := DeviceStatus{}
+		decodeTestResponse(t, w, &respStatus)
+		if !reflect.DeepEqual(respStatus, test.expected) {
+			t.Errorf("%s: GET status got %+v, expected %+v", test.name, respStatus, test.expected)
+		}
+	}
+
+	// state.json that can't be parsed
+	if err := os.WriteFile(stateFileName, []byte(`{"to2State":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, httpErr := getDeviceStatus(rec); httpErr == nil || httpErr.Code != http.StatusInternalServerError {
+		t.Errorf("corrupt state.json: got %v, expected a 500 error", httpErr)
+	}
+}
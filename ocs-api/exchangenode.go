@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Optional pre-registration of the device's node in the exchange at voucher import time, so the node (with its id and token) is
+visible in the exchange before the device boots, and the device only has to register. It is done when SDO_PREREGISTER_NODES=true,
+or when the import body includes "exchangeNode" (see DeviceServiceInfo). It uses the credentials of the client that imports the voucher.
+*/
+
+const (
+	ExchangeNodeTypeDevice  = "device"
+	ExchangeNodeTypeCluster = "cluster"
+)
+
+var archRegex = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// The options of the node to create in the exchange
+type ExchangeNodeOptions struct {
+	Name     string `json:"name"`     // defaults to the device uuid
+	NodeType string `json:"nodeType"` // device (the default) or cluster
+	Arch     string `json:"arch"`     // e.g. amd64, arm64. If not set, the agent sets it when it registers.
+}
+
+func (o *ExchangeNodeOptions) validate() *outils.HttpError {
+	if o.NodeType != "" && o.NodeType != ExchangeNodeTypeDevice && o.NodeType != ExchangeNodeTypeCluster {
+		return outils.NewHttpError(http.StatusBadRequest, "exchangeNode.nodeType must be %s or %s", ExchangeNodeTypeDevice, ExchangeNodeTypeCluster)
+	}
+	if o.Arch != "" && !archRegex.MatchString(o.Arch) {
+		return outils.NewHttpError(http.StatusBadRequest, "exchangeNode.arch must contain only letters, numbers, '_', and '-'")
+	}
+	return nil
+}
+
+// Whether the node of this device should be created in the exchange when the voucher is imported
+func shouldPreregisterNode(serviceInfo *DeviceServiceInfo) bool {
+	return PreregisterNodes || (serviceInfo != nil && serviceInfo.ExchangeNode != nil)
+}
+
+// Returns 409 if the node of the device already exists in the exchange, unless this API pre-registered it when the voucher was
+// imported before and the device has not started onboarding with it. Called before the voucher is imported, because a node someone
+// else created is not replaced: it may be in use, and replacing it would remove its public key and registered services.
+func checkNodeCanBeRegistered(r *http.Request, deviceOrgId, deviceUuid string) *outils.HttpError {
+	exists, httpErr := outils.ExchangeNodeExists(r, ExchangeInternalUrl, ExchangeInternalCertPath, deviceOrgId, deviceUuid)
+	if httpErr != nil || !exists {
+		return httpErr
+	}
+	if rec := Devices.Get(deviceUuid); rec != nil && rec.Orgid == deviceOrgId && rec.ExchangeNode {
+		status, httpErr := getDeviceStatus(rec)
+		if httpErr != nil {
+			return httpErr
+		}
+		if status.State != DeviceStateOnboarded && status.State != DeviceStateTo2InProgress {
+			outils.Verbose("POST /api/orgs/%s/vouchers: replacing node %s/%s, which was pre-registered when the voucher was imported before", deviceOrgId, deviceOrgId, deviceUuid)
+			return nil
+		}
+	}
+	return outils.NewHttpError(http.StatusConflict, "node %s/%s already exists in the exchange. Remove it from the exchange before importing the voucher of the device again with node pre-registration.", deviceOrgId, deviceUuid)
+}
+
+// Create the node in the exchange with the node token, and set its node policy (if there is one)
+func preregisterNode(r *http.Request, deviceOrgId, deviceUuid, nodeToken string, serviceInfo *DeviceServiceInfo) *outils.HttpError {
+	options := &ExchangeNodeOptions{}
+	var nodePolicy *NodePolicy
+	pattern := ""
+	if serviceInfo != nil {
+		if serviceInfo.ExchangeNode != nil {
+			options = serviceInfo.ExchangeNode
+		}
+		nodePolicy = serviceInfo.NodePolicy
+		pattern = serviceInfo.Pattern
+	}
+
+	node := &outils.ExchangeNode{
+		Token:              nodeToken,
+		Name:               options.Name,
+		NodeType:           options.NodeType,
+		Pattern:            pattern,
+		Arch:               options.Arch,
+		RegisteredServices: []interface{}{},
+		SoftwareVersions:   map[string]string{},
+	}
+	if node.Name == "" {
+		node.Name = deviceUuid
+	}
+	if node.NodeType == "" {
+		node.NodeType = ExchangeNodeTypeDevice
+	}
+	outils.Verbose("POST /api/orgs/%s/vouchers: creating node %s/%s in the exchange ...", deviceOrgId, deviceOrgId, deviceUuid)
+	if httpErr := outils.PutExchangeNode(r, ExchangeInternalUrl, ExchangeInternalCertPath, deviceOrgId, deviceUuid, node); httpErr != nil {
+		return httpErr
+	}
+
+	if nodePolicy != nil {
+		outils.Verbose("POST /api/orgs/%s/vouchers: setting the policy of node %s/%s in the exchange ...", deviceOrgId, deviceOrgId, deviceUuid)
+		if httpErr := outils.PutExchangeNodePolicy(r, ExchangeInternalUrl, ExchangeInternalCertPath, deviceOrgId, deviceUuid, nodePolicy); httpErr != nil {
+			unregisterNode(r, deviceOrgId, deviceUuid)
+			return httpErr
+		}
+	}
+	return nil
+}
+
+// Delete the node that preregisterNode() created, because the import failed after it. This is best effort: the error is only
+// logged, so the caller returns the error that made the import fail.
+func unregisterNode(r *http.Request, deviceOrgId, deviceUuid string) {
+	outils.Verbose("POST /api/orgs/%s/vouchers: the import failed, deleting node %s/%s from the exchange ...", deviceOrgId, deviceOrgId, deviceUuid)
+	if httpErr := outils.DeleteExchangeNode(r, ExchangeInternalUrl, ExchangeInternalCertPath, deviceOrgId, deviceUuid); httpErr != nil {
+		outils.Error("could not delete node %s/%s from the exchange after the voucher import failed: %s", deviceOrgId, deviceUuid, httpErr.Error())
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// The body of an import that pre-registers the node, with a node policy
+func preregisterImportBody(t *testing.T, voucherBytes []byte) []byte {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{
+		"voucher":      json.RawMessage(voucherBytes),
+		"exchangeNode": map[string]string{"arch": "amd64"},
+		"nodePolicy":   map[string]interface{}{"properties": []map[string]string{{"name": "color", "value": "blue"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestPreregisterNode(t *testing.T) {
+	ex, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	nodePath := "/orgs/myorg/nodes/" + deviceUuid
+
+	w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		NodeToken string `json:"nodeToken"`
+	}
+	decodeTestResponse(t, w, &resp)
+	if ex.nodes["myorg/"+deviceUuid] != resp.NodeToken {
+		t.Errorf("the node in the exchange has token %q, expected the token of the import", ex.nodes["myorg/"+deviceUuid])
+	}
+	if len(ex.requestsFor(http.MethodPut, nodePath+"/policy")) != 1 {
+		t.Errorf("the node policy was not set in the exchange: %v", ex.requests)
+	}
+	if rec := Devices.Get(deviceUuid); rec == nil || !rec.ExchangeNode {
+		t.Errorf("device record is %v, expected a pre-registered node", rec)
+	}
+
+	// Importing the device again before it onboards replaces the node this API created, with a new token
+	w = testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("reimport before onboarding: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	decodeTestResponse(t, w, &resp)
+	if ex.nodes["myorg/"+deviceUuid] != resp.NodeToken {
+		t.Error("the reimport did not change the token of the node in the exchange")
+	}
+
+	// Once the device has onboarded, the node is in use and is not replaced
+	writeTestTo2End(t, deviceUuid, "2026-03-01T10:00:00.2Z")
+	execBytes, _ := os.ReadFile(OcsDbDir + "/v1/values/" + deviceUuid + "_exec")
+	w = testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes))
+	if w.Code != http.StatusConflict {
+		t.Errorf("reimport after onboarding: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusConflict)
+	}
+	if ex.nodes["myorg/"+deviceUuid] != resp.NodeToken {
+		t.Error("the reimport after onboarding changed the token of the node in the exchange")
+	}
+	if newExecBytes, _ := os.ReadFile(OcsDbDir + "/v1/values/" + deviceUuid + "_exec"); string(newExecBytes) != string(execBytes) {
+		t.Error("the reimport after onboarding changed the exec file of the device")
+	}
+	if _, err := os.Stat(OcsDbDir + "/v1/devices/" + deviceUuid + "/state.json"); err != nil {
+		t.Error("the reimport after onboarding removed state.json")
+	}
+
+	// Without pre-registration the device can be imported again
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Errorf("reimport without pre-registration: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPreregisterNodeFailures(t *testing.T) {
+	ex, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+
+	// Setting the node policy fails
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	nodePath := "/orgs/myorg/nodes/" + deviceUuid
+	ex.fail[http.MethodPut+" "+nodePath+"/policy"] = http.StatusInternalServerError
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes)); w.Code != http.StatusInternalServerError {
+		t.Errorf("policy failure: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusInternalServerError)
+	}
+	if _, ok := ex.nodes["myorg/"+deviceUuid]; ok || len(ex.requestsFor(http.MethodDelete, nodePath)) != 1 {
+		t.Errorf("policy failure: the node was not deleted from the exchange: %v", ex.requests)
+	}
+	if Devices.Get(deviceUuid) != nil {
+		t.Error("policy failure: the device was added to the index")
+	}
+
+	// The client is not allowed to create nodes
+	voucherBytes, deviceUuid = newTestVoucher(t, &ownerKey.PublicKey)
+	ex.fail[http.MethodPut+" /orgs/myorg/nodes/"+deviceUuid] = http.StatusForbidden
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes)); w.Code != http.StatusForbidden {
+		t.Errorf("node creation failure: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusForbidden)
+	}
+	if len(ex.requestsFor(http.MethodDelete, "/orgs/myorg/nodes/"+deviceUuid)) != 0 {
+		t.Error("node creation failure: a node that was not created was deleted")
+	}
+
+	// Adding the device to the index fails, after the exec file was written
+	voucherBytes, deviceUuid = newTestVoucher(t, &ownerKey.PublicKey)
+	nodePath = "/orgs/myorg/nodes/" + deviceUuid
+	Devices.file.Close()
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes)); w.Code != http.StatusInternalServerError {
+		t.Errorf("device index failure: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusInternalServerError)
+	}
+	if _, ok := ex.nodes["myorg/"+deviceUuid]; ok || len(ex.requestsFor(http.MethodDelete, nodePath)) != 1 {
+		t.Errorf("device index failure: the node was not deleted from the exchange: %v", ex.requests)
+	}
+}
+
+// The node calls go through the exchange retries and circuit breaker
+func TestPreregisterNodeExchangeUnavailable(t *testing.T) {
+	ex, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	nodePath := "/orgs/myorg/nodes/" + deviceUuid
+
+	ex.fail[http.MethodPut+" "+nodePath] = http.StatusBadGateway
+	w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("import: got %d %s, expected 503 with Retry-After", w.Code, w.Body.String())
+	}
+	if calls := len(ex.requestsFor(http.MethodPut, nodePath)); calls != 4 {
+		t.Errorf("import: the exchange got %d calls to create the node, expected 4 (with the retries)", calls)
+	}
+
+	delete(ex.fail, http.MethodPut+" "+nodePath)
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes)); w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s, expected 201", w.Code, w.Body.String())
+	}
+	ex.fail[http.MethodPatch+" "+nodePath] = http.StatusServiceUnavailable
+	w = testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers/"+deviceUuid+"/token", "myorg/admin", "", nil)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("rotate: got %d %s, expected 503 with Retry-After", w.Code, w.Body.String())
+	}
+}
+
+// A node this API did not create is not replaced
+func TestPreregisterNodeNotOurs(t *testing.T) {
+	ex, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	ex.nodes["myorg/"+deviceUuid] = "registered-by-the-agent"
+
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes)); w.Code != http.StatusConflict {
+		t.Errorf("got %d %s, expected %d", w.Code, w.Body.String(), http.StatusConflict)
+	}
+	if ex.nodes["myorg/"+deviceUuid] != "registered-by-the-agent" {
+		t.Error("the node was replaced")
+	}
+	if _, err := os.Stat(OcsDbDir + "/v1/devices/" + deviceUuid); !os.IsNotExist(err) {
+		t.Errorf("the device dir was created: %v", err)
+	}
+}
+
+// The node is created before any of the OCS db files of the device are changed, so a failure leaves the device as it was
+func TestPreregisterNodeFailureKeepsDevice(t *testing.T) {
+	ex, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+	writeTestTo2End(t, deviceUuid, "2026-03-01T10:00:00.2Z")
+	execBytes, _ := os.ReadFile(OcsDbDir + "/v1/values/" + deviceUuid + "_exec")
+
+	ex.fail[http.MethodPut+" /orgs/myorg/nodes/"+deviceUuid] = http.StatusForbidden
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes)); w.Code != http.StatusForbidden {
+		t.Errorf("got %d %s, expected %d", w.Code, w.Body.String(), http.StatusForbidden)
+	}
+	if _, err := os.Stat(OcsDbDir + "/v1/devices/" + deviceUuid + "/state.json"); err != nil {
+		t.Error("the failed import removed state.json")
+	}
+	if newExecBytes, _ := os.ReadFile(OcsDbDir + "/v1/values/" + deviceUuid + "_exec"); string(newExecBytes) != string(execBytes) {
+		t.Error("the failed import changed the exec file")
+	}
+
+	// The device dir can't be written after the node was created
+	delete(ex.fail, http.MethodPut+" /orgs/myorg/nodes/"+deviceUuid)
+	voucherBytes, deviceUuid = newTestVoucher(t, &ownerKey.PublicKey)
+	if err := os.WriteFile(OcsDbDir+"/v1/devices/"+deviceUuid, []byte("not a dir"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", preregisterImportBody(t, voucherBytes)); w.Code != http.StatusInternalServerError {
+		t.Errorf("device dir failure: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusInternalServerError)
+	}
+	if _, ok := ex.nodes["myorg/"+deviceUuid]; ok {
+		t.Error("device dir failure: the node was not deleted from the exchange")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/open-horizon/SDO-support/ocs-api/keystore"
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+// The password of all of the users of the test exchange
+const testPassword = "pw"
+
+// A user of the test exchange
+type testExchangeUser struct {
+	Admin    bool `json:"admin"`
+	HubAdmin bool `json:"hubAdmin"`
+}
+
+// A fake exchange, with the users and nodes the tests need. It only implements the parts of the exchange api the ocs-api uses.
+type testExchange struct {
+	server   *httptest.Server
+	lock     sync.Mutex
+	users    map[string]testExchangeUser // <org>/<user>
+	nodes    map[string]string           // <org>/<node-id> to the node token
+	requests []string                    // <method> <path> of the requests it received
+	fail     map[string]int              // the status to return for <method> <path>
+}
+
+func newTestExchange(t *testing.T) *testExchange {
+	ex := &testExchange{
+		users: map[string]testExchangeUser{
+			"myorg/admin": {Admin: true},
+			"myorg/bob":   {},
+			"myorg/carol": {},
+			"other/eve":   {Admin: true},
+			"root/hub":    {HubAdmin: true},
+		},
+		nodes: map[string]string{},
+		fail:  map[string]int{},
+	}
+	ex.server = httptest.NewServer(http.HandlerFunc(ex.serveHTTP))
+	t.Cleanup(ex.server.Close)
+	return ex
+}
+
+func (ex *testExchange) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ex.lock.Lock()
+	defer ex.lock.Unlock()
+	ex.requests = append(ex.requests, r.Method+" "+r.URL.Path)
+	if code := ex.fail[r.Method+" "+r.URL.Path]; code != 0 {
+		http.Error(w, `{"msg":"failed by the test"}`, code)
+		return
+	}
+
+	// Authenticate the user or node
+	cred, password, _ := r.BasicAuth()
+	credUser, isUser := ex.users[cred]
+	nodeToken, isNode := ex.nodes[cred]
+	if !(isUser && password == testPassword) && !(isNode && password == nodeToken) {
+		http.Error(w, `{"msg":"invalid credentials"}`, http.StatusUnauthorized)
+		return
+	}
+	credOrg := strings.SplitN(cred, "/", 2)[0]
+
+	// The paths are /orgs/{org}/{resource}/{id}[/policy]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/orgs/"), "/")
+	if len(parts) < 3 {
+		http.Error(w, `{"msg":"not found"}`, http.StatusNotFound)
+		return
+	}
+	org, resource, id := parts[0], parts[1], parts[2]
+	key := org + "/" + id
+	canRead := cred == key || credUser.HubAdmin || (isUser && credOrg == org)
+	canWrite := isUser && credOrg == org
+	switch {
+	case resource == "users" && r.Method == http.MethodGet:
+		if !canRead || (cred != key && !credUser.Admin && !credUser.HubAdmin) {
+			http.Error(w, `{"msg":"access denied"}`, http.StatusForbidden)
+		} else if user, ok := ex.users[key]; !ok {
+			http.Error(w, `{"msg":"not found"}`, http.StatusNotFound)
+		} else {
+			writeTestJson(w, http.StatusOK, map[string]interface{}{"users": map[string]testExchangeUser{key: user}})
+		}
+	case resource == "nodes" && len(parts) == 3 && r.Method == http.MethodGet:
+		if !canRead {
+			http.Error(w, `{"msg":"access denied"}`, http.StatusForbidden)
+		} else if _, ok := ex.nodes[key]; !ok {
+			http.Error(w, `{"msg":"not found"}`, http.StatusNotFound)
+		} else {
+			writeTestJson(w, http.StatusOK, map[string]interface{}{"nodes": map[string]interface{}{key: map[string]string{"token": "********"}}})
+		}
+	case resource == "nodes" && len(parts) == 3 && (r.Method == http.MethodPut || r.Method == http.MethodPatch):
+		node := outils.ExchangeNode{}
+		if !canWrite {
+			http.Error(w, `{"msg":"access denied"}`, http.StatusForbidden)
+		} else if err := json.NewDecoder(r.Body).Decode(&node); err != nil || node.Token == "" {
+			http.Error(w, `{"msg":"invalid body"}`, http.StatusBadRequest)
+		} else if _, ok := ex.nodes[key]; !ok && r.Method == http.MethodPatch {
+			http.Error(w, `{"msg":"not found"}`, http.StatusNotFound)
+		} else {
+			ex.nodes[key] = node.Token
+			writeTestJson(w, http.StatusCreated, map[string]string{"msg": "node added or updated"})
+		}
+	case resource == "nodes" && len(parts) == 3 && r.Method == http.MethodDelete:
+		if !canWrite {
+			http.Error(w, `{"msg":"access denied"}`, http.StatusForbidden)
+		} else if _, ok := ex.nodes[key]; !ok {
+			http.Error(w, `{"msg":"not found"}`, http.StatusNotFound)
+		} else {
+			delete(ex.nodes, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case resource == "nodes" && len(parts) == 4 && parts[3] == "policy" && r.Method == http.MethodPut:
+		if !canWrite {
+			http.Error(w, `{"msg":"access denied"}`, http.StatusForbidden)
+		} else if _, ok := ex.nodes[key]; !ok {
+			http.Error(w, `{"msg":"not found"}`, http.StatusNotFound)
+		} else {
+			writeTestJson(w, http.StatusCreated, map[string]string{"msg": "policy added or updated"})
+		}
+	default:
+		http.Error(w, `{"msg":"not found"}`, http.StatusNotFound)
+	}
+}
+
+func writeTestJson(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// The requests the exchange received with this method and path prefix
+func (ex *testExchange) requestsFor(method, pathPrefix string) []string {
+	ex.lock.Lock()
+	defer ex.lock.Unlock()
+	matches := []string{}
+	for _, req := range ex.requests {
+		if strings.HasPrefix(req, method+" "+pathPrefix) {
+			matches = append(matches, req)
+		}
+	}
+	return matches
+}
+
+// Set up the globals of the ocs-api for a test: an empty OCS db in a temp dir and a test exchange. Returns the exchange and the api router.
+func newTestApi(t *testing.T) (*testExchange, http.Handler) {
+	ex := newTestExchange(t)
+	OcsDbDir = t.TempDir()
+	for _, dir := range []string{"/v1/devices", "/v1/values", "/v1/creds/publicKeys"} {
+		if err := os.MkdirAll(OcsDbDir+dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ExchangeUrl = ex.server.URL
+	ExchangeInternalUrl = ex.server.URL
+	ExchangeInternalCertPath = ""
+	CssUrl = "https://css.example.com"
+	PkgsFrom = "css:"
+	CfgFileFrom = "css:"
+	AllowSampleOwnerKey = false
+	PreregisterNodes = false
+	PurgeNodeTokens = false
+	AllowKeyImportOverHttp = false
+	NodeTokenPolicy = outils.DefaultNodeTokenPolicy()
+	ApiPermissions = outils.DefaultApiPermissions()
+	outils.AuthCache = outils.NewExchangeAuthCache(outils.DefaultAuthCacheConfig())
+	retryConfig := outils.DefaultExchangeRetryConfig()
+	retryConfig.Backoff, retryConfig.MaxBackoff = time.Millisecond, time.Millisecond
+	outils.ExchangeCallBreaker = outils.NewExchangeBreaker(retryConfig)
+	outils.TokenIntrospection = outils.TokenIntrospectionConfig{OrgClaim: "org", UserClaim: "username", AdminScope: "orgadmin"}
+	var err error
+	if Devices, err = OpenDeviceIndex(OcsDbDir + "/v1/ocs-api/device-index.json"); err != nil {
+		t.Fatal(err)
+	}
+	return ex, newApiRouter()
+}
+
+// Run the request with the basic auth of the user (if not empty) and return the response
+func testRequest(t *testing.T, handler http.Handler, method, path, user, contentType string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(string(body)))
+	if user != "" {
+		req.SetBasicAuth(user, testPassword)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func newTestEcdsaKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Write the public key file of an owner key, like POST /api/orgs/{org-id}/keys does
+func addTestOwnerKey(t *testing.T, orgId, user, keyName string, publicKey crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := append([]byte("ecdsa256:\n"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	fileName := ownerPublicKeyFileName(orgId, user, keyName)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName, pemBytes, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The password of the owner keystore of newTestOwnerKeystore
+const testOwnerKeystorePassword = "MLP3QA!Z"
+
+// Create the owner keystore (a copy of the sample keystore) and the ocs/ocs.env file with its password. ocs/ocs.env is relative to
+// the working dir, so this changes to a temporary dir for the rest of the test.
+func newTestOwnerKeystore(t *testing.T) {
+	t.Helper()
+	ksBytes, err := os.ReadFile("keystore/testdata/sample-owner-keystore.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ownerKeystoreFileName(), ksBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir := t.TempDir()
+	if err := os.Mkdir(tmpDir+"/ocs", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmpDir+"/ocs/ocs.env", []byte("FS_OWNER_KEYSTORE_PASSWORD="+testOwnerKeystorePassword+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// Return a new ecdsa P-256 owner key pair and its self-signed certificate, as the PEM body of POST /api/orgs/{org-id}/keys/import
+func newTestKeyPairPem(t *testing.T) string {
+	t.Helper()
+	key := newTestEcdsaKey(t)
+	cert, err := keystore.NewSelfSignedCertificate(key, keystore.Subject{CommonName: "test owner"}, time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})) + string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// Return a new SDO voucher (made by a new manufacturer key) that is signed over to the owner key, and its device uuid
+func newTestVoucher(t *testing.T, ownerKey crypto.PublicKey) ([]byte, string) {
+	t.Helper()
+	mfgKey := newTestEcdsaKey(t)
+	deviceUuid := uuid.New()
+	b64 := base64.StdEncoding.EncodeToString
+	sdoKey := func(key crypto.PublicKey) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyType := 13 // ECDSA P-256
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			keyType = 4
+			if rsaKey.N.BitLen() == 2048 {
+				keyType = 1
+			}
+		} else if key.(*ecdsa.PublicKey).Curve == elliptic.P384() {
+			keyType = 14
+		}
+		return fmt.Sprintf(`[%d,1,[%d,"%s"]]`, keyType, len(der), b64(der))
+	}
+	sdoHash := func(input []byte) string {
+		sum := sha256.Sum256(input)
+		return fmt.Sprintf(`[32,8,"%s"]`, b64(sum[:]))
+	}
+
+	deviceInfo := "test-device"
+	oh := fmt.Sprintf(`{"pv":113,"pe":1,"r":[1,[4,{"dn":"rv.example.com","po":8040,"pr":"http"}]],"g":"%s","d":"%s","pk":%s}`, b64(deviceUuid[:]), deviceInfo, sdoKey(&mfgKey.PublicKey))
+	hmacValue := make([]byte, 32)
+	rand.Read(hmacValue)
+	hmac := fmt.Sprintf(`[32,108,"%s"]`, b64(hmacValue))
+	bo := fmt.Sprintf(`{"hp":%s,"hc":%s,"pk":%s}`, sdoHash([]byte(oh+hmac)), sdoHash(append(deviceUuid[:], deviceInfo...)), sdoKey(ownerKey))
+	digest := sha256.Sum256([]byte(bo))
+	sig, err := ecdsa.SignASN1(rand.Reader, mfgKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	voucherJson := fmt.Sprintf(`{"sz":1,"oh":%s,"hmac":%s,"en":[{"bo":%s,"pk":[0,0,[0]],"sg":[%d,"%s"]}]}`, oh, hmac, bo, len(sig), b64(sig))
+	return []byte(voucherJson), deviceUuid.String()
+}
+
+// Decode the json response body into v
+func decodeTestResponse(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("could not decode the response %q: %v", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Rotating an owner key: a new key is created and the old one is marked "retiring". A retiring key stays in the owner keystore, so
+the OCS can still run TO2 for the devices whose vouchers were already imported, but new vouchers signed over to it are rejected.
+Once none of the imported vouchers that depend on it are left (they were onboarded or deleted), it can be deleted.
+The state of the keys is in v1/ocs-api/owner-key-states.json, keys that are not in it are active. Access to it is serialized
+with KeyImportLock, like the rest of the owner key files.
+*/
+
+const (
+	OwnerKeyStatusActive   = "active"
+	OwnerKeyStatusRetiring = "retiring"
+)
+
+// The state of 1 owner key
+type OwnerKeyState struct {
+	Status     string `json:"status"`
+	RetiringAt string `json:"retiringAt,omitempty"` // RFC 3339
+	ReplacedBy string `json:"replacedBy,omitempty"` // the name of the key that replaced it
+}
+
+// An imported voucher that still needs its owner key
+type KeyDependentVoucher struct {
+	DeviceUuid string `json:"deviceUuid"`
+	State      string `json:"state"`
+	ImportedAt string `json:"importedAt"`
+}
+
+// The response body of GET /api/orgs/{org-id}/keys/{key-name}/vouchers
+type KeyDependentVouchers struct {
+	Name       string                `json:"name"`
+	Status     string                `json:"status"`
+	ReplacedBy string                `json:"replacedBy,omitempty"`
+	Vouchers   []KeyDependentVoucher `json:"vouchers"`
+}
+
+func ownerKeyStatesFileName() string {
+	return OcsDbDir + "/v1/ocs-api/owner-key-states.json"
+}
+
+// The key of an owner key in the states file
+func ownerKeyStateId(orgId, keyName string) string {
+	return orgId + "/" + strings.ToLower(keyName)
+}
+
+// Read the states of all of the owner keys. The caller must hold KeyImportLock.
+func readOwnerKeyStates() (map[string]*OwnerKeyState, *outils.HttpError) {
+	states := map[string]*OwnerKeyState{}
+	fileName := ownerKeyStatesFileName()
+	statesBytes, err := ioutil.ReadFile(filepath.Clean(fileName))
+	if os.IsNotExist(err) {
+		return states, nil // no key has been rotated yet
+	} else if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading "+fileName+": "+err.Error())
+	}
+	if err := json.Unmarshal(statesBytes, &states); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error parsing "+fileName+": "+err.Error())
+	}
+	return states, nil
+}
+
+// Write the states of all of the owner keys. The caller must hold the KeyImportLock write lock.
+func writeOwnerKeyStates(states map[string]*OwnerKeyState) *outils.HttpError {
+	fileName := ownerKeyStatesFileName()
+	statesBytes, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error encoding the owner key states: "+err.Error())
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory "+filepath.Dir(fileName)+": "+err.Error())
+	}
+	tmpFileName := fileName + ".tmp"
+	if err := ioutil.WriteFile(filepath.Clean(tmpFileName), statesBytes, 0600); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+tmpFileName+": "+err.Error())
+	}
+	if err := os.Rename(filepath.Clean(tmpFileName), filepath.Clean(fileName)); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not rename "+tmpFileName+" to "+fileName+": "+err.Error())
+	}
+	return nil
+}
+
+// Return the state of the owner key, from the states read by readOwnerKeyStates()
+func getOwnerKeyState(states map[string]*OwnerKeyState, orgId, keyName string) OwnerKeyState {
+	if state, ok := states[ownerKeyStateId(orgId, keyName)]; ok {
+		return *state
+	}
+	return OwnerKeyState{Status: OwnerKeyStatusActive}
+}
+
+// Mark the owner key as retiring, replaced by the new key. The caller must hold the KeyImportLock write lock.
+func retireOwnerKey(orgId, keyName, newKeyName string) *outils.HttpError {
+	states, httpErr := readOwnerKeyStates()
+	if httpErr != nil {
+		return httpErr
+	}
+	states[ownerKeyStateId(orgId, keyName)] = &OwnerKeyState{Status: OwnerKeyStatusRetiring, RetiringAt: time.Now().UTC().Format(ocsTimestampDisplayFormat), ReplacedBy: strings.ToLower(newKeyName)}
+	return writeOwnerKeyStates(states)
+}
+
+// Remove the state of a deleted owner key. The caller must hold the KeyImportLock write lock.
+func removeOwnerKeyState(orgId, keyName string) *outils.HttpError {
+	states, httpErr := readOwnerKeyStates()
+	if httpErr != nil {
+		return httpErr
+	}
+	if _, ok := states[ownerKeyStateId(orgId, keyName)]; !ok {
+		return nil
+	}
+	delete(states, ownerKeyStateId(orgId, keyName))
+	return writeOwnerKeyStates(states)
+}
+
+// Return the imported vouchers signed over to the owner key whose devices have not been onboarded yet, so they still need the key to run TO2
+func getKeyDependentVouchers(orgId, keyName string) ([]KeyDependentVoucher, *outils.HttpError) {
+	vouchers := []KeyDependentVoucher{}
+	for _, rec := range Devices.ListOrg(orgId) {
+		if rec.OwnerKey != strings.ToLower(keyName) {
+			continue
+		}
+		status, httpErr := getDeviceStatus(&rec)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		if status.State == DeviceStateOnboarded {
+			continue
+		}
+		vouchers = append(vouchers, KeyDependentVoucher{DeviceUuid: rec.DeviceUuid, State: status.State, ImportedAt: rec.ImportedAt})
+	}
+	return vouchers, nil
+}
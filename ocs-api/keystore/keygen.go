@@ -0,0 +1,159 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Creating the owner key pairs: 1 of each key type, with self-signed certificates, stored under aliases <org>_<key-name>_<key-type>
+
+type KeyType string
+
+const (
+	KeyTypeRsa      KeyType = "rsa"
+	KeyTypeEcdsa256 KeyType = "ecdsa256"
+	KeyTypeEcdsa384 KeyType = "ecdsa384"
+)
+
+// The key types of an owner key, in the order their public keys are in the owner public key file
+var OwnerKeyTypes = []KeyType{KeyTypeRsa, KeyTypeEcdsa256, KeyTypeEcdsa384}
+
+const rsaKeyBits = 2048
+
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// The subject of an owner key certificate
+type Subject struct {
+	CommonName         string
+	Email              string
+	Organization       string
+	OrganizationalUnit string
+	Country            string
+	State              string
+	Locality           string
+}
+
+// The alias of 1 of the key pairs of an owner key
+func OwnerKeyAlias(orgId, keyName string, keyType KeyType) string {
+	return strings.ToLower(orgId+"_"+keyName) + "_" + string(keyType)
+}
+
+// Split an alias created by OwnerKeyAlias into <org>_<key-name> and the key type. Returns false if it is not an owner key alias
+// (e.g. the aliases of the sample owner keys).
+func ParseOwnerKeyAlias(alias string) (string, KeyType, bool) {
+	for _, keyType := range OwnerKeyTypes {
+		if orgAndKeyName := strings.TrimSuffix(alias, "_"+string(keyType)); orgAndKeyName != alias && orgAndKeyName != "" {
+			return orgAndKeyName, keyType, true
+		}
+	}
+	return "", "", false
+}
+
+// Return the owner key type of the key pair of the entry. Returns an error if the private key does not match the certificate, or it
+// is not a type of key owner keys can have (rsa 2048, ecdsa P-256, ecdsa P-384).
+func (e *Entry) OwnerKeyType() (KeyType, error) {
+	key, ok := e.PrivateKey.(crypto.Signer)
+	if !ok || len(e.Certificates) == 0 {
+		return "", errors.New("keystore: the entry does not have a private key and certificate")
+	}
+	if !publicKeysEqual(key.Public(), e.Certificates[0].PublicKey) {
+		return "", errors.New("keystore: the " + KeyAlgorithm(key.Public()) + " private key does not match the public key of its certificate (" + KeyAlgorithm(e.Certificates[0].PublicKey) + ")")
+	}
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() == rsaKeyBits {
+			return KeyTypeRsa, nil
+		}
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return KeyTypeEcdsa256, nil
+		case elliptic.P384():
+			return KeyTypeEcdsa384, nil
+		}
+	}
+	return "", &UnsupportedError{What: "owner key algorithm " + KeyAlgorithm(key.Public()) + " (must be RSA-2048, ECDSA-P-256, or ECDSA-P-384)"}
+}
+
+// Generate a private key of this type
+func GenerateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRsa:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case KeyTypeEcdsa256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEcdsa384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, &UnsupportedError{What: "key type " + string(keyType)}
+}
+
+// Create a self-signed certificate for the key, valid from notBefore for the duration
+func NewSelfSignedCertificate(key crypto.Signer, subject Subject, notBefore time.Time, validity time.Duration) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	name := pkix.Name{CommonName: subject.CommonName}
+	for _, v := range []struct {
+		field *[]string
+		value string
+	}{{&name.Country, subject.Country}, {&name.Province, subject.State}, {&name.Locality, subject.Locality}, {&name.Organization, subject.Organization}, {&name.OrganizationalUnit, subject.OrganizationalUnit}} {
+		if v.value != "" {
+			*v.field = []string{v.value}
+		}
+	}
+	if subject.Email != "" {
+		name.ExtraNames = append(name.ExtraNames, pkix.AttributeTypeAndValue{Type: oidEmailAddress, Value: subject.Email})
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               name,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if _, ok := key.Public().(*ecdsa.PublicKey); ok && key.Public().(*ecdsa.PublicKey).Curve == elliptic.P384() {
+		template.SignatureAlgorithm = x509.ECDSAWithSHA384
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(certBytes)
+}
+
+// A short description of the algorithm and size of the public key, e.g. RSA-2048 or ECDSA-P-256
+func KeyAlgorithm(publicKey crypto.PublicKey) string {
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + pub.Curve.Params().Name
+	}
+	return fmt.Sprintf("%T", publicKey)
+}
+
+// Encode the public key of the certificate as a PEM PUBLIC KEY block
+func PublicKeyPem(cert *x509.Certificate) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: can not marshal the public key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
@@ -0,0 +1,256 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Package keystore reads and writes the PKCS#12 owner keystore of the OCS (ocs/config/db/v1/creds/owner-keystore.p12), so the ocs-api
+can manage the owner keys without running keytool. The keystore is read the way keytool reads it: each private key and the
+certificates with the same localKeyId attribute are an entry, named by their friendlyName attribute (the alias). It is written
+the way keytool from java 11 writes it (3DES encrypted keys and certificates, and a SHA-1 MAC), so the OCS can read it.
+Aliases are case insensitive, like they are in keytool, and are stored in lowercase.
+*/
+
+var (
+	ErrIncorrectPassword = errors.New("keystore: the password is incorrect, or the keystore is corrupted")
+	ErrAliasExists       = errors.New("keystore: the alias already exists")
+	ErrAliasNotFound     = errors.New("keystore: the alias does not exist")
+)
+
+// The keystore is malformed
+type FormatError struct {
+	Msg string
+}
+
+func (e *FormatError) Error() string { return "keystore: malformed data: " + e.Msg }
+
+func formatError(msg string) error { return &FormatError{Msg: msg} }
+
+// The keystore uses an algorithm or structure this package does not support
+type UnsupportedError struct {
+	What string
+}
+
+func (e *UnsupportedError) Error() string { return "keystore: unsupported " + e.What }
+
+// 1 entry of the keystore. PrivateKey is nil for a trusted certificate entry.
+type Entry struct {
+	Alias        string
+	PrivateKey   interface{}         // *rsa.PrivateKey or *ecdsa.PrivateKey
+	Certificates []*x509.Certificate // the certificate of the private key, followed by the rest of its chain
+}
+
+type Keystore struct {
+	entries map[string]*Entry
+}
+
+// Create an empty keystore
+func New() *Keystore {
+	return &Keystore{entries: map[string]*Entry{}}
+}
+
+// Read and decode the keystore file
+func Load(fileName, password string) (*Keystore, error) {
+	pfxBytes, err := ioutil.ReadFile(filepath.Clean(fileName))
+	if err != nil {
+		return nil, err
+	}
+	return Decode(pfxBytes, password)
+}
+
+// Decode the PKCS#12 data
+func Decode(pfxBytes []byte, password string) (*Keystore, error) {
+	bags, err := decodeSafeBags(pfxBytes, password)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := New()
+	keyEntries := map[string]*Entry{} // by local key id
+	var certBags []safeBag
+	for i := range bags {
+		bag := &bags[i]
+		switch {
+		case bag.Id.Equal(oidPKCS8ShroudedKeyBag), bag.Id.Equal(oidKeyBag):
+			alias, localKeyId, err := bagAttributes(bag)
+			if err != nil {
+				return nil, err
+			}
+			if localKeyId == nil {
+				return nil, formatError("private key without a localKeyId")
+			}
+			if alias == "" {
+				alias = hex.EncodeToString(localKeyId) // e.g. openssl pkcs12 -export without -name
+			}
+			key, err := decodeKeyBag(bag, password)
+			if err != nil {
+				return nil, err
+			}
+			entry := &Entry{Alias: strings.ToLower(alias), PrivateKey: key}
+			ks.entries[entry.Alias] = entry
+			keyEntries[string(localKeyId)] = entry
+		case bag.Id.Equal(oidCertBag):
+			certBags = append(certBags, *bag)
+		} // other bag types (CRLs, secrets) are not used in owner keystores, so ignore them
+	}
+
+	// Attach each certificate to the key with the same local key id. The rest are trusted certificate entries or chain certificates.
+	var chainCerts []*x509.Certificate
+	for i := range certBags {
+		bag := &certBags[i]
+		alias, localKeyId, err := bagAttributes(bag)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := decodeCertBag(bag)
+		if err != nil {
+			return nil, err
+		}
+		if entry, ok := keyEntries[string(localKeyId)]; ok {
+			if len(entry.Certificates) > 0 {
+				return nil, formatError("more than 1 certificate for the key of " + entry.Alias)
+			}
+			entry.Certificates = []*x509.Certificate{cert}
+		} else if alias != "" {
+			ks.entries[strings.ToLower(alias)] = &Entry{Alias: strings.ToLower(alias), Certificates: []*x509.Certificate{cert}}
+			chainCerts = append(chainCerts, cert)
+		} else {
+			chainCerts = append(chainCerts, cert)
+		}
+	}
+	for _, entry := range keyEntries {
+		if len(entry.Certificates) == 0 {
+			return nil, formatError("no certificate for the key of " + entry.Alias)
+		}
+		entry.Certificates = append(entry.Certificates, buildChain(entry.Certificates[0], chainCerts)...)
+	}
+	return ks, nil
+}
+
+// Find the issuers of the certificate, up to the root, in certs
+func buildChain(cert *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	var chain []*x509.Certificate
+	for len(chain) < len(certs) && !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		var issuer *x509.Certificate
+		for _, c := range certs {
+			if bytes.Equal(c.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+		cert = issuer
+	}
+	return chain
+}
+
+// Encode the keystore as PKCS#12 data
+func (ks *Keystore) Encode(password string) ([]byte, error) {
+	var keyBags, certBags []safeBag
+	chainCerts := map[string]bool{}
+	for _, alias := range ks.Aliases() {
+		entry := ks.entries[alias]
+		if entry.PrivateKey == nil {
+			bag, err := makeCertBag(alias, nil, entry.Certificates[0], true)
+			if err != nil {
+				return nil, err
+			}
+			certBags = append(certBags, bag)
+			continue
+		}
+
+		localKeyId := sha1.Sum(entry.Certificates[0].Raw)
+		keyBag, err := makeKeyBag(alias, localKeyId[:], entry.PrivateKey, password)
+		if err != nil {
+			return nil, err
+		}
+		keyBags = append(keyBags, keyBag)
+		certBag, err := makeCertBag(alias, localKeyId[:], entry.Certificates[0], false)
+		if err != nil {
+			return nil, err
+		}
+		certBags = append(certBags, certBag)
+		for _, cert := range entry.Certificates[1:] {
+			if chainCerts[string(cert.Raw)] {
+				continue
+			}
+			chainCerts[string(cert.Raw)] = true
+			bag, err := makeCertBag("", nil, cert, false)
+			if err != nil {
+				return nil, err
+			}
+			certBags = append(certBags, bag)
+		}
+	}
+	return encodeSafeBags(keyBags, certBags, password)
+}
+
+// Encode the keystore and write it to the file. The file is replaced atomically, so the OCS never sees a partially written keystore.
+func (ks *Keystore) Save(fileName, password string) error {
+	pfxBytes, err := ks.Encode(password)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmpFileName := fileName + ".tmp"
+	if err := ioutil.WriteFile(filepath.Clean(tmpFileName), pfxBytes, mode); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Clean(tmpFileName), filepath.Clean(fileName))
+}
+
+// Return the aliases of all of the entries, sorted
+func (ks *Keystore) Aliases() []string {
+	aliases := make([]string, 0, len(ks.entries))
+	for alias := range ks.entries {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+// Return the entry with this alias, or nil
+func (ks *Keystore) Get(alias string) *Entry {
+	return ks.entries[strings.ToLower(alias)]
+}
+
+// Add the entry. Returns ErrAliasExists if there is already an entry with this alias.
+func (ks *Keystore) Add(entry *Entry) error {
+	if len(entry.Certificates) == 0 {
+		return errors.New("keystore: an entry must have a certificate")
+	}
+	alias := strings.ToLower(entry.Alias)
+	if _, ok := ks.entries[alias]; ok {
+		return ErrAliasExists
+	}
+	e := *entry
+	e.Alias = alias
+	ks.entries[alias] = &e
+	return nil
+}
+
+// Remove the entry with this alias. Returns ErrAliasNotFound if there is no entry with this alias.
+func (ks *Keystore) Delete(alias string) error {
+	alias = strings.ToLower(alias)
+	if _, ok := ks.entries[alias]; !ok {
+		return ErrAliasNotFound
+	}
+	delete(ks.entries, alias)
+	return nil
+}
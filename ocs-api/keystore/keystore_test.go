@@ -0,0 +1,301 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/data"
+)
+
+// The password of keys/sample-owner-keystore.p12 (FS_OWNER_KEYSTORE_PASSWORD in ocs/ocs.env), and of the openssl test keystores
+const (
+	sampleKeystorePassword  = "MLP3QA!Z"
+	opensslKeystorePassword = "test-pw"
+)
+
+func loadTestKeystore(t *testing.T, fileName, password string) *Keystore {
+	t.Helper()
+	ks, err := Load(filepath.Join("testdata", fileName), password)
+	if err != nil {
+		t.Fatalf("%s: %v", fileName, err)
+	}
+	return ks
+}
+
+// Create an owner key pair of this type, with a self-signed certificate
+func newTestEntry(t *testing.T, alias string, keyType KeyType) *Entry {
+	t.Helper()
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := NewSelfSignedCertificate(key, Subject{CommonName: alias, Organization: "test"}, time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Entry{Alias: alias, PrivateKey: key, Certificates: []*x509.Certificate{cert}}
+}
+
+// Create a key pair whose certificate is issued by the ca entry
+func newTestIssuedEntry(t *testing.T, alias string, ca *Entry) *Entry {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: alias}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, ca.Certificates[0], key.Public(), ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Entry{Alias: alias, PrivateKey: key, Certificates: []*x509.Certificate{cert, ca.Certificates[0]}}
+}
+
+// Check that the 2 entries have the same alias, key, and certificates
+func checkEntry(t *testing.T, got, expected *Entry) {
+	t.Helper()
+	if got == nil {
+		t.Errorf("entry %s is missing", expected.Alias)
+		return
+	}
+	if got.Alias != expected.Alias {
+		t.Errorf("entry %s has alias %s", expected.Alias, got.Alias)
+	}
+	if (got.PrivateKey == nil) != (expected.PrivateKey == nil) {
+		t.Errorf("entry %s has private key %T, expected %T", expected.Alias, got.PrivateKey, expected.PrivateKey)
+	} else if expected.PrivateKey != nil && !got.PrivateKey.(interface{ Equal(crypto.PrivateKey) bool }).Equal(expected.PrivateKey) {
+		t.Errorf("entry %s has a different private key", expected.Alias)
+	}
+	if len(got.Certificates) != len(expected.Certificates) {
+		t.Errorf("entry %s has %d certificates, expected %d", expected.Alias, len(got.Certificates), len(expected.Certificates))
+		return
+	}
+	for i := range got.Certificates {
+		if !got.Certificates[i].Equal(expected.Certificates[i]) {
+			t.Errorf("certificate %d of entry %s is %s, expected %s", i, expected.Alias, got.Certificates[i].Subject, expected.Certificates[i].Subject)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	ks := New()
+	var entries []*Entry
+	for _, keyType := range OwnerKeyTypes {
+		entries = append(entries, newTestEntry(t, OwnerKeyAlias("myorg", "k1", keyType), keyType))
+	}
+	ca := newTestEntry(t, "ca", KeyTypeEcdsa256)
+	entries = append(entries, newTestIssuedEntry(t, "issued-1", ca), newTestIssuedEntry(t, "issued-2", ca))
+	entries = append(entries, &Entry{Alias: "trusted", Certificates: ca.Certificates})
+	for _, entry := range entries {
+		if err := ks.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, password := range []string{"pw", "pässwörd ✓", ""} {
+		pfxBytes, err := ks.Encode(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(pfxBytes, password)
+		if err != nil {
+			t.Fatalf("password %q: %v", password, err)
+		}
+		if len(decoded.Aliases()) != len(entries) {
+			t.Errorf("password %q: decoded aliases %v, expected %d", password, decoded.Aliases(), len(entries))
+		}
+		for _, entry := range entries {
+			checkEntry(t, decoded.Get(entry.Alias), entry)
+		}
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "owner-keystore.p12")
+	ks := New()
+	entry := newTestEntry(t, "Owner", KeyTypeEcdsa384)
+	if err := ks.Add(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Save(fileName, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(fileName, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Save(fileName, "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(fileName); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("the mode of the saved keystore is %v %v, expected it to be kept", info.Mode(), err)
+	}
+	loaded, err := Load(fileName, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Alias = "owner" // aliases are stored in lowercase
+	checkEntry(t, loaded.Get("OWNER"), entry)
+}
+
+// The keystore the OCS is shipped with, which was written by keytool
+func TestDecodeKeytoolKeystore(t *testing.T) {
+	ks := loadTestKeystore(t, "sample-owner-keystore.p12", sampleKeystorePassword)
+	expectedTypes := map[string]KeyType{"owner_rsa_2048": KeyTypeRsa, "owner_ecdsa_256": KeyTypeEcdsa256, "owner_ecdsa_384": KeyTypeEcdsa384}
+	if aliases := ks.Aliases(); len(aliases) != len(expectedTypes) {
+		t.Errorf("got aliases %v, expected %v", aliases, expectedTypes)
+	}
+	for alias, expectedType := range expectedTypes {
+		entry := ks.Get(alias)
+		if entry == nil {
+			t.Errorf("entry %s is missing", alias)
+			continue
+		}
+		if keyType, err := entry.OwnerKeyType(); err != nil || keyType != expectedType {
+			t.Errorf("entry %s has key type %s %v, expected %s", alias, keyType, err, expectedType)
+		}
+	}
+
+	// It is the private key of the sample owner public key
+	block, _ := pem.Decode([]byte(data.SampleOwnerPublicKey))
+	samplePublicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry := ks.Get("owner_ecdsa_256"); entry == nil || !publicKeysEqual(entry.Certificates[0].PublicKey, samplePublicKey) {
+		t.Error("the owner_ecdsa_256 certificate does not have the sample owner public key")
+	}
+
+	// Writing it again keeps all of the entries
+	pfxBytes, err := ks.Encode(sampleKeystorePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(pfxBytes, sampleKeystorePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, alias := range ks.Aliases() {
+		checkEntry(t, decoded.Get(alias), ks.Get(alias))
+	}
+}
+
+// Keystores written by openssl pkcs12 -export, with a key whose certificate is issued by a ca (see testdata/gen-keystores.sh)
+func TestDecodeOpensslKeystores(t *testing.T) {
+	for _, fileName := range []string{"openssl-owner-keystore.p12", "openssl-legacy-owner-keystore.p12"} {
+		ks := loadTestKeystore(t, fileName, opensslKeystorePassword)
+		if aliases := ks.Aliases(); len(aliases) != 1 || aliases[0] != "test-owner" {
+			t.Errorf("%s: got aliases %v, expected [test-owner]", fileName, aliases)
+			continue
+		}
+		entry := ks.Get("Test-Owner")
+		if keyType, err := entry.OwnerKeyType(); err != nil || keyType != KeyTypeEcdsa256 {
+			t.Errorf("%s: got key type %s %v, expected %s", fileName, keyType, err, KeyTypeEcdsa256)
+		}
+		if len(entry.Certificates) != 2 || entry.Certificates[0].Subject.CommonName != "test owner" || entry.Certificates[1].Subject.CommonName != "test ca" {
+			t.Errorf("%s: expected the owner certificate and the ca certificate, got %d certificates", fileName, len(entry.Certificates))
+		} else if err := entry.Certificates[0].CheckSignatureFrom(entry.Certificates[1]); err != nil {
+			t.Errorf("%s: the owner certificate is not issued by the ca: %v", fileName, err)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// A wrong password fails the MAC check
+	for _, test := range []struct{ fileName, password string }{
+		{"sample-owner-keystore.p12", "wrong"},
+		{"openssl-owner-keystore.p12", ""},
+		{"openssl-legacy-owner-keystore.p12", sampleKeystorePassword},
+	} {
+		if _, err := Load(filepath.Join("testdata", test.fileName), test.password); !errors.Is(err, ErrIncorrectPassword) {
+			t.Errorf("%s with a wrong password: got %v, expected %v", test.fileName, err, ErrIncorrectPassword)
+		}
+	}
+
+	pfxBytes, err := os.ReadFile(filepath.Join("testdata", "openssl-owner-keystore.p12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var formatErr *FormatError
+	for _, corrupted := range [][]byte{pfxBytes[:len(pfxBytes)/2], append(append([]byte{}, pfxBytes...), 0), []byte("not a keystore")} {
+		if _, err := Decode(corrupted, opensslKeystorePassword); !errors.As(err, &formatErr) {
+			t.Errorf("malformed keystore of %d bytes: got %v, expected a format error", len(corrupted), err)
+		}
+	}
+	// A changed byte in the content fails the MAC check
+	changed := append([]byte{}, pfxBytes...)
+	changed[len(changed)/2] ^= 1
+	if _, err := Decode(changed, opensslKeystorePassword); err == nil {
+		t.Error("a changed keystore was decoded")
+	}
+}
+
+func TestAddDelete(t *testing.T) {
+	ks := New()
+	if err := ks.Add(newTestEntry(t, "MyOrg_k1_rsa", KeyTypeRsa)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Add(newTestEntry(t, "myorg_K1_RSA", KeyTypeRsa)); !errors.Is(err, ErrAliasExists) {
+		t.Errorf("adding an alias that differs in case: got %v, expected %v", err, ErrAliasExists)
+	}
+	if err := ks.Add(&Entry{Alias: "no-cert"}); err == nil {
+		t.Error("added an entry without a certificate")
+	}
+	if err := ks.Delete("other"); !errors.Is(err, ErrAliasNotFound) {
+		t.Errorf("deleting a missing alias: got %v, expected %v", err, ErrAliasNotFound)
+	}
+	if err := ks.Delete("MYORG_K1_RSA"); err != nil || len(ks.Aliases()) != 0 {
+		t.Errorf("deleting the entry: got %v, aliases %v", err, ks.Aliases())
+	}
+	if orgAndKeyName, keyType, ok := ParseOwnerKeyAlias(OwnerKeyAlias("MyOrg", "k1", KeyTypeEcdsa384)); !ok || orgAndKeyName != "myorg_k1" || keyType != KeyTypeEcdsa384 {
+		t.Errorf("parsed the alias into %s %s %v", orgAndKeyName, keyType, ok)
+	}
+	if _, _, ok := ParseOwnerKeyAlias("owner_ecdsa_256"); ok {
+		t.Error("parsed a sample key alias as an owner key alias")
+	}
+}
+
+// Encode writes the bags in the layout keytool writes: the shrouded key bag, then its certificate bag, with the same local key id
+func TestEncodeLayout(t *testing.T) {
+	ks := New()
+	if err := ks.Add(newTestEntry(t, "owner", KeyTypeEcdsa256)); err != nil {
+		t.Fatal(err)
+	}
+	pfxBytes, err := ks.Encode("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bags, err := decodeSafeBags(pfxBytes, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bags) != 2 || !bags[0].Id.Equal(oidPKCS8ShroudedKeyBag) || !bags[1].Id.Equal(oidCertBag) {
+		t.Fatalf("got %d bags, expected a shrouded key bag and a cert bag", len(bags))
+	}
+	var localKeyIds [][]byte
+	for i := range bags {
+		alias, localKeyId, err := bagAttributes(&bags[i])
+		if err != nil || alias != "owner" || len(localKeyId) != 20 {
+			t.Errorf("bag %s has attributes %q %x %v", bags[i].Id, alias, localKeyId, err)
+		}
+		localKeyIds = append(localKeyIds, localKeyId)
+	}
+	if !bytes.Equal(localKeyIds[0], localKeyIds[1]) {
+		t.Error("the key and certificate bags have different local key ids")
+	}
+}
@@ -0,0 +1,322 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+)
+
+// The password based encryption and MAC algorithms of PKCS#12 (RFC 7292) and PKCS#5 (RFC 8018) that keystores are written with.
+
+var (
+	oidPbeWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPbeWithSHAAnd128BitRC2CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPbeWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacWithSHA1                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHmacWithSHA256                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHmacWithSHA384                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHmacWithSHA512                = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC                     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC                    = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidSHA1                          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512                        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// The purposes of the PKCS#12 key derivation function
+const (
+	pkcs12KdfKey = 1
+	pkcs12KdfIV  = 2
+	pkcs12KdfMAC = 3
+)
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc algorithmIdentifier
+	EncryptionScheme  algorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                 `asn1:"optional"`
+	Prf        algorithmIdentifier `asn1:"optional"`
+}
+
+// The password as the PKCS#12 KDF uses it: a null terminated BMPString
+func bmpPassword(password string) []byte {
+	if password == "" {
+		return nil
+	}
+	return append(bmpString(password), 0, 0)
+}
+
+// Encode the string as UTF-16 big endian, the content of an ASN.1 BMPString
+func bmpString(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		b[2*i] = byte(c >> 8)
+		b[2*i+1] = byte(c)
+	}
+	return b
+}
+
+func decodeBMPString(b []byte) (string, error) {
+	if len(b)%2 != 0 {
+		return "", formatError("odd length BMPString")
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+// The PKCS#12 key derivation function (RFC 7292 appendix B.2)
+func pkcs12Kdf(newHash func() hash.Hash, v int, salt, password []byte, iterations int, id byte, size int) []byte {
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	one := big.NewInt(1)
+	result := make([]byte, 0, size)
+	for len(result) < size {
+		h := newHash()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		result = append(result, a...)
+		if len(result) >= size {
+			break
+		}
+
+		// I_j = (I_j + B + 1) mod 2^(v*8) for each v byte block of I, where B is A repeated to v bytes
+		b := new(big.Int).SetBytes(fill(a)[:v])
+		b.Add(b, one)
+		for j := 0; j < len(i); j += v {
+			ij := new(big.Int).SetBytes(i[j : j+v])
+			ij.Add(ij, b)
+			ijBytes := ij.Bytes()
+			if len(ijBytes) > v {
+				ijBytes = ijBytes[len(ijBytes)-v:]
+			}
+			block := i[j : j+v]
+			for k := range block {
+				block[k] = 0
+			}
+			copy(block[v-len(ijBytes):], ijBytes)
+		}
+	}
+	return result[:size]
+}
+
+// PBKDF2 (RFC 8018 section 5.2)
+func pbkdf2(newHash func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+	dk := make([]byte, 0, numBlocks*hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for x := range t {
+				t[x] ^= u[x]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+func hashForDigestOid(oid asn1.ObjectIdentifier) (func() hash.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return sha1.New, true
+	case oid.Equal(oidSHA256):
+		return sha256.New, true
+	case oid.Equal(oidSHA384):
+		return sha512.New384, true
+	case oid.Equal(oidSHA512):
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+func hashForHmacOid(oid asn1.ObjectIdentifier) (func() hash.Hash, bool) {
+	switch {
+	case oid.Equal(oidHmacWithSHA1):
+		return sha1.New, true
+	case oid.Equal(oidHmacWithSHA256):
+		return sha256.New, true
+	case oid.Equal(oidHmacWithSHA384):
+		return sha512.New384, true
+	case oid.Equal(oidHmacWithSHA512):
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+// The block size (v in RFC 7292) of the hash, for the PKCS#12 KDF
+func hashBlockSize(newHash func() hash.Hash) int {
+	return newHash().BlockSize()
+}
+
+// Create the cipher and IV for this encryption algorithm and password
+func pbeCipher(alg algorithmIdentifier, password string) (cipher.Block, []byte, error) {
+	switch {
+	case alg.Algorithm.Equal(oidPbeWithSHAAnd3KeyTripleDESCBC), alg.Algorithm.Equal(oidPbeWithSHAAnd128BitRC2CBC), alg.Algorithm.Equal(oidPbeWithSHAAnd40BitRC2CBC):
+		var params pbeParams
+		if err := unmarshalFully(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, nil, err
+		}
+		pw := bmpPassword(password)
+		v := hashBlockSize(sha1.New)
+		iv := pkcs12Kdf(sha1.New, v, params.Salt, pw, params.Iterations, pkcs12KdfIV, 8)
+		switch {
+		case alg.Algorithm.Equal(oidPbeWithSHAAnd3KeyTripleDESCBC):
+			block, err := des.NewTripleDESCipher(pkcs12Kdf(sha1.New, v, params.Salt, pw, params.Iterations, pkcs12KdfKey, 24))
+			return block, iv, err
+		case alg.Algorithm.Equal(oidPbeWithSHAAnd128BitRC2CBC):
+			return newRC2Cipher(pkcs12Kdf(sha1.New, v, params.Salt, pw, params.Iterations, pkcs12KdfKey, 16), 128), iv, nil
+		default:
+			return newRC2Cipher(pkcs12Kdf(sha1.New, v, params.Salt, pw, params.Iterations, pkcs12KdfKey, 5), 40), iv, nil
+		}
+
+	case alg.Algorithm.Equal(oidPBES2):
+		var params pbes2Params
+		if err := unmarshalFully(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, nil, err
+		}
+		if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+			return nil, nil, &UnsupportedError{What: "key derivation function " + params.KeyDerivationFunc.Algorithm.String()}
+		}
+		var kdfParams pbkdf2Params
+		if err := unmarshalFully(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+			return nil, nil, err
+		}
+		prf := sha1.New
+		if len(kdfParams.Prf.Algorithm) > 0 {
+			var ok bool
+			if prf, ok = hashForHmacOid(kdfParams.Prf.Algorithm); !ok {
+				return nil, nil, &UnsupportedError{What: "PBKDF2 pseudo random function " + kdfParams.Prf.Algorithm.String()}
+			}
+		}
+		var keyLen int
+		var newCipher func([]byte) (cipher.Block, error)
+		switch {
+		case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+			keyLen, newCipher = 16, aes.NewCipher
+		case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+			keyLen, newCipher = 24, aes.NewCipher
+		case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+			keyLen, newCipher = 32, aes.NewCipher
+		case params.EncryptionScheme.Algorithm.Equal(oidDESEDE3CBC):
+			keyLen, newCipher = 24, des.NewTripleDESCipher
+		default:
+			return nil, nil, &UnsupportedError{What: "PBES2 encryption scheme " + params.EncryptionScheme.Algorithm.String()}
+		}
+		var iv []byte
+		if err := unmarshalFully(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, nil, err
+		}
+		block, err := newCipher(pbkdf2(prf, []byte(password), kdfParams.Salt, kdfParams.Iterations, keyLen))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(iv) != block.BlockSize() {
+			return nil, nil, formatError("the PBES2 IV length is wrong")
+		}
+		return block, iv, nil
+	}
+	return nil, nil, &UnsupportedError{What: "encryption algorithm " + alg.Algorithm.String()}
+}
+
+// Decrypt data that was encrypted with this algorithm. A wrong password shows up as bad padding.
+func pbeDecrypt(alg algorithmIdentifier, password string, encrypted []byte) ([]byte, error) {
+	block, iv, err := pbeCipher(alg, password)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) == 0 || len(encrypted)%block.BlockSize() != 0 {
+		return nil, formatError("the encrypted data length is not a multiple of the block size")
+	}
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+
+	// Remove the PKCS#7 padding
+	padLen := int(decrypted[len(decrypted)-1])
+	if padLen == 0 || padLen > block.BlockSize() || padLen > len(decrypted) {
+		return nil, ErrIncorrectPassword
+	}
+	for _, b := range decrypted[len(decrypted)-padLen:] {
+		if int(b) != padLen {
+			return nil, ErrIncorrectPassword
+		}
+	}
+	return decrypted[:len(decrypted)-padLen], nil
+}
+
+// Encrypt the data with pbeWithSHAAnd3-KeyTripleDES-CBC, which every version of keytool and openssl can read
+func pbeEncrypt(password string, salt []byte, iterations int, data []byte) (algorithmIdentifier, []byte, error) {
+	paramBytes, err := asn1.Marshal(pbeParams{Salt: salt, Iterations: iterations})
+	if err != nil {
+		return algorithmIdentifier{}, nil, err
+	}
+	alg := algorithmIdentifier{Algorithm: oidPbeWithSHAAnd3KeyTripleDESCBC, Parameters: asn1.RawValue{FullBytes: paramBytes}}
+	block, iv, err := pbeCipher(alg, password)
+	if err != nil {
+		return algorithmIdentifier{}, nil, err
+	}
+	padLen := block.BlockSize() - len(data)%block.BlockSize()
+	encrypted := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	return alg, encrypted, nil
+}
+
+// Compute the MAC of the keystore content, with the PKCS#12 KDF derived key
+func computeMac(newHash func() hash.Hash, password string, salt []byte, iterations int, content []byte) []byte {
+	key := pkcs12Kdf(newHash, hashBlockSize(newHash), salt, bmpPassword(password), iterations, pkcs12KdfMAC, newHash().Size())
+	mac := hmac.New(newHash, key)
+	mac.Write(content)
+	return mac.Sum(nil)
+}
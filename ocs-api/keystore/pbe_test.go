@@ -0,0 +1,113 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The expected values were computed with: openssl kdf -kdfopt digest:SHA1 -kdfopt hexpass:<bmp-password> ... PKCS12KDF
+func TestPkcs12Kdf(t *testing.T) {
+	for _, test := range []struct {
+		newHash    func() hash.Hash
+		password   string
+		salt       string
+		iterations int
+		id         byte
+		expected   string
+	}{
+		{sha1.New, "smeg", "0a58cf64530d823f", 1, pkcs12KdfKey, "8aaae6297b6cb04642ab5b077851284eb7128f1a2a7fbca3"},
+		{sha1.New, "smeg", "0a58cf64530d823f", 1, pkcs12KdfIV, "79993dfe048d3b76"},
+		{sha1.New, "queeg", "1682c0fc5b3f7ec5", 1000, pkcs12KdfKey, "483dd6e919d7de2e8e648ba8f862f3fbfbdc2bcb2c02957f"},
+		{sha1.New, "queeg", "1682c0fc5b3f7ec5", 1000, pkcs12KdfIV, "9d461d1b00355c50"},
+		{sha1.New, "smeg", "3d83c0e4546ac140", 1, pkcs12KdfMAC, "8d967d88f6caa9d714800ab3d48051d63f73a312"},
+		{sha256.New, "queeg", "1682c0fc5b3f7ec5", 1000, pkcs12KdfMAC, "2886c84718145a841a2efe4a91a5e48d50f53b8debc34f9883818ccf638e58d3"},
+		// longer than 1 hash, so the salt and password blocks are adjusted between the rounds
+		{sha1.New, "smeg", "0a58cf64530d823f", 2, pkcs12KdfKey, "a9ab3f7635c50df231528e4228c98e5352bdb1003dbc9f6425d3271c0403804b4a045960af9822cd20dbc656a325892d3c1b749edb3900fe7f15069ea4471e3874c339e4c189bad5c8ebb5bfe1dfbba3cb810f7c6e71ec631dfff7b15f58e3f5ce14d424"},
+	} {
+		expected := mustDecodeHex(t, test.expected)
+		key := pkcs12Kdf(test.newHash, hashBlockSize(test.newHash), mustDecodeHex(t, test.salt), bmpPassword(test.password), test.iterations, test.id, len(expected))
+		if !bytes.Equal(key, expected) {
+			t.Errorf("%s %s %d id %d: got %x, expected %x", test.password, test.salt, test.iterations, test.id, key, expected)
+		}
+	}
+}
+
+// The expected values are the HMACs (computed with python hmac) of the content with the key of the MAC test vectors of TestPkcs12Kdf
+func TestComputeMac(t *testing.T) {
+	content := []byte("the authenticated safe")
+	if mac := computeMac(sha1.New, "smeg", mustDecodeHex(t, "3d83c0e4546ac140"), 1, content); hex.EncodeToString(mac) != "33e13c52a7d0f07216a3c4831be9524aed8942b9" {
+		t.Errorf("sha1: got %x", mac)
+	}
+	if mac := computeMac(sha256.New, "queeg", mustDecodeHex(t, "1682c0fc5b3f7ec5"), 1000, content); hex.EncodeToString(mac) != "69d5d49e7b6f09cdb0e770d43a8e8c55550f00ec3338db24c2574aa2bfc2761f" {
+		t.Errorf("sha256: got %x", mac)
+	}
+}
+
+// The test vectors of RFC 6070, and the same inputs with SHA-256 (computed with python hashlib.pbkdf2_hmac)
+func TestPbkdf2(t *testing.T) {
+	for _, test := range []struct {
+		newHash    func() hash.Hash
+		password   string
+		salt       string
+		iterations int
+		expected   string
+	}{
+		{sha1.New, "password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{sha1.New, "password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{sha1.New, "password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{sha1.New, "passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{sha256.New, "password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{sha256.New, "password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{sha256.New, "passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+	} {
+		expected := mustDecodeHex(t, test.expected)
+		if key := pbkdf2(test.newHash, []byte(test.password), []byte(test.salt), test.iterations, len(expected)); !bytes.Equal(key, expected) {
+			t.Errorf("%s %s %d: got %x, expected %x", test.password, test.salt, test.iterations, key, expected)
+		}
+	}
+}
+
+func TestPbeEncryptDecrypt(t *testing.T) {
+	salt := mustDecodeHex(t, "0102030405060708")
+	for _, data := range [][]byte{[]byte("1234567"), []byte("12345678"), bytes.Repeat([]byte("owner key "), 10)} {
+		alg, encrypted, err := pbeEncrypt("pw", salt, 2048, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encrypted)%8 != 0 || len(encrypted) <= len(data) {
+			t.Errorf("%d bytes were encrypted to %d bytes", len(data), len(encrypted))
+		}
+		if decrypted, err := pbeDecrypt(alg, "pw", encrypted); err != nil || !bytes.Equal(decrypted, data) {
+			t.Errorf("decrypted %q %v, expected %q", decrypted, err, data)
+		}
+		// A wrong password almost always shows up as bad padding, but for 1 in 256 keys the padding is accidentally valid
+		if decrypted, err := pbeDecrypt(alg, "wrong", encrypted); err == nil && bytes.Equal(decrypted, data) {
+			t.Error("decrypted with the wrong password")
+		} else if err != nil && !errors.Is(err, ErrIncorrectPassword) {
+			t.Errorf("wrong password: got %v, expected %v", err, ErrIncorrectPassword)
+		}
+	}
+
+	// Algorithms that are not supported
+	for _, oid := range []asn1.ObjectIdentifier{oidSHA1, {1, 2, 840, 113549, 1, 12, 1, 1}} {
+		var unsupportedErr *UnsupportedError
+		if _, err := pbeDecrypt(algorithmIdentifier{Algorithm: oid}, "pw", make([]byte, 8)); !errors.As(err, &unsupportedErr) {
+			t.Errorf("%s: got %v, expected an unsupported error", oid, err)
+		}
+	}
+}
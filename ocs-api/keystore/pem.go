@@ -0,0 +1,94 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+)
+
+// Reading key pairs from PEM, e.g. the output of: openssl req -x509 -newkey ... -keyout key.pem -out cert.pem
+
+// Parse the private keys and certificates in the PEM data, and pair each private key with the certificate of its public key. The rest
+// of the certificates are used to build the chain of each key's certificate. The entries do not have an alias. Encrypted private keys
+// are not supported (use PKCS#12 for those).
+func ParsePem(pemBytes []byte) ([]*Entry, error) {
+	var keys []crypto.Signer
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if _, ok := block.Headers["Proc-Type"]; ok || block.Type == "ENCRYPTED PRIVATE KEY" {
+			return nil, &UnsupportedError{What: "encrypted PEM private key (use PKCS#12 instead)"}
+		}
+		switch block.Type {
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			key, err := parsePemPrivateKey(block)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, formatError("can not parse a certificate: " + err.Error())
+			}
+			certs = append(certs, cert)
+		case "EC PARAMETERS":
+			// openssl ecparam -genkey outputs these before the key, the curve is also in the key
+		default:
+			return nil, &UnsupportedError{What: "PEM block type " + block.Type}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, formatError("no private key found in the PEM data")
+	}
+
+	entries := make([]*Entry, 0, len(keys))
+	for _, key := range keys {
+		var keyCert *x509.Certificate
+		var chainCerts []*x509.Certificate
+		for _, cert := range certs {
+			if keyCert == nil && publicKeysEqual(key.Public(), cert.PublicKey) {
+				keyCert = cert
+			} else {
+				chainCerts = append(chainCerts, cert)
+			}
+		}
+		if keyCert == nil {
+			return nil, formatError("no certificate found for the " + KeyAlgorithm(key.Public()) + " private key")
+		}
+		entries = append(entries, &Entry{PrivateKey: key, Certificates: append([]*x509.Certificate{keyCert}, buildChain(keyCert, chainCerts)...)})
+	}
+	return entries, nil
+}
+
+// Parse a PKCS#8, PKCS#1 (rsa), or SEC 1 (ec) private key
+func parsePemPrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, formatError("can not parse a private key: " + err.Error())
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, &UnsupportedError{What: "private key type"}
+	}
+	return signer, nil
+}
+
+// Whether the 2 public keys are the same
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	aEq, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && aEq.Equal(b)
+}
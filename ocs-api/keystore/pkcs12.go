@@ -0,0 +1,366 @@
+package keystore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// The ASN.1 structure of a PKCS#12 file (RFC 7292), and reading/writing its safe bags
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidJavaTrustedKeyUsage      = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1} // how keytool marks a trusted certificate entry
+	oidAnyExtendedKeyUsage      = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+)
+
+// The same values keytool uses
+const (
+	pfxVersion          = 3
+	pbeIterations       = 50000
+	macIterations       = 100000
+	saltLength          = 20
+	bmpStringTag        = 30
+	contextSpecificTag0 = 0
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm algorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm algorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	Id   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm algorithmIdentifier
+	EncryptedData       []byte
+}
+
+// Unmarshal the DER and make sure there is nothing after it
+func unmarshalFully(der []byte, v interface{}) error {
+	rest, err := asn1.Unmarshal(der, v)
+	if err != nil {
+		return formatError(err.Error())
+	}
+	if len(rest) != 0 {
+		return formatError("trailing data after the ASN.1 structure")
+	}
+	return nil
+}
+
+// Verify the MAC and return the safe bags of all of the safe contents, decrypted
+func decodeSafeBags(pfxBytes []byte, password string) ([]safeBag, error) {
+	var pfx pfxPdu
+	if err := unmarshalFully(pfxBytes, &pfx); err != nil {
+		return nil, err
+	}
+	if pfx.Version != pfxVersion {
+		return nil, formatError("unsupported PKCS#12 version")
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, &UnsupportedError{What: "public key integrity mode (only password integrity mode is supported)"}
+	}
+	var authSafeContent []byte
+	if err := unmarshalFully(pfx.AuthSafe.Content.Bytes, &authSafeContent); err != nil {
+		return nil, err
+	}
+
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) == 0 {
+		return nil, &UnsupportedError{What: "keystore without a MAC"}
+	}
+	newHash, ok := hashForDigestOid(pfx.MacData.Mac.Algorithm.Algorithm)
+	if !ok {
+		return nil, &UnsupportedError{What: "MAC algorithm " + pfx.MacData.Mac.Algorithm.Algorithm.String()}
+	}
+	mac := computeMac(newHash, password, pfx.MacData.MacSalt, pfx.MacData.Iterations, authSafeContent)
+	if !hmac.Equal(mac, pfx.MacData.Mac.Digest) {
+		return nil, ErrIncorrectPassword
+	}
+
+	var authSafe []contentInfo
+	if err := unmarshalFully(authSafeContent, &authSafe); err != nil {
+		return nil, err
+	}
+	var bags []safeBag
+	for _, ci := range authSafe {
+		var safeContents []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if err := unmarshalFully(ci.Content.Bytes, &safeContents); err != nil {
+				return nil, err
+			}
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed encryptedData
+			if err := unmarshalFully(ci.Content.Bytes, &ed); err != nil {
+				return nil, err
+			}
+			var err error
+			if safeContents, err = pbeDecrypt(ed.EncryptedContentInfo.ContentEncryptionAlgorithm, password, ed.EncryptedContentInfo.EncryptedContent); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, &UnsupportedError{What: "content type " + ci.ContentType.String()}
+		}
+		var contentBags []safeBag
+		if err := unmarshalFully(safeContents, &contentBags); err != nil {
+			return nil, err
+		}
+		bags = append(bags, contentBags...)
+	}
+	return bags, nil
+}
+
+// Return the friendly name (alias) and local key id attributes of the bag
+func bagAttributes(bag *safeBag) (string, []byte, error) {
+	alias := ""
+	var localKeyId []byte
+	for _, attr := range bag.Attributes {
+		switch {
+		case attr.Id.Equal(oidFriendlyName):
+			var raw asn1.RawValue
+			if err := unmarshalFully(attr.Value.Bytes, &raw); err != nil {
+				return "", nil, err
+			}
+			if raw.Tag != bmpStringTag {
+				return "", nil, formatError("the friendlyName attribute is not a BMPString")
+			}
+			var err error
+			if alias, err = decodeBMPString(raw.Bytes); err != nil {
+				return "", nil, err
+			}
+		case attr.Id.Equal(oidLocalKeyID):
+			if err := unmarshalFully(attr.Value.Bytes, &localKeyId); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return alias, localKeyId, nil
+}
+
+// Decrypt the private key of a key bag
+func decodeKeyBag(bag *safeBag, password string) (interface{}, error) {
+	pkcs8 := bag.Value.Bytes
+	if bag.Id.Equal(oidPKCS8ShroudedKeyBag) {
+		var epki encryptedPrivateKeyInfo
+		if err := unmarshalFully(bag.Value.Bytes, &epki); err != nil {
+			return nil, err
+		}
+		var err error
+		if pkcs8, err = pbeDecrypt(epki.EncryptionAlgorithm, password, epki.EncryptedData); err != nil {
+			return nil, err
+		}
+	}
+	key, err := x509.ParsePKCS8PrivateKey(pkcs8)
+	if err != nil {
+		return nil, &UnsupportedError{What: "private key: " + err.Error()}
+	}
+	return key, nil
+}
+
+func decodeCertBag(bag *safeBag) (*x509.Certificate, error) {
+	var cb certBag
+	if err := unmarshalFully(bag.Value.Bytes, &cb); err != nil {
+		return nil, err
+	}
+	if !cb.Id.Equal(oidCertTypeX509) {
+		return nil, &UnsupportedError{What: "certificate type " + cb.Id.String()}
+	}
+	cert, err := x509.ParseCertificate(cb.Data)
+	if err != nil {
+		return nil, formatError("invalid certificate: " + err.Error())
+	}
+	return cert, nil
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// Marshal the value of a SET OF attribute values with 1 value
+func attributeSet(value []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value}
+}
+
+// The friendlyName and localKeyId attributes of a bag. localKeyId is omitted if it is nil.
+func makeBagAttributes(alias string, localKeyId []byte) ([]pkcs12Attribute, error) {
+	nameBytes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: bmpStringTag, Bytes: bmpString(alias)})
+	if err != nil {
+		return nil, err
+	}
+	attrs := []pkcs12Attribute{{Id: oidFriendlyName, Value: attributeSet(nameBytes)}}
+	if localKeyId != nil {
+		idBytes, err := asn1.Marshal(localKeyId)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, pkcs12Attribute{Id: oidLocalKeyID, Value: attributeSet(idBytes)})
+	}
+	return attrs, nil
+}
+
+// Make the value of a [0] EXPLICIT field from the DER of its content
+func explicitValue(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: contextSpecificTag0, IsCompound: true, Bytes: der}
+}
+
+func makeKeyBag(alias string, localKeyId []byte, key interface{}, password string) (safeBag, error) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return safeBag{}, &UnsupportedError{What: "private key: " + err.Error()}
+	}
+	salt, err := randomSalt()
+	if err != nil {
+		return safeBag{}, err
+	}
+	alg, encrypted, err := pbeEncrypt(password, salt, pbeIterations, pkcs8)
+	if err != nil {
+		return safeBag{}, err
+	}
+	epkiBytes, err := asn1.Marshal(encryptedPrivateKeyInfo{EncryptionAlgorithm: alg, EncryptedData: encrypted})
+	if err != nil {
+		return safeBag{}, err
+	}
+	attrs, err := makeBagAttributes(alias, localKeyId)
+	if err != nil {
+		return safeBag{}, err
+	}
+	return safeBag{Id: oidPKCS8ShroudedKeyBag, Value: explicitValue(epkiBytes), Attributes: attrs}, nil
+}
+
+// Make a certificate bag. If alias is "", the bag has no attributes (it is part of the chain of a key entry).
+func makeCertBag(alias string, localKeyId []byte, cert *x509.Certificate, trusted bool) (safeBag, error) {
+	cbBytes, err := asn1.Marshal(certBag{Id: oidCertTypeX509, Data: cert.Raw})
+	if err != nil {
+		return safeBag{}, err
+	}
+	bag := safeBag{Id: oidCertBag, Value: explicitValue(cbBytes)}
+	if alias != "" {
+		if bag.Attributes, err = makeBagAttributes(alias, localKeyId); err != nil {
+			return safeBag{}, err
+		}
+	}
+	if trusted {
+		// keytool only treats a certificate without a key as a trusted certificate entry if it has this attribute
+		usageBytes, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+		if err != nil {
+			return safeBag{}, err
+		}
+		bag.Attributes = append(bag.Attributes, pkcs12Attribute{Id: oidJavaTrustedKeyUsage, Value: attributeSet(usageBytes)})
+	}
+	return bag, nil
+}
+
+// Write the bags into a PKCS#12 file: the key bags (which are already encrypted) in a data content, the certificate bags in an
+// encrypted data content, and a SHA-1 MAC of it all. This is the layout and the algorithms that keytool (before java 17) uses.
+func encodeSafeBags(keyBags, certBags []safeBag, password string) ([]byte, error) {
+	var authSafe []contentInfo
+
+	keyContents, err := asn1.Marshal(keyBags)
+	if err != nil {
+		return nil, err
+	}
+	keyOctets, err := asn1.Marshal(keyContents)
+	if err != nil {
+		return nil, err
+	}
+	authSafe = append(authSafe, contentInfo{ContentType: oidDataContentType, Content: explicitValue(keyOctets)})
+
+	certContents, err := asn1.Marshal(certBags)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := randomSalt()
+	if err != nil {
+		return nil, err
+	}
+	alg, encrypted, err := pbeEncrypt(password, salt, pbeIterations, certContents)
+	if err != nil {
+		return nil, err
+	}
+	edBytes, err := asn1.Marshal(encryptedData{Version: 0, EncryptedContentInfo: encryptedContentInfo{ContentType: oidDataContentType, ContentEncryptionAlgorithm: alg, EncryptedContent: encrypted}})
+	if err != nil {
+		return nil, err
+	}
+	authSafe = append(authSafe, contentInfo{ContentType: oidEncryptedDataContentType, Content: explicitValue(edBytes)})
+
+	authSafeContent, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+	authSafeOctets, err := asn1.Marshal(authSafeContent)
+	if err != nil {
+		return nil, err
+	}
+	macSalt, err := randomSalt()
+	if err != nil {
+		return nil, err
+	}
+	pfx := pfxPdu{
+		Version:  pfxVersion,
+		AuthSafe: contentInfo{ContentType: oidDataContentType, Content: explicitValue(authSafeOctets)},
+		MacData: macData{
+			Mac:        digestInfo{Algorithm: algorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue}, Digest: computeMac(sha1.New, password, macSalt, macIterations, authSafeContent)},
+			MacSalt:    macSalt,
+			Iterations: macIterations,
+		},
+	}
+	return asn1.Marshal(pfx)
+}
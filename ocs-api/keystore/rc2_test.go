@@ -0,0 +1,59 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+)
+
+// The test vectors of RFC 2268 section 5
+func TestRC2(t *testing.T) {
+	for _, test := range []struct {
+		key           string
+		effectiveBits int
+		plaintext     string
+		ciphertext    string
+	}{
+		{"0000000000000000", 63, "0000000000000000", "ebb773f993278eff"},
+		{"ffffffffffffffff", 64, "ffffffffffffffff", "278b27e42e2f0d49"},
+		{"3000000000000000", 64, "1000000000000001", "30649edf9be7d2c2"},
+		{"88", 64, "0000000000000000", "61a8a244adacccf0"},
+		{"88bca90e90875a", 64, "0000000000000000", "6ccf4308974c267f"},
+		{"88bca90e90875a7f0f79c384627bafb2", 64, "0000000000000000", "1a807d272bbe5db1"},
+		{"88bca90e90875a7f0f79c384627bafb2", 128, "0000000000000000", "2269552ab0f85ca6"},
+		{"88bca90e90875a7f0f79c384627bafb216f80a6f85920584c42fceb0be255daf1e", 129, "0000000000000000", "5b78d3a43dfff1f1"},
+	} {
+		c := newRC2Cipher(mustDecodeHex(t, test.key), test.effectiveBits)
+		plaintext, expected := mustDecodeHex(t, test.plaintext), mustDecodeHex(t, test.ciphertext)
+		ciphertext := make([]byte, rc2BlockSize)
+		c.Encrypt(ciphertext, plaintext)
+		if !bytes.Equal(ciphertext, expected) {
+			t.Errorf("key %s, %d bits: encrypted to %x, expected %x", test.key, test.effectiveBits, ciphertext, expected)
+		}
+		decrypted := make([]byte, rc2BlockSize)
+		c.Decrypt(decrypted, expected)
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("key %s, %d bits: decrypted to %x, expected %x", test.key, test.effectiveBits, decrypted, plaintext)
+		}
+	}
+}
+
+// The 40 and 128 bit RC2 of the PKCS#12 algorithms, in CBC mode. The expected values were computed with: openssl enc -rc2-40-cbc
+// and openssl enc -rc2-cbc.
+func TestRC2CBC(t *testing.T) {
+	plaintext := []byte("SDO owner keys!!")
+	for _, test := range []struct {
+		key, iv       string
+		effectiveBits int
+		ciphertext    string
+	}{
+		{"0102030405", "0000000000000000", 40, "286b14ac67373498a3d68fcaefd2cc74"},
+		{"000102030405060708090a0b0c0d0e0f", "0001020304050607", 128, "a9913d1703ca906638d8091eddba0fd3"},
+	} {
+		ciphertext := make([]byte, len(plaintext))
+		cipher.NewCBCEncrypter(newRC2Cipher(mustDecodeHex(t, test.key), test.effectiveBits), mustDecodeHex(t, test.iv)).CryptBlocks(ciphertext, plaintext)
+		if expected := mustDecodeHex(t, test.ciphertext); !bytes.Equal(ciphertext, expected) {
+			t.Errorf("%d bits: encrypted to %x, expected %x", test.effectiveBits, ciphertext, expected)
+		}
+	}
+}
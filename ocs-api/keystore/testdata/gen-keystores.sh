@@ -0,0 +1,20 @@
+#!/bin/sh
+
+# Generates the openssl keystores of the tests: an ecdsa 256 key whose certificate is issued by an rsa ca, in the default format
+# of openssl 3 (PBES2 with AES-256 and PBKDF2, and a SHA-256 MAC) and in the legacy format of openssl 1.1 (3DES encrypted key,
+# RC2-40 encrypted certificates, and a SHA-1 MAC).
+# sample-owner-keystore.p12 is a copy of keys/sample-owner-keystore.p12, which was created by keytool.
+# Usage: cd keystore/testdata && ./gen-keystores.sh
+
+set -e
+password='test-pw'
+tmpDir=$(mktemp -d)
+trap "rm -rf $tmpDir" EXIT
+
+openssl req -x509 -newkey rsa:2048 -nodes -keyout $tmpDir/ca.key -out $tmpDir/ca.crt -days 36500 -subj '/CN=test ca'
+openssl ecparam -name prime256v1 -genkey -noout -out $tmpDir/owner.key
+openssl req -new -key $tmpDir/owner.key -out $tmpDir/owner.csr -subj '/CN=test owner'
+openssl x509 -req -in $tmpDir/owner.csr -CA $tmpDir/ca.crt -CAkey $tmpDir/ca.key -CAcreateserial -out $tmpDir/owner.crt -days 36500
+
+openssl pkcs12 -export -name 'Test-Owner' -inkey $tmpDir/owner.key -in $tmpDir/owner.crt -certfile $tmpDir/ca.crt -passout pass:$password -out openssl-owner-keystore.p12
+openssl pkcs12 -export -legacy -name 'Test-Owner' -inkey $tmpDir/owner.key -in $tmpDir/owner.crt -certfile $tmpDir/ca.crt -passout pass:$password -out openssl-legacy-owner-keystore.p12
@@ -1,20 +1,24 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/open-horizon/SDO-support/ocs-api/data"
 	"github.com/open-horizon/SDO-support/ocs-api/outils"
+	"github.com/open-horizon/SDO-support/ocs-api/voucher"
 )
 
 /*
@@ -23,21 +27,24 @@ REST API server to configure the SDO OCS (Owner Companion Service) DB files for
 
 // These global vars are necessary because the handler functions are not given any context
 var OcsDbDir string
-var GetOrgVoucherRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/vouchers/([^/]+)$`)
-var GetVoucherRegex = regexp.MustCompile(`^/api/vouchers/([^/]+)$`)       // backward compat
-var OrgVouchersRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/vouchers$`) // used for both GET and POST
-var OrgKeyRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/keys/([^/]+)$`)  // used for both GET and DELETE
-var OrgKeysRegex = regexp.MustCompile(`^/api/orgs/([^/]+)/keys$`)         // used for both GET and POST
-var ExchangeUrl string                                                    // the external url, that the device needs
-var ExchangeInternalUrl string                                            // will default to ExchangeUrl
-var ExchangeInternalCertPath string                                       // will default to /home/sdouser/ocs-api-dir/keys/sdoapi.crt if not set by EXCHANGE_INTERNAL_CERT
-var ExchangeInternalRetries int                                           // the number of times to retry connecting to the exchange during startup
-var ExchangeInternalInterval int                                          // the number of seconds to wait before retrying again to connect to the exchange during startup
-var CssUrl string                                                         // the external url, that the device needs
-var PkgsFrom string                                                       // the argument to the agent-install.sh -i flag
-var CfgFileFrom string                                                    // the argument to the agent-install.sh -k flag
+var ExchangeUrl string              // the external url, that the device needs
+var ExchangeInternalUrl string      // will default to ExchangeUrl
+var ExchangeInternalCertPath string // will default to /home/sdouser/ocs-api-dir/keys/sdoapi.crt if not set by EXCHANGE_INTERNAL_CERT
+var ExchangeInternalRetries int     // the number of times to retry connecting to the exchange during startup
+var ExchangeInternalInterval int    // the number of seconds to wait before retrying again to connect to the exchange during startup
+var CssUrl string                   // the external url, that the device needs
+var PkgsFrom string                 // the argument to the agent-install.sh -i flag
+var CfgFileFrom string              // the argument to the agent-install.sh -k flag
+var AllowSampleOwnerKey bool        // accept vouchers signed over to the sample owner key (only for dev/test)
+var Devices *DeviceIndex            // index of the imported devices, kept in sync with the device dirs of the OCS db
+var PreregisterNodes bool           // create the node in the exchange when a voucher is imported
+var PurgeNodeTokens bool            // remove the node token from the exec file after the device is onboarded
+var AllowKeyImportOverHttp bool     // accept private keys over http, e.g. when a proxy in front of the ocs-api terminates TLS
 var KeyImportLock sync.RWMutex
 
+// What the generated node tokens look like, from the SDO_NODE_TOKEN_* env vars
+var NodeTokenPolicy = outils.DefaultNodeTokenPolicy()
+
 func main() {
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: ./ocs-api <port> <ocs-db-path>")
@@ -50,6 +57,39 @@ func main() {
 	outils.SetVerbose()
 	ExchangeInternalRetries = outils.GetEnvVarIntWithDefault("EXCHANGE_INTERNAL_RETRIES", 12) // by default a total of 1 minute of trying
 	ExchangeInternalInterval = outils.GetEnvVarIntWithDefault("EXCHANGE_INTERNAL_INTERVAL", 5)
+	AllowSampleOwnerKey = outils.GetEnvVarWithDefault("SDO_ALLOW_SAMPLE_OWNER_KEY", "false") == "true"
+	PreregisterNodes = outils.GetEnvVarWithDefault("SDO_PREREGISTER_NODES", "false") == "true"
+	PurgeNodeTokens = outils.GetEnvVarWithDefault("SDO_PURGE_NODE_TOKENS", "true") == "true"
+	AllowKeyImportOverHttp = outils.GetEnvVarWithDefault("SDO_ALLOW_KEY_IMPORT_OVER_HTTP", "false") == "true"
+	purgeInterval := outils.GetEnvVarIntWithDefault("SDO_PURGE_NODE_TOKENS_INTERVAL", 60)
+	var err error
+	if NodeTokenPolicy, err = outils.GetNodeTokenPolicyFromEnv(); err != nil {
+		outils.Fatal(1, "invalid node token policy: %v", err)
+	}
+	if ApiPermissions, err = outils.GetApiPermissionsFromEnv(); err != nil {
+		outils.Fatal(1, "invalid API permissions: %v", err)
+	}
+	outils.Verbose("API permissions: %s", ApiPermissions.String())
+	authCacheConfig := outils.GetAuthCacheConfigFromEnv()
+	if authCacheConfig.TTL > 0 && authCacheConfig.MaxEntries <= 0 {
+		outils.Fatal(1, "environment variable SDO_API_AUTH_CACHE_SIZE must be greater than 0")
+	}
+	outils.AuthCache = outils.NewExchangeAuthCache(authCacheConfig)
+	exchangeRetryConfig := outils.GetExchangeRetryConfigFromEnv()
+	if exchangeRetryConfig.Retries < 0 || exchangeRetryConfig.Backoff < 0 || exchangeRetryConfig.MaxBackoff < 0 || exchangeRetryConfig.Deadline < 0 || exchangeRetryConfig.BreakerThreshold < 0 {
+		outils.Fatal(1, "environment variables SDO_EXCHANGE_RETRIES, SDO_EXCHANGE_RETRY_BACKOFF_MS, SDO_EXCHANGE_RETRY_MAX_BACKOFF_MS, SDO_EXCHANGE_RETRY_DEADLINE_SECONDS, and SDO_EXCHANGE_BREAKER_THRESHOLD can not be negative")
+	}
+	if exchangeRetryConfig.BreakerThreshold > 0 && exchangeRetryConfig.BreakerOpen <= 0 {
+		outils.Fatal(1, "environment variable SDO_EXCHANGE_BREAKER_OPEN_SECONDS must be greater than 0")
+	}
+	outils.ExchangeCallBreaker = outils.NewExchangeBreaker(exchangeRetryConfig)
+	outils.TokenIntrospection = outils.GetTokenIntrospectionConfigFromEnv()
+	if outils.TokenIntrospection.Url != "" {
+		outils.Verbose("Validating bearer tokens with %s", outils.TokenIntrospection.Url)
+		if _, httpErr := outils.GetTokenIntrospectionHTTPClient(); httpErr != nil {
+			outils.Fatal(1, "invalid SDO_API_TOKEN_INTROSPECTION_CA_CERT: %v", httpErr)
+		}
+	}
 
 	// Ensure we can get to the db, and create the necessary subdirs, if necessary
 	if err := os.MkdirAll(OcsDbDir+"/v1/devices", 0750); err != nil {
@@ -62,13 +102,26 @@ func main() {
 		outils.Fatal(3, "could not create directory %s: %v", OcsDbDir+"/v1/creds/publicKeys", err)
 	}
 
+	// Open the device index, which is rebuilt from the device dirs if it doesn't exist yet
+	if Devices, err = OpenDeviceIndex(OcsDbDir + "/v1/ocs-api/device-index.json"); err != nil {
+		outils.Fatal(3, "could not open the device index: %v", err)
+	}
+
+	// Remove the node tokens of the devices that have been onboarded, now and periodically
+	if PurgeNodeTokens {
+		if purgeInterval <= 0 {
+			outils.Fatal(1, "environment variable SDO_PURGE_NODE_TOKENS_INTERVAL must be greater than 0")
+		}
+		startNodeTokenPurger(purgeInterval)
+	}
+
 	// Create all of the common config files, if we have the necessary env vars to do so
 	if httpErr := createConfigFiles(); httpErr != nil {
 		outils.Fatal(3, "creating common config files: %s", httpErr.Error())
 	}
 
 	//http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/api/", apiHandler)
+	http.Handle("/api/", newApiRouter())
 
 	// Get the cert to use when talking to the exchange for authentication, if set
 	if outils.IsEnvVarSet("EXCHANGE_INTERNAL_CERT") {
@@ -103,36 +156,65 @@ func main() {
 	}
 } // end of main
 
-// API route dispatcher
-func apiHandler(w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("Handling %s ...", r.URL.Path)
-	if r.Method == "GET" && r.URL.Path == "/api/version" {
-		getVersionHandler(w, r)
-	} else if matches := GetOrgVoucherRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{ord-id}/vouchers/{device-id}
-		getVoucherHandler(matches[1], matches[2], w, r)
-	} else if matches := GetVoucherRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // backward compat: GET /api/vouchers/{device-id}
-		getVoucherHandler("", matches[1], w, r)
-	} else if matches := OrgVouchersRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/orgs/{ord-id}/vouchers
-		getVouchersHandler(matches[1], w, r)
-	} else if r.Method == "GET" && r.URL.Path == "/api/vouchers" { // backward compat
-		getVouchersHandler("", w, r)
-	} else if matches := OrgVouchersRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/orgs/{ord-id}/vouchers
-		postVoucherHandler(matches[1], w, r)
-	} else if r.Method == "POST" && (r.URL.Path == "/api/vouchers" || r.URL.Path == "/api/voucher") { // backward compat: /api/voucher is for until we update hzn voucher import
-		postVoucherHandler("", w, r)
-	} else if matches := OrgKeyRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 3 { // GET /api/orgs/{org-id}/keys/{key-name}
-		getKeyHandler(matches[1], matches[2], w, r)
-	} else if matches := OrgKeyRegex.FindStringSubmatch(r.URL.Path); r.Method == "DELETE" && len(matches) >= 3 { // DELETE /api/orgs/{org-id}/keys/{key-name}
-		deleteKeyHandler(matches[1], matches[2], w, r)
-	} else if matches := OrgKeysRegex.FindStringSubmatch(r.URL.Path); r.Method == "GET" && len(matches) >= 2 { // GET /api/orgs/{ord-id}/keys
-		getKeysHandler(matches[1], w, r)
-	} else if matches := OrgKeysRegex.FindStringSubmatch(r.URL.Path); r.Method == "POST" && len(matches) >= 2 { // POST /api/orgs/{ord-id}/keys
-		postImportKeysHandler(matches[1], w, r)
-	} else {
-		http.Error(w, "Route "+r.URL.Path+" not found", http.StatusNotFound)
-	}
+// The API routes. To add an endpoint, add a route here, the dispatching (including 405 and OPTIONS) is handled by the Router.
+func newApiRouter() *Router {
+	rt := &Router{Authorize: authorizeRoute}
+	rt.Handle(http.MethodGet, "/api/version", func(p PathParams, w http.ResponseWriter, r *http.Request) { getVersionHandler(w, r) })
+	rt.Handle(http.MethodGet, "/api/health", func(p PathParams, w http.ResponseWriter, r *http.Request) { getHealthHandler(w, r) })
+
+	// Vouchers
+	rt.Handle(http.MethodGet, "/api/orgs/{org-id}/vouchers/{device-id}", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		getVoucherHandler(p["org-id"], p["device-id"], w, r)
+	})
+	rt.Handle(http.MethodDelete, "/api/orgs/{org-id}/vouchers/{device-id}", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		deleteVoucherHandler(p["org-id"], p["device-id"], w, r)
+	})
+	rt.Handle(http.MethodGet, "/api/orgs/{org-id}/vouchers/{device-id}/status", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		getVoucherStatusHandler(p["org-id"], p["device-id"], w, r)
+	})
+	rt.Handle(http.MethodPost, "/api/orgs/{org-id}/vouchers/{device-id}/token", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		postVoucherTokenHandler(p["org-id"], p["device-id"], w, r)
+	})
+	rt.Handle(http.MethodGet, "/api/orgs/{org-id}/vouchers/{device-id}/token", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		getVoucherTokenHandler(p["org-id"], p["device-id"], w, r)
+	})
+	rt.Handle(http.MethodGet, "/api/vouchers/{device-id}", func(p PathParams, w http.ResponseWriter, r *http.Request) { // backward compat
+		getVoucherHandler("", p["device-id"], w, r)
+	})
+	rt.Handle(http.MethodGet, "/api/orgs/{org-id}/vouchers", func(p PathParams, w http.ResponseWriter, r *http.Request) { getVouchersHandler(p["org-id"], w, r) })
+	rt.Handle(http.MethodGet, "/api/vouchers", func(p PathParams, w http.ResponseWriter, r *http.Request) { getVouchersHandler("", w, r) }) // backward compat
+	rt.Handle(http.MethodPost, "/api/orgs/{org-id}/vouchers", func(p PathParams, w http.ResponseWriter, r *http.Request) { postVoucherHandler(p["org-id"], w, r) })
+	rt.Handle(http.MethodPost, "/api/orgs/{org-id}/vouchers/bulk", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		postBulkVouchersHandler(p["org-id"], w, r)
+	})
+	rt.Handle(http.MethodPost, "/api/vouchers", func(p PathParams, w http.ResponseWriter, r *http.Request) { postVoucherHandler("", w, r) }) // backward compat
+	rt.Handle(http.MethodPost, "/api/voucher", func(p PathParams, w http.ResponseWriter, r *http.Request) { postVoucherHandler("", w, r) })  // backward compat: until we update hzn voucher import
+
+	// Keys
+	rt.Handle(http.MethodGet, "/api/orgs/{org-id}/keys/{key-name}", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		getKeyHandler(p["org-id"], p["key-name"], w, r)
+	})
+	rt.Handle(http.MethodDelete, "/api/orgs/{org-id}/keys/{key-name}", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		deleteKeyHandler(p["org-id"], p["key-name"], w, r)
+	})
+	rt.Handle(http.MethodPost, "/api/orgs/{org-id}/keys/import", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		postImportKeyPairsHandler(p["org-id"], w, r)
+	})
+	rt.Handle(http.MethodPost, "/api/orgs/{org-id}/keys/{key-name}/rotate", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		postRotateKeyHandler(p["org-id"], p["key-name"], w, r)
+	})
+	rt.Handle(http.MethodGet, "/api/orgs/{org-id}/keys/{key-name}/vouchers", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		getKeyVouchersHandler(p["org-id"], p["key-name"], w, r)
+	})
+	rt.Handle(http.MethodPut, "/api/orgs/{org-id}/keys/{key-name}/owner", func(p PathParams, w http.ResponseWriter, r *http.Request) {
+		putKeyOwnerHandler(p["org-id"], p["key-name"], w, r)
+	})
+	rt.Handle(http.MethodGet, "/api/orgs/{org-id}/keys", func(p PathParams, w http.ResponseWriter, r *http.Request) { getKeysHandler(p["org-id"], w, r) })
+	rt.Handle(http.MethodPost, "/api/orgs/{org-id}/keys", func(p PathParams, w http.ResponseWriter, r *http.Request) { postImportKeysHandler(p["org-id"], w, r) })
+
 	// Note: we used to also support a route that would allow an admin to change the config (i.e. run createConfigFiles()) w/o restarting
 	//		the container, but penetration testing deemed it a security exposure, because you can cause this service to do arbitrary DNS lookups.
+	return rt
 }
 
 // Route Handlers --------------------------------------------------------------------------------------------------
@@ -151,23 +233,35 @@ func getVersionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//============= GET /api/health =============
+// Returns the health of the ocs-api, including the state of the circuit breaker of the exchange calls that authenticate requests.
+// The status is degraded while the breaker is open, because then requests that need authentication fail with 503.
+func getHealthHandler(w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("GET /api/health ...")
+
+	type ExchangeHealth struct {
+		CircuitBreaker outils.BreakerStatus `json:"circuitBreaker"`
+	}
+	type Health struct {
+		Status   string         `json:"status"` // ok or degraded
+		Version  string         `json:"version"`
+		Exchange ExchangeHealth `json:"exchange"`
+	}
+	health := Health{Status: "ok", Version: OCS_API_VERSION, Exchange: ExchangeHealth{CircuitBreaker: outils.ExchangeCallBreaker.Status()}}
+	if health.Exchange.CircuitBreaker.State == outils.BreakerStateOpen {
+		health.Status = "degraded"
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, health)
+}
+
 //============= GET /api/orgs/{ord-id}/vouchers/{device-id} and GET /api/vouchers/{device-id} =============
 // Reads/returns an already imported voucher
 func getVoucherHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.Request) {
 	outils.Verbose("GET /api/orgs/%s/vouchers/%s ...", orgId, deviceUuid)
 
-	// Determine the org id to use for the device, based on various inputs
-	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
-	if httpErr != nil {
-		http.Error(w, httpErr.Error(), httpErr.Code)
-		return
-	}
-
-	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
-		http.Error(w, httpErr.Error(), httpErr.Code)
-		return
-	} else if !authenticated {
-		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -181,12 +275,7 @@ func getVoucherHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.
 
 	// Confirm this voucher/device is in the client's org. Doing this check after getting the voucher, because if the
 	// voucher doesn't exist, we want them get that error, rather than that it is not in their org
-	orgidTxtStr, httpErr := getOrgidTxtStr(deviceUuid)
-	if httpErr != nil {
-		http.Error(w, httpErr.Error(), httpErr.Code)
-		return
-	}
-	if orgidTxtStr != deviceOrgId { // this device is in our org
+	if rec := Devices.Get(deviceUuid); rec == nil || rec.Orgid != deviceOrgId { // this device is in our org
 		http.Error(w, "Device "+deviceUuid+" is not in org "+deviceOrgId, http.StatusForbidden)
 		return
 	}
@@ -196,50 +285,170 @@ func getVoucherHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.
 	outils.WriteResponse(http.StatusOK, w, voucherBytes)
 }
 
-//============= GET /api/orgs/{ord-id}/vouchers and GET /api/vouchers =============
-// Reads/returns all of the already imported vouchers
-func getVouchersHandler(orgId string, w http.ResponseWriter, r *http.Request) {
-	outils.Verbose("GET /api/orgs/%s/vouchers ...", orgId)
+//============= GET /api/orgs/{ord-id}/vouchers/{device-id}/status =============
+// Returns the onboarding status of the device of an imported voucher
+func getVoucherStatusHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("GET /api/orgs/%s/vouchers/%s/status ...", orgId, deviceUuid)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := uuid.Parse(deviceUuid); err != nil {
+		http.Error(w, "Invalid device id "+deviceUuid+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec := Devices.Get(deviceUuid)
+	if rec == nil {
+		http.Error(w, "Voucher "+deviceUuid+" not found", http.StatusNotFound)
+		return
+	}
+
+	// Confirm this voucher/device is in the client's org
+	if rec.Orgid != deviceOrgId {
+		http.Error(w, "Device "+deviceUuid+" is not in org "+deviceOrgId, http.StatusForbidden)
+		return
+	}
 
-	// Determine the org id to use for the device, based on various inputs
-	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	status, httpErr := getDeviceStatus(rec)
 	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+	outils.WriteJsonResponse(http.StatusOK, w, status)
+}
+
+//============= GET /api/orgs/{ord-id}/vouchers/{device-id}/token =============
+// Reports whether the node token of an imported voucher is still present in the OCS db, or was purged after the device was onboarded.
+// The token itself is not returned.
+func getVoucherTokenHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("GET /api/orgs/%s/vouchers/%s/token ...", orgId, deviceUuid)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := uuid.Parse(deviceUuid); err != nil {
+		http.Error(w, "Invalid device id "+deviceUuid+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec := Devices.Get(deviceUuid)
+	if rec == nil {
+		http.Error(w, "Voucher "+deviceUuid+" not found", http.StatusNotFound)
+		return
+	}
+
+	// Confirm this voucher/device is in the client's org
+	if rec.Orgid != deviceOrgId {
+		http.Error(w, "Device "+deviceUuid+" is not in org "+deviceOrgId, http.StatusForbidden)
+		return
+	}
+
+	tokenStatus, httpErr := getNodeTokenStatus(rec)
+	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else if !authenticated {
-		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+	}
+
+	outils.WriteJsonResponse(http.StatusOK, w, tokenStatus)
+}
+
+//============= POST /api/orgs/{ord-id}/vouchers/{device-id}/token =============
+// Generates a new node token for an imported voucher, and returns it. Only the exec file of the device is changed. If the node was
+// pre-registered in the exchange (or updateExchange=true), its token in the exchange is also changed.
+func postVoucherTokenHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("POST /api/orgs/%s/vouchers/%s/token ...", orgId, deviceUuid)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	// Read the v1/devices/ directory in the db
-	vouchersDirName := OcsDbDir + "/v1/devices"
-	deviceDirs, err := ioutil.ReadDir(filepath.Clean(vouchersDirName))
-	if err != nil {
-		http.Error(w, "Error reading "+vouchersDirName+" directory: "+err.Error(), http.StatusInternalServerError)
+	// The device id is used in the file path we write, so make sure it really is a uuid
+	if _, err := uuid.Parse(deviceUuid); err != nil {
+		http.Error(w, "Invalid device id "+deviceUuid+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec := Devices.Get(deviceUuid)
+	if rec == nil {
+		http.Error(w, "Voucher "+deviceUuid+" not found", http.StatusNotFound)
 		return
 	}
 
-	vouchers := []string{}
-	for _, dir := range deviceDirs {
-		if dir.IsDir() {
-			// Look inside the device dir for orgid.txt to see if is part of the org we are listing
-			orgidTxtStr, httpErr := getOrgidTxtStr(dir.Name())
-			if httpErr != nil {
-				http.Error(w, httpErr.Error(), httpErr.Code)
-				return
-			}
-			if orgidTxtStr == deviceOrgId { // this device is in our org
-				vouchers = append(vouchers, dir.Name())
-			}
+	// Confirm this voucher/device is in the client's org
+	if rec.Orgid != deviceOrgId {
+		http.Error(w, "Device "+deviceUuid+" is not in org "+deviceOrgId, http.StatusForbidden)
+		return
+	}
+
+	updateExchange := rec.ExchangeNode
+	if s := r.URL.Query().Get("updateExchange"); s != "" {
+		var err error
+		if updateExchange, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "updateExchange must be true or false", http.StatusBadRequest)
+			return
 		}
 	}
 
+	nodeToken, httpErr := rotateNodeToken(r, rec, updateExchange)
+	if httpErr != nil {
+		outils.WriteHttpError(w, httpErr) // includes Retry-After when the exchange is not available
+		return
+	}
+
+	respBody := map[string]interface{}{
+		"deviceUuid": deviceUuid,
+		"nodeToken":  nodeToken,
+	}
+	outils.WriteJsonResponse(http.StatusOK, w, respBody)
+}
+
+//============= GET /api/orgs/{ord-id}/vouchers and GET /api/vouchers =============
+// Reads/returns the already imported vouchers. Supports paging (limit, offset, after), filters (importedAfter, state, hasNodeToken),
+// and returning the metadata of each voucher (long=true).
+func getVouchersHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("GET /api/orgs/%s/vouchers ...", orgId)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Get the paging, filter, and output options from the url params
+	opts, httpErr := getVoucherListOptions(r.URL.Query())
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	voucherMetas, total, more, httpErr := listOrgVouchers(deviceOrgId, opts)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// The paging info is returned in headers, so the body stays the same as when paging is not used
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if more && len(voucherMetas) > 0 {
+		w.Header().Set("X-Next-Cursor", voucherMetas[len(voucherMetas)-1].DeviceUuid) // pass this as ?after= to get the next page
+	}
+
 	// Send vouchers to client
+	if opts.Long {
+		outils.WriteJsonResponse(http.StatusOK, w, voucherMetas)
+		return
+	}
+	vouchers := make([]string, 0, len(voucherMetas))
+	for _, m := range voucherMetas {
+		vouchers = append(vouchers, m.DeviceUuid)
+	}
 	outils.WriteJsonResponse(http.StatusOK, w, vouchers)
 }
 
@@ -247,129 +456,193 @@ func getVouchersHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 // Imports a voucher (can be called again for an existing voucher and will update/overwrite)
 func postVoucherHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 	outils.Verbose("POST /api/orgs/%s/vouchers ...", orgId)
-	valuesDir := OcsDbDir + "/v1/values"
 
-	// Determine the org id to use for the device, based on various inputs
-	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
-	if httpErr != nil {
-		http.Error(w, httpErr.Error(), httpErr.Code)
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, exUser, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
+	user := exUser.Name
 
-	// Authenticate this user with the exchange
-	if authenticated, _, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath); httpErr != nil {
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else if !authenticated {
-		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
-		return
 	}
 
-	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+	// Read the request body and import the voucher
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	voucherBytes, serviceInfo, httpErr := parseVoucherImportBody(bodyBytes)
+	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
+	orgKeys, httpErr := getOrgOwnerKeys(deviceOrgId)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	deviceUuid, nodeToken, vErr, httpErr := importVoucher(r, deviceOrgId, user, voucherBytes, serviceInfo, orgKeys)
+	if vErr != nil {
+		outils.WriteJsonResponse(http.StatusBadRequest, w, vErr)
+		return
+	} else if httpErr != nil {
+		outils.WriteHttpError(w, httpErr) // includes Retry-After when the exchange is not available
+		return
+	}
 
-	// Parse the request body
-	type OhStruct struct {
-		Guid []byte `json:"g"` // making it type []byte will automatically base64 decode the json value
+	// Send response to client
+	respBody := map[string]interface{}{
+		"deviceUuid": deviceUuid,
+		"nodeToken":  nodeToken,
 	}
-	type Voucher struct {
-		Oh OhStruct `json:"oh"`
+	outils.WriteJsonResponse(http.StatusCreated, w, respBody)
+}
+
+//============= POST /api/orgs/{ord-id}/vouchers/bulk =============
+// Imports many vouchers in 1 call. The body can be a json array of vouchers, a multipart/form-data upload of voucher files,
+// or a tar, tar.gz, or zip file of voucher files. Each voucher is imported independently, so 1 bad voucher does not prevent the others from being imported.
+func postBulkVouchersHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("POST /api/orgs/%s/vouchers/bulk ...", orgId)
+
+	// The org of the device and the exchange user were authorized before the handler was called, once for the whole batch
+	deviceOrgId, exUser, ok := authorizedUser(w, r)
+	if !ok {
+		return
 	}
+	user := exUser.Name
 
-	voucher := Voucher{}
-	bodyBytes, err := ioutil.ReadAll(r.Body) // we need the request body in 2 forms (bytes and the Voucher struct), but can only read it once, so get it as bytes
-	if err != nil {
-		http.Error(w, "Error reading the request body: "+err.Error(), http.StatusBadRequest)
+	bulkVouchers, httpErr := readBulkVouchers(r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
-	if httpErr := outils.ParseJsonString(bodyBytes, &voucher); httpErr != nil {
+	orgKeys, httpErr := getOrgOwnerKeys(deviceOrgId)
+	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	// Get, decode, and convert the device uuid
-	uuid, err := uuid.FromBytes(voucher.Oh.Guid)
-	if err != nil {
-		http.Error(w, "Error converting GUID to UUID: "+err.Error(), http.StatusBadRequest)
-		return
+	// Struct for 1 element of the results array of the response body
+	type VoucherImportResult struct {
+		Name       string `json:"name"`
+		DeviceUuid string `json:"deviceUuid,omitempty"`
+		NodeToken  string `json:"nodeToken,omitempty"`
+		Field      string `json:"field,omitempty"`
+		Error      string `json:"error,omitempty"`
 	}
-	outils.Verbose("POST /api/orgs/%/vouchers: device UUID: %s", deviceOrgId, uuid.String())
 
-	// Create the device directory in the OCS DB
-	deviceDir := OcsDbDir + "/v1/devices/" + uuid.String()
-	if err := os.MkdirAll(deviceDir, 0750); err != nil {
-		http.Error(w, "could not create directory "+deviceDir+": "+err.Error(), http.StatusInternalServerError)
-		return
+	// Find the devices that are in the batch more than once. None of their vouchers are imported, because importing a device again
+	// replaces its voucher and node token, so the results would depend on the order of the vouchers.
+	deviceVoucherNames := map[string][]string{}
+	for _, bv := range bulkVouchers {
+		if bv.Err == "" {
+			if voucherBytes, _, httpErr := parseVoucherImportBody(bv.Bytes); httpErr == nil {
+				if deviceUuid := bulkVoucherDeviceUuid(voucherBytes); deviceUuid != "" {
+					deviceVoucherNames[deviceUuid] = append(deviceVoucherNames[deviceUuid], bv.Name)
+				}
+			}
+		}
 	}
 
-	// Remove the state.json file, in case this voucher was previously imported. This allows to0 to be run again (register it with RV)
-	fileName := deviceDir + "/state.json"
-	outils.Verbose("POST /api/orgs/%s/vouchers: removing %s (if exists) ...", deviceOrgId, fileName)
-	if err := os.RemoveAll(filepath.Clean(fileName)); err != nil { // RemoveAll does NOT return an error if fileName doesn't exist
-		http.Error(w, "could not remove "+fileName+": "+err.Error(), http.StatusInternalServerError)
-		return
+	results := make([]VoucherImportResult, 0, len(bulkVouchers))
+	numImported := 0
+	for _, bv := range bulkVouchers {
+		result := VoucherImportResult{Name: bv.Name}
+		if bv.Err != "" {
+			result.Error = bv.Err
+			results = append(results, result)
+			continue
+		}
+		voucherBytes, serviceInfo, httpErr := parseVoucherImportBody(bv.Bytes)
+		if httpErr != nil {
+			result.Error = httpErr.Error()
+			results = append(results, result)
+			continue
+		}
+		if deviceUuid := bulkVoucherDeviceUuid(voucherBytes); len(deviceVoucherNames[deviceUuid]) > 1 {
+			result.DeviceUuid = deviceUuid
+			result.Field = "oh.g"
+			result.Error = "device " + deviceUuid + " is in more than 1 voucher of the request: " + strings.Join(deviceVoucherNames[deviceUuid], ", ")
+			results = append(results, result)
+			continue
+		}
+		deviceUuid, nodeToken, vErr, httpErr := importVoucher(r, deviceOrgId, user, voucherBytes, serviceInfo, orgKeys)
+		if vErr != nil {
+			result.Field = vErr.Field
+			result.Error = vErr.Message
+		} else if httpErr != nil {
+			result.Error = httpErr.Error()
+		} else {
+			result.DeviceUuid = deviceUuid
+			result.NodeToken = nodeToken
+			numImported++
+		}
+		results = append(results, result)
 	}
+	outils.Verbose("POST /api/orgs/%s/vouchers/bulk: imported %d of %d vouchers", deviceOrgId, numImported, len(bulkVouchers))
 
-	// Put the voucher in the OCS DB
-	fileName = deviceDir + "/voucher.json"
-	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
-	if err := ioutil.WriteFile(filepath.Clean(fileName), bodyBytes, 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
-		return
+	// Send response to client
+	respBody := map[string]interface{}{
+		"imported": numImported,
+		"failed":   len(bulkVouchers) - numImported,
+		"results":  results,
 	}
+	outils.WriteJsonResponse(http.StatusOK, w, respBody)
+}
 
-	// Create the device download file (svi.json) and psi.json
-	fileName = deviceDir + "/svi.json"
-	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
-	sviJson1 := ""
-	if outils.PathExists(valuesDir + "/agent-install.crt") {
-		sviJson1 = data.SviJson1
+//============= DELETE /api/orgs/{ord-id}/vouchers/{device-id} =============
+// Deletes an imported voucher and all of the OCS files for this device
+func deleteVoucherHandler(orgId, deviceUuid string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("DELETE /api/orgs/%s/vouchers/%s ...", orgId, deviceUuid)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
+		return
 	}
-	sviJson := "[" + sviJson1 + data.SviJson2 + uuid.String() + data.SviJson3 + "]"
-	if err := ioutil.WriteFile(filepath.Clean(fileName), []byte(sviJson), 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
+
+	// The device id is used in file paths we remove, so make sure it really is a uuid
+	if _, err := uuid.Parse(deviceUuid); err != nil {
+		http.Error(w, "Invalid device id "+deviceUuid+": "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	fileName = deviceDir + "/psi.json"
-	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
-	if err := ioutil.WriteFile(filepath.Clean(fileName), []byte(data.PsiJson), 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
+	rec := Devices.Get(deviceUuid)
+	if rec == nil {
+		http.Error(w, "Voucher "+deviceUuid+" not found", http.StatusNotFound)
 		return
 	}
 
-	// Create orgid.txt file to identify what org this device/voucher is part of
-	fileName = deviceDir + "/orgid.txt"
-	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s with value: %s ...", deviceOrgId, fileName, deviceOrgId)
-	if err := ioutil.WriteFile(filepath.Clean(fileName), []byte(deviceOrgId), 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
+	// Confirm this voucher/device is in the client's org
+	if rec.Orgid != deviceOrgId {
+		http.Error(w, "Device "+deviceUuid+" is not in org "+deviceOrgId, http.StatusForbidden)
 		return
 	}
 
-	// Generate a node token
-	nodeToken, httpErr := outils.GenerateNodeToken()
-	if httpErr != nil {
+	// Remove the value files (exec and per-device service info) 1st, so if removing the device dir fails, the voucher can still be found and deleted again
+	outils.Verbose("DELETE /api/orgs/%s/vouchers/%s: removing the value files ...", deviceOrgId, deviceUuid)
+	if httpErr := removeDeviceValueFiles(deviceUuid); httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	// Create exec file
-	// Note: currently agent-install-wrapper.sh requires that the flags be in this order!!!!
-	execCmd := outils.MakeExecCmd(fmt.Sprintf("/bin/sh agent-install-wrapper.sh -i %s -a %s:%s -O %s -k %s", PkgsFrom, uuid.String(), nodeToken, deviceOrgId, CfgFileFrom))
-	fileName = OcsDbDir + "/v1/values/" + uuid.String() + "_exec"
-	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
-	if err := ioutil.WriteFile(filepath.Clean(fileName), []byte(execCmd), 0644); err != nil {
-		http.Error(w, "could not create "+fileName+": "+err.Error(), http.StatusInternalServerError)
+	// Remove the device dir: voucher.json, state.json, svi.json, psi.json, orgid.txt
+	deviceDir := OcsDbDir + "/v1/devices/" + deviceUuid
+	outils.Verbose("DELETE /api/orgs/%s/vouchers/%s: removing %s ...", deviceOrgId, deviceUuid, deviceDir)
+	if err := os.RemoveAll(filepath.Clean(deviceDir)); err != nil {
+		http.Error(w, "could not remove "+deviceDir+": "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Send response to client
-	respBody := map[string]interface{}{
-		"deviceUuid": uuid.String(),
-		"nodeToken":  nodeToken,
+	if httpErr := Devices.Delete(deviceUuid); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
 	}
-	outils.WriteJsonResponse(http.StatusCreated, w, respBody)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 //============= GET /api/orgs/{org-id}/keys =============
@@ -377,61 +650,26 @@ func postVoucherHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 func getKeysHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 	outils.Verbose("GET /api/orgs/%s/keys ...", orgId)
 
-	// Determine the org id to use for the device, based on various inputs
-	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
-	if httpErr != nil {
-		http.Error(w, httpErr.Error(), httpErr.Code)
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	// Get the certificate metadata of each key
+	// using read mutex so no other client can write to the keystore while we are reading the keystore
+	KeyImportLock.RLock()
+	certInfos, httpErr := getOwnerKeyCertInfos(deviceOrgId)
+	var keyStates map[string]*OwnerKeyState
+	if httpErr == nil {
+		keyStates, httpErr = readOwnerKeyStates()
+	}
+	KeyImportLock.RUnlock()
 	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else if !authenticated {
-		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
-		return
 	}
 
-	// Get the expired disposition of each key certificate and build a map of them
-	outils.Verbose("Running command: ./get-owner-key-expirations.sh %s %s", deviceOrgId, user)
-	// using read mutex so only no other client can write to the keystore while we are reading the keystore
-	KeyImportLock.RLock()
-	stdOut, stdErr, err := outils.RunCmd(outils.RunCmdOpts{}, "./get-owner-key-expirations.sh", deviceOrgId, user)
-	KeyImportLock.RUnlock()
-	if err != nil {
-		http.Error(w, "error running get-owner-key-expirations.sh: "+err.Error(), http.StatusInternalServerError) // this includes stdErr
-		return
-	} else {
-		if len(stdErr) > 0 { // with shell scripts there can be error msgs in stderr even though the exit code was 0
-			outils.Verbose("stderr from delete-owner-key.sh: %s", string(stdErr))
-		}
-		outils.Verbose("get-owner-key-expirations.sh stdout: " + string(stdOut))
-	}
-	expiredMap := make(map[string]bool)
-	trimmedStdOut := strings.TrimRight(string(stdOut), "\n") // using TrimRight() instead of TrimSuffix() because the former will trim multiple newlines
-	if len(trimmedStdOut) > 0 {
-		for _, line := range strings.Split(trimmedStdOut, "\n") {
-			// echo line is: <org>_<key-name>: <true or false>
-			parts := strings.Split(line, ": ")
-			if len(parts) != 2 {
-				http.Error(w, "unexpected line of output from get-owner-key-expirations.sh: "+line, http.StatusInternalServerError)
-				return
-			}
-			orgAndKey := parts[0]
-			var isExpired bool
-			if parts[1] == "true" {
-				isExpired = true
-			} else if parts[1] == "false" {
-				isExpired = false
-			} else {
-				http.Error(w, "unexpected expiration value from get-owner-key-expirations.sh: "+parts[1], http.StatusInternalServerError)
-				return
-			}
-			expiredMap[orgAndKey] = isExpired
-		}
-	} // else just leave expiredMap empty
-
 	// Read the publicKeys/<org> directory in the db, and then read each <user> sub-dir to get all of the pubic key file names
 	pubKeyDirName := OcsDbDir + "/v1/creds/publicKeys/" + deviceOrgId
 	if err := os.MkdirAll(pubKeyDirName, 0750); err != nil { // in case the sub-dir doesn't even exist yet
@@ -444,13 +682,30 @@ func getKeysHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Count the imported vouchers signed over to each key
+	voucherCounts := make(map[string]int)
+	for _, rec := range Devices.ListOrg(deviceOrgId) {
+		if rec.OwnerKey != "" {
+			voucherCounts[rec.OwnerKey]++
+		}
+	}
+
 	// Struct for 1 element of the response body array
 	type KeyMeta struct {
-		Name      string `json:"name"`
-		Orgid     string `json:"orgid"`
-		Owner     string `json:"owner"`
-		FileName  string `json:"fileName"`
-		IsExpired bool   `json:"isExpired"`
+		Name         string   `json:"name"`
+		Orgid        string   `json:"orgid"`
+		Owner        string   `json:"owner"`
+		FileName     string   `json:"fileName"`
+		IsExpired    bool     `json:"isExpired"`
+		NotBefore    string   `json:"notBefore"`    // RFC 3339
+		NotAfter     string   `json:"notAfter"`     // RFC 3339
+		Algorithms   []string `json:"algorithms"`   // e.g. RSA-2048, ECDSA-P-256, ECDSA-P-384
+		Subject      string   `json:"subject"`      // the subject DN of the key certificates
+		Fingerprint  string   `json:"fingerprint"`  // hex sha256 of the public key file, the same as: sha256sum <file>
+		CreatedAt    string   `json:"createdAt"`    // RFC 3339
+		VoucherCount int      `json:"voucherCount"` // the number of imported vouchers signed over to this key
+		Status       string   `json:"status"`       // active or retiring
+		ReplacedBy   string   `json:"replacedBy,omitempty"`
 	}
 
 	pubKeyList := make([]KeyMeta, 0)
@@ -468,13 +723,24 @@ func getKeysHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 					// determine key-name by stripping org and public-key.pem
 					orgAndKey := strings.TrimSuffix(f.Name(), "_public-key.pem")
 					keyName := strings.TrimPrefix(orgAndKey, strings.ToLower(deviceOrgId)+"_")
-					// get whether of not this key is expired from the map we created earlier
-					isExpired, ok := expiredMap[orgAndKey]
+					// get the certificate metadata of this key from the map we created earlier
+					certInfo, ok := certInfos[orgAndKey]
 					if !ok {
-						http.Error(w, "map key "+orgAndKey+" does not exist in expiration map", http.StatusInternalServerError) // mismatch between private keys in keystore and public keys in directory
+						http.Error(w, "map key "+orgAndKey+" does not exist in certificate map", http.StatusInternalServerError) // mismatch between private keys in keystore and public keys in directory
+						return
+					}
+					pemBytes, err := ioutil.ReadFile(filepath.Clean(uDir + "/" + f.Name()))
+					if err != nil {
+						http.Error(w, "Error reading "+uDir+"/"+f.Name()+": "+err.Error(), http.StatusInternalServerError)
 						return
 					}
-					keyMeta := KeyMeta{Name: keyName, FileName: f.Name(), Orgid: deviceOrgId, Owner: user, IsExpired: isExpired}
+					fingerprint := sha256.Sum256(pemBytes)
+					keyMeta := KeyMeta{Name: keyName, FileName: f.Name(), Orgid: deviceOrgId, Owner: user, IsExpired: certInfo.IsExpired(),
+						NotBefore: certInfo.NotBefore.UTC().Format(ocsTimestampDisplayFormat), NotAfter: certInfo.NotAfter.UTC().Format(ocsTimestampDisplayFormat),
+						Algorithms: certInfo.Algorithms, Subject: certInfo.Subject, Fingerprint: hex.EncodeToString(fingerprint[:]),
+						CreatedAt: f.ModTime().UTC().Format(ocsTimestampDisplayFormat), VoucherCount: voucherCounts[keyName]}
+					keyState := getOwnerKeyState(keyStates, deviceOrgId, keyName)
+					keyMeta.Status, keyMeta.ReplacedBy = keyState.Status, keyState.ReplacedBy
 					pubKeyList = append(pubKeyList, keyMeta)
 				}
 			}
@@ -494,34 +760,25 @@ func getKeysHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 func getKeyHandler(orgId, keyName string, w http.ResponseWriter, r *http.Request) {
 	outils.Verbose("GET /api/orgs/%s/keys/%s ...", orgId, keyName)
 
-	// Determine the org id to use for the device, based on various inputs
-	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
-	if httpErr != nil {
-		http.Error(w, httpErr.Error(), httpErr.Code)
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	// Verify key file is in the db. Every user of the org can read all of the org's keys.
+	KeyImportLock.RLock()
+	keyUser, httpErr := findOwnerKeyUser(deviceOrgId, keyName)
+	KeyImportLock.RUnlock()
 	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else if !authenticated {
-		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
-		return
-	}
-
-	// Verify key file is in the db
-	pubKeyDirName := OcsDbDir + "/v1/creds/publicKeys/" + deviceOrgId
-	if err := os.MkdirAll(pubKeyDirName, 0750); err != nil { // in case the sub-dir doesn't even exist yet
-		http.Error(w, "could not create directory "+pubKeyDirName+": "+err.Error(), http.StatusInternalServerError)
-		return
 	}
-	pubKeyFileName := pubKeyDirName + "/" + user + "/" + strings.ToLower(deviceOrgId+"_"+keyName) + "_public-key.pem"
-	if !outils.PathExists(pubKeyFileName) {
-		//http.Error(w, "Public key "+keyName+" for user "+user+" not found", http.StatusNotFound)
+	if keyUser == "" {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	pubKeyFileName := ownerPublicKeyFileName(deviceOrgId, keyUser, keyName)
 
 	// Send public key file to client
 	//w.WriteHeader(http.StatusCreated) // http.ServeFile() does this too
@@ -531,155 +788,307 @@ func getKeyHandler(orgId, keyName string, w http.ResponseWriter, r *http.Request
 }
 
 //============= DELETE /api/orgs/{org-id}/keys/{key-name} =============
-// Deletes an already imported key pair (public and private keys)
+// Deletes an already imported key pair (public and private keys). Only org admins can do this.
 func deleteKeyHandler(orgId, keyName string, w http.ResponseWriter, r *http.Request) {
 	outils.Verbose("DELETE /api/orgs/%s/keys/%s ...", orgId, keyName)
 
-	// Determine the org id to use for the device, based on various inputs
-	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
-	if httpErr != nil {
-		http.Error(w, httpErr.Error(), httpErr.Code)
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, exUser, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	if !canManageOwnerKey(exUser) {
+		http.Error(w, "only an admin of org "+deviceOrgId+" can delete owner keys", http.StatusForbidden)
+		return
+	}
+
+	// Look up the key, check that no voucher depends on it, and delete it under the same write lock, so the key can not be rotated or
+	// transferred in between
+	KeyImportLock.Lock()
+	defer KeyImportLock.Unlock()
+
+	// Verify key file is in the db
+	keyUser, httpErr := findOwnerKeyUser(deviceOrgId, keyName)
 	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else if !authenticated {
-		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
+	}
+	if keyUser == "" {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	// Verify key file is in the db
-	pubKeyDirName := OcsDbDir + "/v1/creds/publicKeys/" + deviceOrgId
-	if err := os.MkdirAll(pubKeyDirName, 0750); err != nil { // in case the sub-dir doesn't even exist yet
-		http.Error(w, "could not create directory "+pubKeyDirName+": "+err.Error(), http.StatusInternalServerError)
+	// Deleting the key while there are imported vouchers signed over to it would prevent those devices from being onboarded
+	dependentVouchers, httpErr := getKeyDependentVouchers(deviceOrgId, keyName)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
-	pubKeyFileName := pubKeyDirName + "/" + user + "/" + strings.ToLower(deviceOrgId+"_"+keyName) + "_public-key.pem"
-	if !outils.PathExists(pubKeyFileName) {
-		//http.Error(w, "Public key "+keyName+" for user "+user+" not found", http.StatusNotFound)
-		w.WriteHeader(http.StatusNotFound)
+	if len(dependentVouchers) > 0 {
+		http.Error(w, fmt.Sprintf("owner key %s can not be deleted, because %d imported vouchers that have not been onboarded are signed over to it. Rotate the key (POST /api/orgs/%s/keys/%s/rotate), and delete it after those devices are onboarded or their vouchers are deleted. See GET /api/orgs/%s/keys/%s/vouchers", keyName, len(dependentVouchers), deviceOrgId, keyName, deviceOrgId, keyName), http.StatusConflict)
 		return
 	}
 
-	// Run script to delete the private and public keys
-	outils.Verbose("Running command: ./delete-owner-key.sh %s %s %s", deviceOrgId, user, keyName)
-	// Using mutex so only 1 instance of the script writes to the keystore at a time
-	KeyImportLock.Lock()
-	stdOut, stdErr, err := outils.RunCmd(outils.RunCmdOpts{}, "./delete-owner-key.sh", deviceOrgId, user, keyName)
-	KeyImportLock.Unlock()
-	if err != nil {
-		http.Error(w, "error running delete-owner-key.sh: "+err.Error(), http.StatusBadRequest) // this includes stdErr
+	// Delete the private and public keys
+	outils.Verbose("Deleting owner key %s of user %s/%s ...", keyName, deviceOrgId, keyUser)
+	httpErr = deleteOwnerKey(deviceOrgId, keyUser, keyName)
+	if httpErr == nil {
+		httpErr = removeOwnerKeyState(deviceOrgId, keyName)
+	}
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else {
-		if len(stdErr) > 0 { // with shell scripts there can be error msgs in stderr even though the exit code was 0
-			outils.Verbose("stderr from delete-owner-key.sh: %s", string(stdErr))
-		}
-		outils.Verbose(string(stdOut))
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
 //============= POST /api/orgs/{org-id}/keys =============
-// Receives in the body json the arguments required to run import-owner-key-pairs.sh script, which will create and import the private keys into the master keystore,
-// and stores the combine public keys into the file DB.
+// Receives in the body json the information for the key certificates, creates the key pairs and imports the private keys into the master keystore,
+// and stores the combined public keys into the file DB.
 // This allows sdo-owner-services to read vouchers intended for them, and to securely communicate with their devices booting up.
 func postImportKeysHandler(orgId string, w http.ResponseWriter, r *http.Request) {
 	outils.Verbose("POST /api/orgs/%s/keys ...", orgId)
 
-	// Determine the org id to use for the device, based on various inputs
-	deviceOrgId, httpErr := getDeviceOrgId(orgId, r)
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, exUser, ok := authorizedUser(w, r)
+	if !ok {
+		return
+	}
+	user := exUser.Name
+
+	// Parse and validate the request body
+	keyName, subject, httpErr := readOwnerKeyInput(r, deviceOrgId)
 	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	//valuesDir := OcsDbDir + "/v1/values"
-	authenticated, user, httpErr := outils.ExchangeAuthenticate(r, ExchangeInternalUrl, deviceOrgId, ExchangeInternalCertPath)
+	// Create the key pairs and import them into the keystore
+	// for dev/test they can specify the url param expired=true to create an already expired key
+	expired := r.URL.Query().Get("expired") == "true"
+	if expired {
+		fmt.Printf("Creating expired test key %s ...\n", strings.ToLower(deviceOrgId+"_"+keyName))
+	}
+	outils.Verbose("Creating owner key %s of user %s/%s with subject %+v ...", keyName, deviceOrgId, user, subject)
+	// Using mutex so only 1 client writes to the keystore at a time
+	KeyImportLock.Lock()
+	httpErr = createOwnerKey(deviceOrgId, user, keyName, subject, expired)
+	KeyImportLock.Unlock()
 	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else if !authenticated {
-		http.Error(w, "invalid exchange credentials provided", http.StatusUnauthorized)
-		return
 	}
 
-	// Verify content type
-	if httpErr := outils.IsValidPostBinary(r); httpErr == nil {
-		http.Error(w, "Error: Passing a key pair tar file into this API is no longer supported.", http.StatusBadRequest)
+	w.WriteHeader(http.StatusCreated) // http.ServeFile() sets the code to StatusOK so you'll see a warning about superfluous response.WriteHeader
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=owner-public-key.pem")
+	http.ServeFile(w, r, ownerPublicKeyFileName(deviceOrgId, user, keyName))
+}
+
+//============= POST /api/orgs/{org-id}/keys/import =============
+// Imports an existing owner key: private keys and their certificates (created by the customer's own tooling), as PEM or PKCS#12.
+// Each key pair must be rsa 2048, ecdsa P-256, or ecdsa P-384 (at most 1 of each), and the private key must match its certificate.
+// The body contains private keys, so it is only accepted over https (unless SDO_ALLOW_KEY_IMPORT_OVER_HTTP=true), and it is never logged. Returns the public keys, like POST /api/orgs/{org-id}/keys.
+func postImportKeyPairsHandler(orgId string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("POST /api/orgs/%s/keys/import ...", orgId)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, exUser, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
+	user := exUser.Name
 
-	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
-		http.Error(w, "Error: This API only supports json.", httpErr.Code)
+	if r.TLS == nil && !AllowKeyImportOverHttp {
+		http.Error(w, "Error: private keys can only be imported over https. Configure the ocs-api with a certificate (see SDO_API_CERT_PATH), or if a proxy in front of it terminates TLS, set SDO_ALLOW_KEY_IMPORT_OVER_HTTP=true.", http.StatusBadRequest)
 		return
 	}
 
-	// Struct for json form containing key pair information
-	type Information struct {
-		Key_name     string `json:"key_name"`
-		Common_name  string `json:"common_name"`
-		Email_name   string `json:"email_name"`
-		Company_name string `json:"company_name"`
-		Country_name string `json:"country_name"`
-		State_name   string `json:"state_name"`
-		Locale_name  string `json:"locale_name"`
+	keyName, keyPairs, httpErr := readOwnerKeyImportInput(r)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
 	}
 
-	info := Information{}
-	// Parse the request body
-	if httpErr := outils.ReadJsonBody(r, &info); httpErr != nil {
+	outils.Verbose("Importing owner key %s of user %s/%s with %d key pairs ...", keyName, deviceOrgId, user, len(keyPairs))
+	// Using mutex so only 1 client writes to the keystore at a time
+	KeyImportLock.Lock()
+	httpErr = addOwnerKey(deviceOrgId, user, keyName, keyPairs)
+	KeyImportLock.Unlock()
+	if httpErr != nil {
 		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
 	}
 
-	// Key name must not contain any characters that cant be stored in a file name.
-	// Also can't allow underscores - since orgs can also have them, it could result in 2 different combos of org and key name having the same private key alias
-	var isStringAlphabetic = regexp.MustCompile(`^[a-z0-9\-]*$`).MatchString
-	if !isStringAlphabetic(info.Key_name) {
-		http.Error(w, "Key Name can only contain lowercase characters, numbers, and hyphens.", http.StatusBadRequest)
+	w.WriteHeader(http.StatusCreated) // http.ServeFile() sets the code to StatusOK so you'll see a warning about superfluous response.WriteHeader
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=owner-public-key.pem")
+	http.ServeFile(w, r, ownerPublicKeyFileName(deviceOrgId, user, keyName))
+}
+
+//============= POST /api/orgs/{org-id}/keys/{key-name}/rotate =============
+// Creates a new owner key (the body is the same as POST /api/orgs/{org-id}/keys) and marks this key as retiring, replaced by the new key.
+// The retiring key can still be used by the OCS for the vouchers already imported, but new vouchers signed over to it are rejected.
+// Returns the public keys of the new key. Only org admins can do this.
+func postRotateKeyHandler(orgId, keyName string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("POST /api/orgs/%s/keys/%s/rotate ...", orgId, keyName)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, exUser, ok := authorizedUser(w, r)
+	if !ok {
 		return
 	}
 
-	if len(info.Country_name) > 2 {
-		http.Error(w, "Country name must be a 2 Letter Country Code.", http.StatusBadRequest)
+	if !canManageOwnerKey(exUser) {
+		http.Error(w, "only an admin of org "+deviceOrgId+" can rotate owner keys", http.StatusForbidden)
 		return
 	}
 
-	// Run the script that will create and import the key pairs
-	// for dev/test they can specify the url param expired=true to create an already expired key
-	runCmdOpts := outils.RunCmdOpts{}
-	expired, ok := r.URL.Query()["expired"]
-	if ok && len(expired) > 0 && expired[0] == "true" {
-		runCmdOpts.Environ = append(runCmdOpts.Environ, "CREATE_EXPIRED_KEY=true")
-		//os.Setenv("CREATE_EXPIRED_KEY", "true") // can't do this, because it will set it persistently for all threads serving clients
-		fmt.Printf("Creating expired test key %s ...\n", strings.ToLower(deviceOrgId+"_"+info.Key_name))
-	}
-	outils.Verbose("Running command: ./import-owner-private-keys2.sh %s %s %s %s %s %s %s %s %s", deviceOrgId, info.Key_name, info.Common_name, info.Email_name, info.Company_name, info.Country_name, info.State_name, info.Locale_name, user)
-	// Using mutex so only 1 instance of the script writes to the keystore at a time
+	// Verify the key being rotated is in the db
+	KeyImportLock.RLock()
+	user, httpErr := findOwnerKeyUser(deviceOrgId, keyName)
+	KeyImportLock.RUnlock()
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if user == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	newKeyName, subject, httpErr := readOwnerKeyInput(r, deviceOrgId)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// Create the new key (it belongs to the same user as the old key) and retire the old one, under the same lock so 2 clients can not
+	// rotate the same key at the same time
+	outils.Verbose("Rotating owner key %s of user %s/%s to new key %s ...", keyName, deviceOrgId, user, newKeyName)
 	KeyImportLock.Lock()
-	stdOut, stdErr, err := outils.RunCmd(runCmdOpts, "./import-owner-private-keys2.sh", deviceOrgId, info.Key_name, info.Common_name, info.Email_name, info.Company_name, info.Country_name, info.State_name, info.Locale_name, user)
-	KeyImportLock.Unlock()
-	if err != nil {
-		http.Error(w, "error running import-owner-private-keys2.sh: "+err.Error(), http.StatusBadRequest) // this includes stdErr
+	defer KeyImportLock.Unlock()
+	states, httpErr := readOwnerKeyStates()
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
 		return
-	} else {
-		if len(stdErr) > 0 { // with shell scripts there can be error msgs in stderr even though the exit code was 0
-			outils.Verbose("stderr from import-owner-private-keys2.sh: %s", string(stdErr))
+	}
+	if state := getOwnerKeyState(states, deviceOrgId, keyName); state.Status == OwnerKeyStatusRetiring {
+		http.Error(w, "owner key "+keyName+" is already retiring, replaced by "+state.ReplacedBy, http.StatusConflict)
+		return
+	}
+	if httpErr := createOwnerKey(deviceOrgId, user, newKeyName, subject, false); httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if httpErr := retireOwnerKey(deviceOrgId, keyName, newKeyName); httpErr != nil {
+		// Remove the new key, so the rotation can be tried again with the same new key name
+		if delErr := deleteOwnerKey(deviceOrgId, user, newKeyName); delErr != nil {
+			outils.Error("could not delete new owner key %s of user %s/%s after retiring key %s failed: %s", newKeyName, deviceOrgId, user, keyName, delErr.Error())
 		}
-		outils.Verbose(string(stdOut))
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
 	}
 
-	pubKeyDirName := OcsDbDir + "/v1/creds/publicKeys/" + deviceOrgId + "/" + user
-	fileName := strings.ToLower(deviceOrgId+"_"+info.Key_name) + "_public-key.pem" // need to make the file name lowercase, because the script did
-
 	w.WriteHeader(http.StatusCreated) // http.ServeFile() sets the code to StatusOK so you'll see a warning about superfluous response.WriteHeader
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", "attachment; filename=owner-public-key.pem")
-	http.ServeFile(w, r, pubKeyDirName+"/"+fileName)
+	http.ServeFile(w, r, ownerPublicKeyFileName(deviceOrgId, user, newKeyName))
+}
+
+//============= GET /api/orgs/{org-id}/keys/{key-name}/vouchers =============
+// Returns the imported vouchers that still depend on this key: they are signed over to it and their devices have not been onboarded yet
+func getKeyVouchersHandler(orgId, keyName string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("GET /api/orgs/%s/keys/%s/vouchers ...", orgId, keyName)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, _, ok := authorizedUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Verify key file is in the db (every user of the org can read this for all of the org's keys)
+	KeyImportLock.RLock()
+	keyUser, httpErr := findOwnerKeyUser(deviceOrgId, keyName)
+	var states map[string]*OwnerKeyState
+	if httpErr == nil && keyUser != "" {
+		states, httpErr = readOwnerKeyStates()
+	}
+	KeyImportLock.RUnlock()
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if keyUser == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	state := getOwnerKeyState(states, deviceOrgId, keyName)
+	vouchers, httpErr := getKeyDependentVouchers(deviceOrgId, keyName)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	respBody := KeyDependentVouchers{Name: strings.ToLower(keyName), Status: state.Status, ReplacedBy: state.ReplacedBy, Vouchers: vouchers}
+	outils.WriteJsonResponse(http.StatusOK, w, respBody)
+}
+
+//============= PUT /api/orgs/{org-id}/keys/{key-name}/owner =============
+// Transfers the ownership of the key to another user of the org, e.g. before the user that created it leaves. Only org admins can do this.
+func putKeyOwnerHandler(orgId, keyName string, w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("PUT /api/orgs/%s/keys/%s/owner ...", orgId, keyName)
+
+	// The org of the device and the exchange user were authorized before the handler was called
+	deviceOrgId, exUser, ok := authorizedUser(w, r)
+	if !ok {
+		return
+	}
+	if !canManageOwnerKey(exUser) {
+		http.Error(w, "only an admin of org "+deviceOrgId+" can transfer the ownership of owner keys", http.StatusForbidden)
+		return
+	}
+
+	newOwner, httpErr := readKeyOwnerInput(r, deviceOrgId)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+
+	// The new owner must be a user of the org in the exchange
+	exists, httpErr := outils.ExchangeUserExists(r, ExchangeInternalUrl, ExchangeInternalCertPath, deviceOrgId, newOwner)
+	if httpErr != nil {
+		outils.WriteHttpError(w, httpErr) // includes Retry-After when the exchange is not available
+		return
+	}
+	if !exists {
+		http.Error(w, "user "+deviceOrgId+"/"+newOwner+" does not exist in the exchange", http.StatusBadRequest)
+		return
+	}
+
+	// Using mutex so only 1 client changes the owner key files at a time
+	KeyImportLock.Lock()
+	defer KeyImportLock.Unlock()
+	keyUser, httpErr := findOwnerKeyUser(deviceOrgId, keyName)
+	if httpErr != nil {
+		http.Error(w, httpErr.Error(), httpErr.Code)
+		return
+	}
+	if keyUser == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if keyUser != newOwner {
+		outils.Verbose("Transferring owner key %s of org %s from user %s to user %s ...", keyName, deviceOrgId, keyUser, newOwner)
+		if httpErr := transferOwnerKey(deviceOrgId, keyName, keyUser, newOwner); httpErr != nil {
+			http.Error(w, httpErr.Error(), httpErr.Code)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 //============= Non-Route Functions =============
@@ -689,21 +1098,22 @@ func getDeviceOrgId(orgId string, r *http.Request) (string, *outils.HttpError) {
 	/* Get the orgid this device should be put in. It can come from several places (in precedence order):
 	- they ran a route that includes the org id (and is passed to this function as orgId)
 	- they explicitly specify the org in the url param: ?orgid=<org>
-	- if the creds are NOT in the root org, use the cred org
+	- if the creds are NOT in the root org, use the cred org (bearer tokens don't have an org)
 	*/
 	if orgId != "" {
 		return orgId, nil
 	}
 
-	orgAndUser, _, ok := r.BasicAuth()
-	if !ok {
-		return "", outils.NewHttpError(http.StatusUnauthorized, "invalid exchange credentials provided")
-	}
-	parts := strings.Split(orgAndUser, "/")
-	if len(parts) != 2 {
+	credOrgId := ""
+	if orgAndUser, _, ok := r.BasicAuth(); ok {
+		parts := strings.Split(orgAndUser, "/")
+		if len(parts) != 2 {
+			return "", outils.NewHttpError(http.StatusUnauthorized, "invalid exchange credentials provided")
+		}
+		credOrgId = parts[0]
+	} else if _, ok := outils.GetBearerToken(r); !ok {
 		return "", outils.NewHttpError(http.StatusUnauthorized, "invalid exchange credentials provided")
 	}
-	credOrgId := parts[0]
 
 	deviceOrgId := ""
 	orgidParams, ok := r.URL.Query()["orgid"]
@@ -713,7 +1123,9 @@ func getDeviceOrgId(orgId string, r *http.Request) (string, *outils.HttpError) {
 		deviceOrgId = credOrgId
 	}
 
-	if deviceOrgId == "" {
+	if deviceOrgId == "" && credOrgId == "" {
+		return "", outils.NewHttpError(http.StatusBadRequest, "if using a bearer token, you must explicitly specify the org id via the ?orgid=<org-id> URL query parameter")
+	} else if deviceOrgId == "" {
 		return "", outils.NewHttpError(http.StatusBadRequest, "if using the exchange root user, you must explicitly specify the org id via the ?orgid=<org-id> URL query parameter")
 	}
 	return deviceOrgId, nil
@@ -738,6 +1150,218 @@ func getOrgidTxtStr(deviceId string) (string, *outils.HttpError) {
 	return orgidTxtStr, nil
 }
 
+// The public key file of 1 owner key
+type OwnerKeyFile struct {
+	Name     string // the key name, without the org prefix
+	User     string // the user that owns the key: the user that created it, or the user it was transferred to
+	PemBytes []byte // the public keys of the key pair, concatenated together
+	State    OwnerKeyState
+}
+
+// Read all of the owner public keys of this org (created by POST /api/orgs/{org-id}/keys)
+func getOrgOwnerKeys(orgId string) ([]OwnerKeyFile, *outils.HttpError) {
+	keys := []OwnerKeyFile{}
+	pubKeyDirName := OcsDbDir + "/v1/creds/publicKeys/" + orgId
+	if !outils.PathExists(pubKeyDirName) {
+		return keys, nil // no keys have been created in this org yet
+	}
+
+	// using read mutex so no other client can change the keys while we are reading them
+	KeyImportLock.RLock()
+	defer KeyImportLock.RUnlock()
+	states, httpErr := readOwnerKeyStates()
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	userDirs, err := ioutil.ReadDir(filepath.Clean(pubKeyDirName))
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading "+pubKeyDirName+" directory: "+err.Error())
+	}
+	for _, u := range userDirs {
+		if !u.IsDir() {
+			continue
+		}
+		uDir := pubKeyDirName + "/" + u.Name()
+		keyFiles, err := ioutil.ReadDir(filepath.Clean(uDir))
+		if err != nil {
+			return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading "+uDir+" directory: "+err.Error())
+		}
+		for _, f := range keyFiles {
+			if f.IsDir() || !strings.HasSuffix(f.Name(), "_public-key.pem") {
+				continue
+			}
+			pemBytes, err := ioutil.ReadFile(filepath.Clean(uDir + "/" + f.Name()))
+			if err != nil {
+				return nil, outils.NewHttpError(http.StatusInternalServerError, "Error reading "+uDir+"/"+f.Name()+": "+err.Error())
+			}
+			keyName := strings.TrimPrefix(strings.TrimSuffix(f.Name(), "_public-key.pem"), strings.ToLower(orgId)+"_")
+			keys = append(keys, OwnerKeyFile{Name: keyName, User: u.Name(), PemBytes: pemBytes, State: getOwnerKeyState(states, orgId, keyName)})
+		}
+	}
+	return keys, nil
+}
+
+// Parse and validate the voucher, and create all of the OCS db files for the device, including the optional per-device service info.
+// Returns the device uuid and its node token. Returns a ValidationError if the voucher is invalid (e.g. truncated or tampered with)
+// or not signed over to one of the org's owner keys. The node is pre-registered in the exchange (with the client's creds in r), if requested.
+// (This can be called again for an existing voucher and will update/overwrite.)
+func importVoucher(r *http.Request, deviceOrgId, user string, voucherBytes []byte, serviceInfo *DeviceServiceInfo, orgKeys []OwnerKeyFile) (string, string, *voucher.ValidationError, *outils.HttpError) {
+	// Parse/validate the voucher. A voucher that is truncated or was tampered with is rejected here, instead of failing when the device runs TO2.
+	ownerVoucher, vErr := voucher.Parse(voucherBytes)
+	if vErr != nil {
+		outils.Verbose("POST /api/orgs/%s/vouchers: %s", deviceOrgId, vErr.Error())
+		return "", "", vErr, nil
+	}
+	uuid := ownerVoucher.Header.Guid
+	outils.Verbose("POST /api/orgs/%s/vouchers: device UUID: %s", deviceOrgId, uuid.String())
+
+	// Verify the voucher was signed over to one of this org's owner keys, otherwise the device would not be able to run TO2 with us
+	ownerKey := ownerVoucher.OwnerPublicKey()
+	matchingKey := findOwnerKey(ownerKey, orgKeys)
+	if matchingKey == nil {
+		ownerKeyField := fmt.Sprintf("en[%d].bo.pk", len(ownerVoucher.Entries)-1)
+		if !ownerKey.MatchesPem([]byte(data.SampleOwnerPublicKey)) {
+			return "", "", &voucher.ValidationError{Field: ownerKeyField, Message: "the voucher is signed over to " + ownerKey.String() + ", which is not one of the owner keys of org " + deviceOrgId}, nil
+		} else if !AllowSampleOwnerKey {
+			return "", "", &voucher.ValidationError{Field: ownerKeyField, Message: "the voucher is signed over to the sample owner key (" + ownerKey.String() + "), which is only accepted when SDO_ALLOW_SAMPLE_OWNER_KEY=true"}, nil
+		}
+		outils.Verbose("POST /api/orgs/%s/vouchers: voucher is signed over to the sample owner key", deviceOrgId)
+	} else {
+		outils.Verbose("POST /api/orgs/%s/vouchers: voucher is signed over to owner key %s of user %s", deviceOrgId, matchingKey.Name, matchingKey.User)
+		// A retiring key is only kept for the vouchers that were already imported, so only allow importing them again
+		if matchingKey.State.Status == OwnerKeyStatusRetiring {
+			if rec := Devices.Get(uuid.String()); rec == nil || rec.Orgid != deviceOrgId || rec.OwnerKey != matchingKey.Name {
+				ownerKeyField := fmt.Sprintf("en[%d].bo.pk", len(ownerVoucher.Entries)-1)
+				return "", "", &voucher.ValidationError{Field: ownerKeyField, Message: "the voucher is signed over to owner key " + matchingKey.Name + ", which is retiring (replaced by " + matchingKey.State.ReplacedBy + "). Have the voucher signed over to " + matchingKey.State.ReplacedBy + " instead"}, nil
+			}
+		}
+	}
+
+	// Generate a node token
+	nodeToken, httpErr := outils.GenerateNodeToken(NodeTokenPolicy)
+	if httpErr != nil {
+		return "", "", nil, httpErr
+	}
+
+	// Create the node in the exchange before any of the OCS db files of the device are changed, so if that fails the device is left
+	// as it was (and the device can't onboard with a token the exchange doesn't know)
+	preregistered := false
+	if shouldPreregisterNode(serviceInfo) {
+		if httpErr := checkNodeCanBeRegistered(r, deviceOrgId, uuid.String()); httpErr != nil {
+			return "", "", nil, httpErr
+		}
+		if httpErr := preregisterNode(r, deviceOrgId, uuid.String(), nodeToken, serviceInfo); httpErr != nil {
+			return "", "", nil, httpErr
+		}
+		preregistered = true
+	}
+
+	if httpErr := writeDeviceDbFiles(deviceOrgId, uuid.String(), voucherBytes, serviceInfo); httpErr != nil {
+		if preregistered {
+			unregisterNode(r, deviceOrgId, uuid.String())
+		}
+		return "", "", nil, httpErr
+	}
+
+	// Create exec file. The agent-install.sh options are in the manifest, so only the node auth is passed here.
+	outils.Verbose("POST /api/orgs/%s/vouchers: creating the exec file ...", deviceOrgId)
+	nodeTokenLock.Lock()
+	defer nodeTokenLock.Unlock()
+	if httpErr := writeDeviceExecFile(uuid.String(), nodeToken); httpErr != nil {
+		if preregistered {
+			unregisterNode(r, deviceOrgId, uuid.String())
+		}
+		return "", "", nil, httpErr
+	}
+
+	// Record the device in the index, now that all of the OCS db files exist
+	now := time.Now().UTC()
+	rec := DeviceRecord{DeviceUuid: uuid.String(), Orgid: deviceOrgId, ImportedAt: now.Format(ocsTimestampDisplayFormat), ImportedBy: user, NodeTokenHash: hashNodeToken(nodeToken), NodeTokenIssuedAt: now.Format(nodeTokenTimestampFormat), ExchangeNode: preregistered}
+	if matchingKey != nil {
+		rec.OwnerKey = matchingKey.Name
+	}
+	if httpErr := Devices.Put(rec); httpErr != nil {
+		if preregistered {
+			unregisterNode(r, deviceOrgId, uuid.String())
+		}
+		return "", "", nil, httpErr
+	}
+
+	return uuid.String(), nodeToken, nil, nil
+}
+
+// Create the OCS db files of the device (except the exec file): voucher.json, svi.json and its per-device value files, psi.json, and
+// orgid.txt. The state.json and value files of a previous import of the device are removed.
+func writeDeviceDbFiles(deviceOrgId, deviceUuid string, voucherBytes []byte, serviceInfo *DeviceServiceInfo) *outils.HttpError {
+	valuesDir := OcsDbDir + "/v1/values"
+
+	// Create the device directory in the OCS DB
+	deviceDir := OcsDbDir + "/v1/devices/" + deviceUuid
+	if err := os.MkdirAll(deviceDir, 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory "+deviceDir+": "+err.Error())
+	}
+
+	// Remove the state.json file, in case this voucher was previously imported. This allows to0 to be run again (register it with RV)
+	fileName := deviceDir + "/state.json"
+	outils.Verbose("POST /api/orgs/%s/vouchers: removing %s (if exists) ...", deviceOrgId, fileName)
+	if err := os.RemoveAll(filepath.Clean(fileName)); err != nil { // RemoveAll does NOT return an error if fileName doesn't exist
+		return outils.NewHttpError(http.StatusInternalServerError, "could not remove "+fileName+": "+err.Error())
+	}
+
+	// Put the voucher in the OCS DB
+	fileName = deviceDir + "/voucher.json"
+	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
+	if err := ioutil.WriteFile(filepath.Clean(fileName), voucherBytes, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+	}
+
+	// Remove the per-device value files of a previous import, so files that are no longer in the service info are not left behind
+	if httpErr := removeDeviceValueFiles(deviceUuid); httpErr != nil {
+		return httpErr
+	}
+
+	// Create the device download file (svi.json), its per-device value files, and psi.json
+	fileEntries, msgEntries, valueFiles, httpErr := serviceInfo.sviEntries(deviceUuid)
+	if httpErr != nil {
+		return httpErr
+	}
+	manifestEntries, manifestValueFiles, httpErr := newAgentInstallManifest(deviceOrgId, serviceInfo).sviEntries(deviceUuid)
+	if httpErr != nil {
+		return httpErr
+	}
+	fileEntries = append(fileEntries, manifestEntries...)
+	valueFiles = append(valueFiles, manifestValueFiles...)
+	if httpErr := writeDeviceValueFiles(valueFiles); httpErr != nil {
+		return httpErr
+	}
+	fileName = deviceDir + "/svi.json"
+	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
+	sviJson, httpErr := makeSviJson(deviceUuid, outils.PathExists(valuesDir+"/agent-install.crt"), fileEntries, msgEntries)
+	if httpErr != nil {
+		return httpErr
+	}
+	if err := ioutil.WriteFile(filepath.Clean(fileName), sviJson, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+	}
+	fileName = deviceDir + "/psi.json"
+	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s ...", deviceOrgId, fileName)
+	psiJson, err := data.BuildPsi(data.NewDevicePsiEntries())
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error building psi.json: "+err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Clean(fileName), psiJson, 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+	}
+
+	// Create orgid.txt file to identify what org this device/voucher is part of
+	fileName = deviceDir + "/orgid.txt"
+	outils.Verbose("POST /api/orgs/%s/vouchers: creating %s with value: %s ...", deviceOrgId, fileName, deviceOrgId)
+	if err := ioutil.WriteFile(filepath.Clean(fileName), []byte(deviceOrgId), 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+	}
+	return nil
+}
+
 // Create the common (not device specific) config files. Called during startup.
 func createConfigFiles() *outils.HttpError {
 	// These env vars are required
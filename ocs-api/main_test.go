@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDeleteVoucher(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+
+	for _, test := range []struct {
+		name, path, user string
+		code             int
+	}{
+		{"voucher that does not exist", "/api/orgs/myorg/vouchers/" + uuid.New().String(), "myorg/admin", http.StatusNotFound},
+		{"invalid device id", "/api/orgs/myorg/vouchers/not-a-uuid", "myorg/admin", http.StatusBadRequest},
+		{"voucher of another org", "/api/orgs/other/vouchers/" + deviceUuid, "other/eve", http.StatusForbidden},
+		{"voucher", "/api/orgs/myorg/vouchers/" + deviceUuid, "myorg/admin", http.StatusNoContent},
+		{"voucher that was already deleted", "/api/orgs/myorg/vouchers/" + deviceUuid, "myorg/admin", http.StatusNotFound},
+	} {
+		if w := testRequest(t, api, http.MethodDelete, test.path, test.user, "", nil); w.Code != test.code {
+			t.Errorf("delete %s: got %d %s, expected %d", test.name, w.Code, w.Body.String(), test.code)
+		}
+	}
+	if _, err := os.Stat(OcsDbDir + "/v1/devices/" + deviceUuid); !os.IsNotExist(err) {
+		t.Errorf("the device dir was not removed: %v", err)
+	}
+	if _, err := os.Stat(OcsDbDir + "/v1/values/" + deviceUuid + "_exec"); !os.IsNotExist(err) {
+		t.Errorf("the exec file was not removed: %v", err)
+	}
+	if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers/"+deviceUuid, "myorg/admin", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("get the deleted voucher: got %d %s, expected 404", w.Code, w.Body.String())
+	}
+}
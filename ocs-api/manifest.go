@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/open-horizon/SDO-support/ocs-api/data"
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+The per-device manifest that tells agent-install-wrapper.sh how to run agent-install.sh. It is sent to the device as a file before
+agent-install-wrapper.sh is run, so the exec cmd only has to pass the manifest file name and the node auth:
+	/bin/sh agent-install-wrapper.sh -m agent-install.manifest -a <device-uuid>:<node-token>
+The manifest is lines of KEY='value' that the wrapper sources. To add an installer option, add it to AgentInstallManifest and
+manifestEntries(), and handle it in agent-install-wrapper.sh. (The node token is not in the manifest, so it only has to be
+changed in the exec file.)
+*/
+
+const (
+	AgentInstallManifestFileName = "agent-install.manifest"
+	AgentInstallManifestVersion  = "1"
+)
+
+// The options of agent-install.sh for 1 device
+type AgentInstallManifest struct {
+	PkgsFrom    string // agent-install.sh -i
+	OrgId       string // agent-install.sh -O
+	CfgFileFrom string // agent-install.sh -k
+	NodePolicy  string // agent-install.sh -n: the file name of the node policy on the device
+	Pattern     string // agent-install.sh -p
+}
+
+type manifestEntry struct {
+	key      string
+	value    string
+	required bool
+}
+
+// Create the manifest for this device from the common config and the device's service info
+func newAgentInstallManifest(deviceOrgId string, serviceInfo *DeviceServiceInfo) *AgentInstallManifest {
+	manifest := &AgentInstallManifest{PkgsFrom: PkgsFrom, OrgId: deviceOrgId, CfgFileFrom: CfgFileFrom}
+	if serviceInfo != nil {
+		if serviceInfo.NodePolicy != nil {
+			manifest.NodePolicy = NodePolicyFileName
+		}
+		manifest.Pattern = serviceInfo.Pattern
+	}
+	return manifest
+}
+
+// The keys and values of the manifest, in the order they are written
+func (m *AgentInstallManifest) manifestEntries() []manifestEntry {
+	return []manifestEntry{
+		{key: "SDO_MANIFEST_VERSION", value: AgentInstallManifestVersion, required: true},
+		{key: "SDO_PKGS_FROM", value: m.PkgsFrom, required: true},
+		{key: "SDO_ORG_ID", value: m.OrgId, required: true},
+		{key: "SDO_CFG_FILE_FROM", value: m.CfgFileFrom, required: true},
+		{key: "SDO_NODE_POLICY", value: m.NodePolicy},
+		{key: "SDO_PATTERN", value: m.Pattern},
+	}
+}
+
+// Verify the manifest is something agent-install-wrapper.sh can handle
+func (m *AgentInstallManifest) Validate() *outils.HttpError {
+	for _, e := range m.manifestEntries() {
+		if e.required && e.value == "" {
+			return outils.NewHttpError(http.StatusInternalServerError, "agent-install manifest value "+e.key+" must be set")
+		}
+		if strings.IndexFunc(e.value, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+			return outils.NewHttpError(http.StatusBadRequest, "agent-install manifest value "+e.key+" must not contain control characters")
+		}
+	}
+	if m.NodePolicy != "" && m.Pattern != "" {
+		return outils.NewHttpError(http.StatusBadRequest, "only 1 of a node policy and a pattern can be specified")
+	}
+	if m.NodePolicy != "" && !serviceInfoFileNameRegex.MatchString(m.NodePolicy) {
+		return outils.NewHttpError(http.StatusBadRequest, "the node policy file name "+m.NodePolicy+" is invalid")
+	}
+	if m.Pattern != "" && !patternRegex.MatchString(m.Pattern) {
+		return outils.NewHttpError(http.StatusBadRequest, "pattern must be a pattern name or <org>/<pattern-name>, without spaces")
+	}
+	return nil
+}
+
+// Validate the manifest and return the content of the manifest file
+func (m *AgentInstallManifest) Marshal() ([]byte, *outils.HttpError) {
+	if httpErr := m.Validate(); httpErr != nil {
+		return nil, httpErr
+	}
+	var sb strings.Builder
+	for _, e := range m.manifestEntries() {
+		if e.value != "" {
+			sb.WriteString(e.key + "=" + shellQuote(e.value) + "\n")
+		}
+	}
+	return []byte(sb.String()), nil
+}
+
+// The svi entries and value files that send the manifest to the device
+func (m *AgentInstallManifest) sviEntries(deviceUuid string) ([]data.SviEntry, []sviValueFile, *outils.HttpError) {
+	manifestBytes, httpErr := m.Marshal()
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+	nameValueId := deviceUuid + "_manifest_name"
+	contentValueId := deviceUuid + "_manifest"
+	valueFiles := []sviValueFile{{valueId: nameValueId, value: []byte(AgentInstallManifestFileName)}, {valueId: contentValueId, value: manifestBytes}}
+	return data.NewSviFileEntries(nameValueId, contentValueId), valueFiles, nil
+}
+
+// The exec cmd of the device, which runs agent-install-wrapper.sh with the manifest
+func makeAgentInstallExecCmd(deviceUuid, nodeToken string) string {
+	return outils.MakeExecCmd("/bin/sh agent-install-wrapper.sh -m " + AgentInstallManifestFileName + " -a " + deviceUuid + ":" + nodeToken)
+}
+
+// Quote the value so the shell uses it literally
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
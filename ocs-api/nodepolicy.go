@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+The node policy or pattern a device should register with, which can be sent with a voucher import (see DeviceServiceInfo). The node
+policy is sent to the device as a file and agent-install-wrapper.sh passes it to agent-install.sh -n. The pattern is passed to
+agent-install.sh -p. Both are given to agent-install-wrapper.sh in the device's manifest (see manifest.go).
+*/
+
+// The file name of the node policy on the device
+const NodePolicyFileName = "node.policy.json"
+
+// Pattern names are passed as an arg of the exec cmd, which is split on spaces, so they must not contain any
+var patternRegex = regexp.MustCompile(`^([^\s/]+/)?[^\s/]+$`)
+
+// A horizon node policy, the same as the input of: hzn policy update -f
+type NodePolicy struct {
+	Properties  []NodePolicyProperty `json:"properties,omitempty"`
+	Constraints []string             `json:"constraints,omitempty"`
+	Deployment  *NodePolicySection   `json:"deployment,omitempty"`
+	Management  *NodePolicySection   `json:"management,omitempty"`
+}
+
+type NodePolicySection struct {
+	Properties  []NodePolicyProperty `json:"properties,omitempty"`
+	Constraints []string             `json:"constraints,omitempty"`
+}
+
+type NodePolicyProperty struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+	Type  string      `json:"type,omitempty"`
+}
+
+// The node policy is decoded strictly, so a typo in a field name is reported instead of the device registering with the wrong policy
+func (np *NodePolicy) UnmarshalJSON(policyBytes []byte) error {
+	type nodePolicyFields NodePolicy // so Decode doesn't call this method again
+	decoder := json.NewDecoder(bytes.NewReader(policyBytes))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*nodePolicyFields)(np))
+}
+
+func (np *NodePolicy) validate() *outils.HttpError {
+	prefixes := []string{"", "deployment.", "management."}
+	sections := []*NodePolicySection{{Properties: np.Properties, Constraints: np.Constraints}, np.Deployment, np.Management}
+	for j, section := range sections {
+		if section == nil {
+			continue
+		}
+		prefix := prefixes[j]
+		for i, prop := range section.Properties {
+			if prop.Name == "" {
+				return outils.NewHttpError(http.StatusBadRequest, "nodePolicy.%sproperties[%d].name must be set", prefix, i)
+			}
+		}
+		for i, constraint := range section.Constraints {
+			if constraint == "" {
+				return outils.NewHttpError(http.StatusBadRequest, "nodePolicy.%sconstraints[%d] must not be empty", prefix, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate the node policy and pattern of the device service info
+func (si *DeviceServiceInfo) validateNodePolicy() *outils.HttpError {
+	if si.NodePolicy != nil && si.Pattern != "" {
+		return outils.NewHttpError(http.StatusBadRequest, "only 1 of nodePolicy and pattern can be specified")
+	}
+	if si.Pattern != "" && !patternRegex.MatchString(si.Pattern) {
+		return outils.NewHttpError(http.StatusBadRequest, "pattern must be a pattern name or <org>/<pattern-name>, without spaces")
+	}
+	if si.NodePolicy != nil {
+		return si.NodePolicy.validate()
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/data"
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+The node token of a device is only stored in its exec value file (v1/values/<device-uuid>_exec), which is sent to the device to
+run agent-install-wrapper.sh, and as a hash in the device index. Rotating the token rewrites only the exec file, so the rest of the
+device's OCS db files (including state.json) are not changed.
+
+The OCS reads the exec file as is and sends it to the device, so it can not be encrypted at rest. Instead the token is only kept
+while it is needed: once state.json shows TO2 finished after the token was generated, the token is purged from the exec file (unless
+SDO_PURGE_NODE_TOKENS=false).
+The exec file is kept, so the OCS can still find it, but agent-install-wrapper.sh will report that the token was purged. To onboard
+the device again, generate a new token with POST /api/orgs/{org-id}/vouchers/{device-id}/token.
+*/
+
+// The format of NodeTokenIssuedAt. It keeps the fractional seconds, so a token rotated in the same second that TO2 finished is not purged.
+const nodeTokenTimestampFormat = time.RFC3339Nano
+
+// Serializes the changes to the exec files and their index records, so the purger does not overwrite a new token of an import or rotation
+var nodeTokenLock sync.Mutex
+
+// Write the exec value file of the device, with this node token. The file is replaced atomically, in case the device is reading it.
+func writeDeviceExecFile(deviceUuid, nodeToken string) *outils.HttpError {
+	execCmd, httpErr := makeDeviceExecCmd(deviceUuid, nodeToken)
+	if httpErr != nil {
+		return httpErr
+	}
+	fileName := OcsDbDir + "/v1/values/" + deviceUuid + "_exec"
+	tmpFileName := fileName + ".tmp"
+	// Readable by all, like the other value files, because the OCS may run as a different user than the ocs-api
+	if err := ioutil.WriteFile(filepath.Clean(tmpFileName), []byte(execCmd), 0644); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create "+tmpFileName+": "+err.Error())
+	}
+	if err := os.Rename(filepath.Clean(tmpFileName), filepath.Clean(fileName)); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not rename "+tmpFileName+" to "+fileName+": "+err.Error())
+	}
+	return nil
+}
+
+// The exec cmd of the device with this node token. The voucher of a device imported by an older version of the ocs-api has no
+// manifest in its svi.json, so its exec cmd passes all of the agent-install.sh args to agent-install-wrapper.sh instead. For those
+// devices only the node token of the existing exec file is replaced, because the rest of the args are not recorded anywhere else.
+func makeDeviceExecCmd(deviceUuid, nodeToken string) (string, *outils.HttpError) {
+	hasManifest, httpErr := deviceHasManifest(deviceUuid)
+	if httpErr != nil {
+		return "", httpErr
+	}
+	if hasManifest {
+		return makeAgentInstallExecCmd(deviceUuid, nodeToken), nil
+	}
+
+	fileName := OcsDbDir + "/v1/values/" + deviceUuid + "_exec"
+	execBytes, err := ioutil.ReadFile(filepath.Clean(fileName))
+	if err != nil {
+		return "", outils.NewHttpError(http.StatusInternalServerError, "could not read "+fileName+": "+err.Error())
+	}
+	// The exec file is the null separated args of agent-install-wrapper.sh, and the -a arg is <device-uuid>:<node-token>
+	args := strings.Split(string(execBytes), "\x00")
+	for i, arg := range args {
+		if arg == "-a" && i+1 < len(args) {
+			args[i+1] = deviceUuid + ":" + nodeToken
+			return strings.Join(args, "\x00"), nil
+		}
+	}
+	return "", outils.NewHttpError(http.StatusInternalServerError, fileName+" does not have the -a argument of agent-install-wrapper.sh")
+}
+
+// Whether the svi.json of the device sends the agent-install manifest to it
+func deviceHasManifest(deviceUuid string) (bool, *outils.HttpError) {
+	fileName := OcsDbDir + "/v1/devices/" + deviceUuid + "/svi.json"
+	sviBytes, err := ioutil.ReadFile(filepath.Clean(fileName))
+	if err != nil {
+		return false, outils.NewHttpError(http.StatusInternalServerError, "could not read "+fileName+": "+err.Error())
+	}
+	var entries []data.SviEntry
+	if err := json.Unmarshal(sviBytes, &entries); err != nil {
+		return false, outils.NewHttpError(http.StatusInternalServerError, "could not parse "+fileName+": "+err.Error())
+	}
+	for _, e := range entries {
+		if e.ValueId == deviceUuid+"_manifest" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Generate a new node token for the device and replace the old one. If updateExchange is true, the token of the node in the exchange
+// is changed 1st (with the client's creds in r), so if that fails the device keeps the token the exchange knows.
+func rotateNodeToken(r *http.Request, rec *DeviceRecord, updateExchange bool) (string, *outils.HttpError) {
+	nodeToken, httpErr := outils.GenerateNodeToken(NodeTokenPolicy)
+	if httpErr != nil {
+		return "", httpErr
+	}
+
+	if updateExchange {
+		outils.Verbose("POST /api/orgs/%s/vouchers/%s/token: changing the token of node %s/%s in the exchange ...", rec.Orgid, rec.DeviceUuid, rec.Orgid, rec.DeviceUuid)
+		if httpErr := outils.PatchExchangeNodeToken(r, ExchangeInternalUrl, ExchangeInternalCertPath, rec.Orgid, rec.DeviceUuid, nodeToken); httpErr != nil {
+			return "", httpErr
+		}
+		rec.ExchangeNode = true
+	}
+
+	outils.Verbose("POST /api/orgs/%s/vouchers/%s/token: rewriting the exec file ...", rec.Orgid, rec.DeviceUuid)
+	nodeTokenLock.Lock()
+	defer nodeTokenLock.Unlock()
+	if httpErr := writeDeviceExecFile(rec.DeviceUuid, nodeToken); httpErr != nil {
+		return "", httpErr
+	}
+
+	rec.NodeTokenHash = hashNodeToken(nodeToken)
+	rec.NodeTokenIssuedAt = time.Now().UTC().Format(nodeTokenTimestampFormat)
+	rec.NodeTokenPurgedAt = ""
+	if httpErr := Devices.Put(*rec); httpErr != nil {
+		return "", httpErr
+	}
+	return nodeToken, nil
+}
+
+// If the device has finished TO2, remove its node token from the exec file. Returns true if the token was purged.
+func purgeNodeTokenIfOnboarded(deviceUuid string) (bool, *outils.HttpError) {
+	nodeTokenLock.Lock()
+	defer nodeTokenLock.Unlock()
+	rec := Devices.Get(deviceUuid) // get it again under the lock, in case it was just imported again
+	if rec == nil || !rec.HasNodeToken() {
+		return false, nil
+	}
+	status, httpErr := getDeviceStatus(rec)
+	if httpErr != nil {
+		return false, httpErr
+	}
+	if status.State != DeviceStateOnboarded {
+		return false, nil
+	}
+	// Without the time TO2 finished, we can't tell if the token is the one the device was onboarded with
+	if status.to2Time.IsZero() {
+		outils.Error("not purging the node token of onboarded device %s/%s, because the TO2 timestamp in its state.json (%q) can not be parsed", rec.Orgid, deviceUuid, status.To2UpdatedAt)
+		return false, nil
+	}
+	// If the token was not generated before the device was onboarded, it is for the next time the device is onboarded. (Older
+	// versions of the ocs-api did not record when the token was generated, but then it was generated when the voucher was imported.)
+	if issuedAt, err := time.Parse(time.RFC3339Nano, rec.NodeTokenIssuedAt); err == nil {
+		if !strings.Contains(rec.NodeTokenIssuedAt, ".") {
+			// older versions of the ocs-api recorded it in seconds, so it could be anywhere in that second
+			issuedAt = issuedAt.Add(time.Second - time.Nanosecond)
+		}
+		if !status.to2Time.After(issuedAt) {
+			return false, nil
+		}
+	}
+	// Only purge the token the index record is for, in case the exec file was changed without going thru us
+	if hashNodeToken(readExecNodeToken(deviceUuid)) != rec.NodeTokenHash {
+		outils.Verbose("not purging the node token of device %s/%s, because its exec file has a different token than its index record", rec.Orgid, deviceUuid)
+		return false, nil
+	}
+
+	outils.Verbose("purging the node token of onboarded device %s/%s ...", rec.Orgid, deviceUuid)
+	if httpErr := writeDeviceExecFile(deviceUuid, ""); httpErr != nil {
+		return false, httpErr
+	}
+	rec.NodeTokenHash = ""
+	rec.NodeTokenPurgedAt = time.Now().UTC().Format(ocsTimestampDisplayFormat)
+	if httpErr := Devices.Put(*rec); httpErr != nil {
+		return false, httpErr
+	}
+	return true, nil
+}
+
+// Purge the node tokens of all of the onboarded devices
+func purgeOnboardedNodeTokens() {
+	for _, rec := range Devices.List() {
+		if !rec.HasNodeToken() {
+			continue
+		}
+		if _, httpErr := purgeNodeTokenIfOnboarded(rec.DeviceUuid); httpErr != nil {
+			outils.Error("could not purge the node token of device %s: %s", rec.DeviceUuid, httpErr.Error())
+		}
+	}
+}
+
+// Periodically purge the node tokens of the devices that have been onboarded since the last time
+func startNodeTokenPurger(intervalSecs int) {
+	go func() {
+		for {
+			purgeOnboardedNodeTokens()
+			time.Sleep(time.Duration(intervalSecs) * time.Second)
+		}
+	}()
+}
+
+// The response body of GET /api/orgs/{org-id}/vouchers/{device-id}/token. The token itself is never returned.
+type NodeTokenStatus struct {
+	DeviceUuid        string `json:"deviceUuid"`
+	NodeTokenPresent  bool   `json:"nodeTokenPresent"`
+	NodeTokenPurgedAt string `json:"nodeTokenPurgedAt,omitempty"`
+}
+
+// Report whether the device's node token is still in its exec file
+func getNodeTokenStatus(rec *DeviceRecord) (*NodeTokenStatus, *outils.HttpError) {
+	if PurgeNodeTokens {
+		// So the response is current, instead of as of the last time the purger ran
+		deviceUuid := rec.DeviceUuid
+		if _, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); httpErr != nil {
+			return nil, httpErr
+		}
+		if rec = Devices.Get(deviceUuid); rec == nil {
+			return nil, outils.NewHttpError(http.StatusNotFound, "Voucher "+deviceUuid+" not found")
+		}
+	}
+	return &NodeTokenStatus{DeviceUuid: rec.DeviceUuid, NodeTokenPresent: rec.HasNodeToken(), NodeTokenPurgedAt: rec.NodeTokenPurgedAt}, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+// Write the state.json the OCS writes when TO2 ends
+func writeTestTo2End(t *testing.T, deviceUuid, to2Timestamp string) {
+	t.Helper()
+	state := `{"to2State": "to2end", "to2Timestamp": "` + to2Timestamp + `", "to0Ws": 0}`
+	if err := os.WriteFile(OcsDbDir+"/v1/devices/"+deviceUuid+"/state.json", []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPurgeNodeToken(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+	nodeToken := readExecNodeToken(deviceUuid)
+	if nodeToken == "" {
+		t.Fatal("the exec file has no node token")
+	}
+	if info, err := os.Stat(OcsDbDir + "/v1/values/" + deviceUuid + "_exec"); err != nil || info.Mode().Perm()&0044 != 0044 {
+		t.Errorf("the exec file is %v %v, expected it to be readable by the OCS", info, err)
+	}
+	setIssuedAt := func(issuedAt string) {
+		rec := Devices.Get(deviceUuid)
+		rec.NodeTokenIssuedAt = issuedAt
+		if httpErr := Devices.Put(*rec); httpErr != nil {
+			t.Fatal(httpErr)
+		}
+	}
+
+	// The token was rotated in the same second that TO2 finished, but after it
+	setIssuedAt("2026-03-01T10:00:00.7Z")
+	writeTestTo2End(t, deviceUuid, "2026-03-01T10:00:00.2Z")
+	if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); purged || httpErr != nil {
+		t.Errorf("token issued after TO2 in the same second: purged=%v %v, expected it to be kept", purged, httpErr)
+	}
+
+	// The token is from an older version of the ocs-api, which recorded the issue time in seconds
+	setIssuedAt("2026-03-01T10:00:00Z")
+	if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); purged || httpErr != nil {
+		t.Errorf("token issued in the same second as TO2: purged=%v %v, expected it to be kept", purged, httpErr)
+	}
+
+	// The exec file has a different token than the index record
+	writeTestTo2End(t, deviceUuid, "2026-03-01T10:00:01.5Z")
+	if httpErr := writeDeviceExecFile(deviceUuid, "another-token"); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); purged || httpErr != nil {
+		t.Errorf("exec file with another token: purged=%v %v, expected it to be kept", purged, httpErr)
+	}
+	if readExecNodeToken(deviceUuid) != "another-token" {
+		t.Error("the token of the exec file was changed")
+	}
+
+	// The TO2 timestamp can't be parsed
+	if httpErr := writeDeviceExecFile(deviceUuid, nodeToken); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	for _, to2Timestamp := range []string{"", "not a timestamp"} {
+		writeTestTo2End(t, deviceUuid, to2Timestamp)
+		if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); purged || httpErr != nil {
+			t.Errorf("TO2 timestamp %q: purged=%v %v, expected it to be kept", to2Timestamp, purged, httpErr)
+		}
+	}
+
+	// TO2 finished after the token was issued
+	writeTestTo2End(t, deviceUuid, "2026-03-01T10:00:01.5Z")
+	if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); !purged || httpErr != nil {
+		t.Errorf("token issued before TO2: purged=%v %v, expected it to be purged", purged, httpErr)
+	}
+	if readExecNodeToken(deviceUuid) != "" {
+		t.Error("the exec file still has the node token")
+	}
+	if rec := Devices.Get(deviceUuid); rec.HasNodeToken() || rec.NodeTokenPurgedAt == "" {
+		t.Errorf("device record is %+v, expected the token to be recorded as purged", rec)
+	}
+}
+
+// A device imported by an older version of the ocs-api has no manifest, so rotating its token must keep the args of its exec file
+func TestRotateNodeTokenLegacyExec(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+
+	// Make the OCS db files of the device look like the older version of the ocs-api created them
+	sviJson, httpErr := makeSviJson(deviceUuid, false, nil, nil)
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	if err := os.WriteFile(OcsDbDir+"/v1/devices/"+deviceUuid+"/svi.json", sviJson, 0644); err != nil {
+		t.Fatal(err)
+	}
+	legacyExec := func(nodeToken string) string {
+		return outils.MakeExecCmd("/bin/sh agent-install-wrapper.sh -i https://example.com/pkgs -a " + deviceUuid + ":" + nodeToken + " -O myorg -k agent-install.cfg -p mypattern")
+	}
+	execFileName := OcsDbDir + "/v1/values/" + deviceUuid + "_exec"
+	if err := os.WriteFile(execFileName, []byte(legacyExec(readExecNodeToken(deviceUuid))), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers/"+deviceUuid+"/token", "myorg/admin", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotate: got %d %s, expected 200", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	decodeTestResponse(t, w, &resp)
+	if execBytes, err := os.ReadFile(execFileName); err != nil || string(execBytes) != legacyExec(resp["nodeToken"]) {
+		t.Errorf("exec file is %q %v, expected %q", execBytes, err, legacyExec(resp["nodeToken"]))
+	}
+
+	// Purging the token also keeps the args
+	writeTestTo2End(t, deviceUuid, time.Now().UTC().Add(time.Second).Format(time.RFC3339Nano))
+	if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); !purged || httpErr != nil {
+		t.Fatalf("purge: purged=%v %v, expected it to be purged", purged, httpErr)
+	}
+	if execBytes, err := os.ReadFile(execFileName); err != nil || string(execBytes) != legacyExec("") {
+		t.Errorf("exec file is %q %v, expected %q", execBytes, err, legacyExec(""))
+	}
+}
+
+// Rotating the token of a device whose token was purged restores it, and if the exchange fails the device stays purged
+func TestRotatePurgedNodeToken(t *testing.T) {
+	ex, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+	}
+	writeTestTo2End(t, deviceUuid, time.Now().UTC().Add(time.Second).Format(time.RFC3339Nano))
+	if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); !purged || httpErr != nil {
+		t.Fatalf("purge: purged=%v %v, expected it to be purged", purged, httpErr)
+	}
+	purgedAt := Devices.Get(deviceUuid).NodeTokenPurgedAt
+
+	ex.fail["PATCH /orgs/myorg/nodes/"+deviceUuid] = http.StatusInternalServerError
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers/"+deviceUuid+"/token?updateExchange=true", "myorg/admin", "", nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("rotate with the exchange failing: got %d %s, expected 500", w.Code, w.Body.String())
+	}
+	if rec := Devices.Get(deviceUuid); rec.HasNodeToken() || rec.NodeTokenPurgedAt != purgedAt || readExecNodeToken(deviceUuid) != "" {
+		t.Errorf("device record is %+v, expected the token to still be purged", rec)
+	}
+
+	w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers/"+deviceUuid+"/token", "myorg/admin", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotate: got %d %s, expected 200", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	decodeTestResponse(t, w, &resp)
+	if rec := Devices.Get(deviceUuid); !rec.HasNodeToken() || rec.NodeTokenPurgedAt != "" || readExecNodeToken(deviceUuid) != resp["nodeToken"] {
+		t.Errorf("device record is %+v, expected the new token", rec)
+	}
+	// The new token was generated after TO2 finished, so it is for the next time the device is onboarded
+	writeTestTo2End(t, deviceUuid, time.Now().UTC().Add(-time.Second).Format(time.RFC3339Nano))
+	if purged, httpErr := purgeNodeTokenIfOnboarded(deviceUuid); purged || httpErr != nil {
+		t.Errorf("purge after rotate: purged=%v %v, expected it to be kept", purged, httpErr)
+	}
+}
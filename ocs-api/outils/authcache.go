@@ -0,0 +1,198 @@
+package outils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+/*
+Cache of the results of verifying request credentials with the exchange, so clients that call the API in a loop don't make an exchange
+round trip for every call. The entries are keyed on a hash of the credentials and the org the request is for, so the cache never
+holds the passwords. Concurrent requests with the same credentials share 1 exchange call. The cache is configured with:
+	SDO_API_AUTH_CACHE_TTL: the number of seconds valid credentials are cached. 0 disables the cache. Default is 60.
+	SDO_API_AUTH_CACHE_NEGATIVE_TTL: the number of seconds credentials that are not valid are cached. Default is 5.
+	SDO_API_AUTH_CACHE_STALE_TTL: the number of seconds after valid credentials expire from the cache that they are still accepted
+		when the exchange is not available (the circuit breaker is open, or the exchange or a proxy in front of it returns 502, 503,
+		or 504), so the API keeps working through short exchange outages. Credentials that were revoked in the exchange are also
+		accepted during that time, so this is never done for DELETE requests or owner keys. 0 disables it. Default is 0.
+	SDO_API_AUTH_CACHE_SIZE: the max number of cached credentials. Default is 1000.
+*/
+
+type AuthCacheConfig struct {
+	TTL         time.Duration
+	NegativeTTL time.Duration
+	StaleTTL    time.Duration
+	MaxEntries  int
+}
+
+func DefaultAuthCacheConfig() AuthCacheConfig {
+	return AuthCacheConfig{TTL: 60 * time.Second, NegativeTTL: 5 * time.Second, StaleTTL: 0, MaxEntries: 1000}
+}
+
+// Get the cache config from the SDO_API_AUTH_CACHE_* env vars, using the defaults for the ones that are not set
+func GetAuthCacheConfigFromEnv() AuthCacheConfig {
+	config := DefaultAuthCacheConfig()
+	config.TTL = time.Duration(GetEnvVarIntWithDefault("SDO_API_AUTH_CACHE_TTL", int(config.TTL/time.Second))) * time.Second
+	config.NegativeTTL = time.Duration(GetEnvVarIntWithDefault("SDO_API_AUTH_CACHE_NEGATIVE_TTL", int(config.NegativeTTL/time.Second))) * time.Second
+	config.StaleTTL = time.Duration(GetEnvVarIntWithDefault("SDO_API_AUTH_CACHE_STALE_TTL", int(config.StaleTTL/time.Second))) * time.Second
+	config.MaxEntries = GetEnvVarIntWithDefault("SDO_API_AUTH_CACHE_SIZE", config.MaxEntries)
+	return config
+}
+
+type authCacheEntry struct {
+	org, user  string        // the org and user of the credentials, for Invalidate()
+	exUser     *ExchangeUser // nil if the credentials are not valid
+	expires    time.Time
+	staleUntil time.Time // when the entry can no longer be used if the exchange fails (only set for valid credentials)
+}
+
+// An exchange call in progress, that other requests with the same credentials wait for
+type authCacheCall struct {
+	done    chan struct{}
+	exUser  *ExchangeUser
+	httpErr *HttpError
+}
+
+type ExchangeAuthCache struct {
+	config  AuthCacheConfig
+	lock    sync.Mutex
+	entries map[string]*authCacheEntry
+	calls   map[string]*authCacheCall
+}
+
+// The cache used by ExchangeAuthenticateIdentity(). Set it at startup to change the config.
+var AuthCache = NewExchangeAuthCache(DefaultAuthCacheConfig())
+
+func NewExchangeAuthCache(config AuthCacheConfig) *ExchangeAuthCache {
+	return &ExchangeAuthCache{config: config, entries: map[string]*authCacheEntry{}, calls: map[string]*authCacheCall{}}
+}
+
+// The cache key of the credentials, for requests for the device org
+func authCacheKey(credOrgId, user, pwOrKey, deviceOrgId string, nodesAndAgbots bool) string {
+	hash := sha256.New()
+	for _, s := range []string{credOrgId, user, pwOrKey, deviceOrgId} {
+		hash.Write([]byte(s))
+		hash.Write([]byte{0})
+	}
+	if nodesAndAgbots {
+		hash.Write([]byte{1})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Return the cached result for the credentials, or call authenticate to verify them with the exchange and cache the result.
+// Errors are not cached, but if allowStale is true and the exchange is not available, valid credentials whose entry has expired are
+// still accepted until their stale time.
+func (c *ExchangeAuthCache) Get(key, credOrgId, user string, allowStale bool, authenticate func() (*ExchangeUser, *HttpError)) (*ExchangeUser, *HttpError) {
+	if c.config.TTL <= 0 {
+		return authenticate()
+	}
+
+	c.lock.Lock()
+	if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expires) {
+		c.lock.Unlock()
+		return entry.copyUser(), nil
+	}
+	call, inProgress := c.calls[key]
+	if !inProgress {
+		call = &authCacheCall{done: make(chan struct{})}
+		c.calls[key] = call
+	}
+	c.lock.Unlock()
+
+	if inProgress {
+		<-call.done
+	} else {
+		call.exUser, call.httpErr = authenticate()
+		c.lock.Lock()
+		delete(c.calls, key)
+		if call.httpErr == nil {
+			c.put(key, credOrgId, user, call.exUser)
+		}
+		c.lock.Unlock()
+		close(call.done)
+	}
+
+	if allowStale && call.httpErr != nil && isRetryableStatus(call.httpErr.Code) { // includes the 503 of the open breaker
+		c.lock.Lock()
+		entry, ok := c.entries[key]
+		c.lock.Unlock()
+		if ok && entry.exUser != nil && time.Now().Before(entry.staleUntil) {
+			Verbose("the exchange could not verify the credentials of %s/%s (%s), using the cached result", credOrgId, user, call.httpErr.Error())
+			return entry.copyUser(), nil
+		}
+	}
+	if call.exUser == nil {
+		return nil, call.httpErr
+	}
+	userCopy := *call.exUser
+	return &userCopy, call.httpErr
+}
+
+// Remove the cached results of the credentials of this user, e.g. because the exchange rejected them. If user is empty, the results of
+// all of the users of the org are removed, and if org is also empty, all of the results are removed.
+func (c *ExchangeAuthCache) Invalidate(credOrgId, user string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, entry := range c.entries {
+		if (credOrgId == "" || entry.org == credOrgId) && (user == "" || entry.user == user) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Add the result to the cache. The caller must hold the lock.
+func (c *ExchangeAuthCache) put(key, credOrgId, user string, exUser *ExchangeUser) {
+	ttl := c.config.TTL
+	if exUser == nil {
+		ttl = c.config.NegativeTTL
+	}
+	if ttl <= 0 {
+		delete(c.entries, key) // so a stale positive result is not used for credentials that are no longer valid
+		return
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.config.MaxEntries {
+		c.evict()
+	}
+	now := time.Now()
+	entry := &authCacheEntry{org: credOrgId, user: user, exUser: exUser, expires: now.Add(ttl)}
+	if exUser != nil {
+		entry.staleUntil = entry.expires.Add(c.config.StaleTTL)
+		if !exUser.expires.IsZero() && exUser.expires.Before(entry.staleUntil) { // e.g. the exp of a bearer token
+			entry.staleUntil = exUser.expires
+			if exUser.expires.Before(entry.expires) {
+				entry.expires = exUser.expires
+			}
+		}
+	}
+	c.entries[key] = entry
+}
+
+// Make room for 1 entry: remove the entries that can no longer be used, and if that doesn't free anything, the entry that expires first.
+// The caller must hold the lock.
+func (c *ExchangeAuthCache) evict() {
+	now := time.Now()
+	var firstKey string
+	var firstExpires time.Time
+	for key, entry := range c.entries {
+		if now.After(entry.expires) && now.After(entry.staleUntil) {
+			delete(c.entries, key)
+		} else if firstKey == "" || entry.expires.Before(firstExpires) {
+			firstKey, firstExpires = key, entry.expires
+		}
+	}
+	if len(c.entries) >= c.config.MaxEntries && firstKey != "" {
+		delete(c.entries, firstKey)
+	}
+}
+
+// A copy of the cached identity, so the callers can't change the cache
+func (entry *authCacheEntry) copyUser() *ExchangeUser {
+	if entry.exUser == nil {
+		return nil
+	}
+	userCopy := *entry.exUser
+	return &userCopy
+}
@@ -0,0 +1,201 @@
+package outils
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Bearer token authentication: clients can send Authorization: Bearer <token> instead of basic auth. The token is not tied to an org,
+so the org comes from the route (or the ?orgid=<org-id> URL query parameter). By default the token is validated by the exchange as
+an IAM token: it is sent as the basic auth <org>/iamtoken:<token>, and the exchange returns the real user, the same way it does for
+<org>/iamapikey:<api-key>. The exchange calls made on behalf of the client (e.g. creating the node) use the same credentials.
+Or the token can be validated by an OAuth 2.0 token introspection endpoint (RFC 7662). The exchange does not accept those tokens, so
+the requests that make exchange calls on behalf of the client (pre-registering the node of a device, rotating the token of a
+pre-registered node, and transferring an owner key to another user) return 403 for them, and need exchange credentials. Configured with:
+	SDO_API_TOKEN_INTROSPECTION_URL: the url of the introspection endpoint. If not set, the exchange validates the tokens.
+	SDO_API_TOKEN_INTROSPECTION_CLIENT_ID and SDO_API_TOKEN_INTROSPECTION_CLIENT_SECRET: the basic auth credentials of the ocs-api
+		for the introspection endpoint, if it requires them.
+	SDO_API_TOKEN_INTROSPECTION_CA_CERT: the CA cert file to trust for the introspection endpoint, in addition to the system CAs.
+	SDO_API_TOKEN_ORG_CLAIM: the field of the introspection response that has the exchange org of the user. Default is org.
+	SDO_API_TOKEN_USER_CLAIM: the field of the introspection response that has the exchange user name. Default is username.
+	SDO_API_TOKEN_ADMIN_SCOPE: the scope of the tokens of org admins. Default is orgadmin.
+*/
+
+// The exchange user name for IAM tokens, like iamapikey for IAM API keys
+const IamTokenUser = "iamtoken"
+
+type TokenIntrospectionConfig struct {
+	Url          string // if empty, the exchange validates the tokens
+	ClientId     string
+	ClientSecret string
+	CaCertPath   string // trusted in addition to the system CAs
+	OrgClaim     string
+	UserClaim    string
+	AdminScope   string
+}
+
+// How bearer tokens are validated. Set it at startup to change the config.
+var TokenIntrospection = TokenIntrospectionConfig{OrgClaim: "org", UserClaim: "username", AdminScope: "orgadmin"}
+
+// Get the introspection config from the SDO_API_TOKEN_* env vars, using the defaults for the ones that are not set
+func GetTokenIntrospectionConfigFromEnv() TokenIntrospectionConfig {
+	config := TokenIntrospection
+	config.Url = GetEnvVarWithDefault("SDO_API_TOKEN_INTROSPECTION_URL", config.Url)
+	config.ClientId = GetEnvVarWithDefault("SDO_API_TOKEN_INTROSPECTION_CLIENT_ID", config.ClientId)
+	config.ClientSecret = GetEnvVarWithDefault("SDO_API_TOKEN_INTROSPECTION_CLIENT_SECRET", config.ClientSecret)
+	config.CaCertPath = GetEnvVarWithDefault("SDO_API_TOKEN_INTROSPECTION_CA_CERT", config.CaCertPath)
+	config.OrgClaim = GetEnvVarWithDefault("SDO_API_TOKEN_ORG_CLAIM", config.OrgClaim)
+	config.UserClaim = GetEnvVarWithDefault("SDO_API_TOKEN_USER_CLAIM", config.UserClaim)
+	config.AdminScope = GetEnvVarWithDefault("SDO_API_TOKEN_ADMIN_SCOPE", config.AdminScope)
+	return config
+}
+
+// The client for the introspection endpoint, separate from HttpClient because that one only trusts the CA of the exchange
+var introspectionClient *http.Client
+var introspectionClientCaCert string // the CA cert introspectionClient was created with
+var introspectionClientLock sync.Mutex
+
+// Return the http client for the introspection endpoint, which trusts the system CAs and TokenIntrospection.CaCertPath
+func GetTokenIntrospectionHTTPClient() (*http.Client, *HttpError) {
+	introspectionClientLock.Lock()
+	defer introspectionClientLock.Unlock()
+	caCertPath := TokenIntrospection.CaCertPath
+	if introspectionClient != nil && introspectionClientCaCert == caCertPath {
+		return introspectionClient, nil
+	}
+	httpClient, httpErr := NewHTTPClient("")
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if caCertPath != "" {
+		caCertPool, err := x509.SystemCertPool()
+		if err != nil {
+			caCertPool = x509.NewCertPool()
+		}
+		caCert, err := ioutil.ReadFile(filepath.Clean(caCertPath))
+		if err != nil {
+			return nil, NewHttpError(http.StatusInternalServerError, "unable to read the CA cert file %s of the token introspection endpoint: %v", caCertPath, err)
+		}
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, NewHttpError(http.StatusInternalServerError, "the CA cert file %s of the token introspection endpoint does not have any PEM certificates", caCertPath)
+		}
+		transport := httpClient.Transport.(*http.Transport)
+		if !transport.TLSClientConfig.InsecureSkipVerify {
+			transport.TLSClientConfig.RootCAs = caCertPool
+		}
+	}
+	introspectionClient, introspectionClientCaCert = httpClient, caCertPath
+	return introspectionClient, nil
+}
+
+// Returns the bearer token passed in the header of the request, and false if there isn't one
+func GetBearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if len(authHeader) < 7 || !strings.EqualFold(authHeader[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(authHeader[7:])
+	return token, token != ""
+}
+
+// Returns the org, user, and password (or key or token) to pass to the exchange for the client's request: its basic auth, or for a
+// bearer token <deviceOrgId>/iamtoken:<token>. The 4th value is false if the request has neither.
+func GetExchangeCredentials(r *http.Request, deviceOrgId string) (string, string, string, bool) {
+	if token, ok := GetBearerToken(r); ok {
+		return deviceOrgId, IamTokenUser, token, true
+	}
+	return GetBasicAuth(r)
+}
+
+// Returns 403 if the request has a bearer token that was validated by the introspection endpoint, because the exchange does not
+// accept it for the exchange calls made on behalf of the client, otherwise nil
+func introspectedTokenError(r *http.Request, apiMsg string) *HttpError {
+	if _, ok := GetBearerToken(r); ok && TokenIntrospection.Url != "" {
+		return NewHttpError(http.StatusForbidden, "%s needs exchange credentials: the exchange does not accept bearer tokens that are validated by token introspection", apiMsg)
+	}
+	return nil
+}
+
+// Validate the bearer token with the introspection endpoint. Returns the user the token belongs to, or nil if the token is not
+// active (or has expired), or error: 401 or 403 if the endpoint rejects the request, 503 if it is not available
+func introspectToken(token, deviceOrgId string) (*ExchangeUser, *HttpError) {
+	config := TokenIntrospection
+	method := http.MethodPost
+	apiMsg := fmt.Sprintf("%v %v", method, config.Url)
+	Verbose("confirming bearer token via %s", apiMsg)
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(method, config.Url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	if config.ClientId != "" {
+		req.SetBasicAuth(config.ClientId, config.ClientSecret)
+	}
+
+	httpClient, httpErr := GetTokenIntrospectionHTTPClient()
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	resp, httpErr := ExchangeCallBreaker.Do(httpClient, req, apiMsg)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, NewHttpError(http.StatusForbidden, "the bearer token could not be validated: %s returned %d", apiMsg, resp.StatusCode)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		if resp.StatusCode == http.StatusUnauthorized && config.ClientId != "" {
+			Error("%s rejected the credentials of the ocs-api, check SDO_API_TOKEN_INTROSPECTION_CLIENT_ID and SDO_API_TOKEN_INTROSPECTION_CLIENT_SECRET", apiMsg)
+		}
+		return nil, NewHttpError(http.StatusUnauthorized, "the bearer token could not be validated: %s returned %d", apiMsg, resp.StatusCode)
+	case resp.StatusCode >= 500:
+		httpErr := NewHttpError(http.StatusServiceUnavailable, "the token introspection endpoint is not available (%s returned %d), try again later", apiMsg, resp.StatusCode)
+		httpErr.RetryAfter = ExchangeCallBreaker.retryAfter()
+		return nil, httpErr
+	default:
+		return nil, NewHttpError(http.StatusInternalServerError, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
+	}
+	claims := map[string]interface{}{}
+	if bodyBytes, err := ioutil.ReadAll(resp.Body); err != nil {
+		return nil, NewHttpError(http.StatusInternalServerError, "unable to read HTTP response body for %s, error: %v", apiMsg, err)
+	} else if err = json.Unmarshal(bodyBytes, &claims); err != nil {
+		return nil, NewHttpError(http.StatusInternalServerError, "unable to unmarshal HTTP response body for %s, error: %v", apiMsg, err)
+	}
+
+	if active, _ := claims["active"].(bool); !active {
+		return nil, nil
+	}
+	var expires time.Time // the cache entry of the token must not outlive it
+	if exp, ok := claims["exp"].(float64); ok {
+		if expires = time.Unix(int64(exp), 0); !expires.After(time.Now()) {
+			return nil, nil
+		}
+	}
+	orgId, _ := claims[config.OrgClaim].(string)
+	user, _ := claims[config.UserClaim].(string)
+	if orgId == "" || user == "" {
+		return nil, NewHttpError(http.StatusInternalServerError, "the response of %s does not have the %s and %s fields", apiMsg, config.OrgClaim, config.UserClaim)
+	}
+	if orgId != deviceOrgId {
+		return nil, NewHttpError(http.StatusUnauthorized, "the org id of the credentials ("+orgId+") does not match the org id of the SDO device ("+deviceOrgId+")")
+	}
+	scope, _ := claims["scope"].(string)
+	if config.AdminScope != "" && containsString(strings.Fields(scope), config.AdminScope) {
+		return &ExchangeUser{Org: orgId, Name: user, Admin: true, Role: RoleOrgAdmin, expires: expires}, nil
+	}
+	return &ExchangeUser{Org: orgId, Name: user, Role: RoleUser, expires: expires}, nil
+}
@@ -0,0 +1,117 @@
+package outils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Managing node resources in the exchange, with the credentials of the client of the ocs-api
+
+// The body of PUT /orgs/{orgid}/nodes/{nodeid}
+type ExchangeNode struct {
+	Token              string            `json:"token"`
+	Name               string            `json:"name"`
+	NodeType           string            `json:"nodeType,omitempty"`
+	Pattern            string            `json:"pattern"`
+	Arch               string            `json:"arch,omitempty"`
+	RegisteredServices []interface{}     `json:"registeredServices"`
+	PublicKey          string            `json:"publicKey"`
+	SoftwareVersions   map[string]string `json:"softwareVersions"`
+}
+
+// Returns true if the node exists in the exchange
+func ExchangeNodeExists(r *http.Request, currentExchangeUrl, certificatePath, nodeOrgId, nodeId string) (bool, *HttpError) {
+	url := fmt.Sprintf("%v/orgs/%v/nodes/%v", currentExchangeUrl, nodeOrgId, nodeId)
+	httpErr := exchangeRequest(r, http.MethodGet, url, certificatePath, nodeOrgId, nil)
+	if httpErr == nil {
+		return true, nil
+	} else if httpErr.Code == http.StatusNotFound {
+		return false, nil
+	}
+	return false, httpErr
+}
+
+// Create (or replace) the node in the exchange
+func PutExchangeNode(r *http.Request, currentExchangeUrl, certificatePath, nodeOrgId, nodeId string, node *ExchangeNode) *HttpError {
+	url := fmt.Sprintf("%v/orgs/%v/nodes/%v", currentExchangeUrl, nodeOrgId, nodeId)
+	return exchangeRequest(r, http.MethodPut, url, certificatePath, nodeOrgId, node)
+}
+
+// Delete the node (and its policy) from the exchange
+func DeleteExchangeNode(r *http.Request, currentExchangeUrl, certificatePath, nodeOrgId, nodeId string) *HttpError {
+	url := fmt.Sprintf("%v/orgs/%v/nodes/%v", currentExchangeUrl, nodeOrgId, nodeId)
+	return exchangeRequest(r, http.MethodDelete, url, certificatePath, nodeOrgId, nil)
+}
+
+// Set the policy of the node in the exchange. The policy is the same as the input of: hzn exchange node updatepolicy
+func PutExchangeNodePolicy(r *http.Request, currentExchangeUrl, certificatePath, nodeOrgId, nodeId string, policy interface{}) *HttpError {
+	url := fmt.Sprintf("%v/orgs/%v/nodes/%v/policy", currentExchangeUrl, nodeOrgId, nodeId)
+	return exchangeRequest(r, http.MethodPut, url, certificatePath, nodeOrgId, policy)
+}
+
+// Change only the token of the node in the exchange
+func PatchExchangeNodeToken(r *http.Request, currentExchangeUrl, certificatePath, nodeOrgId, nodeId, nodeToken string) *HttpError {
+	url := fmt.Sprintf("%v/orgs/%v/nodes/%v", currentExchangeUrl, nodeOrgId, nodeId)
+	return exchangeRequest(r, http.MethodPatch, url, certificatePath, nodeOrgId, map[string]string{"token": nodeToken})
+}
+
+// Send an exchange request for a resource of the org, using the exchange credentials of the client's request. The body is
+// not sent if it is nil. Returns 404 if the resource does not exist, or 503 (with RetryAfter) if the exchange is not available.
+func exchangeRequest(r *http.Request, method, url, certificatePath, orgId string, body interface{}) *HttpError {
+	credOrgId, user, pwOrKey, ok := GetExchangeCredentials(r, orgId)
+	if !ok {
+		return NewHttpError(http.StatusUnauthorized, "invalid exchange credentials provided")
+	}
+	apiMsg := fmt.Sprintf("%v %v", method, url)
+	if httpErr := introspectedTokenError(r, apiMsg); httpErr != nil {
+		return httpErr
+	}
+	Verbose("running %s", apiMsg)
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return NewHttpError(http.StatusInternalServerError, "unable to marshal the body for %s, error: %v", apiMsg, err)
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, url, bodyReader)
+	if err != nil {
+		return NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
+	}
+	req.SetBasicAuth(credOrgId+"/"+user, pwOrKey)
+	req.Header.Add("Accept", "application/json")
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	certPath := ""
+	if PathExists(certificatePath) {
+		certPath = certificatePath
+	}
+	httpClient, httpErr := GetHTTPClient(certPath)
+	if httpErr != nil {
+		return httpErr
+	}
+	resp, httpErr := ExchangeCallBreaker.Do(httpClient, req, apiMsg)
+	if httpErr != nil {
+		return httpErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	respBytes, _ := ioutil.ReadAll(resp.Body) // the exchange returns json with a msg field, but just pass it along as is
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		if resp.StatusCode == http.StatusUnauthorized {
+			AuthCache.Invalidate(credOrgId, user) // the credentials are no longer valid
+		}
+		return NewHttpError(http.StatusForbidden, "the credentials are not authorized for %s: %s", apiMsg, string(respBytes))
+	}
+	return NewHttpError(resp.StatusCode, "unexpected http status code received from %s: %d: %s", apiMsg, resp.StatusCode, string(respBytes))
+}
@@ -0,0 +1,272 @@
+package outils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+Retries and circuit breaker for the exchange calls of API requests (authenticating them, and creating or changing the nodes of
+devices), and the token introspection calls. A call that fails with a timeout, a refused or reset connection, or a 502/503/504
+response is retried, with exponential backoff and full jitter, until SDO_EXCHANGE_RETRY_DEADLINE_SECONDS have passed since the call
+started. If it still fails, the client gets 503 and Retry-After. When ExchangeBreakerThreshold calls in a row have failed (after
+their retries), the breaker opens: for the next ExchangeBreakerOpenSeconds the calls fail right away with 503 and Retry-After,
+instead of making every client wait for the exchange timeout. After that, 1 call is let through to test the exchange: if it
+succeeds the breaker closes, otherwise it opens again. Configured with:
+	SDO_EXCHANGE_RETRIES: the number of times a failed call is retried. Default is 3.
+	SDO_EXCHANGE_RETRY_BACKOFF_MS: the max wait before the 1st retry, doubled for each retry after that. Default is 200.
+	SDO_EXCHANGE_RETRY_MAX_BACKOFF_MS: the max wait before any retry. Default is 2000.
+	SDO_EXCHANGE_RETRY_DEADLINE_SECONDS: the max time for a call, including its retries. 0 means only the http client timeout of each attempt. Default is 30.
+	SDO_EXCHANGE_BREAKER_THRESHOLD: the number of failed calls in a row that open the breaker. 0 disables the breaker. Default is 5.
+	SDO_EXCHANGE_BREAKER_OPEN_SECONDS: how long the breaker stays open before the exchange is tested again. Default is 30.
+*/
+
+const (
+	BreakerStateClosed   = "closed"
+	BreakerStateOpen     = "open"
+	BreakerStateHalfOpen = "half-open" // a call is testing the exchange
+)
+
+type ExchangeRetryConfig struct {
+	Retries          int
+	Backoff          time.Duration
+	MaxBackoff       time.Duration
+	Deadline         time.Duration
+	BreakerThreshold int
+	BreakerOpen      time.Duration
+}
+
+func DefaultExchangeRetryConfig() ExchangeRetryConfig {
+	return ExchangeRetryConfig{Retries: 3, Backoff: 200 * time.Millisecond, MaxBackoff: 2 * time.Second, Deadline: 30 * time.Second, BreakerThreshold: 5, BreakerOpen: 30 * time.Second}
+}
+
+// Get the retry config from the SDO_EXCHANGE_RETRY* and SDO_EXCHANGE_BREAKER_* env vars, using the defaults for the ones that are not set
+func GetExchangeRetryConfigFromEnv() ExchangeRetryConfig {
+	config := DefaultExchangeRetryConfig()
+	config.Retries = GetEnvVarIntWithDefault("SDO_EXCHANGE_RETRIES", config.Retries)
+	config.Backoff = time.Duration(GetEnvVarIntWithDefault("SDO_EXCHANGE_RETRY_BACKOFF_MS", int(config.Backoff/time.Millisecond))) * time.Millisecond
+	config.MaxBackoff = time.Duration(GetEnvVarIntWithDefault("SDO_EXCHANGE_RETRY_MAX_BACKOFF_MS", int(config.MaxBackoff/time.Millisecond))) * time.Millisecond
+	config.Deadline = time.Duration(GetEnvVarIntWithDefault("SDO_EXCHANGE_RETRY_DEADLINE_SECONDS", int(config.Deadline/time.Second))) * time.Second
+	config.BreakerThreshold = GetEnvVarIntWithDefault("SDO_EXCHANGE_BREAKER_THRESHOLD", config.BreakerThreshold)
+	config.BreakerOpen = time.Duration(GetEnvVarIntWithDefault("SDO_EXCHANGE_BREAKER_OPEN_SECONDS", int(config.BreakerOpen/time.Second))) * time.Second
+	return config
+}
+
+// The state of the circuit breaker, for health checks
+type BreakerStatus struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	OpenUntil           string `json:"openUntil,omitempty"` // RFC 3339, only when open
+	LastError           string `json:"lastError,omitempty"`
+}
+
+type ExchangeBreaker struct {
+	config    ExchangeRetryConfig
+	lock      sync.Mutex
+	state     string
+	failures  int // consecutive failed calls
+	openUntil time.Time
+	lastError string
+}
+
+// The breaker used by the exchange calls that authenticate requests, and the other exchange and introspection calls for them. Set it at startup to change the config.
+var ExchangeCallBreaker = NewExchangeBreaker(DefaultExchangeRetryConfig())
+
+func NewExchangeBreaker(config ExchangeRetryConfig) *ExchangeBreaker {
+	return &ExchangeBreaker{config: config, state: BreakerStateClosed}
+}
+
+// Return the current state of the breaker
+func (b *ExchangeBreaker) Status() BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	status := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures, LastError: b.lastError}
+	if b.state == BreakerStateOpen {
+		if time.Now().Before(b.openUntil) {
+			status.OpenUntil = b.openUntil.UTC().Format(time.RFC3339)
+		} else {
+			status.State = BreakerStateHalfOpen // the next call will test the exchange
+		}
+	}
+	return status
+}
+
+// Send the request to the exchange, retrying it if it fails with an error that is likely to be transient. If the request has a body,
+// it must have GetBody set (http.NewRequest sets it for the common body types) so it can be sent again. The retries stop when the
+// context of the request is done (e.g. the client of the API request it was created with went away), or the deadline of the breaker
+// config has passed. Returns the response, or error: 503 with RetryAfter set if the exchange is not available (the breaker is open,
+// or the call still failed with a timeout, a refused or reset connection, or 502/503/504 after the retries).
+func (b *ExchangeBreaker) Do(httpClient *http.Client, req *http.Request, apiMsg string) (*http.Response, *HttpError) {
+	if httpErr := b.allow(); httpErr != nil {
+		return nil, httpErr
+	}
+
+	clientCtx := req.Context()
+	ctx, cancel := clientCtx, context.CancelFunc(func() {})
+	if b.config.Deadline > 0 {
+		ctx, cancel = context.WithTimeout(clientCtx, b.config.Deadline)
+	}
+	req = req.WithContext(ctx)
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				cancel()
+				b.record(false, apiMsg+": "+err.Error())
+				return nil, NewHttpError(http.StatusInternalServerError, "unable to send HTTP request for %s again, error: %v", apiMsg, err)
+			}
+		}
+		resp, err = httpClient.Do(req)
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			b.record(true, "")
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel} // the body can only be read until the context is canceled
+			return resp, nil
+		}
+		if clientCtx.Err() != nil {
+			// the client went away, which says nothing about the exchange
+			cancel()
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, NewHttpError(http.StatusServiceUnavailable, "%s was canceled: %v", apiMsg, clientCtx.Err())
+		}
+		if err != nil && !isRetryableError(err) {
+			cancel()
+			// e.g. the certificate of the exchange is not trusted, or its host name does not exist: retrying won't help
+			b.record(false, apiMsg+": "+err.Error())
+			return nil, NewHttpError(http.StatusInternalServerError, "unable to send HTTP request for %s, error: %v", apiMsg, err)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if attempt >= b.config.Retries || ctx.Err() != nil {
+			break
+		}
+		wait := b.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			break
+		}
+		Verbose("%s failed (%s), retrying in %v ...", apiMsg, describeExchangeFailure(resp, err), wait)
+		time.Sleep(wait)
+	}
+
+	cancel()
+	failure := describeExchangeFailure(resp, err)
+	b.record(false, apiMsg+": "+failure)
+	httpErr := NewHttpError(http.StatusServiceUnavailable, "the exchange is not available (%s: %s), try again later", apiMsg, failure)
+	httpErr.RetryAfter = b.retryAfter()
+	return nil, httpErr
+}
+
+// The body of a response, which cancels the context of its request when it is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// The number of seconds clients should wait before trying again after a call failed: until the breaker closes if it opened, else 1
+func (b *ExchangeBreaker) retryAfter() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if wait := time.Until(b.openUntil); b.state == BreakerStateOpen && wait > 0 {
+		return int((wait + time.Second - 1) / time.Second)
+	}
+	return 1
+}
+
+// Whether a call can be made now. Returns 503 if the breaker is open, or if it is testing the exchange with another call.
+func (b *ExchangeBreaker) allow() *HttpError {
+	if b.config.BreakerThreshold <= 0 {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case BreakerStateOpen:
+		if now := time.Now(); now.Before(b.openUntil) {
+			return b.openError(b.openUntil.Sub(now))
+		}
+		b.state = BreakerStateHalfOpen // this call tests the exchange
+	case BreakerStateHalfOpen:
+		return b.openError(time.Second)
+	}
+	return nil
+}
+
+// The error returned while the breaker is open, with the number of seconds until the exchange will be tried again
+func (b *ExchangeBreaker) openError(wait time.Duration) *HttpError {
+	httpErr := NewHttpError(http.StatusServiceUnavailable, "the exchange is not available (%s), try again later", b.lastError)
+	httpErr.RetryAfter = int((wait + time.Second - 1) / time.Second)
+	return httpErr
+}
+
+// Record the result of a call
+func (b *ExchangeBreaker) record(success bool, errStr string) {
+	if b.config.BreakerThreshold <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if success {
+		if b.state != BreakerStateClosed {
+			Verbose("the exchange is available again, closing the circuit breaker")
+		}
+		b.state, b.failures, b.lastError = BreakerStateClosed, 0, ""
+		return
+	}
+	b.failures++
+	b.lastError = errStr
+	if b.state == BreakerStateHalfOpen || b.failures >= b.config.BreakerThreshold {
+		Verbose("%d exchange calls in a row failed, opening the circuit breaker for %v", b.failures, b.config.BreakerOpen)
+		b.state = BreakerStateOpen
+		b.openUntil = time.Now().Add(b.config.BreakerOpen)
+	}
+}
+
+// The wait before the retry after the attempt: a random duration up to the exponential backoff (full jitter)
+func (b *ExchangeBreaker) backoff(attempt int) time.Duration {
+	maxWait := b.config.Backoff << uint(attempt)
+	if maxWait > b.config.MaxBackoff || maxWait <= 0 {
+		maxWait = b.config.MaxBackoff
+	}
+	if maxWait <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(maxWait) + 1))
+}
+
+// The network errors that are likely to be transient: timeouts, and connections that were refused or reset (e.g. while the exchange
+// restarts). TLS and certificate errors, and host names that do not exist, are not.
+func isRetryableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// The statuses the exchange (or a proxy or load balancer in front of it) returns when it is temporarily unavailable
+func isRetryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+func describeExchangeFailure(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return resp.Status
+}
@@ -0,0 +1,164 @@
+package outils
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBreaker() *ExchangeBreaker {
+	return NewExchangeBreaker(ExchangeRetryConfig{Retries: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, BreakerThreshold: 5, BreakerOpen: time.Minute})
+}
+
+func TestBreakerRetriesUnavailable(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, httpErr := newTestBreaker().Do(http.DefaultClient, req, "GET test")
+	if resp != nil || httpErr == nil || httpErr.Code != http.StatusServiceUnavailable || httpErr.RetryAfter <= 0 {
+		t.Errorf("got %v %v, expected 503 with Retry-After", resp, httpErr)
+	}
+	if calls != 3 {
+		t.Errorf("the exchange was called %d times, expected 3", calls)
+	}
+}
+
+func TestBreakerRetriesConnectionRefused(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // nothing listens on its port now
+
+	breaker := newTestBreaker()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, httpErr := breaker.Do(http.DefaultClient, req, "GET test"); httpErr == nil || httpErr.Code != http.StatusServiceUnavailable || httpErr.RetryAfter <= 0 {
+		t.Errorf("got %v, expected 503 with Retry-After", httpErr)
+	}
+	if status := breaker.Status(); status.ConsecutiveFailures != 1 {
+		t.Errorf("breaker status is %+v, expected 1 failure", status)
+	}
+}
+
+func TestBreakerRetriesTimeout(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, httpErr := newTestBreaker().Do(&http.Client{Timeout: 50 * time.Millisecond}, req, "GET test")
+	if httpErr != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v %v, expected 200 after the retry", resp, httpErr)
+	}
+	resp.Body.Close()
+	if calls != 2 {
+		t.Errorf("the exchange was called %d times, expected 2", calls)
+	}
+}
+
+// A certificate the client does not trust is not a transient error
+func TestBreakerDoesNotRetryTlsError(t *testing.T) {
+	var calls, handshakes int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&handshakes, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if _, httpErr := newTestBreaker().Do(&http.Client{}, req, "GET test"); httpErr == nil || httpErr.Code != http.StatusInternalServerError {
+		t.Errorf("got %v, expected 500", httpErr)
+	}
+	if handshakes != 1 || calls != 0 {
+		t.Errorf("the exchange got %d connections and %d calls, expected 1 connection", handshakes, calls)
+	}
+}
+
+// The body of a request is sent again when it is retried
+func TestBreakerRetriesBody(t *testing.T) {
+	var calls int32
+	bodies := make(chan string, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("token=abc"))
+	resp, httpErr := newTestBreaker().Do(http.DefaultClient, req, "POST test")
+	if httpErr != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v %v, expected 200 after the retry", resp, httpErr)
+	}
+	resp.Body.Close()
+	close(bodies)
+	for body := range bodies {
+		if body != "token=abc" {
+			t.Errorf("the exchange got the body %q, expected token=abc", body)
+		}
+	}
+}
+
+// The retries stop at the deadline, even if the exchange does not respond before the http client timeout
+func TestBreakerDeadline(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	breaker := NewExchangeBreaker(ExchangeRetryConfig{Retries: 5, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Deadline: 100 * time.Millisecond, BreakerThreshold: 5, BreakerOpen: time.Minute})
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	start := time.Now()
+	if _, httpErr := breaker.Do(&http.Client{Timeout: time.Minute}, req, "GET test"); httpErr == nil || httpErr.Code != http.StatusServiceUnavailable || httpErr.RetryAfter <= 0 {
+		t.Errorf("got %v, expected 503 with Retry-After", httpErr)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the call took %v, expected it to stop at the deadline", elapsed)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("the exchange was called %d times, expected 1", calls)
+	}
+}
+
+// A canceled client request is not retried, and is not counted as an exchange failure
+func TestBreakerClientCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	breaker := newTestBreaker()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if _, httpErr := breaker.Do(http.DefaultClient, req, "GET test"); httpErr == nil {
+		t.Error("got no error for the canceled request")
+	}
+	if status := breaker.Status(); status.ConsecutiveFailures != 0 {
+		t.Errorf("breaker status is %+v, expected no failures", status)
+	}
+}
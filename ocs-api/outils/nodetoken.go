@@ -0,0 +1,177 @@
+package outils
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+/*
+Node token generation. All randomness (the characters and their positions) comes from crypto/rand. What the token looks like is
+controlled by a NodeTokenPolicy, so it can be made to match the password rules of the exchange the nodes register with:
+	SDO_NODE_TOKEN_LENGTH: the number of chars in the token. Default is 88.
+	SDO_NODE_TOKEN_CHAR_CLASSES: comma-separated list of: lower, upper, digit, symbol. The token has at least 1 char of each class, and
+		only chars of these classes. Default is all of them.
+	SDO_NODE_TOKEN_EXCHANGE_COMPAT: the exchange password rules the policy must satisfy: current (exchange versions that require node
+		tokens to have at least 15 chars, including an uppercase letter, a lowercase letter, and a digit), or legacy (older exchange
+		versions, that accept any token). Default is current.
+*/
+
+const (
+	NodeTokenClassLower  = "lower"
+	NodeTokenClassUpper  = "upper"
+	NodeTokenClassDigit  = "digit"
+	NodeTokenClassSymbol = "symbol"
+
+	NodeTokenExchangeCompatCurrent = "current"
+	NodeTokenExchangeCompatLegacy  = "legacy"
+
+	// The token is passed to the device in the exec cmd (which is split on spaces) and to agent-install.sh as <uuid>:<token>, and
+	// agent-install-wrapper.sh quotes it, so only symbols that don't need escaping anywhere are used (the same ones as base64 url encoding)
+	nodeTokenSymbols = "-_"
+
+	nodeTokenMinLength = 16 // regardless of what the exchange accepts, so the token can not be guessed
+	nodeTokenMaxLength = 256
+)
+
+var nodeTokenClassChars = map[string]string{
+	NodeTokenClassLower:  "abcdefghijklmnopqrstuvwxyz",
+	NodeTokenClassUpper:  "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	NodeTokenClassDigit:  "0123456789",
+	NodeTokenClassSymbol: nodeTokenSymbols,
+}
+
+// The password rules of each exchange version we are compatible with: the min length and the char classes that are required
+var nodeTokenExchangeRules = map[string]struct {
+	minLength int
+	classes   []string
+}{
+	NodeTokenExchangeCompatCurrent: {minLength: 15, classes: []string{NodeTokenClassUpper, NodeTokenClassLower, NodeTokenClassDigit}},
+	NodeTokenExchangeCompatLegacy:  {minLength: 1},
+}
+
+// What the generated node tokens look like
+type NodeTokenPolicy struct {
+	Length         int
+	CharClasses    []string // the token contains at least 1 char of each of these classes, and only chars of these classes
+	ExchangeCompat string   // the exchange password rules the tokens must satisfy
+}
+
+// The policy that was used before the policy was configurable: 88 chars of base64 url encoding, with at least 1 digit, uppercase, and lowercase char
+func DefaultNodeTokenPolicy() *NodeTokenPolicy {
+	return &NodeTokenPolicy{
+		Length:         88,
+		CharClasses:    []string{NodeTokenClassLower, NodeTokenClassUpper, NodeTokenClassDigit, NodeTokenClassSymbol},
+		ExchangeCompat: NodeTokenExchangeCompatCurrent,
+	}
+}
+
+// Get the node token policy from the SDO_NODE_TOKEN_* env vars, using the default policy for the ones that are not set
+func GetNodeTokenPolicyFromEnv() (*NodeTokenPolicy, error) {
+	policy := DefaultNodeTokenPolicy()
+	policy.Length = GetEnvVarIntWithDefault("SDO_NODE_TOKEN_LENGTH", policy.Length)
+	if classes := GetEnvVarWithDefault("SDO_NODE_TOKEN_CHAR_CLASSES", ""); classes != "" {
+		policy.CharClasses = nil
+		for _, c := range strings.Split(classes, ",") {
+			if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+				policy.CharClasses = append(policy.CharClasses, c)
+			}
+		}
+	}
+	policy.ExchangeCompat = GetEnvVarWithDefault("SDO_NODE_TOKEN_EXCHANGE_COMPAT", policy.ExchangeCompat)
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Verify the policy is valid, and the tokens it generates will be accepted by the exchange
+func (p *NodeTokenPolicy) Validate() error {
+	if p.Length < nodeTokenMinLength || p.Length > nodeTokenMaxLength {
+		return fmt.Errorf("the node token length must be between %d and %d", nodeTokenMinLength, nodeTokenMaxLength)
+	}
+	if len(p.CharClasses) == 0 {
+		return errors.New("at least 1 node token char class must be specified")
+	}
+	classes := map[string]bool{}
+	for _, c := range p.CharClasses {
+		if _, ok := nodeTokenClassChars[c]; !ok {
+			return fmt.Errorf("invalid node token char class %s, the valid classes are: %s, %s, %s, %s", c, NodeTokenClassLower, NodeTokenClassUpper, NodeTokenClassDigit, NodeTokenClassSymbol)
+		}
+		if classes[c] {
+			return fmt.Errorf("node token char class %s is specified more than once", c)
+		}
+		classes[c] = true
+	}
+
+	rules, ok := nodeTokenExchangeRules[p.ExchangeCompat]
+	if !ok {
+		return fmt.Errorf("invalid node token exchange compatibility %s, the valid values are: %s, %s", p.ExchangeCompat, NodeTokenExchangeCompatCurrent, NodeTokenExchangeCompatLegacy)
+	}
+	if p.Length < rules.minLength {
+		return fmt.Errorf("node token exchange compatibility %s requires tokens of at least %d chars", p.ExchangeCompat, rules.minLength)
+	}
+	for _, c := range rules.classes {
+		if !classes[c] {
+			return fmt.Errorf("node token exchange compatibility %s requires tokens to include char class %s", p.ExchangeCompat, c)
+		}
+	}
+	return nil
+}
+
+// Generate a random node token that follows the policy
+func GenerateNodeToken(policy *NodeTokenPolicy) (string, *HttpError) {
+	if err := policy.Validate(); err != nil {
+		return "", NewHttpError(http.StatusInternalServerError, "invalid node token policy: "+err.Error())
+	}
+
+	// 1 char of each class, so every class is present, then fill the rest from all of the classes
+	allChars := ""
+	token := make([]byte, 0, policy.Length)
+	for _, c := range policy.CharClasses {
+		ch, err := randomChar(nodeTokenClassChars[c])
+		if err != nil {
+			return "", NewHttpError(http.StatusInternalServerError, "Error reading random bytes for node token: "+err.Error())
+		}
+		token = append(token, ch)
+		allChars += nodeTokenClassChars[c]
+	}
+	for len(token) < policy.Length {
+		ch, err := randomChar(allChars)
+		if err != nil {
+			return "", NewHttpError(http.StatusInternalServerError, "Error reading random bytes for node token: "+err.Error())
+		}
+		token = append(token, ch)
+	}
+
+	// Shuffle (Fisher-Yates), so the required chars are not always at the beginning
+	for i := len(token) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", NewHttpError(http.StatusInternalServerError, "Error reading random bytes for node token: "+err.Error())
+		}
+		token[i], token[j] = token[j], token[i]
+	}
+	return string(token), nil
+}
+
+// Return a uniformly random char of the string
+func randomChar(chars string) (byte, error) {
+	i, err := randomInt(len(chars))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i], nil
+}
+
+// Return a uniformly random int in [0,max)
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()), nil
+}
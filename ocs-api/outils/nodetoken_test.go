@@ -0,0 +1,86 @@
+package outils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNodeTokenPolicyValidate(t *testing.T) {
+	all := []string{NodeTokenClassLower, NodeTokenClassUpper, NodeTokenClassDigit, NodeTokenClassSymbol}
+	for _, test := range []struct {
+		name   string
+		policy NodeTokenPolicy
+		valid  bool
+	}{
+		{"default", *DefaultNodeTokenPolicy(), true},
+		{"min length", NodeTokenPolicy{Length: nodeTokenMinLength, CharClasses: all, ExchangeCompat: NodeTokenExchangeCompatCurrent}, true},
+		{"max length", NodeTokenPolicy{Length: nodeTokenMaxLength, CharClasses: all, ExchangeCompat: NodeTokenExchangeCompatCurrent}, true},
+		{"too short", NodeTokenPolicy{Length: nodeTokenMinLength - 1, CharClasses: all, ExchangeCompat: NodeTokenExchangeCompatLegacy}, false},
+		{"too long", NodeTokenPolicy{Length: nodeTokenMaxLength + 1, CharClasses: all, ExchangeCompat: NodeTokenExchangeCompatCurrent}, false},
+		{"no classes", NodeTokenPolicy{Length: 32, ExchangeCompat: NodeTokenExchangeCompatLegacy}, false},
+		{"invalid class", NodeTokenPolicy{Length: 32, CharClasses: []string{"emoji"}, ExchangeCompat: NodeTokenExchangeCompatLegacy}, false},
+		{"duplicate class", NodeTokenPolicy{Length: 32, CharClasses: []string{NodeTokenClassDigit, NodeTokenClassDigit}, ExchangeCompat: NodeTokenExchangeCompatLegacy}, false},
+		{"invalid exchange compat", NodeTokenPolicy{Length: 32, CharClasses: all, ExchangeCompat: "future"}, false},
+		{"current exchange without upper", NodeTokenPolicy{Length: 32, CharClasses: []string{NodeTokenClassLower, NodeTokenClassDigit}, ExchangeCompat: NodeTokenExchangeCompatCurrent}, false},
+		{"legacy exchange with only digits", NodeTokenPolicy{Length: 32, CharClasses: []string{NodeTokenClassDigit}, ExchangeCompat: NodeTokenExchangeCompatLegacy}, true},
+	} {
+		if err := test.policy.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: got %v, expected valid=%v", test.name, err, test.valid)
+		}
+		if _, httpErr := GenerateNodeToken(&test.policy); (httpErr == nil) != test.valid {
+			t.Errorf("%s: GenerateNodeToken got %v, expected valid=%v", test.name, httpErr, test.valid)
+		}
+	}
+}
+
+// The tokens have the length of the policy, at least 1 char of each of its classes, and only chars of its classes
+func TestGenerateNodeToken(t *testing.T) {
+	for _, policy := range []*NodeTokenPolicy{
+		DefaultNodeTokenPolicy(),
+		{Length: nodeTokenMinLength, CharClasses: []string{NodeTokenClassUpper, NodeTokenClassLower, NodeTokenClassDigit}, ExchangeCompat: NodeTokenExchangeCompatCurrent},
+		{Length: nodeTokenMaxLength, CharClasses: []string{NodeTokenClassDigit, NodeTokenClassSymbol}, ExchangeCompat: NodeTokenExchangeCompatLegacy},
+	} {
+		allChars := ""
+		for _, c := range policy.CharClasses {
+			allChars += nodeTokenClassChars[c]
+		}
+		for i := 0; i < 50; i++ {
+			token, httpErr := GenerateNodeToken(policy)
+			if httpErr != nil {
+				t.Fatalf("%+v: %v", policy, httpErr)
+			}
+			if len(token) != policy.Length {
+				t.Errorf("%+v: token %s has %d chars", policy, token, len(token))
+			}
+			for _, c := range policy.CharClasses {
+				if !strings.ContainsAny(token, nodeTokenClassChars[c]) {
+					t.Errorf("%+v: token %s has no %s char", policy, token, c)
+				}
+			}
+			if i := strings.IndexFunc(token, func(r rune) bool { return !strings.ContainsRune(allChars, r) }); i >= 0 {
+				t.Errorf("%+v: token %s has char %q, which is not in its classes", policy, token, token[i])
+			}
+		}
+	}
+}
+
+func TestGetNodeTokenPolicyFromEnv(t *testing.T) {
+	t.Setenv("SDO_NODE_TOKEN_LENGTH", "20")
+	t.Setenv("SDO_NODE_TOKEN_CHAR_CLASSES", " Upper, lower,digit ,")
+	policy, err := GetNodeTokenPolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Length != 20 || strings.Join(policy.CharClasses, ",") != "upper,lower,digit" || policy.ExchangeCompat != NodeTokenExchangeCompatCurrent {
+		t.Errorf("got %+v", policy)
+	}
+
+	t.Setenv("SDO_NODE_TOKEN_CHAR_CLASSES", "digit")
+	if _, err := GetNodeTokenPolicyFromEnv(); err == nil {
+		t.Error("got no error for only digits with the current exchange rules")
+	}
+	t.Setenv("SDO_NODE_TOKEN_EXCHANGE_COMPAT", NodeTokenExchangeCompatLegacy)
+	if _, err := GetNodeTokenPolicyFromEnv(); err != nil {
+		t.Errorf("only digits with the legacy exchange rules: %v", err)
+	}
+}
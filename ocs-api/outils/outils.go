@@ -1,17 +1,15 @@
 package outils
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	mrand "math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -35,8 +33,9 @@ var HttpClient *http.Client
 
 // A "subclass" of error that also contains the http code that should be sent to the client
 type HttpError struct {
-	Code int
-	Err  error
+	Code       int
+	Err        error
+	RetryAfter int // the number of seconds the client should wait before retrying, or 0
 }
 
 func NewHttpError(code int, errStr string, args ...interface{}) *HttpError {
@@ -47,6 +46,14 @@ func (e *HttpError) Error() string {
 	return e.Err.Error()
 }
 
+// Write the error as the response, with the Retry-After header if the error has it
+func WriteHttpError(w http.ResponseWriter, httpErr *HttpError) {
+	if httpErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(httpErr.RetryAfter))
+	}
+	http.Error(w, httpErr.Error(), httpErr.Code)
+}
+
 // Verify that the request content type is json
 func IsValidPostJson(r *http.Request) *HttpError {
 	val, ok := r.Header["Content-Type"]
@@ -112,42 +119,6 @@ func WriteResponse(httpCode int, w http.ResponseWriter, bodyBytes []byte) {
 	}
 }
 
-// Generate a random node token that follows the new exchange requirements for node and agbot tokens
-func GenerateNodeToken() (string, *HttpError) {
-	// Taken from anax/cutil/cutil.go
-	random := mrand.New(mrand.NewSource(int64(time.Now().Nanosecond())))
-
-	randStr := ""
-	randStr += string(rune(random.Intn(10) + 48)) // add a random digit to the string
-	randStr += string(rune(random.Intn(26) + 65)) // add an uppercase letter to the string
-	randStr += string(rune(random.Intn(26) + 97)) // add a lowercase letter to the string
-	randStr += string(rune(random.Intn(10) + 48)) // add one more random digit so we reach 64 bytes at the end
-
-	// pad out the password to make it <=15 chars
-	bytes := make([]byte, 63)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", NewHttpError(http.StatusInternalServerError, "Error reading random bytes for node token: "+err.Error())
-	}
-	randStr += base64.URLEncoding.EncodeToString(bytes)
-
-	// shuffle the string
-	shuffledStr := []rune(randStr)
-	mrand.Shuffle(len(shuffledStr), func(i, j int) {
-		shuffledStr[i], shuffledStr[j] = shuffledStr[j], shuffledStr[i]
-	})
-
-	return string(shuffledStr), nil
-
-	/* this method generates a 44 char token of random numbers and lowercase chars
-	bytes := make([]byte, 22) // 44 hex chars
-	_, err := rand.Read(bytes)
-	if err != nil {
-		return "", NewHttpError(http.StatusInternalServerError, "Error creating random bytes for node token: "+err.Error())
-	}
-	return hex.EncodeToString(bytes), nil
-	*/
-}
-
 // Convert a space-separated string into a null separated string (with extra null at end)
 func MakeExecCmd(execString string) string {
 	returnStr := ""
@@ -346,13 +317,61 @@ func VerifyExchangeConnection(currentExchangeUrl, certificatePath string, retrie
 	}
 }
 
-// Verify the request credentials with the exchange. Returns true/false and the user (if true), or error
-func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, certificatePath string) (bool, string, *HttpError) {
-	credOrgId, user, pwOrKey, ok := GetBasicAuth(r)
+// An authenticated exchange identity: a user, or (only when checking the API permissions) a node, agbot, or hub admin
+type ExchangeUser struct {
+	Org   string
+	Name  string
+	Admin bool   // an org admin (the exchange root user is also an admin)
+	Role  string // one of the Role* values, that the API permissions are based on
+
+	expires time.Time // when the credentials expire (the exp of a bearer token), if known, so they are not cached longer
+}
+
+// The key of the exchange identity in the request context, set by WithExchangeUser()
+type exchangeUserContextKey struct{}
+
+type contextExchangeUser struct {
+	deviceOrgId string
+	exUser      *ExchangeUser
+}
+
+// Return a copy of the request whose context holds the exchange identity that was authenticated (and authorized) for the device org.
+// The handlers get the identity from the context (with ContextExchangeUser), instead of authenticating the request again.
+func WithExchangeUser(r *http.Request, deviceOrgId string, exUser *ExchangeUser) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), exchangeUserContextKey{}, contextExchangeUser{deviceOrgId: deviceOrgId, exUser: exUser}))
+}
+
+// Return the device org and the exchange identity that WithExchangeUser() stored in the request context. Returns false if the
+// request was not authorized.
+func ContextExchangeUser(r *http.Request) (string, *ExchangeUser, bool) {
+	ctxUser, ok := r.Context().Value(exchangeUserContextKey{}).(contextExchangeUser)
+	if !ok || ctxUser.exUser == nil {
+		return "", nil, false
+	}
+	return ctxUser.deviceOrgId, ctxUser.exUser, true
+}
+
+// Verify the request credentials with the exchange (or AuthCache), and determine the role of the identity. Node and agbot credentials
+// are only checked if nodesAndAgbots is true, because that takes more calls to the exchange. If allowStale is true, an expired cache
+// entry can be used when the exchange is not available (see AuthCache). Returns the identity, or nil if the credentials are not valid,
+// or error
+func ExchangeAuthenticateIdentity(r *http.Request, currentExchangeUrl, deviceOrgId, certificatePath string, nodesAndAgbots, allowStale bool) (*ExchangeUser, *HttpError) {
+	if token, ok := GetBearerToken(r); ok && TokenIntrospection.Url != "" {
+		return AuthCache.Get(authCacheKey("", "", token, deviceOrgId, false), deviceOrgId, IamTokenUser, allowStale, func() (*ExchangeUser, *HttpError) {
+			return introspectToken(token, deviceOrgId)
+		})
+	}
+	credOrgId, user, pwOrKey, ok := GetExchangeCredentials(r, deviceOrgId)
 	if !ok {
-		return false, "", nil
+		return nil, nil
 	}
+	return AuthCache.Get(authCacheKey(credOrgId, user, pwOrKey, deviceOrgId, nodesAndAgbots), credOrgId, user, allowStale, func() (*ExchangeUser, *HttpError) {
+		return exchangeAuthenticateIdentity(currentExchangeUrl, deviceOrgId, certificatePath, nodesAndAgbots, credOrgId, user, pwOrKey)
+	})
+}
 
+// Verify the credentials with the exchange, for ExchangeAuthenticateIdentity()
+func exchangeAuthenticateIdentity(currentExchangeUrl, deviceOrgId, certificatePath string, nodesAndAgbots bool, credOrgId, user, pwOrKey string) (*ExchangeUser, *HttpError) {
 	// Get certificate
 	var certPath string
 	if !PathExists(certificatePath) {
@@ -372,10 +391,7 @@ func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, cert
 	} else {
 		// Non-root creds: Invoke exchange to confirm the client has valid user creds and have the access they need to create and manage this device.
 		// Note: POST /orgs/{orgid}/users/{username}/confirm only confirms that the creds can read its own user resource. This is sufficient if the creds are in
-		//		the same org as the device, so we need to catch the case when the aren't.
-		if credOrgId != deviceOrgId {
-			return false, "", NewHttpError(http.StatusUnauthorized, "the org id of the credentials ("+credOrgId+") does not match the org id of the SDO device ("+deviceOrgId+")")
-		}
+		//		the same org as the device, so we need to catch the case when the aren't (below, after we know if it is a hub admin).
 		//method = http.MethodPost
 		//url = fmt.Sprintf("%v/orgs/%v/users/%v/confirm", currentExchangeUrl, credOrgId, user)
 		//goodStatusCode = http.StatusCreated
@@ -389,7 +405,7 @@ func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, cert
 	// Create an outgoing HTTP request to the exchange.
 	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
-		return false, "", NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
+		return nil, NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
 	}
 
 	// Add the basic auth header so that the exchange will authenticate.
@@ -399,43 +415,143 @@ func ExchangeAuthenticate(r *http.Request, currentExchangeUrl, deviceOrgId, cert
 	// Send the request to verify the user.
 	httpClient, httpErr := GetHTTPClient(certPath)
 	if httpErr != nil {
-		return false, "", httpErr
+		return nil, httpErr
 	}
-	resp, err := httpClient.Do(req) //todo: retry, when necessary, like CSS does
-	if err != nil {
-		return false, "", NewHttpError(http.StatusInternalServerError, "unable to send HTTP request for %s, error: %v", apiMsg, err)
-	} else if resp.StatusCode == goodStatusCode {
+	resp, httpErr := ExchangeCallBreaker.Do(httpClient, req, apiMsg)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == goodStatusCode {
 		// They are authenticated, not get the real user (because the cred user could be iamapikey)
 		if credOrgId == "root" && user == "root" {
-			return true, "root", nil
+			return &ExchangeUser{Org: credOrgId, Name: "root", Admin: true, Role: RoleOrgAdmin}, nil
 		}
 		// Non-root user, parse the response body to get the real user
 		users := new(GetUsersResponse)
 		if bodyBytes, err := ioutil.ReadAll(resp.Body); err != nil {
-			return false, "", NewHttpError(http.StatusInternalServerError, "unable to read HTTP response body for %s, error: %v", apiMsg, err)
+			return nil, NewHttpError(http.StatusInternalServerError, "unable to read HTTP response body for %s, error: %v", apiMsg, err)
 		} else if err = json.Unmarshal(bodyBytes, users); err != nil {
-			return false, "", NewHttpError(http.StatusInternalServerError, "unable to unmarshal HTTP response body for %s, error: %v", apiMsg, err)
+			return nil, NewHttpError(http.StatusInternalServerError, "unable to unmarshal HTTP response body for %s, error: %v", apiMsg, err)
 		} else {
 			for key, userInfo := range users.Users { // there is only 1 entry in this map, but we don't know the key, so loop thru the 1st one
 				// key is {orgid}/{username}
 				orgAndUsername := strings.Split(key, "/")
 				if len(orgAndUsername) != 2 {
-					return false, "", NewHttpError(http.StatusInternalServerError, "user response from exchange in unexpected format for %s, error: %v", apiMsg, err)
+					return nil, NewHttpError(http.StatusInternalServerError, "user response from exchange in unexpected format for %s, error: %v", apiMsg, err)
 				}
 				exUsername := orgAndUsername[1]
 				if userInfo.HubAdmin {
-					return false, "", nil // hub admins can't manage devices
+					return &ExchangeUser{Org: credOrgId, Name: exUsername, Role: RoleHubAdmin}, nil // hub admins are in the root org, so they can be for any org
+				} else if credOrgId != deviceOrgId {
+					return nil, orgMismatchError(credOrgId, deviceOrgId)
+				} else if userInfo.Admin {
+					return &ExchangeUser{Org: credOrgId, Name: exUsername, Admin: true, Role: RoleOrgAdmin}, nil
 				} else {
-					return true, exUsername, nil
+					return &ExchangeUser{Org: credOrgId, Name: exUsername, Role: RoleUser}, nil
 				}
 			}
-			return false, "", nil // will never get here, but have to satisfy the compiler
+			return nil, nil // will never get here, but have to satisfy the compiler
 		}
 	} else if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
-		return false, "", nil
+		if nodesAndAgbots && credOrgId != "root" && user != IamTokenUser {
+			exUser, httpErr := exchangeAuthenticateNodeOrAgbot(currentExchangeUrl, certPath, credOrgId, user, pwOrKey)
+			if exUser != nil && credOrgId != deviceOrgId {
+				return nil, orgMismatchError(credOrgId, deviceOrgId)
+			}
+			return exUser, httpErr
+		}
+		return nil, nil
 	} else {
-		return false, "", NewHttpError(resp.StatusCode, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
+		return nil, NewHttpError(resp.StatusCode, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
+	}
+}
+
+func orgMismatchError(credOrgId, deviceOrgId string) *HttpError {
+	return NewHttpError(http.StatusUnauthorized, "the org id of the credentials ("+credOrgId+") does not match the org id of the SDO device ("+deviceOrgId+")")
+}
+
+// Verify the credentials are those of a node or an agbot of the org. Returns the identity, or nil if they are neither, or error
+func exchangeAuthenticateNodeOrAgbot(currentExchangeUrl, certPath, credOrgId, id, token string) (*ExchangeUser, *HttpError) {
+	httpClient, httpErr := GetHTTPClient(certPath)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	for _, identity := range []struct{ resource, role string }{{"nodes", RoleNode}, {"agbots", RoleAgbot}} {
+		method := http.MethodGet
+		url := fmt.Sprintf("%v/orgs/%v/%v/%v", currentExchangeUrl, credOrgId, identity.resource, id)
+		apiMsg := fmt.Sprintf("%v %v", method, url)
+		Verbose("confirming credentials via %s", apiMsg)
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			return nil, NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
+		}
+		req.SetBasicAuth(credOrgId+"/"+id, token)
+		req.Header.Add("Accept", "application/json")
+		resp, httpErr := ExchangeCallBreaker.Do(httpClient, req, apiMsg)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return &ExchangeUser{Org: credOrgId, Name: id, Role: identity.role}, nil
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			continue // not this kind of identity
+		default:
+			return nil, NewHttpError(resp.StatusCode, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
+		}
+	}
+	return nil, nil
+}
+
+// Verify the user exists in the exchange, using the exchange credentials of the client's request (which must be able to read the
+// user, e.g. an org admin)
+func ExchangeUserExists(r *http.Request, currentExchangeUrl, certificatePath, orgId, user string) (bool, *HttpError) {
+	credOrgId, credUser, pwOrKey, ok := GetExchangeCredentials(r, orgId)
+	if !ok {
+		return false, NewHttpError(http.StatusUnauthorized, "invalid exchange credentials provided")
+	}
+	method := http.MethodGet
+	url := fmt.Sprintf("%v/orgs/%v/users/%v", currentExchangeUrl, orgId, user)
+	apiMsg := fmt.Sprintf("%v %v", method, url)
+	if httpErr := introspectedTokenError(r, apiMsg); httpErr != nil {
+		return false, httpErr
+	}
+	Verbose("running %s", apiMsg)
+
+	req, err := http.NewRequestWithContext(r.Context(), method, url, nil)
+	if err != nil {
+		return false, NewHttpError(http.StatusInternalServerError, "unable to create HTTP request for %s, error: %v", apiMsg, err)
+	}
+	req.SetBasicAuth(credOrgId+"/"+credUser, pwOrKey)
+	req.Header.Add("Accept", "application/json")
+
+	certPath := ""
+	if PathExists(certificatePath) {
+		certPath = certificatePath
+	}
+	httpClient, httpErr := GetHTTPClient(certPath)
+	if httpErr != nil {
+		return false, httpErr
+	}
+	resp, httpErr := ExchangeCallBreaker.Do(httpClient, req, apiMsg)
+	if httpErr != nil {
+		return false, httpErr
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if resp.StatusCode == http.StatusUnauthorized {
+			AuthCache.Invalidate(credOrgId, credUser) // the credentials are no longer valid
+		}
+		return false, NewHttpError(http.StatusForbidden, "the credentials are not authorized for %s", apiMsg)
 	}
+	return false, NewHttpError(resp.StatusCode, "unexpected http status code received from %s: %d", apiMsg, resp.StatusCode)
 }
 
 func GetHTTPClient(certPath string) (*http.Client, *HttpError) {
@@ -0,0 +1,151 @@
+package outils
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+Role based authorization of the API. Every exchange identity that calls the API has 1 role, and the permission matrix lists what
+each role is allowed to do, as rules of the form <method>:<resource>, where either can be *. For example GET:vouchers allows
+reading vouchers, and *:keys allows everything on owner keys. The matrix is set with:
+	SDO_API_PERMISSIONS: semicolon-separated list of <role>=<rule>,<rule>,... The roles that are not listed keep their default
+		rules, and a role listed without rules (e.g. node=) is not allowed to do anything. For example, to make org admins the
+		only users that can change owner keys: user=GET:*,POST:vouchers,PUT:vouchers
+The roles are: orgadmin, user (exchange users that are not org admins), node, agbot, and hubadmin. By default org admins can do
+everything, users everything except delete (the handlers also restrict some key operations to org admins), and the others nothing.
+*/
+
+const (
+	RoleOrgAdmin = "orgadmin"
+	RoleUser     = "user"
+	RoleNode     = "node"
+	RoleAgbot    = "agbot"
+	RoleHubAdmin = "hubadmin"
+
+	ApiResourceVouchers = "vouchers"
+	ApiResourceKeys     = "keys"
+
+	permissionAny = "*"
+)
+
+var apiRoles = []string{RoleOrgAdmin, RoleUser, RoleNode, RoleAgbot, RoleHubAdmin}
+var apiResources = []string{ApiResourceVouchers, ApiResourceKeys}
+var apiMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+
+// 1 rule of the permission matrix
+type ApiPermissionRule struct {
+	Method   string // an http method, or *
+	Resource string // an ApiResource* value, or *
+}
+
+func (rule ApiPermissionRule) String() string {
+	return rule.Method + ":" + rule.Resource
+}
+
+// The permission matrix: the rules of each role
+type ApiPermissions map[string][]ApiPermissionRule
+
+// The default permissions: org admins can do everything, the other exchange users of the org everything except delete, and other
+// identities nothing
+func DefaultApiPermissions() ApiPermissions {
+	return ApiPermissions{
+		RoleOrgAdmin: {{Method: permissionAny, Resource: permissionAny}},
+		RoleUser:     {{Method: http.MethodGet, Resource: permissionAny}, {Method: http.MethodPost, Resource: permissionAny}, {Method: http.MethodPut, Resource: permissionAny}},
+		RoleNode:     nil,
+		RoleAgbot:    nil,
+		RoleHubAdmin: nil,
+	}
+}
+
+// Get the permission matrix from the SDO_API_PERMISSIONS env var, using the default rules for the roles that are not in it
+func GetApiPermissionsFromEnv() (ApiPermissions, error) {
+	permissions := DefaultApiPermissions()
+	if value := GetEnvVarWithDefault("SDO_API_PERMISSIONS", ""); value != "" {
+		if err := permissions.parse(value); err != nil {
+			return nil, err
+		}
+	}
+	return permissions, nil
+}
+
+// Set the rules of the roles in the value of SDO_API_PERMISSIONS
+func (p ApiPermissions) parse(value string) error {
+	for _, roleRules := range strings.Split(value, ";") {
+		if roleRules = strings.TrimSpace(roleRules); roleRules == "" {
+			continue
+		}
+		parts := strings.SplitN(roleRules, "=", 2)
+		role := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid permissions %s, the format is <role>=<method>:<resource>,...", roleRules)
+		}
+		if !containsString(apiRoles, role) {
+			return fmt.Errorf("invalid role %s, the valid roles are: %s", role, strings.Join(apiRoles, ", "))
+		}
+		rules := []ApiPermissionRule{}
+		for _, ruleStr := range strings.Split(parts[1], ",") {
+			if ruleStr = strings.TrimSpace(ruleStr); ruleStr == "" {
+				continue
+			}
+			ruleParts := strings.SplitN(ruleStr, ":", 2)
+			if len(ruleParts) != 2 {
+				return fmt.Errorf("invalid permission rule %s of role %s, the format is <method>:<resource>", ruleStr, role)
+			}
+			rule := ApiPermissionRule{Method: strings.ToUpper(strings.TrimSpace(ruleParts[0])), Resource: strings.ToLower(strings.TrimSpace(ruleParts[1]))}
+			if rule.Method != permissionAny && !containsString(apiMethods, rule.Method) {
+				return fmt.Errorf("invalid method %s in permission rule %s of role %s, the valid methods are: %s, *", rule.Method, ruleStr, role, strings.Join(apiMethods, ", "))
+			}
+			if rule.Resource != permissionAny && !containsString(apiResources, rule.Resource) {
+				return fmt.Errorf("invalid resource %s in permission rule %s of role %s, the valid resources are: %s, *", rule.Resource, ruleStr, role, strings.Join(apiResources, ", "))
+			}
+			rules = append(rules, rule)
+		}
+		p[role] = rules
+	}
+	return nil
+}
+
+// Whether the role is allowed to run the method on the resource
+func (p ApiPermissions) Allows(role, method, resource string) bool {
+	for _, rule := range p[role] {
+		if (rule.Method == permissionAny || rule.Method == method) && (rule.Resource == permissionAny || rule.Resource == resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether nodes or agbots are allowed to do anything, so it is worth checking if the credentials are those of a node or agbot
+func (p ApiPermissions) AllowsNodesOrAgbots() bool {
+	return len(p[RoleNode]) > 0 || len(p[RoleAgbot]) > 0
+}
+
+// The matrix in the SDO_API_PERMISSIONS format, for displaying it at startup
+func (p ApiPermissions) String() string {
+	roles := make([]string, 0, len(p))
+	for role := range p {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	roleStrs := make([]string, 0, len(roles))
+	for _, role := range roles {
+		ruleStrs := make([]string, 0, len(p[role]))
+		for _, rule := range p[role] {
+			ruleStrs = append(ruleStrs, rule.String())
+		}
+		roleStrs = append(roleStrs, role+"="+strings.Join(ruleStrs, ","))
+	}
+	return strings.Join(roleStrs, ";")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
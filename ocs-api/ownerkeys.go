@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/keystore"
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+	"github.com/open-horizon/SDO-support/ocs-api/voucher"
+)
+
+/*
+The owner keys are managed directly in the OCS owner keystore (v1/creds/owner-keystore.p12), using the keystore package.
+Each owner key is 3 key pairs (rsa, ecdsa256, ecdsa384) stored under the aliases <org>_<key-name>_<key-type> (lowercase), and their
+public keys concatenated in v1/creds/publicKeys/<org>/<user>/<org>_<key-name>_public-key.pem, which is what the user gives to the
+manufacturer. The callers must hold KeyImportLock.
+*/
+
+const ownerKeyValidity = 3650 * 24 * time.Hour
+
+func ownerKeystoreFileName() string {
+	return OcsDbDir + "/v1/creds/owner-keystore.p12"
+}
+
+func ownerPublicKeyFileName(orgId, user, keyName string) string {
+	return OcsDbDir + "/v1/creds/publicKeys/" + orgId + "/" + user + "/" + strings.ToLower(orgId+"_"+keyName) + "_public-key.pem"
+}
+
+// Return the user whose directory the public key file of the owner key is in, or "" if the org does not have this key.
+// (Key names are unique in an org, even though the public key files are stored per user.)
+func findOwnerKeyUser(orgId, keyName string) (string, *outils.HttpError) {
+	pubKeyDirName := OcsDbDir + "/v1/creds/publicKeys/" + orgId
+	if !outils.PathExists(pubKeyDirName) {
+		return "", nil
+	}
+	userDirs, err := ioutil.ReadDir(filepath.Clean(pubKeyDirName))
+	if err != nil {
+		return "", outils.NewHttpError(http.StatusInternalServerError, "Error reading "+pubKeyDirName+" directory: "+err.Error())
+	}
+	for _, u := range userDirs {
+		if u.IsDir() && outils.PathExists(ownerPublicKeyFileName(orgId, u.Name(), keyName)) {
+			return u.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// Whether the user can change or delete the owner keys of the org: only org admins can, the other users of the org have read-only access
+func canManageOwnerKey(exUser *outils.ExchangeUser) bool {
+	return exUser.Admin
+}
+
+// Move the public key file of the owner key to the directory of another user of the org, which makes them the owner of the key.
+// (The private keys in the keystore are not per user, so they don't change.) The caller must hold the KeyImportLock write lock.
+func transferOwnerKey(orgId, keyName, fromUser, toUser string) *outils.HttpError {
+	fromFileName := ownerPublicKeyFileName(orgId, fromUser, keyName)
+	toFileName := ownerPublicKeyFileName(orgId, toUser, keyName)
+	if err := os.MkdirAll(filepath.Dir(toFileName), 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory "+filepath.Dir(toFileName)+": "+err.Error())
+	}
+	if err := os.Rename(filepath.Clean(fromFileName), filepath.Clean(toFileName)); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not move "+fromFileName+" to "+toFileName+": "+err.Error())
+	}
+	return nil
+}
+
+// Get the owner keystore password from the FS_OWNER_KEYSTORE_PASSWORD line of ocs/ocs.env (written by start-sdo-owner-services.sh)
+func getOwnerKeystorePassword() (string, *outils.HttpError) {
+	fileName := "ocs/ocs.env"
+	envBytes, err := ioutil.ReadFile(filepath.Clean(fileName))
+	if err != nil {
+		return "", outils.NewHttpError(http.StatusInternalServerError, "could not read "+fileName+": "+err.Error())
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(envBytes))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "FS_OWNER_KEYSTORE_PASSWORD=") {
+			return strings.TrimPrefix(line, "FS_OWNER_KEYSTORE_PASSWORD="), nil
+		}
+	}
+	return "", outils.NewHttpError(http.StatusInternalServerError, "FS_OWNER_KEYSTORE_PASSWORD not found in "+fileName)
+}
+
+// Read the owner keystore. Also returns its password, to save it with.
+func loadOwnerKeystore() (*keystore.Keystore, string, *outils.HttpError) {
+	password, httpErr := getOwnerKeystorePassword()
+	if httpErr != nil {
+		return nil, "", httpErr
+	}
+	ks, err := keystore.Load(ownerKeystoreFileName(), password)
+	if err != nil {
+		return nil, "", outils.NewHttpError(http.StatusInternalServerError, "could not read "+ownerKeystoreFileName()+": "+err.Error())
+	}
+	return ks, password, nil
+}
+
+// The request body of POST /api/orgs/{org-id}/keys: the key name and the values for the key certificates
+type OwnerKeyInput struct {
+	Key_name     string `json:"key_name"`
+	Common_name  string `json:"common_name"`
+	Email_name   string `json:"email_name"`
+	Company_name string `json:"company_name"`
+	Country_name string `json:"country_name"`
+	State_name   string `json:"state_name"`
+	Locale_name  string `json:"locale_name"`
+}
+
+// Key name must not contain any characters that cant be stored in a file name.
+// Also can't allow underscores - since orgs can also have them, it could result in 2 different combos of org and key name having the same private key alias
+func validateOwnerKeyName(keyName string) *outils.HttpError {
+	var isStringAlphabetic = regexp.MustCompile(`^[a-z0-9\-]*$`).MatchString
+	if !isStringAlphabetic(keyName) {
+		return outils.NewHttpError(http.StatusBadRequest, "Key Name can only contain lowercase characters, numbers, and hyphens.")
+	}
+	return nil
+}
+
+// Parse and validate the request body of creating an owner key. Returns the key name and the certificate subject.
+func readOwnerKeyInput(r *http.Request, deviceOrgId string) (string, keystore.Subject, *outils.HttpError) {
+	// Verify content type
+	if httpErr := outils.IsValidPostBinary(r); httpErr == nil {
+		return "", keystore.Subject{}, outils.NewHttpError(http.StatusBadRequest, "Error: Passing a key pair tar file into this API is no longer supported. Use POST /api/orgs/{org-id}/keys/import to import an existing key pair.")
+	}
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		return "", keystore.Subject{}, outils.NewHttpError(httpErr.Code, "Error: This API only supports json.")
+	}
+
+	info := OwnerKeyInput{}
+	if httpErr := outils.ReadJsonBody(r, &info); httpErr != nil {
+		return "", keystore.Subject{}, httpErr
+	}
+
+	if httpErr := validateOwnerKeyName(info.Key_name); httpErr != nil {
+		return "", keystore.Subject{}, httpErr
+	}
+	if len(info.Country_name) > 2 {
+		return "", keystore.Subject{}, outils.NewHttpError(http.StatusBadRequest, "Country name must be a 2 Letter Country Code.")
+	}
+	if info.Key_name == "" || info.Common_name == "" || info.Email_name == "" || info.Company_name == "" || info.Country_name == "" || info.State_name == "" || info.Locale_name == "" {
+		return "", keystore.Subject{}, outils.NewHttpError(http.StatusBadRequest, "All of the key information fields must be specified.")
+	}
+
+	subject := keystore.Subject{CommonName: info.Common_name, Email: info.Email_name, Organization: info.Company_name, OrganizationalUnit: deviceOrgId, Country: info.Country_name, State: info.State_name, Locality: info.Locale_name}
+	return info.Key_name, subject, nil
+}
+
+// The request body of PUT /api/orgs/{org-id}/keys/{key-name}/owner
+type KeyOwnerInput struct {
+	Owner string `json:"owner"` // the user name, without the org prefix
+}
+
+// Parse and validate the request body of transferring an owner key. Returns the user name of the new owner.
+func readKeyOwnerInput(r *http.Request, deviceOrgId string) (string, *outils.HttpError) {
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		return "", outils.NewHttpError(httpErr.Code, "Error: This API only supports json.")
+	}
+	info := KeyOwnerInput{}
+	if httpErr := outils.ReadJsonBody(r, &info); httpErr != nil {
+		return "", httpErr
+	}
+	if info.Owner == "" || strings.ContainsAny(info.Owner, "/\\") || strings.Contains(info.Owner, "..") {
+		return "", outils.NewHttpError(http.StatusBadRequest, "owner must be specified, as the name of a user in org "+deviceOrgId+" (without the org prefix).")
+	}
+	return info.Owner, nil
+}
+
+// The request body of POST /api/orgs/{org-id}/keys/import: the key name and the key pairs, either as PEM or as a PKCS#12 keystore
+type OwnerKeyImportInput struct {
+	Key_name string `json:"key_name"`
+	Pem      string `json:"pem"`      // the private keys and their certificates
+	Pkcs12   string `json:"pkcs12"`   // base64 encoded
+	Password string `json:"password"` // of the PKCS#12 keystore
+}
+
+// Parse and validate the request body of importing an owner key. Returns the key name and the key pairs. The body contains private
+// keys, so it and the values in it must never be logged.
+func readOwnerKeyImportInput(r *http.Request) (string, []*keystore.Entry, *outils.HttpError) {
+	if httpErr := outils.IsValidPostJson(r); httpErr != nil {
+		return "", nil, outils.NewHttpError(httpErr.Code, "Error: This API only supports json.")
+	}
+	info := OwnerKeyImportInput{}
+	if httpErr := outils.ReadJsonBody(r, &info); httpErr != nil {
+		return "", nil, httpErr
+	}
+	if httpErr := validateOwnerKeyName(info.Key_name); httpErr != nil {
+		return "", nil, httpErr
+	}
+	if info.Key_name == "" {
+		return "", nil, outils.NewHttpError(http.StatusBadRequest, "key_name must be specified.")
+	}
+	if (info.Pem == "") == (info.Pkcs12 == "") {
+		return "", nil, outils.NewHttpError(http.StatusBadRequest, "Exactly 1 of pem or pkcs12 must be specified.")
+	}
+
+	// Note: the keystore errors never contain key material, so they can be returned to the client
+	if info.Pem != "" {
+		keyPairs, err := keystore.ParsePem([]byte(info.Pem))
+		if err != nil {
+			return "", nil, outils.NewHttpError(http.StatusBadRequest, "Error reading pem: "+err.Error())
+		}
+		return info.Key_name, keyPairs, nil
+	}
+
+	pfxBytes, err := base64.StdEncoding.DecodeString(info.Pkcs12)
+	if err != nil {
+		return "", nil, outils.NewHttpError(http.StatusBadRequest, "pkcs12 must be base64 encoded: "+err.Error())
+	}
+	ks, err := keystore.Decode(pfxBytes, info.Password)
+	if err != nil {
+		return "", nil, outils.NewHttpError(http.StatusBadRequest, "Error reading pkcs12: "+err.Error())
+	}
+	keyPairs := []*keystore.Entry{}
+	for _, alias := range ks.Aliases() {
+		if entry := ks.Get(alias); entry.PrivateKey != nil {
+			keyPairs = append(keyPairs, entry)
+		}
+	}
+	return info.Key_name, keyPairs, nil
+}
+
+// Create the 3 key pairs of the owner key, add them to the owner keystore, and write their public keys to the public key file.
+// If expired is true, the certificates are already expired (for dev/test).
+func createOwnerKey(orgId, user, keyName string, subject keystore.Subject, expired bool) *outils.HttpError {
+	notBefore, validity := time.Now(), ownerKeyValidity
+	if expired {
+		notBefore, validity = notBefore.AddDate(0, 0, -2), 24*time.Hour
+	}
+	keyPairs := make([]*keystore.Entry, 0, len(keystore.OwnerKeyTypes))
+	for _, keyType := range keystore.OwnerKeyTypes {
+		key, err := keystore.GenerateKey(keyType)
+		if err != nil {
+			return outils.NewHttpError(http.StatusInternalServerError, "could not generate the "+string(keyType)+" key: "+err.Error())
+		}
+		cert, err := keystore.NewSelfSignedCertificate(key, subject, notBefore, validity)
+		if err != nil {
+			return outils.NewHttpError(http.StatusInternalServerError, "could not create the "+string(keyType)+" certificate: "+err.Error())
+		}
+		keyPairs = append(keyPairs, &keystore.Entry{PrivateKey: key, Certificates: []*x509.Certificate{cert}})
+	}
+	return addOwnerKey(orgId, user, keyName, keyPairs)
+}
+
+// Add the key pairs of the owner key (at most 1 of each owner key type) to the owner keystore, and write their public keys to the public
+// key file. The aliases of the entries are set by this function.
+func addOwnerKey(orgId, user, keyName string, keyPairs []*keystore.Entry) *outils.HttpError {
+	byType := map[keystore.KeyType]*keystore.Entry{}
+	for _, keyPair := range keyPairs {
+		keyType, err := keyPair.OwnerKeyType()
+		if err != nil {
+			return outils.NewHttpError(http.StatusBadRequest, err.Error())
+		}
+		if byType[keyType] != nil {
+			return outils.NewHttpError(http.StatusBadRequest, "more than 1 "+string(keyType)+" key pair was specified")
+		}
+		byType[keyType] = keyPair
+	}
+	if len(byType) == 0 {
+		return outils.NewHttpError(http.StatusBadRequest, "no key pairs were specified")
+	}
+
+	ks, password, httpErr := loadOwnerKeystore()
+	if httpErr != nil {
+		return httpErr
+	}
+	var pubKeys bytes.Buffer
+	for _, keyType := range keystore.OwnerKeyTypes {
+		alias := keystore.OwnerKeyAlias(orgId, keyName, keyType)
+		if ks.Get(alias) != nil {
+			return outils.NewHttpError(http.StatusBadRequest, "Key Name "+strings.ToLower(orgId+"_"+keyName)+" Already Used")
+		}
+		keyPair := byType[keyType]
+		if keyPair == nil {
+			continue
+		}
+		keyPair.Alias = alias
+		if err := ks.Add(keyPair); err != nil {
+			return outils.NewHttpError(http.StatusInternalServerError, "could not add "+alias+" to the owner keystore: "+err.Error())
+		}
+
+		// The SDO 1.9+ format of the public key file is: <key-type>:\n<pem>,\n<key-type>:\n<pem>...
+		pemBytes, err := keystore.PublicKeyPem(keyPair.Certificates[0])
+		if err != nil {
+			return outils.NewHttpError(http.StatusInternalServerError, err.Error())
+		}
+		if pubKeys.Len() > 0 {
+			pubKeys.WriteString(",\n")
+		}
+		pubKeys.WriteString(string(keyType) + ":\n")
+		pubKeys.Write(pemBytes)
+	}
+
+	// Write the public key file 1st, so if saving the keystore fails, there are no private keys without a public key file (which couldn't be deleted)
+	pubKeyFileName := ownerPublicKeyFileName(orgId, user, keyName)
+	if err := os.MkdirAll(filepath.Dir(pubKeyFileName), 0750); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not create directory "+filepath.Dir(pubKeyFileName)+": "+err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Clean(pubKeyFileName), pubKeys.Bytes(), 0640); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not write "+pubKeyFileName+": "+err.Error())
+	}
+	if err := ks.Save(ownerKeystoreFileName(), password); err != nil {
+		os.Remove(filepath.Clean(pubKeyFileName))
+		return outils.NewHttpError(http.StatusInternalServerError, "could not write "+ownerKeystoreFileName()+": "+err.Error())
+	}
+	return nil
+}
+
+// The certificate metadata of 1 owner key
+type OwnerKeyCertInfo struct {
+	NotBefore  time.Time // the latest not-before of the certificates of its key pairs
+	NotAfter   time.Time // the earliest not-after of the certificates of its key pairs
+	Algorithms []string  // the algorithm of each key pair, in the order of keystore.OwnerKeyTypes
+	Subject    string    // the subject DN of the certificate of its 1st key pair (the certificates of generated keys all have the same subject)
+}
+
+func (info *OwnerKeyCertInfo) IsExpired() bool { return !time.Now().Before(info.NotAfter) }
+
+// Return the certificate metadata of each owner key of this org, as a map of <org>_<key-name> (lowercase) to its info.
+// Keys that were not created by the ocs-api (like the sample keys) are skipped.
+func getOwnerKeyCertInfos(orgId string) (map[string]*OwnerKeyCertInfo, *outils.HttpError) {
+	ks, _, httpErr := loadOwnerKeystore()
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	infos := make(map[string]*OwnerKeyCertInfo)
+	for _, alias := range ks.Aliases() {
+		orgAndKey, _, ok := keystore.ParseOwnerKeyAlias(alias)
+		if !ok || infos[orgAndKey] != nil {
+			continue // not an owner key, or 1 of the other key pairs of a key we already have
+		}
+		// key names can not contain underscores (but orgs can), so the org is everything before the last underscore
+		if i := strings.LastIndex(orgAndKey, "_"); i < 0 || orgAndKey[:i] != strings.ToLower(orgId) {
+			continue
+		}
+		info := &OwnerKeyCertInfo{}
+		for _, kt := range keystore.OwnerKeyTypes {
+			entry := ks.Get(orgAndKey + "_" + string(kt))
+			if entry == nil || len(entry.Certificates) == 0 {
+				continue // imported keys do not have to have all of the key types
+			}
+			cert := entry.Certificates[0]
+			if info.Subject == "" {
+				info.Subject = cert.Subject.String()
+			}
+			if info.NotBefore.IsZero() || cert.NotBefore.After(info.NotBefore) {
+				info.NotBefore = cert.NotBefore
+			}
+			if info.NotAfter.IsZero() || cert.NotAfter.Before(info.NotAfter) {
+				info.NotAfter = cert.NotAfter
+			}
+			info.Algorithms = append(info.Algorithms, keystore.KeyAlgorithm(cert.PublicKey))
+		}
+		infos[orgAndKey] = info
+	}
+	return infos, nil
+}
+
+// Return the org owner key that matches the public key a voucher is signed over to, or nil
+func findOwnerKey(ownerKey *voucher.PublicKey, orgKeys []OwnerKeyFile) *OwnerKeyFile {
+	for i := range orgKeys {
+		if ownerKey.MatchesPem(orgKeys[i].PemBytes) {
+			return &orgKeys[i]
+		}
+	}
+	return nil
+}
+
+// Return the name of the org owner key the imported voucher of the device is signed over to, or "" if it is not one of them
+// (or the voucher can not be read)
+func getDeviceOwnerKey(deviceUuid string, orgKeys []OwnerKeyFile) string {
+	voucherBytes, err := ioutil.ReadFile(filepath.Clean(OcsDbDir + "/v1/devices/" + deviceUuid + "/voucher.json"))
+	if err != nil {
+		return ""
+	}
+	ownerVoucher, vErr := voucher.Parse(voucherBytes)
+	if vErr != nil {
+		return ""
+	}
+	if key := findOwnerKey(ownerVoucher.OwnerPublicKey(), orgKeys); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+// Remove the 3 key pairs of the owner key from the owner keystore, and its public key file. Key pairs that are missing (from a
+// partial creation) are skipped, so the rest is still cleaned up.
+func deleteOwnerKey(orgId, user, keyName string) *outils.HttpError {
+	ks, password, httpErr := loadOwnerKeystore()
+	if httpErr != nil {
+		return httpErr
+	}
+	for _, keyType := range keystore.OwnerKeyTypes {
+		alias := keystore.OwnerKeyAlias(orgId, keyName, keyType)
+		if err := ks.Delete(alias); errors.Is(err, keystore.ErrAliasNotFound) {
+			outils.Verbose("key %s is not in the owner keystore, skipping it", alias)
+		}
+	}
+	if err := ks.Save(ownerKeystoreFileName(), password); err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not write "+ownerKeystoreFileName()+": "+err.Error())
+	}
+
+	pubKeyFileName := ownerPublicKeyFileName(orgId, user, keyName)
+	if err := os.Remove(filepath.Clean(pubKeyFileName)); err != nil && !os.IsNotExist(err) {
+		return outils.NewHttpError(http.StatusInternalServerError, "could not remove "+pubKeyFileName+": "+err.Error())
+	}
+	return nil
+}
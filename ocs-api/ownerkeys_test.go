@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/open-horizon/SDO-support/ocs-api/data"
+	"github.com/open-horizon/SDO-support/ocs-api/voucher"
+)
+
+func TestFindOwnerKey(t *testing.T) {
+	newTestApi(t)
+	k1, k2, unknown := newTestEcdsaKey(t), newTestEcdsaKey(t), newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &k1.PublicKey)
+	addTestOwnerKey(t, "myorg", "bob", "k2", &k2.PublicKey)
+	orgKeys, httpErr := getOrgOwnerKeys("myorg")
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+
+	for _, test := range []struct {
+		name        string
+		key         interface{}
+		expectedKey string
+	}{
+		{"key of admin", &k1.PublicKey, "k1"},
+		{"key of bob", &k2.PublicKey, "k2"},
+		{"unknown key", &unknown.PublicKey, ""},
+	} {
+		voucherBytes, _ := newTestVoucher(t, test.key)
+		v, vErr := voucher.Parse(voucherBytes)
+		if vErr != nil {
+			t.Fatal(vErr)
+		}
+		found := findOwnerKey(v.OwnerPublicKey(), orgKeys)
+		if (found == nil && test.expectedKey != "") || (found != nil && found.Name != test.expectedKey) {
+			t.Errorf("%s: found %v, expected %q", test.name, found, test.expectedKey)
+		}
+	}
+}
+
+func TestImportVoucherOwnerKey(t *testing.T) {
+	_, api := newTestApi(t)
+	orgKey, otherOrgKey, retiringKey := newTestEcdsaKey(t), newTestEcdsaKey(t), newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &orgKey.PublicKey)
+	addTestOwnerKey(t, "other", "eve", "k1", &otherOrgKey.PublicKey)
+	addTestOwnerKey(t, "myorg", "admin", "old", &retiringKey.PublicKey)
+	if httpErr := retireOwnerKey("myorg", "old", "k1"); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	sampleBlock, _ := pem.Decode([]byte(data.SampleOwnerPublicKey)) // the ec_256 key
+	sampleKey, err := x509.ParsePKIXPublicKey(sampleBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importVoucher := func(key interface{}) (*voucher.ValidationError, string, int) {
+		voucherBytes, deviceUuid := newTestVoucher(t, key)
+		w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes)
+		vErr := &voucher.ValidationError{}
+		if w.Code == http.StatusBadRequest {
+			decodeTestResponse(t, w, vErr)
+		}
+		return vErr, deviceUuid, w.Code
+	}
+
+	// A key of the org
+	if _, deviceUuid, code := importVoucher(&orgKey.PublicKey); code != http.StatusCreated {
+		t.Errorf("voucher signed over to an org key: got %d, expected %d", code, http.StatusCreated)
+	} else if rec := Devices.Get(deviceUuid); rec == nil || rec.OwnerKey != "k1" {
+		t.Errorf("voucher signed over to an org key: device record is %v, expected owner key k1", rec)
+	}
+
+	// A key of another org
+	if vErr, _, code := importVoucher(&otherOrgKey.PublicKey); code != http.StatusBadRequest || vErr.Field != "en[0].bo.pk" {
+		t.Errorf("voucher signed over to a key of another org: got %d %v, expected %d for en[0].bo.pk", code, vErr, http.StatusBadRequest)
+	}
+
+	// The sample key, only accepted when SDO_ALLOW_SAMPLE_OWNER_KEY=true
+	if vErr, _, code := importVoucher(sampleKey); code != http.StatusBadRequest || vErr.Field != "en[0].bo.pk" {
+		t.Errorf("voucher signed over to the sample key: got %d %v, expected %d for en[0].bo.pk", code, vErr, http.StatusBadRequest)
+	}
+	AllowSampleOwnerKey = true
+	if _, deviceUuid, code := importVoucher(sampleKey); code != http.StatusCreated {
+		t.Errorf("voucher signed over to the sample key with SDO_ALLOW_SAMPLE_OWNER_KEY=true: got %d, expected %d", code, http.StatusCreated)
+	} else if rec := Devices.Get(deviceUuid); rec == nil || rec.OwnerKey != "" {
+		t.Errorf("voucher signed over to the sample key: device record is %v, expected no owner key", rec)
+	}
+	AllowSampleOwnerKey = false
+
+	// A retiring key, only accepted for the vouchers that were already imported with it
+	voucherBytes, deviceUuid := newTestVoucher(t, &retiringKey.PublicKey)
+	w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes)
+	vErr := &voucher.ValidationError{}
+	if decodeTestResponse(t, w, vErr); w.Code != http.StatusBadRequest || vErr.Field != "en[0].bo.pk" {
+		t.Errorf("new voucher signed over to a retiring key: got %d %v, expected %d for en[0].bo.pk", w.Code, vErr, http.StatusBadRequest)
+	}
+	if httpErr := Devices.Put(DeviceRecord{DeviceUuid: deviceUuid, Orgid: "myorg", OwnerKey: "old"}); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+		t.Errorf("reimported voucher signed over to a retiring key: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+}
+
+func TestImportKeyPairsOverHttp(t *testing.T) {
+	_, api := newTestApi(t)
+	newTestOwnerKeystore(t)
+	importKey := func(keyName string, overTls bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(OwnerKeyImportInput{Key_name: keyName, Pem: newTestKeyPairPem(t)})
+		req := httptest.NewRequest(http.MethodPost, "/api/orgs/myorg/keys/import", bytes.NewReader(body))
+		req.SetBasicAuth("myorg/admin", testPassword)
+		req.Header.Set("Content-Type", "application/json")
+		if overTls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := importKey("k1", true); w.Code != http.StatusCreated {
+		t.Errorf("over https: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	if w := importKey("k2", false); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "SDO_ALLOW_KEY_IMPORT_OVER_HTTP") {
+		t.Errorf("over http: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusBadRequest)
+	}
+	if user, _ := findOwnerKeyUser("myorg", "k2"); user != "" {
+		t.Error("the key imported over http was added")
+	}
+
+	// Behind a proxy that terminates TLS
+	AllowKeyImportOverHttp = true
+	if w := importKey("k2", false); w.Code != http.StatusCreated {
+		t.Errorf("over http with SDO_ALLOW_KEY_IMPORT_OVER_HTTP=true: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	if user, _ := findOwnerKeyUser("myorg", "k2"); user != "admin" {
+		t.Errorf("the key imported over http is in the dir of user %q, expected admin", user)
+	}
+}
+
+// Only org admins can delete, rotate, or transfer owner keys. The other users of the org can read all of them, including their own.
+func TestManageOwnerKeysAdminOnly(t *testing.T) {
+	_, api := newTestApi(t)
+	newTestOwnerKeystore(t)
+	keyInput := func(keyName string) []byte {
+		body, _ := json.Marshal(OwnerKeyInput{Key_name: keyName, Common_name: "test", Email_name: "test@example.com", Company_name: "test", Country_name: "US", State_name: "NY", Locale_name: "Albany"})
+		return body
+	}
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/keys", "myorg/admin", "application/json", keyInput("k1")); w.Code != http.StatusCreated {
+		t.Fatalf("create key: got %d %s", w.Code, w.Body.String())
+	}
+	// Make bob the owner of the key
+	if w := testRequest(t, api, http.MethodPut, "/api/orgs/myorg/keys/k1/owner", "myorg/admin", "application/json", []byte(`{"owner": "bob"}`)); w.Code != http.StatusNoContent {
+		t.Fatalf("transfer key to bob: got %d %s", w.Code, w.Body.String())
+	}
+
+	for _, test := range []struct {
+		method, path string
+		body         []byte
+	}{
+		{http.MethodDelete, "/api/orgs/myorg/keys/k1", nil},
+		{http.MethodPost, "/api/orgs/myorg/keys/k1/rotate", keyInput("k2")},
+		{http.MethodPut, "/api/orgs/myorg/keys/k1/owner", []byte(`{"owner": "carol"}`)},
+	} {
+		if w := testRequest(t, api, test.method, test.path, "myorg/bob", "application/json", test.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s by the owner of the key: got %d %s, expected %d", test.method, test.path, w.Code, w.Body.String(), http.StatusForbidden)
+		}
+	}
+	if user, _ := findOwnerKeyUser("myorg", "k1"); user != "bob" {
+		t.Errorf("the key belongs to %q, expected bob", user)
+	}
+	for _, user := range []string{"myorg/bob", "myorg/carol"} {
+		if w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/keys/k1", user, "", nil); w.Code != http.StatusOK {
+			t.Errorf("get key by %s: got %d %s, expected %d", user, w.Code, w.Body.String(), http.StatusOK)
+		}
+	}
+
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/keys/k1/rotate", "myorg/admin", "application/json", keyInput("k2")); w.Code != http.StatusCreated {
+		t.Errorf("rotate key by an admin: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusCreated)
+	}
+	if w := testRequest(t, api, http.MethodDelete, "/api/orgs/myorg/keys/k1", "myorg/admin", "", nil); w.Code != http.StatusNoContent {
+		t.Errorf("delete key by an admin: got %d %s, expected %d", w.Code, w.Body.String(), http.StatusNoContent)
+	}
+}
+
+// Checking the new owner in the exchange goes through the exchange retries and circuit breaker
+func TestTransferOwnerKeyExchangeUnavailable(t *testing.T) {
+	ex, api := newTestApi(t)
+	newTestOwnerKeystore(t)
+	body, _ := json.Marshal(OwnerKeyInput{Key_name: "k1", Common_name: "test", Email_name: "test@example.com", Company_name: "test", Country_name: "US", State_name: "NY", Locale_name: "Albany"})
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/keys", "myorg/admin", "application/json", body); w.Code != http.StatusCreated {
+		t.Fatalf("create key: got %d %s", w.Code, w.Body.String())
+	}
+	ex.fail["GET /orgs/myorg/users/bob"] = http.StatusGatewayTimeout
+	w := testRequest(t, api, http.MethodPut, "/api/orgs/myorg/keys/k1/owner", "myorg/admin", "application/json", []byte(`{"owner": "bob"}`))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d %s, expected 503 with Retry-After", w.Code, w.Body.String())
+	}
+	if calls := len(ex.requestsFor(http.MethodGet, "/orgs/myorg/users/bob")); calls != 4 {
+		t.Errorf("the exchange got %d calls for the new owner, expected 4 (with the retries)", calls)
+	}
+}
+
+// If the old key can't be retired, the new key is deleted, so the rotation can be run again
+func TestRotateOwnerKeyRetireFails(t *testing.T) {
+	_, api := newTestApi(t)
+	newTestOwnerKeystore(t)
+	keyInput := func(keyName string) []byte {
+		body, _ := json.Marshal(OwnerKeyInput{Key_name: keyName, Common_name: "test", Email_name: "test@example.com", Company_name: "test", Country_name: "US", State_name: "NY", Locale_name: "Albany"})
+		return body
+	}
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/keys", "myorg/admin", "application/json", keyInput("k1")); w.Code != http.StatusCreated {
+		t.Fatalf("create key: got %d %s", w.Code, w.Body.String())
+	}
+
+	// The states file can't be written, because its temp file name is a dir
+	if err := os.MkdirAll(ownerKeyStatesFileName()+".tmp", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/keys/k1/rotate", "myorg/admin", "application/json", keyInput("k2")); w.Code != http.StatusInternalServerError {
+		t.Errorf("rotate with the states file failing: got %d %s, expected 500", w.Code, w.Body.String())
+	}
+	if user, _ := findOwnerKeyUser("myorg", "k2"); user != "" {
+		t.Errorf("the new key was not deleted, it belongs to %q", user)
+	}
+
+	if err := os.Remove(ownerKeyStatesFileName() + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/keys/k1/rotate", "myorg/admin", "application/json", keyInput("k2")); w.Code != http.StatusCreated {
+		t.Errorf("rotate again: got %d %s, expected 201", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Declarative route table for the ocs-api. Each route is a method, a path pattern, and a handler. Path patterns are literal
+paths with {name} placeholders for the variable segments, e.g. /api/orgs/{org-id}/vouchers/{device-id}. Any value of a
+placeholder is a single, non-empty path segment.
+*/
+
+// The values of the {name} placeholders of the path pattern, for the path of the current request
+type PathParams map[string]string
+
+type RouteHandler func(params PathParams, w http.ResponseWriter, r *http.Request)
+
+type Route struct {
+	Method     string
+	Pattern    string
+	Handler    RouteHandler
+	regex      *regexp.Regexp
+	paramNames []string
+}
+
+// Run before the handler of every route. Returns the request to pass to the handler, or false if the request is not allowed, in which
+// case it has written the error response.
+type RouteAuthorizer func(route *Route, params PathParams, w http.ResponseWriter, r *http.Request) (*http.Request, bool)
+
+type Router struct {
+	routes    []*Route
+	Authorize RouteAuthorizer // optional
+}
+
+var placeholderRegex = regexp.MustCompile(`\{([^/{}]+)\}`)
+
+// Add a route to the router. Panics if the pattern is malformed, because that is a programming error that should be caught at startup.
+func (rt *Router) Handle(method, pattern string, handler RouteHandler) {
+	route := &Route{Method: method, Pattern: pattern, Handler: handler}
+	regexStr := "^"
+	lastIndex := 0
+	for _, loc := range placeholderRegex.FindAllStringSubmatchIndex(pattern, -1) {
+		regexStr += regexp.QuoteMeta(pattern[lastIndex:loc[0]]) + `([^/]+)`
+		route.paramNames = append(route.paramNames, pattern[loc[2]:loc[3]])
+		lastIndex = loc[1]
+	}
+	regexStr += regexp.QuoteMeta(pattern[lastIndex:]) + "$"
+	route.regex = regexp.MustCompile(regexStr)
+	rt.routes = append(rt.routes, route)
+}
+
+// Find the route for this request and run it. If the path exists, but not for this method, 405 is returned with the Allow header,
+// and OPTIONS requests are answered automatically with the Allow header. HEAD requests are run by the GET route of the path (the
+// http server doesn't send the body of HEAD responses).
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	outils.Verbose("Handling %s %s ...", r.Method, r.URL.Path)
+	allowed := map[string]bool{}
+	for _, route := range rt.routes {
+		matches := route.regex.FindStringSubmatch(r.URL.Path)
+		if matches == nil {
+			continue
+		}
+		if route.Method == r.Method || (r.Method == http.MethodHead && route.Method == http.MethodGet) {
+			params := PathParams{}
+			for i, name := range route.paramNames {
+				params[name] = matches[i+1]
+			}
+			if rt.Authorize != nil {
+				var ok bool
+				if r, ok = rt.Authorize(route, params, w, r); !ok {
+					return
+				}
+			}
+			route.Handler(params, w, r)
+			return
+		}
+		allowed[route.Method] = true
+		if route.Method == http.MethodGet {
+			allowed[http.MethodHead] = true
+		}
+	}
+
+	if len(allowed) == 0 {
+		http.Error(w, "Route "+r.URL.Path+" not found", http.StatusNotFound)
+		return
+	}
+
+	allowed[http.MethodOptions] = true
+	methods := make([]string, 0, len(allowed))
+	for m := range allowed {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "Method "+r.Method+" not allowed for route "+r.URL.Path, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestRouter(ran *string) *Router {
+	rt := &Router{}
+	handler := func(method string) RouteHandler {
+		return func(params PathParams, w http.ResponseWriter, r *http.Request) {
+			*ran = method + " " + params["id"]
+			w.Write([]byte("body"))
+		}
+	}
+	rt.Handle(http.MethodGet, "/api/things/{id}", handler(http.MethodGet))
+	rt.Handle(http.MethodDelete, "/api/things/{id}", handler(http.MethodDelete))
+	rt.Handle(http.MethodPost, "/api/things", handler(http.MethodPost))
+	return rt
+}
+
+func TestRouterHeadRunsGetRoute(t *testing.T) {
+	var ran string
+	rt := newTestRouter(&ran)
+	srv := httptest.NewServer(rt)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodHead, srv.URL+"/api/things/123", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || ran != "GET 123" {
+		t.Errorf("HEAD got status %d and ran %q, expected 200 and the GET route", resp.StatusCode, ran)
+	}
+	if len(body) != 0 {
+		t.Errorf("HEAD response has a body: %q", body)
+	}
+}
+
+func TestRouterAllow(t *testing.T) {
+	var ran string
+	rt := newTestRouter(&ran)
+	tests := []struct {
+		method, path string
+		code         int
+		allow        string
+	}{
+		{http.MethodOptions, "/api/things/1", http.StatusNoContent, "DELETE, GET, HEAD, OPTIONS"},
+		{http.MethodPut, "/api/things/1", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, OPTIONS"},
+		{http.MethodHead, "/api/things", http.StatusMethodNotAllowed, "OPTIONS, POST"},
+		{http.MethodGet, "/api/nothing", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code || w.Header().Get("Allow") != test.allow {
+			t.Errorf("%s %s: got %d with Allow %q, expected %d with Allow %q", test.method, test.path, w.Code, w.Header().Get("Allow"), test.code, test.allow)
+		}
+	}
+}
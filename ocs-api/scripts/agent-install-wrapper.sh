@@ -6,13 +6,28 @@
 # like agent-install.cfg and agent-install.crt are downloaded by SDO to the same directory.
 
 echo "$0 starting...."
-echo "Will be running: ./agent-install.sh $*"
 
-# Verify the number of args is what we are handling below
-maxArgs=8   # the exec statement below is only passing up to this many args to agent-install.sh
-if [ $# -gt $maxArgs -o "$1" != '-i' -o "$3" != '-a' -o "$5" != '-O' -o "$7" != '-k' ]; then
-    # it is easy to miss this error msg in the midst of the verbose sdo output, so make it more obvious
-    echo "~~~~~~~~~~~~~~~~\nError: too many arguments passed to agent-install-wrapper.sh or the arguments are in the wrong order\n~~~~~~~~~~~~~~~~"
+# The args are: -m <manifest-file> -a <device-uuid>:<node-token>   (the manifest has the rest of the agent-install.sh options)
+# Vouchers imported by older versions of the ocs-api instead pass the agent-install.sh args in this order:
+#   -i <pkgs-from> -a <node-auth> -O <org> -k <cfg-from> [-n <node-policy-file> | -p <pattern>]
+if [ "$1" = '-m' ]; then
+    if [ $# -ne 4 -o "$3" != '-a' ]; then
+        # it is easy to miss this error msg in the midst of the verbose sdo output, so make it more obvious
+        echo "~~~~~~~~~~~~~~~~\nError: the arguments passed to agent-install-wrapper.sh must be: -m <manifest-file> -a <node-auth>\n~~~~~~~~~~~~~~~~"
+        exit 2
+    fi
+    manifestFile="$2"
+    nodeAuth="$4"
+else
+    # Verify the number of args is what we are handling below
+    if [ $# -gt 10 -o "$1" != '-i' -o "$3" != '-a' -o "$5" != '-O' -o "$7" != '-k' ] || { [ $# -gt 8 ] && [ $# -ne 10 -o \( "$9" != '-n' -a "$9" != '-p' \) ]; }; then
+        echo "~~~~~~~~~~~~~~~~\nError: too many arguments passed to agent-install-wrapper.sh or the arguments are in the wrong order\n~~~~~~~~~~~~~~~~"
+        exit 2
+    fi
+fi
+# In both forms of the args, $4 is <device-uuid>:<node-token>. The ocs-api removes the node token after the device is onboarded.
+if [ -z "${4#*:}" ]; then
+    echo "~~~~~~~~~~~~~~~~\nError: the node token of this device was purged after it was onboarded. Generate a new one with the ocs-api: POST /api/orgs/<org>/vouchers/<device-uuid>/token\n~~~~~~~~~~~~~~~~"
     exit 2
 fi
 
@@ -24,18 +39,42 @@ if [ -f /target/boot/inside-sdo-container ]; then
     find . -maxdepth 1 -type f ! -name inside-sdo-container ! -name linux-client ! -name run_csdk_sdo.sh -exec cp -p -t /target/boot/ {} +
     if [ $? -ne 0 ]; then echo "Error: can not copy downloaded files to /target/boot"; fi
     # The <device-uuid>_exec file is not actually saved to disk, so recreate it (with a fixed name)
-    echo "/bin/sh agent-install-wrapper.sh \"$1\" \"$2\" \"$3\" \"$4\" \"$5\" \"$6\" \"$7\" \"$8\" " > /target/boot/device_exec
+    execArgs=''
+    for arg in "$@"; do execArgs="$execArgs \"$arg\""; done
+    echo "/bin/sh agent-install-wrapper.sh$execArgs" > /target/boot/device_exec
     chmod +x /target/boot/device_exec
     echo "Created /target/boot/device_exec: $(cat /target/boot/device_exec)"
     exit
     # now the sdo container will exit, then our owner-boot-device script will find the files and run us again
 fi
 
+if [ -n "$manifestFile" ]; then
+    # The manifest is KEY='value' lines generated by the ocs-api
+    if [ ! -f "$manifestFile" ]; then
+        echo "~~~~~~~~~~~~~~~~\nError: manifest file $manifestFile was not downloaded\n~~~~~~~~~~~~~~~~"
+        exit 2
+    fi
+    . "./$manifestFile"
+    if [ "$SDO_MANIFEST_VERSION" != '1' ]; then
+        echo "~~~~~~~~~~~~~~~~\nError: unsupported manifest version $SDO_MANIFEST_VERSION in $manifestFile\n~~~~~~~~~~~~~~~~"
+        exit 2
+    fi
+    pkgsFrom="$SDO_PKGS_FROM"
+    deviceOrgId="$SDO_ORG_ID"
+    cfgFrom="$SDO_CFG_FILE_FROM"
+    # Make the positional args the agent-install.sh args
+    set -- -i "$pkgsFrom" -a "$nodeAuth" -O "$deviceOrgId" -k "$cfgFrom"
+    if [ -n "$SDO_NODE_POLICY" ]; then set -- "$@" -n "$SDO_NODE_POLICY"; fi
+    if [ -n "$SDO_PATTERN" ]; then set -- "$@" -p "$SDO_PATTERN"; fi
+else
+    pkgsFrom="$2"
+    nodeAuth="$4"
+    deviceOrgId="$6"
+    cfgFrom="$8"
+fi
+echo "Will be running: ./agent-install.sh $*"
+
 # Download agent-install.sh
-pkgsFrom="$2"   #future: add a very lightweight arg parser so we are not dependent on these being in a specific order
-nodeAuth="$4"
-deviceOrgId="$6"
-cfgFrom="$8"
 
 #future: When Intel's host native client stops setting these, remove this line
 unset http_proxy https_proxy
@@ -80,10 +119,10 @@ logFile=/var/sdo/agent-install.log
 echo "Logging all output to $logFile"
 
 # If tee is installed, use it so the output can go to both stdout/stderr and the log file
+# Note: the positional args are now the agent-install.sh args, and "$@" keeps each of them quoted to handle spaces in an arg
 if command -v tee >/dev/null 2>&1; then
-    # Note: the individual arg variables need to be listed like this and quoted to handle spaces in an arg
-    exec ./agent-install.sh "$1" "$2" "$3" "$4" "$5" "$6" "$7" "$8" 2>&1 | tee $logFile
+    exec ./agent-install.sh "$@" 2>&1 | tee $logFile
 else
-    exec ./agent-install.sh "$1" "$2" "$3" "$4" "$5" "$6" "$7" "$8" 2>&1 > $logFile
+    exec ./agent-install.sh "$@" 2>&1 > $logFile
 fi
 #exit 2   # it only gets here if exec failed
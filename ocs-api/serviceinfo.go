@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/open-horizon/SDO-support/ocs-api/data"
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Per-device service info (SVI) that can be sent with a voucher import. Instead of only the voucher, the import body can be:
+	{
+		"voucher": { <the voucher> },
+		"files": [ { "name": "node.policy.json", "content": "<base64>" } ],
+		"sdoSysMessages": [ { "msg": "exec", "value": "/bin/sh my-setup.sh" } ],
+		"nodePolicy": { "properties": [ { "name": "color", "value": "blue" } ] }   (or "pattern": "<org>/<pattern-name>")
+	}
+Each file is sent to the device (filedesc and write) before agent-install-wrapper.sh is run, so the install can use them. The
+sdo_sys messages are sent in order after agent-install-wrapper.sh is run. The values of these are stored in per-device value files
+in the OCS db: v1/values/<device-uuid>_*  The node policy or pattern is used when agent-install.sh registers the node (see nodepolicy.go),
+and "exchangeNode": { "nodeType": "device", "arch": "amd64" } pre-registers the node in the exchange (see exchangenode.go).
+*/
+
+const (
+	MaxDeviceServiceInfoFiles    = 32
+	MaxDeviceServiceInfoMessages = 32
+)
+
+var serviceInfoFileNameRegex = regexp.MustCompile(`^[A-Za-z0-9_\-][A-Za-z0-9_.\-]*$`)
+
+// The common files of every device, which the per-device files must not overwrite
+var commonServiceInfoFileNames = []string{"agent-install.crt", "agent-install.cfg", "agent-install-wrapper.sh", AgentInstallManifestFileName}
+
+// A file to send to the device
+type DeviceServiceInfoFile struct {
+	Name    string `json:"name"`    // the file name on the device
+	Content string `json:"content"` // base64 encoded
+}
+
+// An sdo_sys message to send to the device. The value is the file name for filedesc, the base64 encoded file content for write,
+// and the command (args separated by spaces) for exec.
+type DeviceServiceInfoMessage struct {
+	Msg   string `json:"msg"`
+	Value string `json:"value"`
+}
+
+// The extra service info of 1 device
+type DeviceServiceInfo struct {
+	Files          []DeviceServiceInfoFile    `json:"files"`
+	SdoSysMessages []DeviceServiceInfoMessage `json:"sdoSysMessages"`
+	NodePolicy     *NodePolicy                `json:"nodePolicy"`
+	Pattern        string                     `json:"pattern"`
+	ExchangeNode   *ExchangeNodeOptions       `json:"exchangeNode"`
+}
+
+// The body of a voucher import that includes per-device service info
+type VoucherImportBody struct {
+	Voucher json.RawMessage `json:"voucher"` // RawMessage keeps the exact bytes of the voucher, which are needed to verify the voucher hashes
+	DeviceServiceInfo
+}
+
+// 1 per-device value file in v1/values
+type sviValueFile struct {
+	valueId string
+	value   []byte
+}
+
+// Split the body of a voucher import into the voucher and the optional per-device service info. The body is either just the
+// voucher (for backward compatibility) or a VoucherImportBody.
+func parseVoucherImportBody(body []byte) ([]byte, *DeviceServiceInfo, *outils.HttpError) {
+	// Only look at the top level keys, so we don't have to fully parse the voucher twice
+	topLevel := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &topLevel); err != nil {
+		return body, nil, nil // let the voucher parsing report the error
+	}
+	if _, ok := topLevel["voucher"]; !ok {
+		return body, nil, nil
+	}
+
+	importBody := VoucherImportBody{}
+	if err := json.Unmarshal(body, &importBody); err != nil {
+		return nil, nil, outils.NewHttpError(http.StatusBadRequest, "Error parsing the request body: %v", err)
+	}
+	if httpErr := importBody.DeviceServiceInfo.validate(); httpErr != nil {
+		return nil, nil, httpErr
+	}
+	return bytes.TrimSpace(importBody.Voucher), &importBody.DeviceServiceInfo, nil
+}
+
+// Verify the file names, encodings, and messages are all valid, before we write anything
+func (si *DeviceServiceInfo) validate() *outils.HttpError {
+	if len(si.Files) > MaxDeviceServiceInfoFiles {
+		return outils.NewHttpError(http.StatusBadRequest, "a maximum of %d files can be specified", MaxDeviceServiceInfoFiles)
+	}
+	if len(si.SdoSysMessages) > MaxDeviceServiceInfoMessages {
+		return outils.NewHttpError(http.StatusBadRequest, "a maximum of %d sdoSysMessages can be specified", MaxDeviceServiceInfoMessages)
+	}
+	if httpErr := si.validateNodePolicy(); httpErr != nil {
+		return httpErr
+	}
+	if si.ExchangeNode != nil {
+		if httpErr := si.ExchangeNode.validate(); httpErr != nil {
+			return httpErr
+		}
+	}
+	fileNames := map[string]bool{}
+	for _, name := range commonServiceInfoFileNames {
+		fileNames[name] = true
+	}
+	if si.NodePolicy != nil {
+		fileNames[NodePolicyFileName] = true
+	}
+	for i, f := range si.Files {
+		if !serviceInfoFileNameRegex.MatchString(f.Name) {
+			return outils.NewHttpError(http.StatusBadRequest, "files[%d].name must be a file name (without a directory) containing only letters, numbers, '.', '_', and '-'", i)
+		}
+		if fileNames[f.Name] {
+			return outils.NewHttpError(http.StatusBadRequest, "files[%d].name %s is already used", i, f.Name)
+		}
+		fileNames[f.Name] = true
+		if _, err := base64.StdEncoding.DecodeString(f.Content); err != nil {
+			return outils.NewHttpError(http.StatusBadRequest, "files[%d].content is not valid base64: %v", i, err)
+		}
+	}
+	for i, m := range si.SdoSysMessages {
+		switch m.Msg {
+		case data.SdoSysMsgFiledesc:
+			if !serviceInfoFileNameRegex.MatchString(m.Value) {
+				return outils.NewHttpError(http.StatusBadRequest, "sdoSysMessages[%d].value must be a file name (without a directory) containing only letters, numbers, '.', '_', and '-'", i)
+			}
+		case data.SdoSysMsgWrite:
+			if _, err := base64.StdEncoding.DecodeString(m.Value); err != nil {
+				return outils.NewHttpError(http.StatusBadRequest, "sdoSysMessages[%d].value is not valid base64: %v", i, err)
+			}
+		case data.SdoSysMsgExec:
+			if outils.MakeExecCmd(m.Value) == "\x00" {
+				return outils.NewHttpError(http.StatusBadRequest, "sdoSysMessages[%d].value must be a command", i)
+			}
+		default:
+			return outils.NewHttpError(http.StatusBadRequest, "sdoSysMessages[%d].msg must be one of: %s, %s, %s", i, data.SdoSysMsgFiledesc, data.SdoSysMsgWrite, data.SdoSysMsgExec)
+		}
+	}
+	return nil
+}
+
+// Return the svi entries and value files for the per-device files (which go before the exec of agent-install-wrapper.sh), and for
+// the sdo_sys messages (which go after it). The content has already been validated.
+func (si *DeviceServiceInfo) sviEntries(deviceUuid string) ([]data.SviEntry, []data.SviEntry, []sviValueFile, *outils.HttpError) {
+	var fileEntries, msgEntries []data.SviEntry
+	var valueFiles []sviValueFile
+	if si == nil {
+		return fileEntries, msgEntries, valueFiles, nil
+	}
+	if si.NodePolicy != nil {
+		policyBytes, err := json.MarshalIndent(si.NodePolicy, "", "  ")
+		if err != nil {
+			return nil, nil, nil, outils.NewHttpError(http.StatusInternalServerError, "Error encoding the node policy: "+err.Error())
+		}
+		nameValueId := deviceUuid + "_nodepolicy_name"
+		contentValueId := deviceUuid + "_nodepolicy"
+		fileEntries = append(fileEntries, data.NewSviFileEntries(nameValueId, contentValueId)...)
+		valueFiles = append(valueFiles, sviValueFile{valueId: nameValueId, value: []byte(NodePolicyFileName)}, sviValueFile{valueId: contentValueId, value: policyBytes})
+	}
+	for i, f := range si.Files {
+		content, _ := base64.StdEncoding.DecodeString(f.Content)
+		nameValueId := fmt.Sprintf("%s_file%d_name", deviceUuid, i)
+		contentValueId := fmt.Sprintf("%s_file%d", deviceUuid, i)
+		fileEntries = append(fileEntries, data.NewSviFileEntries(nameValueId, contentValueId)...)
+		valueFiles = append(valueFiles, sviValueFile{valueId: nameValueId, value: []byte(f.Name)}, sviValueFile{valueId: contentValueId, value: content})
+	}
+	for i, m := range si.SdoSysMessages {
+		valueId := fmt.Sprintf("%s_msg%d", deviceUuid, i)
+		var value []byte
+		switch m.Msg {
+		case data.SdoSysMsgWrite:
+			value, _ = base64.StdEncoding.DecodeString(m.Value)
+		case data.SdoSysMsgExec:
+			value = []byte(outils.MakeExecCmd(m.Value))
+		default:
+			value = []byte(m.Value)
+		}
+		msgEntries = append(msgEntries, data.NewSdoSysEntry(m.Msg, valueId))
+		valueFiles = append(valueFiles, sviValueFile{valueId: valueId, value: value})
+	}
+	return fileEntries, msgEntries, valueFiles, nil
+}
+
+// Build the content of svi.json: the common files (agent-install.crt is optional), the per-device files, the exec of
+// agent-install-wrapper.sh, and then the per-device sdo_sys messages
+func makeSviJson(deviceUuid string, includeCrt bool, fileEntries, msgEntries []data.SviEntry) ([]byte, *outils.HttpError) {
+	svi := data.NewDeviceSviBuilder(deviceUuid, includeCrt)
+	if err := svi.InsertBefore(data.ExecValueId(deviceUuid), fileEntries...); err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error building svi.json: "+err.Error())
+	}
+	svi.Add(msgEntries...)
+	sviJson, err := svi.Build()
+	if err != nil {
+		return nil, outils.NewHttpError(http.StatusInternalServerError, "Error building svi.json: "+err.Error())
+	}
+	return sviJson, nil
+}
+
+// Remove the per-device value files of this device (the exec file and any service info files)
+func removeDeviceValueFiles(deviceUuid string) *outils.HttpError {
+	fileNames, err := filepath.Glob(OcsDbDir + "/v1/values/" + deviceUuid + "_*")
+	if err != nil {
+		return outils.NewHttpError(http.StatusInternalServerError, "Error listing the value files of device "+deviceUuid+": "+err.Error())
+	}
+	for _, fileName := range fileNames {
+		outils.Verbose("removing %s ...", fileName)
+		if err := os.RemoveAll(filepath.Clean(fileName)); err != nil {
+			return outils.NewHttpError(http.StatusInternalServerError, "could not remove "+fileName+": "+err.Error())
+		}
+	}
+	return nil
+}
+
+// Write the per-device value files
+func writeDeviceValueFiles(valueFiles []sviValueFile) *outils.HttpError {
+	for _, vf := range valueFiles {
+		fileName := OcsDbDir + "/v1/values/" + vf.valueId
+		outils.Verbose("creating %s ...", fileName)
+		if err := ioutil.WriteFile(filepath.Clean(fileName), vf.value, 0644); err != nil {
+			return outils.NewHttpError(http.StatusInternalServerError, "could not create "+fileName+": "+err.Error())
+		}
+	}
+	return nil
+}
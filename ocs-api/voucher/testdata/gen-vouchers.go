@@ -0,0 +1,234 @@
+//go:build ignore
+
+// Generates the test vouchers in this directory, in the json encoding of the SDO 1.1 protocol spec (compact, like the SDO
+// manufacturer and owner services write them). It does not use the voucher package, so the tests check the parser against an
+// independent implementation of the hash chain. Run it from the voucher directory with: go run testdata/gen-vouchers.go
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+const (
+	hashSha256     = 8
+	hashSha384     = 14
+	hmacSha256     = 108
+	hmacSha384     = 114
+	keyRsa2048     = 1
+	keyRsa         = 4
+	keyEcdsaP256   = 13
+	keyEcdsaP384   = 14
+	encodingX509   = 1
+	encodingRsaMod = 2
+)
+
+func main() {
+	p256Mfg := newEcdsaKey(elliptic.P256())
+	p256Owner := newEcdsaKey(elliptic.P256())
+	rsaMfg := newRsaKey(2048)
+	rsaOwner := newRsaKey(2048)
+	p384Mfg := newEcdsaKey(elliptic.P384())
+	p384Owner1 := newEcdsaKey(elliptic.P384())
+	rsa3kOwner2 := newRsaKey(3072)
+	p256Owner3 := newEcdsaKey(elliptic.P256())
+
+	// ECDSA P-256 device, extended to 1 owner
+	writeVoucher("ecdsa256.json", "2d5c8ef0-7b0f-4f6e-9a43-7a0b2c6d0e11", "ecdsa256-device", hashSha256, hmacSha256,
+		p256Mfg, encodingX509, []crypto.Signer{p256Owner})
+	writePublicKey("ecdsa256-owner.pem", p256Owner)
+
+	// RSA 2048 device (manufacturer key in the RSA modulus/exponent encoding), extended to 1 owner
+	writeVoucher("rsa.json", "5e2b1a47-0c9d-4c1e-8f6b-3d7e9a1c2b44", "rsa-device", hashSha256, hmacSha256,
+		rsaMfg, encodingRsaMod, []crypto.Signer{rsaOwner})
+	writePublicKey("rsa-owner.pem", rsaOwner)
+
+	// ECDSA P-384 device, extended 3 times: to a P-384 key, then an RSA 3072 key, then a P-256 key
+	writeVoucher("multi.json", "9a7c3e10-4b2d-4f8a-b6e1-0c5d7f9e3a22", "multi-device", hashSha384, hmacSha384,
+		p384Mfg, encodingX509, []crypto.Signer{p384Owner1, rsa3kOwner2, p256Owner3})
+	writePublicKey("multi-owner.pem", p256Owner3)
+}
+
+func newEcdsaKey(curve elliptic.Curve) crypto.Signer {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	check(err)
+	return key
+}
+
+func newRsaKey(bits int) crypto.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	check(err)
+	return key
+}
+
+func writeVoucher(fileName, guid, deviceInfo string, hashType, hmacType int, mfgKey crypto.Signer, mfgEncoding int, owners []crypto.Signer) {
+	guidBytes := parseGuid(guid)
+	oh := compact(map[string]interface{}{
+		"pv": 113,
+		"pe": mfgEncoding,
+		"r":  []interface{}{1, []interface{}{4, map[string]interface{}{"dn": "rv.example.com", "po": 8040, "pr": "http"}}},
+		"g":  b64(guidBytes),
+		"d":  deviceInfo,
+		"pk": publicKey(mfgKey, mfgEncoding),
+	}, []string{"pv", "pe", "r", "g", "d", "pk"})
+
+	hmacKey := make([]byte, 32)
+	_, err := rand.Read(hmacKey)
+	check(err)
+	hmacFunc := sha256.New
+	if hmacType == hmacSha384 {
+		hmacFunc = sha512.New384
+	}
+	mac := hmac.New(hmacFunc, hmacKey)
+	mac.Write(oh)
+	hmacJson := sizedHash(hmacType, mac.Sum(nil))
+
+	entries := []json.RawMessage{}
+	prev := append(append([]byte{}, oh...), hmacJson...)
+	hc := sizedHash(hashType, digest(hashType, append(guidBytes, []byte(deviceInfo)...)))
+	signer := mfgKey
+	for _, owner := range owners {
+		bo := compact(map[string]interface{}{
+			"hp": json.RawMessage(sizedHash(hashType, digest(hashType, prev))),
+			"hc": json.RawMessage(hc),
+			"pk": publicKey(owner, encodingX509),
+		}, []string{"hp", "hc", "pk"})
+		sig := sign(signer, bo)
+		entry := compact(map[string]interface{}{
+			"bo": json.RawMessage(bo),
+			"pk": []interface{}{0, 0, []interface{}{0}},
+			"sg": []interface{}{len(sig), b64(sig)},
+		}, []string{"bo", "pk", "sg"})
+		entries = append(entries, entry)
+		prev = entry
+		signer = owner
+	}
+
+	voucher := compact(map[string]interface{}{
+		"sz":   len(entries),
+		"oh":   json.RawMessage(oh),
+		"hmac": json.RawMessage(hmacJson),
+		"en":   entries,
+	}, []string{"sz", "oh", "hmac", "en"})
+	check(os.WriteFile(filepath.Join("testdata", fileName), append(voucher, '\n'), 0644))
+}
+
+// The json object with the keys in this order, without whitespace
+func compact(obj map[string]interface{}, keys []string) []byte {
+	out := []byte{'{'}
+	for i, k := range keys {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		keyBytes, _ := json.Marshal(k)
+		valueBytes, err := json.Marshal(obj[k])
+		check(err)
+		out = append(append(append(out, keyBytes...), ':'), valueBytes...)
+	}
+	return append(out, '}')
+}
+
+func publicKey(signer crypto.Signer, encoding int) []interface{} {
+	var keyType int
+	switch key := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		keyType = keyEcdsaP256
+		if key.Curve == elliptic.P384() {
+			keyType = keyEcdsaP384
+		}
+	case *rsa.PublicKey:
+		keyType = keyRsa
+		if key.N.BitLen() == 2048 {
+			keyType = keyRsa2048
+		}
+		if encoding == encodingRsaMod {
+			mod := key.N.Bytes()
+			exp := big.NewInt(int64(key.E)).Bytes()
+			return []interface{}{keyType, encoding, []interface{}{len(mod), b64(mod), len(exp), b64(exp)}}
+		}
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	check(err)
+	return []interface{}{keyType, encoding, []interface{}{len(der), b64(der)}}
+}
+
+func sign(signer crypto.Signer, data []byte) []byte {
+	hashFunc := crypto.SHA256
+	switch key := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P384() {
+			hashFunc = crypto.SHA384
+		}
+	case *rsa.PublicKey:
+		if key.N.BitLen() == 3072 {
+			hashFunc = crypto.SHA384
+		}
+	}
+	h := hashFunc.New()
+	h.Write(data)
+	sig, err := signer.Sign(rand.Reader, h.Sum(nil), hashFunc)
+	check(err)
+	return sig
+}
+
+func digest(hashType int, data []byte) []byte {
+	var h hash.Hash = sha256.New()
+	if hashType == hashSha384 {
+		h = sha512.New384()
+	}
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func sizedHash(hashType int, value []byte) []byte {
+	out, err := json.Marshal([]interface{}{len(value), hashType, b64(value)})
+	check(err)
+	return out
+}
+
+func writePublicKey(fileName string, signer crypto.Signer) {
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	check(err)
+	check(os.WriteFile(filepath.Join("testdata", fileName), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+}
+
+func parseGuid(guid string) []byte {
+	var b []byte
+	for i := 0; i < len(guid); i++ {
+		if guid[i] == '-' {
+			continue
+		}
+		var v byte
+		_, err := fmt.Sscanf(guid[i:i+2], "%02x", &v)
+		check(err)
+		b = append(b, v)
+		i++
+	}
+	return b
+}
+
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func check(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,656 @@
+package voucher
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+/*
+Parsing and validation of SDO ownership vouchers (in the JSON encoding of the SDO protocol spec), so that corrupted or
+tampered vouchers are rejected when they are imported, instead of when the device runs TO2.
+*/
+
+// SDO protocol versions we accept in oh.pv
+var SupportedProtocolVersions = []int{112, 113}
+
+// Hash types
+const (
+	HashTypeSha256     = 8
+	HashTypeSha384     = 14
+	HashTypeHmacSha256 = 108
+	HashTypeHmacSha384 = 114
+)
+
+// Public key types
+const (
+	PubKeyTypeNone       = 0
+	PubKeyTypeRsa2048    = 1
+	PubKeyTypeRsa        = 4
+	PubKeyTypeEcdsaP256  = 13
+	PubKeyTypeEcdsaP384  = 14
+	PubKeyTypeEpid10     = 90
+	PubKeyTypeEpid11     = 91
+	PubKeyTypeEpid20     = 92
+	PubKeyEncodingNone   = 0
+	PubKeyEncodingX509   = 1
+	PubKeyEncodingRsaMod = 2
+	PubKeyEncodingEpid   = 3
+)
+
+const guidLength = 16
+
+// The error returned for a voucher that can not be parsed or is not valid. Field is the json path of the bad field, e.g. en[1].sg
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func newValidationError(field, msg string, args ...interface{}) *ValidationError {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(msg, args...)}
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return "invalid voucher: " + e.Message
+	}
+	return "invalid voucher field " + e.Field + ": " + e.Message
+}
+
+// An SDO Hash or HMAC: [length, type, value]
+type Hash struct {
+	Type  int
+	Value []byte
+}
+
+// An SDO PublicKey: [type, encoding, body]. Key is nil for the none and EPID types.
+type PublicKey struct {
+	Type     int
+	Encoding int
+	Key      crypto.PublicKey
+	Raw      json.RawMessage
+}
+
+// Returns true if this is the same key as the other key
+func (pk *PublicKey) Equal(other crypto.PublicKey) bool {
+	switch key := pk.Key.(type) {
+	case *ecdsa.PublicKey:
+		return key.Equal(other)
+	case *rsa.PublicKey:
+		return key.Equal(other)
+	default:
+		return false
+	}
+}
+
+// Returns true if this key is one of the PEM encoded public keys in this file content (like the owner public key files, which contain several keys)
+func (pk *PublicKey) MatchesPem(pemBytes []byte) bool {
+	rest := pemBytes
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest) // this skips any non-PEM text, like the "rsa:" labels and commas between the keys
+		if block == nil {
+			return false
+		}
+		if other, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil && pk.Equal(other) {
+			return true
+		}
+	}
+}
+
+// A description of the key for error messages, e.g.: ECDSA P-256 public key with SHA256 fingerprint 3a:7f:...
+func (pk *PublicKey) String() string {
+	var keyType string
+	switch key := pk.Key.(type) {
+	case *ecdsa.PublicKey:
+		keyType = "ECDSA " + key.Curve.Params().Name
+	case *rsa.PublicKey:
+		keyType = fmt.Sprintf("RSA %d", key.N.BitLen())
+	default:
+		return fmt.Sprintf("public key of type %d", pk.Type)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pk.Key)
+	if err != nil {
+		return keyType + " public key"
+	}
+	sum := sha256.Sum256(der)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02x", b)
+	}
+	return keyType + " public key with SHA256 fingerprint " + strings.Join(hexBytes, ":")
+}
+
+// The ownership voucher header (oh)
+type Header struct {
+	ProtocolVersion int                      // pv
+	KeyEncoding     int                      // pe
+	Rendezvous      []map[string]interface{} // r
+	Guid            uuid.UUID                // g
+	DeviceInfo      string                   // d
+	PublicKey       *PublicKey               // pk, the manufacturer public key
+	DeviceCertHash  *Hash                    // hdc, optional
+	Raw             json.RawMessage
+}
+
+// One entry (signature block) of the voucher entry chain (en)
+type Entry struct {
+	PrevHash   Hash       // bo.hp
+	HeaderHash Hash       // bo.hc
+	PublicKey  *PublicKey // bo.pk, the key ownership is transferred to by this entry
+	Signature  []byte     // sg, signed by the public key of the previous entry (or oh.pk for the 1st entry)
+	Raw        json.RawMessage
+	RawBody    json.RawMessage
+}
+
+type Voucher struct {
+	Size    int
+	Header  Header
+	Hmac    Hash
+	Entries []Entry
+}
+
+// The public key the voucher has been signed over to, i.e. the key of the last entry
+func (v *Voucher) OwnerPublicKey() *PublicKey {
+	if len(v.Entries) == 0 {
+		return v.Header.PublicKey
+	}
+	return v.Entries[len(v.Entries)-1].PublicKey
+}
+
+// Parse the json voucher and verify the hashes and signatures of its entry chain
+func Parse(voucherBytes []byte) (*Voucher, *ValidationError) {
+	var top struct {
+		Sz   json.RawMessage   `json:"sz"`
+		Oh   json.RawMessage   `json:"oh"`
+		Hmac json.RawMessage   `json:"hmac"`
+		En   []json.RawMessage `json:"en"`
+	}
+	if err := json.Unmarshal(voucherBytes, &top); err != nil {
+		return nil, newValidationError("", "not valid json: %v", err)
+	}
+
+	v := &Voucher{}
+	var vErr *ValidationError
+	if v.Size, vErr = decodeInt(top.Sz, "sz"); vErr != nil {
+		return nil, vErr
+	}
+	if vErr = parseHeader(top.Oh, &v.Header); vErr != nil {
+		return nil, vErr
+	}
+	if vErr = parseHash(top.Hmac, "hmac", &v.Hmac); vErr != nil {
+		return nil, vErr
+	}
+	if v.Hmac.Type != HashTypeHmacSha256 && v.Hmac.Type != HashTypeHmacSha384 {
+		return nil, newValidationError("hmac", "unsupported hmac type %d", v.Hmac.Type)
+	}
+
+	if len(top.En) == 0 {
+		return nil, newValidationError("en", "missing or empty, the voucher has not been extended to an owner")
+	}
+	if v.Size != len(top.En) {
+		return nil, newValidationError("sz", "value %d does not match the number of entries (%d)", v.Size, len(top.En))
+	}
+	for i, rawEntry := range top.En {
+		entry := Entry{}
+		if vErr := parseEntry(rawEntry, fmt.Sprintf("en[%d]", i), &entry); vErr != nil {
+			return nil, vErr
+		}
+		v.Entries = append(v.Entries, entry)
+	}
+
+	if vErr := v.verifyEntries(top.Oh, top.Hmac); vErr != nil {
+		return nil, vErr
+	}
+	return v, nil
+}
+
+func parseHeader(raw json.RawMessage, h *Header) *ValidationError {
+	var oh struct {
+		Pv  json.RawMessage `json:"pv"`
+		Pe  json.RawMessage `json:"pe"`
+		R   json.RawMessage `json:"r"`
+		G   json.RawMessage `json:"g"`
+		D   json.RawMessage `json:"d"`
+		Pk  json.RawMessage `json:"pk"`
+		Hdc json.RawMessage `json:"hdc"`
+	}
+	if len(raw) == 0 {
+		return newValidationError("oh", "missing")
+	}
+	if err := json.Unmarshal(raw, &oh); err != nil {
+		return newValidationError("oh", "not a valid json object: %v", err)
+	}
+	h.Raw = raw
+
+	var vErr *ValidationError
+	if h.ProtocolVersion, vErr = decodeInt(oh.Pv, "oh.pv"); vErr != nil {
+		return vErr
+	}
+	supported := false
+	for _, pv := range SupportedProtocolVersions {
+		if h.ProtocolVersion == pv {
+			supported = true
+		}
+	}
+	if !supported {
+		return newValidationError("oh.pv", "unsupported protocol version %d", h.ProtocolVersion)
+	}
+
+	if h.KeyEncoding, vErr = decodeInt(oh.Pe, "oh.pe"); vErr != nil {
+		return vErr
+	}
+	if h.Rendezvous, vErr = parseRendezvous(oh.R, "oh.r"); vErr != nil {
+		return vErr
+	}
+
+	guidBytes, vErr := decodeBytes(oh.G, "oh.g")
+	if vErr != nil {
+		return vErr
+	}
+	if len(guidBytes) != guidLength {
+		return newValidationError("oh.g", "must be %d bytes, but is %d bytes", guidLength, len(guidBytes))
+	}
+	h.Guid, _ = uuid.FromBytes(guidBytes) // can not fail, we checked the length
+
+	if len(oh.D) == 0 {
+		return newValidationError("oh.d", "missing")
+	}
+	if err := json.Unmarshal(oh.D, &h.DeviceInfo); err != nil {
+		return newValidationError("oh.d", "must be a string")
+	}
+
+	if h.PublicKey, vErr = parsePublicKey(oh.Pk, "oh.pk"); vErr != nil {
+		return vErr
+	}
+	if h.PublicKey.Key == nil {
+		return newValidationError("oh.pk", "the manufacturer public key must be an RSA or ECDSA key")
+	}
+	if h.PublicKey.Encoding != h.KeyEncoding {
+		return newValidationError("oh.pe", "value %d does not match the encoding of oh.pk (%d)", h.KeyEncoding, h.PublicKey.Encoding)
+	}
+
+	if len(oh.Hdc) > 0 {
+		h.DeviceCertHash = &Hash{}
+		if vErr := parseHash(oh.Hdc, "oh.hdc", h.DeviceCertHash); vErr != nil {
+			return vErr
+		}
+	}
+	return nil
+}
+
+// RendezvousInfo is [count, [count, {instr}], ...]
+func parseRendezvous(raw json.RawMessage, field string) ([]map[string]interface{}, *ValidationError) {
+	elems, vErr := decodeArray(raw, field, -1)
+	if vErr != nil {
+		return nil, vErr
+	}
+	if len(elems) < 2 {
+		return nil, newValidationError(field, "must contain at least 1 rendezvous instruction")
+	}
+	count, vErr := decodeInt(elems[0], field+"[0]")
+	if vErr != nil {
+		return nil, vErr
+	}
+	if count != len(elems)-1 {
+		return nil, newValidationError(field+"[0]", "value %d does not match the number of rendezvous instructions (%d)", count, len(elems)-1)
+	}
+
+	instrs := make([]map[string]interface{}, 0, count)
+	for i, e := range elems[1:] {
+		instrField := fmt.Sprintf("%s[%d]", field, i+1)
+		parts, vErr := decodeArray(e, instrField, 2)
+		if vErr != nil {
+			return nil, vErr
+		}
+		if _, vErr := decodeInt(parts[0], instrField+"[0]"); vErr != nil {
+			return nil, vErr
+		}
+		instr := map[string]interface{}{}
+		if err := json.Unmarshal(parts[1], &instr); err != nil || len(instr) == 0 {
+			return nil, newValidationError(instrField+"[1]", "must be a non-empty json object")
+		}
+		instrs = append(instrs, instr)
+	}
+	return instrs, nil
+}
+
+// Entry is {"bo": {"hp": Hash, "hc": Hash, "pk": PublicKey}, "pk": PublicKey, "sg": [length, signature]}
+func parseEntry(raw json.RawMessage, field string, entry *Entry) *ValidationError {
+	var en struct {
+		Bo json.RawMessage `json:"bo"`
+		Sg json.RawMessage `json:"sg"`
+	}
+	if err := json.Unmarshal(raw, &en); err != nil {
+		return newValidationError(field, "not a valid json object: %v", err)
+	}
+	entry.Raw = raw
+	if len(en.Bo) == 0 {
+		return newValidationError(field+".bo", "missing")
+	}
+	entry.RawBody = en.Bo
+
+	var bo struct {
+		Hp json.RawMessage `json:"hp"`
+		Hc json.RawMessage `json:"hc"`
+		Pk json.RawMessage `json:"pk"`
+	}
+	if err := json.Unmarshal(en.Bo, &bo); err != nil {
+		return newValidationError(field+".bo", "not a valid json object: %v", err)
+	}
+	if vErr := parseHash(bo.Hp, field+".bo.hp", &entry.PrevHash); vErr != nil {
+		return vErr
+	}
+	if vErr := parseHash(bo.Hc, field+".bo.hc", &entry.HeaderHash); vErr != nil {
+		return vErr
+	}
+	var vErr *ValidationError
+	if entry.PublicKey, vErr = parsePublicKey(bo.Pk, field+".bo.pk"); vErr != nil {
+		return vErr
+	}
+	if entry.PublicKey.Key == nil {
+		return newValidationError(field+".bo.pk", "the owner public key must be an RSA or ECDSA key")
+	}
+
+	sgParts, vErr := decodeArray(en.Sg, field+".sg", 2)
+	if vErr != nil {
+		return vErr
+	}
+	if entry.Signature, vErr = decodeSizedBytes(sgParts[0], sgParts[1], field+".sg"); vErr != nil {
+		return vErr
+	}
+	return nil
+}
+
+// Verify the hash chain and signatures of the entries:
+// - en[0].bo.hp is the hash of oh||hmac, en[i].bo.hp is the hash of en[i-1]
+// - en[i].bo.hc is the hash of g||d
+// - en[0] is signed by oh.pk, en[i] is signed by en[i-1].bo.pk
+// The hashes and signatures are over the json text of the voucher, which SDO writes without whitespace between the tokens, so the
+// text is compacted first, in case the voucher was pretty printed after it was created.
+func (v *Voucher) verifyEntries(rawOh, rawHmac json.RawMessage) *ValidationError {
+	headerHashInput := append(append([]byte{}, v.Header.Guid[:]...), []byte(v.Header.DeviceInfo)...)
+	prevHashInput := append(compactJson(rawOh), compactJson(rawHmac)...)
+	signer := v.Header.PublicKey
+	signerField := "oh.pk"
+
+	for i, entry := range v.Entries {
+		field := fmt.Sprintf("en[%d]", i)
+		if vErr := verifyHash(&entry.PrevHash, prevHashInput, field+".bo.hp"); vErr != nil {
+			return vErr
+		}
+		if vErr := verifyHash(&entry.HeaderHash, headerHashInput, field+".bo.hc"); vErr != nil {
+			return vErr
+		}
+		if err := verifySignature(signer, compactJson(entry.RawBody), entry.Signature); err != nil {
+			return newValidationError(field+".sg", "signature verification with %s failed: %v", signerField, err)
+		}
+		prevHashInput = compactJson(entry.Raw)
+		signer = entry.PublicKey
+		signerField = field + ".bo.pk"
+	}
+	return nil
+}
+
+func verifyHash(h *Hash, input []byte, field string) *ValidationError {
+	var hasher hash.Hash
+	switch h.Type {
+	case HashTypeSha256:
+		hasher = sha256.New()
+	case HashTypeSha384:
+		hasher = sha512.New384()
+	default:
+		return newValidationError(field, "unsupported hash type %d", h.Type)
+	}
+	hasher.Write(input)
+	if !bytes.Equal(hasher.Sum(nil), h.Value) {
+		return newValidationError(field, "hash does not match, the voucher has been modified or is corrupted")
+	}
+	return nil
+}
+
+func verifySignature(pk *PublicKey, signed, signature []byte) error {
+	hashFunc, err := signatureHash(pk)
+	if err != nil {
+		return err
+	}
+	hasher := hashFunc.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+	switch key := pk.Key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, signature) {
+			return fmt.Errorf("ecdsa signature is not valid")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hashFunc, digest, signature)
+	default:
+		return fmt.Errorf("unsupported signing key type")
+	}
+}
+
+// The hash of the signatures made with the key. The SDO 1.1 crypto suites are: ECDSA P-256 and RSA 2048 (RSASSA-PKCS1-v1_5) with
+// SHA256, and ECDSA P-384 and RSA 3072 with SHA384. Keys of other sizes can not sign vouchers.
+func signatureHash(pk *PublicKey) (crypto.Hash, error) {
+	switch key := pk.Key.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return crypto.SHA256, nil
+		case elliptic.P384():
+			return crypto.SHA384, nil
+		}
+		return 0, fmt.Errorf("unsupported ecdsa curve %s", key.Curve.Params().Name)
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return crypto.SHA256, nil
+		case 3072:
+			return crypto.SHA384, nil
+		}
+		return 0, fmt.Errorf("unsupported rsa key size %d, it must be 2048 or 3072 bits", key.N.BitLen())
+	default:
+		return 0, fmt.Errorf("unsupported signing key type")
+	}
+}
+
+// The json text without the whitespace between the tokens. The text has already been parsed, so it is valid json.
+func compactJson(raw json.RawMessage) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return raw
+	}
+	return buf.Bytes()
+}
+
+// Hash is [length, type, value]
+func parseHash(raw json.RawMessage, field string, h *Hash) *ValidationError {
+	parts, vErr := decodeArray(raw, field, 3)
+	if vErr != nil {
+		return vErr
+	}
+	if h.Type, vErr = decodeInt(parts[1], field+"[1]"); vErr != nil {
+		return vErr
+	}
+	if h.Value, vErr = decodeSizedBytes(parts[0], parts[2], field); vErr != nil {
+		return vErr
+	}
+	switch h.Type {
+	case HashTypeSha256, HashTypeHmacSha256:
+		if len(h.Value) != sha256.Size {
+			return newValidationError(field, "hash type %d must be %d bytes, but is %d bytes", h.Type, sha256.Size, len(h.Value))
+		}
+	case HashTypeSha384, HashTypeHmacSha384:
+		if len(h.Value) != sha512.Size384 {
+			return newValidationError(field, "hash type %d must be %d bytes, but is %d bytes", h.Type, sha512.Size384, len(h.Value))
+		}
+	default:
+		return newValidationError(field+"[1]", "unsupported hash type %d", h.Type)
+	}
+	return nil
+}
+
+// PublicKey is [type, encoding, body], where body depends on the encoding:
+// none: [0], X509: [length, der], RSAMODEXP: [modLength, modulus, expLength, exponent], EPID: [length, groupId]
+func parsePublicKey(raw json.RawMessage, field string) (*PublicKey, *ValidationError) {
+	parts, vErr := decodeArray(raw, field, 3)
+	if vErr != nil {
+		return nil, vErr
+	}
+	pk := &PublicKey{Raw: raw}
+	if pk.Type, vErr = decodeInt(parts[0], field+"[0]"); vErr != nil {
+		return nil, vErr
+	}
+	if pk.Encoding, vErr = decodeInt(parts[1], field+"[1]"); vErr != nil {
+		return nil, vErr
+	}
+	bodyField := field + "[2]"
+
+	switch pk.Encoding {
+	case PubKeyEncodingNone:
+		if pk.Type != PubKeyTypeNone {
+			return nil, newValidationError(field+"[0]", "key type %d requires a key encoding", pk.Type)
+		}
+	case PubKeyEncodingX509:
+		body, vErr := decodeArray(parts[2], bodyField, 2)
+		if vErr != nil {
+			return nil, vErr
+		}
+		der, vErr := decodeSizedBytes(body[0], body[1], bodyField)
+		if vErr != nil {
+			return nil, vErr
+		}
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, newValidationError(bodyField, "not a valid X509 public key: %v", err)
+		}
+		pk.Key = key
+	case PubKeyEncodingRsaMod:
+		body, vErr := decodeArray(parts[2], bodyField, 4)
+		if vErr != nil {
+			return nil, vErr
+		}
+		mod, vErr := decodeSizedBytes(body[0], body[1], bodyField+"[1]")
+		if vErr != nil {
+			return nil, vErr
+		}
+		exp, vErr := decodeSizedBytes(body[2], body[3], bodyField+"[3]")
+		if vErr != nil {
+			return nil, vErr
+		}
+		e := new(big.Int).SetBytes(exp)
+		if len(mod) == 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, newValidationError(bodyField, "not a valid RSA modulus and exponent")
+		}
+		pk.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(mod), E: int(e.Int64())}
+	case PubKeyEncodingEpid:
+		body, vErr := decodeArray(parts[2], bodyField, 2)
+		if vErr != nil {
+			return nil, vErr
+		}
+		if _, vErr := decodeSizedBytes(body[0], body[1], bodyField); vErr != nil {
+			return nil, vErr
+		}
+	default:
+		return nil, newValidationError(field+"[1]", "unsupported key encoding %d", pk.Encoding)
+	}
+
+	// Ensure the key type matches the key that was actually encoded
+	switch pk.Type {
+	case PubKeyTypeNone:
+		if pk.Encoding != PubKeyEncodingNone {
+			return nil, newValidationError(field+"[0]", "key type none can not have key encoding %d", pk.Encoding)
+		}
+	case PubKeyTypeRsa2048, PubKeyTypeRsa:
+		if _, ok := pk.Key.(*rsa.PublicKey); !ok {
+			return nil, newValidationError(field+"[0]", "key type %d is RSA, but the key is not", pk.Type)
+		}
+	case PubKeyTypeEcdsaP256, PubKeyTypeEcdsaP384:
+		curve := elliptic.P256()
+		if pk.Type == PubKeyTypeEcdsaP384 {
+			curve = elliptic.P384()
+		}
+		if key, ok := pk.Key.(*ecdsa.PublicKey); !ok || key.Curve != curve {
+			return nil, newValidationError(field+"[0]", "key type %d is ECDSA %s, but the key is not", pk.Type, curve.Params().Name)
+		}
+	case PubKeyTypeEpid10, PubKeyTypeEpid11, PubKeyTypeEpid20:
+		if pk.Encoding != PubKeyEncodingEpid {
+			return nil, newValidationError(field+"[0]", "key type %d is EPID, but the key encoding is %d", pk.Type, pk.Encoding)
+		}
+	default:
+		return nil, newValidationError(field+"[0]", "unsupported key type %d", pk.Type)
+	}
+	return pk, nil
+}
+
+// Decode a json array and verify it has the expected number of elements (unless expectedLen is -1)
+func decodeArray(raw json.RawMessage, field string, expectedLen int) ([]json.RawMessage, *ValidationError) {
+	if len(raw) == 0 {
+		return nil, newValidationError(field, "missing")
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil || elems == nil {
+		return nil, newValidationError(field, "must be a json array")
+	}
+	if expectedLen >= 0 && len(elems) != expectedLen {
+		return nil, newValidationError(field, "must have %d elements, but has %d", expectedLen, len(elems))
+	}
+	return elems, nil
+}
+
+func decodeInt(raw json.RawMessage, field string) (int, *ValidationError) {
+	if len(raw) == 0 {
+		return 0, newValidationError(field, "missing")
+	}
+	var i int
+	if err := json.Unmarshal(raw, &i); err != nil || i < 0 {
+		return 0, newValidationError(field, "must be a non-negative integer")
+	}
+	return i, nil
+}
+
+func decodeBytes(raw json.RawMessage, field string) ([]byte, *ValidationError) {
+	if len(raw) == 0 {
+		return nil, newValidationError(field, "missing")
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, newValidationError(field, "must be a base64 encoded string")
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, newValidationError(field, "not valid base64: %v", err)
+	}
+	return b, nil
+}
+
+// Decode a base64 value that is preceded by its length in bytes, and verify the length matches, to detect truncation
+func decodeSizedBytes(rawLen, rawValue json.RawMessage, field string) ([]byte, *ValidationError) {
+	length, vErr := decodeInt(rawLen, field+" length")
+	if vErr != nil {
+		return nil, vErr
+	}
+	b, vErr := decodeBytes(rawValue, field)
+	if vErr != nil {
+		return nil, vErr
+	}
+	if len(b) != length {
+		return nil, newValidationError(field, "length is %d, but the value is %d bytes", length, len(b))
+	}
+	return b, nil
+}
@@ -0,0 +1,217 @@
+package voucher
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The vouchers in testdata are made by testdata/gen-vouchers.go
+
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Split the voucher into its top level fields and its entries, so the tests can modify them
+func splitVoucher(t *testing.T, voucherBytes []byte) (map[string]json.RawMessage, []json.RawMessage) {
+	t.Helper()
+	top := map[string]json.RawMessage{}
+	if err := json.Unmarshal(voucherBytes, &top); err != nil {
+		t.Fatal(err)
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(top["en"], &entries); err != nil {
+		t.Fatal(err)
+	}
+	return top, entries
+}
+
+func joinVoucher(t *testing.T, top map[string]json.RawMessage, entries []json.RawMessage) []byte {
+	t.Helper()
+	var err error
+	if top["en"], err = json.Marshal(entries); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Return the voucher with the 1 occurrence of old replaced by new
+func replaceOnce(t *testing.T, voucherBytes []byte, old, new string) []byte {
+	t.Helper()
+	if n := bytes.Count(voucherBytes, []byte(old)); n != 1 {
+		t.Fatalf("%s occurs %d times in the voucher", old, n)
+	}
+	return bytes.Replace(voucherBytes, []byte(old), []byte(new), 1)
+}
+
+func TestParseValid(t *testing.T) {
+	tests := []struct {
+		file, ownerPem, guid, ownerKey string
+		entries                        int
+	}{
+		{"ecdsa256.json", "ecdsa256-owner.pem", "2d5c8ef0-7b0f-4f6e-9a43-7a0b2c6d0e11", "ECDSA P-256", 1},
+		{"rsa.json", "rsa-owner.pem", "5e2b1a47-0c9d-4c1e-8f6b-3d7e9a1c2b44", "RSA 2048", 1},
+		{"multi.json", "multi-owner.pem", "9a7c3e10-4b2d-4f8a-b6e1-0c5d7f9e3a22", "ECDSA P-256", 3},
+	}
+	for _, test := range tests {
+		voucherBytes := readTestFile(t, test.file)
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, voucherBytes, "", "  "); err != nil {
+			t.Fatal(err)
+		}
+		// Pretty printing the voucher does not change the compact json text the hashes and signatures are over
+		for name, b := range map[string][]byte{test.file: voucherBytes, test.file + " indented": indented.Bytes()} {
+			v, vErr := Parse(b)
+			if vErr != nil {
+				t.Errorf("%s: %v", name, vErr)
+				continue
+			}
+			if v.Header.Guid.String() != test.guid || len(v.Entries) != test.entries || v.Size != test.entries {
+				t.Errorf("%s: got guid %s with %d entries, expected %s with %d entries", name, v.Header.Guid, len(v.Entries), test.guid, test.entries)
+			}
+			if !v.OwnerPublicKey().MatchesPem(readTestFile(t, test.ownerPem)) {
+				t.Errorf("%s: the owner key is not the key in %s", name, test.ownerPem)
+			}
+			if !strings.HasPrefix(v.OwnerPublicKey().String(), test.ownerKey+" public key") {
+				t.Errorf("%s: the owner key is %s, expected an %s key", name, v.OwnerPublicKey(), test.ownerKey)
+			}
+		}
+	}
+
+	// A key of the voucher is not the owner key
+	v, vErr := Parse(readTestFile(t, "multi.json"))
+	if vErr != nil {
+		t.Fatal(vErr)
+	}
+	if v.OwnerPublicKey().MatchesPem(readTestFile(t, "ecdsa256-owner.pem")) || v.Entries[0].PublicKey.MatchesPem(readTestFile(t, "multi-owner.pem")) {
+		t.Error("a key matched the pem of another key")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	ecdsa256 := readTestFile(t, "ecdsa256.json")
+	multi := readTestFile(t, "multi.json")
+	multiTop, multiEntries := splitVoucher(t, multi)
+	_, ecdsa256Entries := splitVoucher(t, ecdsa256)
+
+	var ecdsa256Entry struct {
+		Bo struct {
+			Pk json.RawMessage `json:"pk"`
+		} `json:"bo"`
+		Sg []json.RawMessage `json:"sg"`
+	}
+	if err := json.Unmarshal(ecdsa256Entries[0], &ecdsa256Entry); err != nil {
+		t.Fatal(err)
+	}
+	var sigB64 string
+	if err := json.Unmarshal(ecdsa256Entry.Sg[1], &sigB64); err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(sigB64)
+	sig[len(sig)/2] ^= 0xff
+	otherKey := otherP256KeyJson(t)
+
+	// The hmac is not verified (the key is in the device), but it is part of the hash of the 1st entry
+	modifiedHmac := copyTop(multiTop)
+	hmacParts := []json.RawMessage{}
+	if err := json.Unmarshal(modifiedHmac["hmac"], &hmacParts); err != nil {
+		t.Fatal(err)
+	}
+	hmacParts[2] = json.RawMessage(`"` + base64.StdEncoding.EncodeToString(make([]byte, 48)) + `"`)
+	modifiedHmac["hmac"], _ = json.Marshal(hmacParts)
+
+	tests := []struct {
+		name          string
+		voucherBytes  []byte
+		expectedField string
+	}{
+		{"modified device info", replaceOnce(t, ecdsa256, `"d":"ecdsa256-device"`, `"d":"ecdsa256-devicf"`), "en[0].bo.hp"},
+		{"modified hmac", joinVoucher(t, modifiedHmac, multiEntries), "en[0].bo.hp"},
+		{"replaced owner key", replaceOnce(t, ecdsa256, string(ecdsa256Entry.Bo.Pk), otherKey), "en[0].sg"},
+		{"modified signature", replaceOnce(t, ecdsa256, sigB64, base64.StdEncoding.EncodeToString(sig)), "en[0].sg"},
+		{"truncated signature", replaceOnce(t, ecdsa256, sigB64, base64.StdEncoding.EncodeToString(sig[:len(sig)-4])), "en[0].sg"},
+		{"truncated file", ecdsa256[:len(ecdsa256)/2], ""},
+		{"missing last entry", joinVoucher(t, copyTop(multiTop), multiEntries[:2]), "sz"},
+		{"missing middle entry", joinVoucher(t, withSize(copyTop(multiTop), 2), []json.RawMessage{multiEntries[0], multiEntries[2]}), "en[1].bo.hp"},
+		{"reordered entries", joinVoucher(t, copyTop(multiTop), []json.RawMessage{multiEntries[0], multiEntries[2], multiEntries[1]}), "en[1].bo.hp"},
+		{"entry of another voucher", joinVoucher(t, withSize(copyTop(multiTop), 1), ecdsa256Entries), "en[0].bo.hp"},
+		{"no entries", joinVoucher(t, withSize(copyTop(multiTop), 0), []json.RawMessage{}), "en"},
+		{"unsupported protocol version", replaceOnce(t, ecdsa256, `"pv":113`, `"pv":100`), "oh.pv"},
+	}
+
+	for _, test := range tests {
+		v, vErr := Parse(test.voucherBytes)
+		if vErr == nil {
+			t.Errorf("%s: voucher %s was accepted", test.name, v.Header.Guid)
+			continue
+		}
+		if vErr.Field != test.expectedField {
+			t.Errorf("%s: got error for field %q (%v), expected field %q", test.name, vErr.Field, vErr, test.expectedField)
+		}
+	}
+}
+
+func TestSignatureHash(t *testing.T) {
+	v, vErr := Parse(readTestFile(t, "multi.json"))
+	if vErr != nil {
+		t.Fatal(vErr)
+	}
+	// The keys of the multi voucher are P-384, P-384, RSA 3072, P-256
+	expected := []string{"SHA-384", "SHA-384", "SHA-384", "SHA-256"}
+	keys := []*PublicKey{v.Header.PublicKey, v.Entries[0].PublicKey, v.Entries[1].PublicKey, v.Entries[2].PublicKey}
+	for i, pk := range keys {
+		hashFunc, err := signatureHash(pk)
+		if err != nil || hashFunc.String() != expected[i] {
+			t.Errorf("key %d (%s): got %v %v, expected %s", i, pk, hashFunc, err, expected[i])
+		}
+	}
+
+	rsaVoucher, vErr := Parse(readTestFile(t, "rsa.json"))
+	if vErr != nil {
+		t.Fatal(vErr)
+	}
+	if hashFunc, err := signatureHash(rsaVoucher.Header.PublicKey); err != nil || hashFunc.String() != "SHA-256" {
+		t.Errorf("RSA 2048 key: got %v %v, expected SHA-256", hashFunc, err)
+	}
+}
+
+func copyTop(top map[string]json.RawMessage) map[string]json.RawMessage {
+	c := map[string]json.RawMessage{}
+	for k, v := range top {
+		c[k] = v
+	}
+	return c
+}
+
+func withSize(top map[string]json.RawMessage, size int) map[string]json.RawMessage {
+	top["sz"], _ = json.Marshal(size)
+	return top
+}
+
+// The SDO json of the owner key of the multi voucher, which is a P-256 key like the owner key of the ecdsa256 voucher
+func otherP256KeyJson(t *testing.T) string {
+	t.Helper()
+	_, entries := splitVoucher(t, readTestFile(t, "multi.json"))
+	var entry struct {
+		Bo struct {
+			Pk json.RawMessage `json:"pk"`
+		} `json:"bo"`
+	}
+	if err := json.Unmarshal(entries[2], &entry); err != nil {
+		t.Fatal(err)
+	}
+	return string(entry.Bo.Pk)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/open-horizon/SDO-support/ocs-api/outils"
+)
+
+/*
+Paging and filtering for GET /api/orgs/{org-id}/vouchers. The vouchers are listed in device uuid order, so the uuid of the last
+voucher of a page can be used as the cursor (?after=<uuid>) to get the next page.
+*/
+
+const MaxVoucherListLimit = 10000
+
+// The query parameters of GET /api/orgs/{org-id}/vouchers
+type VoucherListOptions struct {
+	Limit         int       // 0 means no limit
+	Offset        int       // number of matching vouchers to skip
+	After         string    // cursor: only list vouchers with a device uuid greater than this
+	ImportedAfter time.Time // zero means no filter
+	State         string    // one of the DeviceState* constants, or "" for no filter
+	HasNodeToken  *bool     // nil means no filter
+	Long          bool      // return metadata of each voucher instead of only the device uuid
+}
+
+// 1 element of the response body of GET /api/orgs/{org-id}/vouchers?long=true
+type VoucherMeta struct {
+	DeviceUuid   string `json:"deviceUuid"`
+	Orgid        string `json:"orgid"`
+	State        string `json:"state"`
+	ImportedAt   string `json:"importedAt"`
+	HasNodeToken bool   `json:"hasNodeToken"`
+}
+
+// Parse and validate the query parameters
+func getVoucherListOptions(query url.Values) (*VoucherListOptions, *outils.HttpError) {
+	opts := &VoucherListOptions{}
+	var err error
+	if s := query.Get("limit"); s != "" {
+		if opts.Limit, err = strconv.Atoi(s); err != nil || opts.Limit < 1 || opts.Limit > MaxVoucherListLimit {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "limit must be an integer from 1 to %d", MaxVoucherListLimit)
+		}
+	}
+	if s := query.Get("offset"); s != "" {
+		if opts.Offset, err = strconv.Atoi(s); err != nil || opts.Offset < 0 {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "offset must be a non-negative integer")
+		}
+	}
+	opts.After = query.Get("after")
+	if s := query.Get("importedAfter"); s != "" {
+		if opts.ImportedAfter, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "importedAfter must be an RFC 3339 timestamp, e.g. 2021-06-18T12:36:23Z")
+		}
+	}
+	if s := query.Get("state"); s != "" {
+		switch s {
+		case DeviceStateImported, DeviceStateTo0Registered, DeviceStateTo2InProgress, DeviceStateOnboarded, DeviceStateFailed:
+			opts.State = s
+		default:
+			return nil, outils.NewHttpError(http.StatusBadRequest, "state must be one of: %s, %s, %s, %s, %s", DeviceStateImported, DeviceStateTo0Registered, DeviceStateTo2InProgress, DeviceStateOnboarded, DeviceStateFailed)
+		}
+	}
+	if s := query.Get("hasNodeToken"); s != "" {
+		hasNodeToken, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "hasNodeToken must be true or false")
+		}
+		opts.HasNodeToken = &hasNodeToken
+	}
+	if s := query.Get("long"); s != "" {
+		if opts.Long, err = strconv.ParseBool(s); err != nil {
+			return nil, outils.NewHttpError(http.StatusBadRequest, "long must be true or false")
+		}
+	}
+	return opts, nil
+}
+
+// List the vouchers in this org that match the filters of opts. Returns 1 page of vouchers, the total number of matching
+// vouchers, and whether there are more matching vouchers after this page. The other filters only need the index records, so state.json
+// is only read for every voucher when filtering by state, otherwise only for the vouchers of the page (if opts.Long).
+func listOrgVouchers(orgId string, opts *VoucherListOptions) ([]VoucherMeta, int, bool, *outils.HttpError) {
+	vouchers := []VoucherMeta{}
+	total := 0
+	for _, rec := range Devices.ListOrg(orgId) { // sorted by device uuid
+		if opts.After != "" && rec.DeviceUuid <= opts.After {
+			continue
+		}
+		if !opts.ImportedAfter.IsZero() {
+			if importedAt, err := time.Parse(time.RFC3339, rec.ImportedAt); err != nil || !importedAt.After(opts.ImportedAfter) {
+				continue
+			}
+		}
+		if opts.HasNodeToken != nil && rec.HasNodeToken() != *opts.HasNodeToken {
+			continue
+		}
+		state := ""
+		if opts.State != "" {
+			status, httpErr := getDeviceStatus(&rec)
+			if httpErr != nil {
+				return nil, 0, false, httpErr
+			}
+			if status.State != opts.State {
+				continue
+			}
+			state = status.State
+		}
+
+		total++
+		if total > opts.Offset && (opts.Limit == 0 || len(vouchers) < opts.Limit) {
+			meta, httpErr := getVoucherMeta(&rec, state, opts)
+			if httpErr != nil {
+				return nil, 0, false, httpErr
+			}
+			vouchers = append(vouchers, *meta)
+		}
+	}
+	return vouchers, total, total > opts.Offset+len(vouchers), nil
+}
+
+// Get the metadata of 1 voucher. state is its onboarding state if it was already determined, otherwise it is only determined if
+// opts.Long, because that requires reading state.json.
+func getVoucherMeta(rec *DeviceRecord, state string, opts *VoucherListOptions) (*VoucherMeta, *outils.HttpError) {
+	meta := &VoucherMeta{DeviceUuid: rec.DeviceUuid, Orgid: rec.Orgid, State: state, ImportedAt: rec.ImportedAt, HasNodeToken: rec.HasNodeToken()}
+	if opts.Long && state == "" {
+		status, httpErr := getDeviceStatus(rec)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		meta.State = status.State
+	}
+	return meta, nil
+}
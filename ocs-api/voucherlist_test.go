@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestListOrgVouchersPaging(t *testing.T) {
+	_, api := newTestApi(t)
+	ownerKey := newTestEcdsaKey(t)
+	addTestOwnerKey(t, "myorg", "admin", "k1", &ownerKey.PublicKey)
+	deviceUuids := []string{}
+	for i := 0; i < 5; i++ {
+		voucherBytes, deviceUuid := newTestVoucher(t, &ownerKey.PublicKey)
+		if w := testRequest(t, api, http.MethodPost, "/api/orgs/myorg/vouchers", "myorg/admin", "application/json", voucherBytes); w.Code != http.StatusCreated {
+			t.Fatalf("import: got %d %s", w.Code, w.Body.String())
+		}
+		deviceUuids = append(deviceUuids, deviceUuid)
+	}
+	sort.Strings(deviceUuids)
+
+	// The state.json of the 1st device can't be parsed, so it fails every listing that reads it
+	if err := os.WriteFile(OcsDbDir+"/v1/devices/"+deviceUuids[0]+"/state.json", []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query     string
+		long      bool
+		code      int
+		vouchers  []string
+		total     int
+		nextAfter string // the X-Next-Cursor header, which is only set if there are more vouchers
+	}{
+		{"?long=true&offset=1&limit=2", true, http.StatusOK, deviceUuids[1:3], 5, deviceUuids[2]},
+		{"?long=true&offset=3&limit=2", true, http.StatusOK, deviceUuids[3:5], 5, ""},
+		{"?long=true&offset=4", true, http.StatusOK, deviceUuids[4:5], 5, ""},
+		{"?long=true&offset=5", true, http.StatusOK, []string{}, 5, ""},
+		{"?long=true&after=" + deviceUuids[1] + "&limit=1", true, http.StatusOK, deviceUuids[2:3], 3, deviceUuids[2]},
+		{"?offset=0&limit=1", false, http.StatusOK, deviceUuids[0:1], 5, deviceUuids[0]}, // not long, so state.json is not read
+		{"?long=true&limit=1", true, http.StatusInternalServerError, nil, 0, ""},
+		{"?state=imported&offset=1", false, http.StatusInternalServerError, nil, 0, ""}, // filtering by state reads every state.json
+	} {
+		w := testRequest(t, api, http.MethodGet, "/api/orgs/myorg/vouchers"+test.query, "myorg/admin", "", nil)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d %s, expected %d", test.query, w.Code, w.Body.String(), test.code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if total := w.Header().Get("X-Total-Count"); total != strconv.Itoa(test.total) {
+			t.Errorf("%s: X-Total-Count is %s, expected %d", test.query, total, test.total)
+		}
+		if next := w.Header().Get("X-Next-Cursor"); next != test.nextAfter {
+			t.Errorf("%s: X-Next-Cursor is %q, expected %q", test.query, next, test.nextAfter)
+		}
+		var vouchers []string
+		if test.long {
+			var metas []VoucherMeta
+			decodeTestResponse(t, w, &metas)
+			for _, m := range metas {
+				if m.State != DeviceStateImported {
+					t.Errorf("%s: voucher %s has state %q, expected %s", test.query, m.DeviceUuid, m.State, DeviceStateImported)
+				}
+				vouchers = append(vouchers, m.DeviceUuid)
+			}
+		} else {
+			decodeTestResponse(t, w, &vouchers)
+		}
+		if len(vouchers) != len(test.vouchers) {
+			t.Errorf("%s: got vouchers %v, expected %v", test.query, vouchers, test.vouchers)
+			continue
+		}
+		for i := range vouchers {
+			if vouchers[i] != test.vouchers[i] {
+				t.Errorf("%s: got vouchers %v, expected %v", test.query, vouchers, test.vouchers)
+				break
+			}
+		}
+	}
+}